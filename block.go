@@ -13,16 +13,94 @@ import (
 // IVsize is the number of bytes of the random IV per block.
 const IVsize = 32
 
+// eventHeaderSize is the size of the time and sequence number of an event.
+const eventHeaderSize = 16
+
 type BlockHeader struct {
 	Index, LenCur, LenPrev, Time                 uint64
 	PayloadHash, HeaderHash, RootHash, Signature []byte
 	Encrypted, Compressed                        bool
+	Version                                      byte
+}
+
+// Event is an event in a block. Time (device time) and Seq (a sequence number
+// that increases with every event logged by the device) are zero for blocks
+// older than BlockVersionEvents.
+type Event struct {
+	Time, Seq uint64
+	Data      []byte
 }
 
+// MakeEncodedBlock makes an encoded block of BlockVersionEvents, the latest
+// block format version that does not commit to the history of the device (see
+// MakeEncodedHistoryBlock).
 func MakeEncodedBlock(index, lenPrev, time uint64,
 	encrypt, compress bool,
-	policy Policy, events [][]byte, sk []byte) ([]byte, error) {
-	payload, payloadHash, rootHash, err := packData(events, policy, encrypt, compress)
+	policy Policy, events []Event, sk []byte) ([]byte, error) {
+	return makeEncodedBlock(BlockVersionEvents, index, lenPrev, time,
+		encrypt, compress, policy, EventLeaves(BlockVersionEvents, events), nil, sk)
+}
+
+// MakeEncodedHistoryBlock makes an encoded block of the latest block format
+// version, appending the events to the history of the device and committing
+// to the history in the signed root hash of the block. The payload carries the
+// history, so its events can be checked from any block on.
+func MakeEncodedHistoryBlock(index, lenPrev, time uint64,
+	encrypt, compress bool,
+	policy Policy, events []Event, history *History, sk []byte) ([]byte, error) {
+	leaves := EventLeaves(BlockVersion, events)
+	next := history.clone()
+	next.Append(leaves)
+	block, err := makeEncodedBlock(BlockVersion, index, lenPrev, time,
+		encrypt, compress, policy, leaves, &next, sk)
+	if err != nil {
+		return nil, err
+	}
+	*history = next
+	return block, nil
+}
+
+// EventLeaf encodes an event as a leaf in the Merkle tree of a block of the
+// given version. Before BlockVersionEvents, the leaf is the event data.
+func EventLeaf(version byte, e Event) []byte {
+	if version < BlockVersionEvents {
+		return e.Data
+	}
+	leaf := make([]byte, eventHeaderSize+len(e.Data))
+	binary.BigEndian.PutUint64(leaf, e.Time)
+	binary.BigEndian.PutUint64(leaf[8:], e.Seq)
+	copy(leaf[eventHeaderSize:], e.Data)
+	return leaf
+}
+
+// EventLeaves encodes events as leaves (see EventLeaf).
+func EventLeaves(version byte, events []Event) [][]byte {
+	leaves := make([][]byte, len(events))
+	for i := 0; i < len(events); i++ {
+		leaves[i] = EventLeaf(version, events[i])
+	}
+	return leaves
+}
+
+func decodeEventLeaf(version byte, leaf []byte) (Event, error) {
+	if version < BlockVersionEvents {
+		return Event{Data: leaf}, nil
+	}
+	if len(leaf) < eventHeaderSize {
+		return Event{}, fmt.Errorf("too short encoded event")
+	}
+	return Event{
+		Time: binary.BigEndian.Uint64(leaf),
+		Seq:  binary.BigEndian.Uint64(leaf[8:]),
+		Data: leaf[eventHeaderSize:],
+	}, nil
+}
+
+func makeEncodedBlock(version byte, index, lenPrev, time uint64,
+	encrypt, compress bool,
+	policy Policy, leaves [][]byte, history *History, sk []byte) ([]byte, error) {
+	payload, payloadHash, rootHash, err := packData(version, leaves, history, policy,
+		encrypt, compress)
 	if err != nil {
 		return nil, err
 	}
@@ -31,25 +109,11 @@ func MakeEncodedBlock(index, lenPrev, time uint64,
 	lenCur := uint64(WireBlockHeaderSize + len(payload))
 
 	// generate the header hash
-	tmp := make([]byte, 3*8+lc.HashOutputLen)
-	binary.BigEndian.PutUint64(tmp, index)
-	binary.BigEndian.PutUint64(tmp[8:], lenCur)
-	binary.BigEndian.PutUint64(tmp[16:], lenPrev)
-	copy(tmp[24:], payloadHash)
-	if encrypt {
-		tmp = append(tmp, WireTrue)
-	} else {
-		tmp = append(tmp, WireFalse)
-	}
-	if compress {
-		tmp = append(tmp, WireTrue)
-	} else {
-		tmp = append(tmp, WireFalse)
-	}
-	headerHash := lc.Khash(policy.ID, tmp)
+	headerHash := lc.Khash(policy.ID, encodeHeaderHashInput(index, lenCur, lenPrev,
+		payloadHash, encrypt, compress, version))
 
 	// sign headerHash + rootHash + time
-	tmp = make([]byte, lc.HashOutputLen*2+8)
+	tmp := make([]byte, lc.HashOutputLen*2+8)
 	copy(tmp, headerHash)
 	copy(tmp[lc.HashOutputLen:], rootHash)
 	binary.BigEndian.PutUint64(tmp[lc.HashOutputLen*2:], time)
@@ -70,18 +134,62 @@ func MakeEncodedBlock(index, lenPrev, time uint64,
 	return tmp, nil
 }
 
-func packData(events [][]byte, policy Policy,
+// encodeHeaderHashInput encodes the fields of a block header that are covered
+// by the header hash. Legacy blocks do not commit to a version.
+func encodeHeaderHashInput(index, lenCur, lenPrev uint64, payloadHash []byte,
+	encrypt, compress bool, version byte) []byte {
+	tmp := make([]byte, 3*8+lc.HashOutputLen, 3*8+lc.HashOutputLen+3)
+	binary.BigEndian.PutUint64(tmp, index)
+	binary.BigEndian.PutUint64(tmp[8:], lenCur)
+	binary.BigEndian.PutUint64(tmp[16:], lenPrev)
+	copy(tmp[24:], payloadHash)
+	if encrypt {
+		tmp = append(tmp, WireTrue)
+	} else {
+		tmp = append(tmp, WireFalse)
+	}
+	if compress {
+		tmp = append(tmp, WireTrue)
+	} else {
+		tmp = append(tmp, WireFalse)
+	}
+	if version != BlockVersionLegacy {
+		tmp = append(tmp, version)
+	}
+	return tmp
+}
+
+func packData(version byte, leaves [][]byte, history *History, policy Policy,
 	encrypt, compress bool) (payload, payloadHash, rootHash []byte, err error) {
 	// FIXME: measure if memory is an issue, look at createing a packData that can be streamed, and likely calculate payloadHash here as well then
-	for i := 0; i < len(events); i++ {
-		size := make([]byte, 2)
-		if len(events[i]) > 65535 {
-			return nil, nil, nil, fmt.Errorf("too large events, max %d, got %d",
-				65535, len(events[i]))
+	switch version {
+	case BlockVersionLegacy:
+		for i := 0; i < len(leaves); i++ {
+			size := make([]byte, 2)
+			if len(leaves[i]) > 65535 {
+				return nil, nil, nil, fmt.Errorf("too large events, max %d, got %d",
+					65535, len(leaves[i]))
+			}
+			binary.BigEndian.PutUint16(size, uint16(len(leaves[i])))
+			payload = append(payload, size...)
+			payload = append(payload, leaves[i]...)
+		}
+	case BlockVersionVarint, BlockVersionEvents, BlockVersionHistory:
+		maxLeaf := MaxEventSize
+		if version >= BlockVersionEvents {
+			maxLeaf += eventHeaderSize
+		}
+		size := make([]byte, binary.MaxVarintLen64)
+		for i := 0; i < len(leaves); i++ {
+			if len(leaves[i]) > maxLeaf {
+				return nil, nil, nil, fmt.Errorf("too large events, max %d, got %d",
+					maxLeaf, len(leaves[i]))
+			}
+			payload = append(payload, size[:binary.PutUvarint(size, uint64(len(leaves[i])))]...)
+			payload = append(payload, leaves[i]...)
 		}
-		binary.BigEndian.PutUint16(size, uint16(len(events[i])))
-		payload = append(payload, size...)
-		payload = append(payload, events[i]...)
+	default:
+		return nil, nil, nil, fmt.Errorf("unknown block version %d", version)
 	}
 
 	iv := make([]byte, IVsize)
@@ -89,7 +197,13 @@ func packData(events [][]byte, policy Policy,
 	if err != nil {
 		return nil, nil, nil, err
 	}
-	rootHash = lc.Khash(iv, MerkleTreeHash(events))
+	if version >= BlockVersionHistory {
+		if history == nil {
+			return nil, nil, nil, fmt.Errorf("missing history for block version %d", version)
+		}
+		payload = append(payload, encodeHistory(history)...)
+	}
+	rootHash = BlockRootHash(version, iv, MerkleTreeHash(leaves), history.BlockHistory())
 	payload = append(payload, iv...)
 
 	if compress {
@@ -100,13 +214,34 @@ func packData(events [][]byte, policy Policy,
 	}
 
 	if encrypt {
-		payload, err = lc.Encrypt(policy.Pub, payload)
+		if len(policy.Recipients) > 0 {
+			payload, err = lc.EncryptMulti(policy.RecipientKeys(), payload)
+		} else {
+			payload, err = lc.Encrypt(policy.Pub, payload)
+		}
+		if err != nil {
+			return nil, nil, nil, err
+		}
 	}
 	payloadHash = lc.Khash(policy.ID, payload)
 
 	return
 }
 
+// EncodeBlockHeader encodes a block header as sent on the wire.
+func EncodeBlockHeader(b BlockHeader) []byte {
+	tmp := make([]byte, WireBlockHeaderSize)
+	binary.BigEndian.PutUint64(tmp, b.Index)
+	binary.BigEndian.PutUint64(tmp[8:], b.LenCur)
+	binary.BigEndian.PutUint64(tmp[16:], b.LenPrev)
+	copy(tmp[24:], b.PayloadHash)
+	copy(tmp[24+lc.HashOutputLen:], b.HeaderHash)
+	copy(tmp[24+2*lc.HashOutputLen:], b.RootHash)
+	binary.BigEndian.PutUint64(tmp[24+3*lc.HashOutputLen:], b.Time)
+	copy(tmp[32+3*lc.HashOutputLen:], b.Signature)
+	return tmp
+}
+
 func DecodeBlockHeader(encoded []byte, policy Policy) (b BlockHeader, err error) {
 	if len(encoded) < WireBlockHeaderSize {
 		return BlockHeader{}, fmt.Errorf("too short data, expected at least %d, got %d",
@@ -136,85 +271,122 @@ func DecodeBlockHeader(encoded []byte, policy Policy) (b BlockHeader, err error)
 	}
 
 	// make sure we can trust provided fields and figure out payload to expect
-	valid, encrypted, compressed := checkBlockHeaderHash(b, policy)
+	valid, encrypted, compressed, version := checkBlockHeaderHash(b, policy)
 	if !valid {
 		return BlockHeader{}, fmt.Errorf("invalid header hash")
 	}
 	b.Encrypted = encrypted
 	b.Compressed = compressed
+	b.Version = version
 
 	return
 }
 
-func checkBlockHeaderHash(b BlockHeader, policy Policy) (valid, encrypted, compressed bool) {
-	fn := func(buf []byte, enc, comp bool) bool {
-		if enc {
-			buf[3*8+lc.HashOutputLen] = WireTrue
-		} else {
-			buf[3*8+lc.HashOutputLen] = WireFalse
-		}
-		if comp {
-			buf[3*8+lc.HashOutputLen+1] = WireTrue
-		} else {
-			buf[3*8+lc.HashOutputLen+1] = WireFalse
-		}
-		return subtle.ConstantTimeCompare(lc.Khash(policy.ID, buf), b.HeaderHash) == 1
+func checkBlockHeaderHash(b BlockHeader, policy Policy) (valid, encrypted, compressed bool,
+	version byte) {
+	fn := func(enc, comp bool, v byte) bool {
+		return subtle.ConstantTimeCompare(lc.Khash(policy.ID,
+			encodeHeaderHashInput(b.Index, b.LenCur, b.LenPrev, b.PayloadHash, enc, comp, v)),
+			b.HeaderHash) == 1
 	}
-	tmp := make([]byte, 3*8+lc.HashOutputLen+2)
-	binary.BigEndian.PutUint64(tmp, b.Index)
-	binary.BigEndian.PutUint64(tmp[8:], b.LenCur)
-	binary.BigEndian.PutUint64(tmp[16:], b.LenPrev)
-	copy(tmp[24:], b.PayloadHash)
-	switch {
-	case fn(tmp, true, true): // encrypted and compressed?
-		return true, true, true
-	case fn(tmp, true, false): // encrypted but not compressed?
-		return true, true, false
-	case fn(tmp, false, true): // plaintext but compressed?
-		return true, false, true
-	case fn(tmp, false, false): // plaintext and not compressed?
-		return true, false, false
-	default:
-		return false, false, false
+	// newest version first, it is the most likely one
+	for v := int(BlockVersion); v >= BlockVersionLegacy; v-- {
+		switch {
+		case fn(true, true, byte(v)): // encrypted and compressed?
+			return true, true, true, byte(v)
+		case fn(true, false, byte(v)): // encrypted but not compressed?
+			return true, true, false, byte(v)
+		case fn(false, true, byte(v)): // plaintext but compressed?
+			return true, false, true, byte(v)
+		case fn(false, false, byte(v)): // plaintext and not compressed?
+			return true, false, false, byte(v)
+		}
 	}
+	return false, false, false, 0
 }
 
-func DecodeBlockPayload(payload, pub, pk []byte, policy Policy, bh BlockHeader) (events [][]byte,
+// DecodeBlockPayload decrypts and decodes the events of a block. Use
+// EventLeaves with the block version for the leaves committed to by the root.
+func DecodeBlockPayload(payload, pub, pk []byte, policy Policy, bh BlockHeader) (events []Event,
 	IV []byte, err error) {
+	events, IV, _, err = DecodeBlockPayloadHistory(payload, pub, pk, policy, bh)
+	return
+}
+
+// DecodeBlockPayloadHistory is DecodeBlockPayload, also returning the history
+// of the device committed to by a block of BlockVersionHistory (nil for older
+// versions), up to and including the events of the block. Verify the history
+// with the root hash using BlockRootHash and History.BlockHistory.
+func DecodeBlockPayloadHistory(payload, pub, pk []byte, policy Policy, bh BlockHeader) (events []Event,
+	IV []byte, history *History, err error) {
 	if uint64(len(payload)) != bh.LenCur-WireBlockHeaderSize {
-		return nil, nil, fmt.Errorf("invalid payload length, expected %d, got %d",
+		return nil, nil, nil, fmt.Errorf("invalid payload length, expected %d, got %d",
 			bh.LenCur-WireBlockHeaderSize, len(payload))
 	}
 	if !CheckPayloadHash(payload, policy, bh) {
-		return nil, nil, fmt.Errorf("invalid payload hash")
+		return nil, nil, nil, fmt.Errorf("invalid payload hash")
 	}
 
 	buf := payload
-	if bh.Encrypted {
+	if bh.Encrypted && len(policy.Recipients) > 0 {
+		buf, err = lc.DecryptMulti(buf, pub, pk)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to decrypt: %s", err)
+		}
+	} else if bh.Encrypted {
 		buf, err = lc.Decrypt(buf, pub, pk)
 		if err != nil {
-			return nil, nil, fmt.Errorf("failed to decrypt: %s", err)
+			return nil, nil, nil, fmt.Errorf("failed to decrypt: %s", err)
 		}
 	}
 	if bh.Compressed {
 		buf, err = lc.Decompress(buf)
 		if err != nil {
-			return nil, nil, fmt.Errorf("failed to decompress: %s", err)
+			return nil, nil, nil, fmt.Errorf("failed to decompress: %s", err)
 		}
 	}
+	if len(buf) < IVsize {
+		return nil, nil, nil, fmt.Errorf("too short payload, missing IV")
+	}
 	IV = buf[len(buf)-IVsize:]
 
 	buf = buf[:len(buf)-IVsize]
+	if bh.Version >= BlockVersionHistory {
+		history, buf, err = decodeHistory(buf)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
 	for {
 		if len(buf) == 0 {
 			break
 		}
-		l := binary.BigEndian.Uint16(buf[:2]) // take out len
-		buf = buf[2:]
-		if l < 0 || int(l) > len(buf) {
-			return nil, nil, fmt.Errorf("invalid encoded events")
+		var l uint64
+		switch bh.Version { // take out len
+		case BlockVersionLegacy:
+			if len(buf) < 2 {
+				return nil, nil, nil, fmt.Errorf("invalid encoded events")
+			}
+			l = uint64(binary.BigEndian.Uint16(buf[:2]))
+			buf = buf[2:]
+		case BlockVersionVarint, BlockVersionEvents, BlockVersionHistory:
+			var n int
+			l, n = binary.Uvarint(buf)
+			if n <= 0 {
+				return nil, nil, nil, fmt.Errorf("invalid encoded event length")
+			}
+			buf = buf[n:]
+		default:
+			return nil, nil, nil, fmt.Errorf("unknown block version %d", bh.Version)
+		}
+		if l > uint64(len(buf)) {
+			return nil, nil, nil, fmt.Errorf("invalid encoded events")
+		}
+		e, err := decodeEventLeaf(bh.Version, buf[:l])
+		if err != nil {
+			return nil, nil, nil, err
 		}
-		events = append(events, buf[:l])
+		events = append(events, e)
 		buf = buf[l:]
 	}
 
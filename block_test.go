@@ -20,7 +20,8 @@ func TestMakeBlock(t *testing.T) {
 		{{0x20, 0x21}, {0x30, 0x31}}} {
 		enc := i%2 == 0
 		comp := i%3 == 0
-		block, err := MakeEncodedBlock(uint64(i), prevSize, uint64(time.Now().Unix()), enc, comp, p, events, sk)
+		block, err := MakeEncodedBlock(uint64(i), prevSize, uint64(time.Now().Unix()), enc, comp, p,
+			makeEvents(events), sk)
 		assert.Nil(t, err, "failed to make encoded block: %s", err)
 
 		bh, err := DecodeBlockHeader(block[:WireBlockHeaderSize], p)
@@ -30,7 +31,116 @@ func TestMakeBlock(t *testing.T) {
 		assert.Nil(t, err, "failed to decode valid payload: %s", err)
 		assert.True(t, len(recEvents) == len(events), "received different number of events")
 		for j := 0; j < len(events); j++ {
-			assert.True(t, bytes.Equal(recEvents[j], events[j]), "received different event")
+			assert.True(t, bytes.Equal(recEvents[j].Data, events[j]), "received different event")
 		}
 	}
 }
+
+func TestLegacyBlock(t *testing.T) {
+	vk, sk, _ := lc.SigningKeyGen()
+	pub, pk, _ := lc.EncryptKeyGen()
+	p := MakePolicy(sk, vk, pub, 0, 1, 2)
+
+	events := [][]byte{{0x12, 0x34}, {}, {0x34, 0x12, 0x56}}
+	block, err := makeEncodedBlock(BlockVersionLegacy, 0, 0, uint64(time.Now().Unix()),
+		true, true, p, events, nil, sk)
+	assert.Nil(t, err, "failed to make legacy block: %s", err)
+	bh, err := DecodeBlockHeader(block[:WireBlockHeaderSize], p)
+	assert.Nil(t, err, "failed to decode valid legacy header: %s", err)
+	assert.True(t, bh.Version == BlockVersionLegacy, "wrong version, got %d", bh.Version)
+	recEvents, _, err := DecodeBlockPayload(block[WireBlockHeaderSize:], pub, pk, p, bh)
+	assert.Nil(t, err, "failed to decode valid legacy payload: %s", err)
+	assert.True(t, len(recEvents) == len(events), "received different number of events")
+	for j := 0; j < len(events); j++ {
+		assert.True(t, bytes.Equal(recEvents[j].Data, events[j]), "received different event")
+	}
+
+	_, err = makeEncodedBlock(BlockVersionLegacy, 0, 0, 0, false, false, p,
+		[][]byte{make([]byte, 65536)}, nil, sk)
+	assert.NotNil(t, err, "made legacy block with too large event")
+}
+
+func TestLargeEvents(t *testing.T) {
+	vk, sk, _ := lc.SigningKeyGen()
+	pub, pk, _ := lc.EncryptKeyGen()
+	p := MakePolicy(sk, vk, pub, 0, 1, 2)
+
+	events := [][]byte{make([]byte, 65536), {0x42}, make([]byte, 1<<20)}
+	block, err := MakeEncodedHistoryBlock(0, 0, uint64(time.Now().Unix()), true, false, p,
+		makeEvents(events), &History{}, sk)
+	assert.Nil(t, err, "failed to make block with large events: %s", err)
+	bh, err := DecodeBlockHeader(block[:WireBlockHeaderSize], p)
+	assert.Nil(t, err, "failed to decode valid header: %s", err)
+	assert.True(t, bh.Version == BlockVersion, "wrong version, got %d", bh.Version)
+	recEvents, _, err := DecodeBlockPayload(block[WireBlockHeaderSize:], pub, pk, p, bh)
+	assert.Nil(t, err, "failed to decode valid payload: %s", err)
+	assert.True(t, len(recEvents) == len(events), "received different number of events")
+	for j := 0; j < len(events); j++ {
+		assert.True(t, bytes.Equal(recEvents[j].Data, events[j]), "received different event")
+	}
+}
+
+func TestMultiRecipientBlock(t *testing.T) {
+	vk, sk, _ := lc.SigningKeyGen()
+	pub, pk, _ := lc.EncryptKeyGen()
+	r1, rk1, _ := lc.EncryptKeyGen()
+	p := MakePolicy(sk, vk, pub, 0, 1, 2, r1)
+
+	events := [][]byte{{0x12, 0x34}, {0x34, 0x12, 0x56}}
+	block, err := MakeEncodedBlock(0, 0, uint64(time.Now().Unix()), true, true, p,
+		makeEvents(events), sk)
+	assert.Nil(t, err, "failed to make encoded block: %s", err)
+	bh, err := DecodeBlockHeader(block[:WireBlockHeaderSize], p)
+	assert.Nil(t, err, "failed to decode valid header: %s", err)
+
+	for _, keys := range [][][]byte{{pub, pk}, {r1, rk1}} {
+		recEvents, _, err := DecodeBlockPayload(block[WireBlockHeaderSize:], keys[0], keys[1], p, bh)
+		assert.Nil(t, err, "failed to decode valid payload: %s", err)
+		assert.True(t, len(recEvents) == len(events), "received different number of events")
+		for j := 0; j < len(events); j++ {
+			assert.True(t, bytes.Equal(recEvents[j].Data, events[j]), "received different event")
+		}
+	}
+
+	other, otherk, _ := lc.EncryptKeyGen()
+	_, _, err = DecodeBlockPayload(block[WireBlockHeaderSize:], other, otherk, p, bh)
+	assert.NotNil(t, err, "decoded payload as non-recipient")
+}
+
+func TestEventTimeAndSeq(t *testing.T) {
+	vk, sk, _ := lc.SigningKeyGen()
+	pub, pk, _ := lc.EncryptKeyGen()
+	p := MakePolicy(sk, vk, pub, 0, 1, 2)
+
+	events := makeEvents([][]byte{{0x12, 0x34}, {}, {0x34, 0x12, 0x56}})
+	block, err := MakeEncodedBlock(0, 0, uint64(time.Now().Unix()), false, true, p, events, sk)
+	assert.Nil(t, err, "failed to make encoded block: %s", err)
+	bh, err := DecodeBlockHeader(block[:WireBlockHeaderSize], p)
+	assert.Nil(t, err, "failed to decode valid header: %s", err)
+	recEvents, iv, err := DecodeBlockPayload(block[WireBlockHeaderSize:], pub, pk, p, bh)
+	assert.Nil(t, err, "failed to decode valid payload: %s", err)
+	assert.True(t, len(recEvents) == len(events), "received different number of events")
+	for j := 0; j < len(events); j++ {
+		assert.True(t, recEvents[j].Time == events[j].Time, "received different event time")
+		assert.True(t, recEvents[j].Seq == events[j].Seq, "received different event seq")
+	}
+
+	// the root commits to time and sequence number
+	assert.True(t, bytes.Equal(bh.RootHash,
+		lc.Khash(iv, MerkleTreeHash(EventLeaves(bh.Version, recEvents)))), "root mismatch")
+	recEvents[1].Seq++
+	assert.False(t, bytes.Equal(bh.RootHash,
+		lc.Khash(iv, MerkleTreeHash(EventLeaves(bh.Version, recEvents)))), "root ignores seq")
+}
+
+func makeEvents(data [][]byte) []Event {
+	events := make([]Event, len(data))
+	for i := 0; i < len(data); i++ {
+		events[i] = Event{
+			Time: uint64(time.Now().Unix()),
+			Seq:  uint64(42 + i),
+			Data: data[i],
+		}
+	}
+	return events
+}
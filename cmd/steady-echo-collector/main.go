@@ -6,22 +6,39 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/fatih/color"
 	"github.com/pylls/steady"
 	"github.com/pylls/steady/collector"
+	"github.com/pylls/steady/metrics"
 	"github.com/tidwall/pretty"
 )
 
 var (
 	path            = flag.String("path", "test", "the path")
-	server          = flag.String("server", "localhost:22333", "the server")
+	server          = flag.String("server", "localhost:22333", "the server, or comma-separated servers with the same policy")
 	freq            = flag.Int("freq", 5, "poll frequency")
 	delta           = flag.Uint64("delta", 30, "the maximum amount of drift (s) to accept")
 	printAssessment = flag.Bool("assessments", false, "print collector assessments")
 	printMsgs       = flag.Bool("messages", false, "print log messages")
 	printSummary    = flag.Bool("summary", true, "print summary")
+	jsonFile        = flag.String("jsonl", "", "also write output as JSON lines to this file")
+	dir             = flag.String("dir", "", "also write output as JSON lines to a directory per policy")
+	maxSize         = flag.Int64("maxsize", 64, "rotate JSON lines files at this size in MiB")
+	maxFiles        = flag.Int("maxfiles", 5, "number of rotated JSON lines files to keep")
+	toSyslog        = flag.Bool("syslog", false, "also forward verified events to the local syslog")
+	archiveDir      = flag.String("archive", "", "also archive verified events in this directory (see steady-query)")
+	metricsAddr     = flag.String("metrics", "", "the address to serve Prometheus metrics on, disabled if empty")
+	headFile        = flag.String("head", "", "write the latest block head as JSON to this file, for other collectors")
+	gossipFiles     = flag.String("gossip", "", "comma-separated head files of other collectors to compare with")
+	historyFile     = flag.String("history", "", "keep the history of the device in this file for proofs, resuming from it")
+
+	// verified, unverified, invalid, duplicate
+	// blocks counter
+	numBlocksVerified, numBlocksBroken, numBlocksMissed, numEventsVerified, numEventsBroken int
 )
 
 func main() {
@@ -34,7 +51,8 @@ func main() {
 	}
 	log.Printf("read collector config at %s", fmt.Sprintf(steady.CollectorFilename, *path))
 
-	c, err := collector.NewCollector(*server, *cc, time.Duration(*freq)*time.Second, *delta)
+	c, err := collector.NewMultiRelayCollector(strings.Split(*server, ","), *cc,
+		time.Duration(*freq)*time.Second, *delta)
 	if err != nil {
 		log.Fatalf("failed to connect to relay: %s", err)
 	}
@@ -49,78 +67,173 @@ func main() {
 
 	log.Printf("polling relay every %ds, accepting a time drift of %ds", *freq, *delta)
 
-	// verified, unverified, invalid, duplicate
-	// blocks counter
-	var numBlocksVerified, numBlocksBroken, numBlocksMissed, numEventsVerified, numEventsBroken int
+	outs := []collector.Output{echo}
+	if *jsonFile != "" {
+		s, err := collector.NewJSONLinesSink(*jsonFile, cc.Policy, *maxSize*1024*1024, *maxFiles)
+		if err != nil {
+			log.Fatalf("failed to open JSON lines file: %v", err)
+		}
+		defer s.Close()
+		outs = append(outs, s.Output)
+		log.Printf("writing JSON lines to %s", *jsonFile)
+	}
+	if *dir != "" {
+		s, err := collector.NewDirSink(*dir, cc.Policy, *maxSize*1024*1024, *maxFiles)
+		if err != nil {
+			log.Fatalf("failed to open policy directory: %v", err)
+		}
+		defer s.Close()
+		outs = append(outs, s.Output)
+		log.Printf("writing JSON lines to directory %s", *dir)
+	}
+	if *toSyslog {
+		s, err := collector.NewSyslogSink(cc.Policy, "steady")
+		if err != nil {
+			log.Fatalf("failed to connect to syslog: %v", err)
+		}
+		defer s.Close()
+		outs = append(outs, s.Output)
+		log.Println("forwarding verified events to syslog")
+	}
+	if *archiveDir != "" {
+		a, err := collector.OpenArchive(*archiveDir)
+		if err != nil {
+			log.Fatalf("failed to open archive: %v", err)
+		}
+		defer a.Close()
+		out, err := a.Output(cc.Policy)
+		if err != nil {
+			log.Fatalf("failed to archive policy: %v", err)
+		}
+		outs = append(outs, out)
+		log.Printf("archiving verified events in %s", *archiveDir)
+	}
 
-	c.CollectLoop(collector.State{
+	if *metricsAddr != "" {
+		r := metrics.NewRegistry()
+		outs = append(outs, collector.NewMetrics(r).Output(cc.Policy))
+		go func() {
+			log.Printf("metrics server failed: %v", metrics.ListenAndServe(*metricsAddr, r))
+		}()
+	}
+
+	if *headFile != "" || *gossipFiles != "" {
+		outs = append(outs, gossip(c))
+		log.Println("gossiping block heads with other collectors")
+	}
+
+	state := collector.State{
 		Index: 0,
 		Time:  cc.Policy.Time,
-	}, make(chan struct{}),
-		func(label string, meta interface{}, format string, args ...interface{}) {
-			switch label {
-			case "verified":
-				numEventsVerified++
-				if *printMsgs {
-					log.Printf("%s %s [%s ...]",
-						color.GreenString("Message:"), fmt.Sprintf(format, args...),
-						color.MagentaString("Proof:"))
-				}
-			// all the same from our PoV, should always be zero or bug
-			case "unverified":
-				numEventsBroken++
-				if *printMsgs {
-					log.Printf("%s %s", color.RedString("Unverified message:"), fmt.Sprintf(format, args...))
-				}
-			case "invalid":
-				numEventsBroken++
-				if *printMsgs {
-					log.Printf("%s %s", color.RedString("Invalid message:"), fmt.Sprintf(format, args...))
-				}
-			case "duplicate":
-				numEventsBroken++
-				if *printMsgs {
-					log.Printf("%s %s", color.RedString("Duplicate message:"), fmt.Sprintf(format, args...))
-				}
+	}
+	if *historyFile != "" {
+		resumed, err := c.SetHistoryFile(*historyFile)
+		if err != nil {
+			log.Fatalf("failed to open history file: %v", err)
+		}
+		if resumed != nil {
+			state = *resumed
+			log.Printf("resuming the history in %s after block %d", *historyFile, state.Index-1)
+		}
+	}
 
-			case "assessment":
-				a := meta.(*collector.Assessment)
-				numBlocksVerified += int(a.ValidBlocks)
-				numBlocksBroken += int(a.DuplicateBlocks + a.InvalidBlocks)
-				numBlocksMissed += int(a.MissedBlocks)
-
-				if *printAssessment {
-					m, err := json.Marshal(meta)
-					if err != nil {
-						log.Printf("failed to marshal meta: %s", err)
-						return
-					}
-					log.Printf("%s: %s", label, fmt.Sprintf(format, args...))
-					fmt.Print(string(pretty.Color(pretty.Pretty(m), nil)))
-				}
+	c.CollectLoop(state, make(chan struct{}), collector.Tee(outs...))
+}
 
-				if *printSummary {
-					var ass string
-					switch a.Overall {
-					case "ok":
-						ass = color.GreenString(a.Overall)
-					case "warning":
-						ass = color.YellowString(a.Overall)
-					case "evil":
-						ass = color.RedString(a.Overall)
-					default:
-						ass = a.Overall
-					}
-					log.Printf("%s\t assessment: %17s\t\t events: %s verified, %s broken\t\t blocks: %s verified, %s missed, %s broken",
-						color.CyanString("Summary"), ass,
-						color.GreenString("%9d", numEventsVerified), color.RedString("%2d", numEventsBroken),
-						color.GreenString("%4d", numBlocksVerified), color.YellowString("%4d", numBlocksMissed),
-						color.RedString("%4d", numBlocksBroken))
+// gossip writes the latest head of the collector and imports the heads of
+// other collectors after each assessment, compared at the next run
+func gossip(c *collector.Collector) collector.Output {
+	return func(label string, meta interface{}, format string, args ...interface{}) {
+		if label != "assessment" {
+			return
+		}
+		if h, ok := c.Head(); ok && *headFile != "" {
+			if err := collector.WriteHead(h, *headFile); err != nil {
+				log.Printf("failed to write head: %v", err)
+			}
+		}
+		for _, filename := range strings.Split(*gossipFiles, ",") {
+			if filename == "" {
+				continue
+			}
+			h, err := collector.ReadHead(filename)
+			if err != nil {
+				if !os.IsNotExist(err) {
+					log.Printf("failed to read head: %v", err)
 				}
+				continue
+			}
+			if err = c.ImportHead(h); err != nil {
+				log.Printf("invalid head in %s: %v", filename, err)
+			}
+		}
+	}
+}
+
+// echo prints output to the terminal
+func echo(label string, meta interface{}, format string, args ...interface{}) {
+	switch label {
+	case "verified":
+		numEventsVerified++
+		if *printMsgs {
+			log.Printf("%s %s [%s ...]",
+				color.GreenString("Message:"), fmt.Sprintf(format, args...),
+				color.MagentaString("Proof:"))
+		}
+	// all the same from our PoV, should always be zero or bug
+	case "unverified":
+		numEventsBroken++
+		if *printMsgs {
+			log.Printf("%s %s", color.RedString("Unverified message:"), fmt.Sprintf(format, args...))
+		}
+	case "invalid":
+		numEventsBroken++
+		if *printMsgs {
+			log.Printf("%s %s", color.RedString("Invalid message:"), fmt.Sprintf(format, args...))
+		}
+	case "duplicate":
+		numEventsBroken++
+		if *printMsgs {
+			log.Printf("%s %s", color.RedString("Duplicate message:"), fmt.Sprintf(format, args...))
+		}
+
+	case "assessment":
+		a := meta.(*collector.Assessment)
+		numBlocksVerified += int(a.ValidBlocks)
+		numBlocksBroken += int(a.DuplicateBlocks + a.InvalidBlocks)
+		numBlocksMissed += int(a.MissedBlocks)
+
+		if *printAssessment {
+			m, err := json.Marshal(meta)
+			if err != nil {
+				log.Printf("failed to marshal meta: %s", err)
+				return
 			}
+			log.Printf("%s: %s", label, fmt.Sprintf(format, args...))
+			fmt.Print(string(pretty.Color(pretty.Pretty(m), nil)))
+		}
 
-			if meta == nil {
-				log.Printf("%s: %s", label, fmt.Sprintf(format, args...))
+		if *printSummary {
+			var ass string
+			switch a.Overall {
+			case "ok":
+				ass = color.GreenString(a.Overall)
+			case "warning":
+				ass = color.YellowString(a.Overall)
+			case "evil":
+				ass = color.RedString(a.Overall)
+			default:
+				ass = a.Overall
 			}
-		})
+			log.Printf("%s\t assessment: %17s\t\t events: %s verified, %s broken\t\t blocks: %s verified, %s missed, %s broken",
+				color.CyanString("Summary"), ass,
+				color.GreenString("%9d", numEventsVerified), color.RedString("%2d", numEventsBroken),
+				color.GreenString("%4d", numBlocksVerified), color.YellowString("%4d", numBlocksMissed),
+				color.RedString("%4d", numBlocksBroken))
+		}
+	}
+
+	if meta == nil {
+		log.Printf("%s: %s", label, fmt.Sprintf(format, args...))
+	}
 }
@@ -4,6 +4,7 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"strings"
 	"time"
 
 	"github.com/pylls/steady"
@@ -17,7 +18,8 @@ var (
 	space   = flag.Uint("space", 100*1024*1024, "the space") // 100 MiB relay
 	path    = flag.String("path", "test", "the path")
 	token   = flag.String("token", "secret", "the access token")
-	server  = flag.String("server", "localhost:22333", "the server")
+	server  = flag.String("server", "localhost:22333", "the server, or comma-separated servers to setup the policy at")
+	extra   = flag.Int("recipients", 0, "number of additional recipients, each with its own collector config")
 )
 
 func main() {
@@ -30,8 +32,16 @@ func main() {
 	if err != nil {
 		log.Fatalf("failed to generate encryption keys: %v", err)
 	}
-	policy, err := device.MakeDevice(sk, vk, pub, uint64(*timeout), uint64(*space),
-		uint64(time.Now().Unix()), *path, *server, *token)
+	recipients := make([][]byte, *extra)
+	recipientsPriv := make([][]byte, *extra)
+	for i := 0; i < *extra; i++ {
+		recipients[i], recipientsPriv[i], err = lc.EncryptKeyGen()
+		if err != nil {
+			log.Fatalf("failed to generate encryption keys for recipient %d: %v", i+1, err)
+		}
+	}
+	policy, err := device.MakeMultiDevice(sk, vk, pub, uint64(*timeout), uint64(*space),
+		uint64(time.Now().Unix()), *path, strings.Split(*server, ","), *token, recipients...)
 	if err != nil {
 		log.Fatalf("failed to make device: %v", err)
 	}
@@ -44,6 +54,18 @@ func main() {
 	}, fmt.Sprintf(steady.CollectorFilename, *path)); err != nil {
 		log.Fatalf("failed to write collector config: %v", err)
 	}
+	for i := 0; i < *extra; i++ {
+		filename := fmt.Sprintf(steady.CollectorFilename, fmt.Sprintf("%s-%d", *path, i+1))
+		if err := collector.WriteCollectorConfig(&collector.Config{
+			Pub:    recipients[i],
+			Priv:   recipientsPriv[i],
+			Vk:     vk,
+			Policy: *policy,
+		}, filename); err != nil {
+			log.Fatalf("failed to write collector config for recipient %d: %v", i+1, err)
+		}
+		log.Printf("collector config for recipient %d saved to %s", i+1, filename)
+	}
 
 	log.Printf("new device created, saved to %s", *path)
 }
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/pylls/steady/collector"
+)
+
+var (
+	dir         = flag.String("archive", "archive", "the archive directory")
+	policy      = flag.String("policy", "", "hex-encoded policy ID, all policies if empty")
+	from        = flag.String("from", "", "start of time range (unix time or RFC3339)")
+	to          = flag.String("to", "", "end of time range (unix time or RFC3339)")
+	fromIndex   = flag.Uint64("fromindex", 0, "first block index")
+	toIndex     = flag.Uint64("toindex", 0, "last block index, 0 for no limit")
+	contains    = flag.String("grep", "", "substring to search for in events")
+	asJSON      = flag.Bool("json", false, "print events as JSON lines")
+	export      = flag.String("export", "", "write a disclosure (JSON lines) of each found event to this file")
+	assessments = flag.Bool("assessments", false, "print assessments (as JSON lines) instead of events")
+	limit       = flag.Int("limit", 0, "maximum number of results, 0 for no limit")
+)
+
+// errLimit stops a search at the limit
+var errLimit = fmt.Errorf("limit reached")
+
+func main() {
+	flag.Parse()
+
+	q := collector.Query{
+		FromIndex: *fromIndex,
+		ToIndex:   *toIndex,
+		Contains:  *contains,
+	}
+	var err error
+	if *policy != "" {
+		if q.Policy, err = hex.DecodeString(*policy); err != nil {
+			log.Fatalf("invalid policy ID: %v", err)
+		}
+	}
+	if q.From, err = parseTime(*from); err != nil {
+		log.Fatalf("invalid from time: %v", err)
+	}
+	if q.To, err = parseTime(*to); err != nil {
+		log.Fatalf("invalid to time: %v", err)
+	}
+
+	archive, err := collector.OpenArchive(*dir)
+	if err != nil {
+		log.Fatalf("failed to open archive: %v", err)
+	}
+	defer archive.Close()
+
+	var exportEncoder *json.Encoder
+	if *export != "" {
+		f, err := os.Create(*export)
+		if err != nil {
+			log.Fatalf("failed to create export file: %v", err)
+		}
+		defer f.Close()
+		exportEncoder = json.NewEncoder(f)
+	}
+	stdout := json.NewEncoder(os.Stdout)
+
+	n := 0
+	if *assessments {
+		err = archive.Assessments(q, func(a *collector.Assessment) error {
+			if *limit > 0 && n >= *limit {
+				return errLimit
+			}
+			n++
+			return stdout.Encode(a)
+		})
+	} else {
+		err = archive.Events(q, func(e collector.ArchivedEvent) error {
+			if *limit > 0 && n >= *limit {
+				return errLimit
+			}
+			n++
+			if *asJSON {
+				if err := stdout.Encode(e); err != nil {
+					return err
+				}
+			} else {
+				fmt.Printf("%s %s %d:%d %s\n", e.Policy[:8],
+					time.Unix(int64(e.Time), 0).UTC().Format(time.RFC3339),
+					e.Proof.BlockID, e.Proof.EventIndex, e.Message)
+			}
+			if exportEncoder != nil {
+				d, err := archive.Disclose(e)
+				if err != nil {
+					return fmt.Errorf("failed to export block %d event %d: %v",
+						e.Proof.BlockID, e.Proof.EventIndex, err)
+				}
+				return exportEncoder.Encode(d)
+			}
+			return nil
+		})
+	}
+	if err != nil && err != errLimit {
+		log.Fatalf("failed to search archive: %v", err)
+	}
+	log.Printf("found %d results", n)
+}
+
+// parseTime parses a unix time or a RFC3339 time, empty is zero
+func parseTime(s string) (uint64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if t, err := strconv.ParseUint(s, 10, 64); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(t.Unix()), nil
+}
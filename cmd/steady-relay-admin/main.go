@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/pylls/steady"
+	"github.com/pylls/steady/device"
+	"github.com/pylls/steady/lc"
+)
+
+var (
+	server     = flag.String("server", "localhost:22333", "the server")
+	adminToken = flag.String("admintoken", "", "the admin access token")
+	path       = flag.String("path", "test", "the path of the device to retire")
+)
+
+const usage = `usage: %s [flags] command
+commands:
+  list       list all policies at the relay
+  show ID    show the policy with the hex-encoded ID
+  retire     retire the (closed) device at path with a signed tombstone
+  delete ID  delete the retired policy with the hex-encoded ID
+`
+
+// summary is a summary of a policy at the relay
+type summary struct {
+	id                                 string
+	blocks, used, space, last, nextIdx uint64
+	retired                            bool
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, usage, os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	conn, err := net.Dial("tcp", *server)
+	if err != nil {
+		log.Fatalf("failed to connect to relay: %v", err)
+	}
+	defer conn.Close()
+
+	switch flag.Arg(0) {
+	case "list":
+		list(conn)
+	case "show":
+		id, err := hex.DecodeString(flag.Arg(1))
+		if err != nil || len(id) != steady.WireIdentifierSize {
+			log.Fatalf("invalid policy ID %q", flag.Arg(1))
+		}
+		show(conn, id)
+	case "delete":
+		id, err := hex.DecodeString(flag.Arg(1))
+		if err != nil || len(id) != steady.WireIdentifierSize {
+			log.Fatalf("invalid policy ID %q", flag.Arg(1))
+		}
+		request(conn, steady.WireAdminDelete, id)
+		check(conn, "failed to delete policy")
+		log.Printf("deleted policy %s", flag.Arg(1))
+	case "retire":
+		t, err := device.MakeTombstone(*path)
+		if err != nil {
+			log.Fatalf("failed to make tombstone: %v", err)
+		}
+		retire(conn, t)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+func list(conn net.Conn) {
+	request(conn, steady.WireAdminList, nil)
+	r := check(conn, "failed to list policies")
+	n := binary.BigEndian.Uint64(read(r, make([]byte, 8)))
+	fmt.Printf("%-64s %8s %12s %12s %10s %-20s %s\n",
+		"ID", "blocks", "used (B)", "space (B)", "next index", "last block", "retired")
+	buf := make([]byte, steady.WireAdminPolicySize)
+	for i := uint64(0); i < n; i++ {
+		read(r, buf)
+		s := decodeSummary(buf)
+		fmt.Printf("%-64s %8d %12d %12d %10d %-20s %t\n",
+			s.id, s.blocks, s.used, s.space, s.nextIdx, formatTime(s.last), s.retired)
+	}
+}
+
+func show(conn net.Conn, id []byte) {
+	request(conn, steady.WireAdminShow, id)
+	r := check(conn, "failed to show policy")
+	s := decodeSummary(read(r, make([]byte, steady.WireAdminPolicySize)))
+	size := binary.BigEndian.Uint16(read(r, make([]byte, 2)))
+	p, err := steady.DecodePolicy(read(r, make([]byte, size)))
+	if err != nil {
+		log.Fatalf("relay returned an invalid policy: %v", err)
+	}
+
+	fmt.Printf("ID:\t\t%s\n", hex.EncodeToString(p.ID))
+	fmt.Printf("Vk:\t\t%s\n", hex.EncodeToString(p.Vk))
+	fmt.Printf("Pub:\t\t%s\n", hex.EncodeToString(p.Pub))
+	for i, r := range p.Recipients {
+		fmt.Printf("Recipient %d:\t%s\n", i+1, hex.EncodeToString(r))
+	}
+	fmt.Printf("Timeout (s):\t%d\n", p.Timeout)
+	fmt.Printf("Space (B):\t%d\n", p.Space)
+	fmt.Printf("Time:\t\t%s\n", formatTime(p.Time))
+	fmt.Printf("Blocks:\t\t%d\n", s.blocks)
+	fmt.Printf("Used (B):\t%d\n", s.used)
+	fmt.Printf("Next index:\t%d\n", s.nextIdx)
+	fmt.Printf("Last block:\t%s\n", formatTime(s.last))
+	if s.retired {
+		t, err := steady.DecodeTombstone(read(r, make([]byte, steady.WireTombstoneSize)), p)
+		if err != nil {
+			log.Fatalf("relay returned an invalid tombstone: %v", err)
+		}
+		fmt.Printf("Retired:\tat index %d, %s\n", t.Index, formatTime(t.Time))
+	}
+}
+
+func retire(conn net.Conn, t *steady.Tombstone) {
+	request(conn, steady.WireAdminRetire, steady.EncodeTombstone(*t))
+	check(conn, "failed to retire policy")
+	log.Printf("retired policy %s at index %d", hex.EncodeToString(t.ID), t.Index)
+}
+
+// request sends an admin command, authenticated with the admin token
+func request(conn net.Conn, cmd byte, body []byte) {
+	steady.WriteFrame(conn, steady.WireCmdAdmin, []byte{cmd}, body,
+		lc.Khash([]byte(*adminToken), []byte("admin"), []byte{cmd}, body))
+}
+
+// check reads a reply, exiting on failure, and returns its payload
+func check(conn net.Conn, what string) io.Reader {
+	reply, err := steady.ReadReply(conn)
+	if err != nil {
+		log.Fatalf("%s: %v", what, err)
+	}
+	if reply.Type != steady.WireTrue {
+		log.Fatalf("%s: unexpected reply from relay", what)
+	}
+	return bytes.NewReader(reply.Payload)
+}
+
+// read fills buf from a reply, exiting on failure
+func read(r io.Reader, buf []byte) []byte {
+	if _, err := io.ReadFull(r, buf); err != nil {
+		log.Fatalf("failed to read reply from relay: %v", err)
+	}
+	return buf
+}
+
+func decodeSummary(b []byte) summary {
+	id := steady.WireIdentifierSize
+	return summary{
+		id:      hex.EncodeToString(b[:id]),
+		blocks:  binary.BigEndian.Uint64(b[id:]),
+		used:    binary.BigEndian.Uint64(b[id+8:]),
+		space:   binary.BigEndian.Uint64(b[id+16:]),
+		last:    binary.BigEndian.Uint64(b[id+24:]),
+		nextIdx: binary.BigEndian.Uint64(b[id+32:]),
+		retired: b[id+40] == steady.WireTrue,
+	}
+}
+
+func formatTime(t uint64) string {
+	if t == 0 {
+		return "-"
+	}
+	return time.Unix(int64(t), 0).UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"io"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/pylls/steady"
+	"github.com/pylls/steady/lc"
+)
+
+var (
+	adminToken  = flag.String("admintoken", "", "the admin access token, admin commands are disabled if empty")
+	retireGrace = flag.Duration("retiregrace", 24*time.Hour, "how long retired policies are kept before they may be deleted")
+)
+
+/*
+ * admin commands are authenticated with the admin token over the command and
+ * its arguments, replies start with WireTrue on success, otherwise an error
+ * frame (older clients get WireFalse, or WireAuthErr for an invalid tag):
+ * - list: reply with the number of policies and a summary of each
+ * - show: given an ID, reply with the summary, the length and encoded
+ *   policy, and any tombstone
+ * - retire: given a tombstone signed by the device, retire the policy
+ * - delete: given an ID, delete a policy retired for longer than the grace
+ *   period with all its blocks, freeing its space
+ */
+func admin(req *request) error {
+	cmd := make([]byte, 1)
+	if _, err := io.ReadFull(req.args, cmd); err != nil {
+		return req.fail(nil, steady.WireErrRequest, "failed to read admin command: %v", err)
+	}
+	var size int
+	switch cmd[0] {
+	case steady.WireAdminList:
+	case steady.WireAdminShow, steady.WireAdminDelete:
+		size = steady.WireIdentifierSize
+	case steady.WireAdminRetire:
+		size = steady.WireTombstoneSize
+	default:
+		return req.fail(nil, steady.WireErrCommand, "unknown admin command %d", cmd[0])
+	}
+	buf := make([]byte, size+steady.WireAuthSize)
+	if _, err := io.ReadFull(req.args, buf); err != nil {
+		return req.fail(nil, steady.WireErrRequest, "failed to read admin command: %v", err)
+	}
+	if *adminToken == "" || subtle.ConstantTimeCompare(buf[size:],
+		lc.Khash([]byte(*adminToken), []byte("admin"), cmd, buf[:size])) != 1 {
+		return req.fail([]byte{steady.WireAuthErr}, steady.WireErrAuth, "invalid admin token")
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	switch cmd[0] {
+	case steady.WireAdminList:
+		log.Println("\tlist")
+		ids := make([]string, 0, len(state))
+		for id := range state {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		reply := make([]byte, 8, 8+len(ids)*steady.WireAdminPolicySize)
+		binary.BigEndian.PutUint64(reply, uint64(len(ids)))
+		for _, id := range ids {
+			reply = append(reply, summary(state[id])...)
+		}
+		req.reply(steady.WireTrue, true, reply)
+	case steady.WireAdminShow:
+		id := hex.EncodeToString(buf[:size])
+		log.Printf("\tshow %s", id)
+		s, exists := state[id]
+		if !exists {
+			return req.fail([]byte{steady.WireFalse}, steady.WireErrNoPolicy, "%s", id)
+		}
+		policy := steady.EncodePolicy(s.policy)
+		reply := binary.BigEndian.AppendUint16(summary(s), uint16(len(policy)))
+		req.reply(steady.WireTrue, true, reply, policy, s.tombstone)
+	case steady.WireAdminRetire:
+		id := hex.EncodeToString(buf[:steady.WireIdentifierSize])
+		log.Printf("\tretire %s", id)
+		if err := retire(id, buf[:size]); err != nil {
+			return req.fail([]byte{steady.WireFalse}, err.Code, "%s", err.Message)
+		}
+		req.reply(steady.WireTrue, true)
+	case steady.WireAdminDelete:
+		id := hex.EncodeToString(buf[:size])
+		log.Printf("\tdelete %s", id)
+		if err := remove(id); err != nil {
+			return req.fail([]byte{steady.WireFalse}, err.Code, "%s", err.Message)
+		}
+		req.reply(steady.WireTrue, true)
+	}
+	return nil
+}
+
+// retire retires a policy given an encoded tombstone, must hold lock
+func retire(id string, tombstone []byte) *steady.WireError {
+	s, exists := state[id]
+	if !exists {
+		return steady.NewWireError(steady.WireErrNoPolicy, "%s", id)
+	}
+	if s.tombstone != nil {
+		// already retired, fine if the same tombstone
+		if bytes.Equal(s.tombstone, tombstone) {
+			return nil
+		}
+		return steady.NewWireError(steady.WireErrRetired, "%s", id)
+	}
+	t, err := steady.DecodeTombstone(tombstone, s.policy)
+	if err != nil {
+		return steady.NewWireError(steady.WireErrRequest, "invalid tombstone: %v", err)
+	}
+	// the device has to have written all its blocks
+	if t.Index != s.nextIndex {
+		return steady.NewWireError(steady.WireErrRequest,
+			"tombstone for index %d, but next index is %d", t.Index, s.nextIndex)
+	}
+	s.tombstone = tombstone
+	s.retired = time.Now()
+	state[id] = s
+	replicate(id)
+	log.Printf("\tretired at index %d", t.Index)
+	return nil
+}
+
+// remove deletes a policy retired for longer than the grace period, must hold
+// lock
+func remove(id string) *steady.WireError {
+	s, exists := state[id]
+	if !exists {
+		return steady.NewWireError(steady.WireErrNoPolicy, "%s", id)
+	}
+	if s.tombstone == nil {
+		return steady.NewWireError(steady.WireErrRequest, "%s is not retired", id)
+	}
+	if since := time.Since(s.retired); since < *retireGrace {
+		return steady.NewWireError(steady.WireErrRequest, "%s retired %s ago, grace period is %s",
+			id, since.Round(time.Second), *retireGrace)
+	}
+	delete(state, id)
+	log.Printf("\tdeleted, freeing %d bytes", s.policy.Space)
+	return nil
+}
+
+// summary encodes a summary of the state of a policy
+func summary(s State) []byte {
+	b := make([]byte, 0, steady.WireAdminPolicySize)
+	b = append(b, s.policy.ID...)
+	b = binary.BigEndian.AppendUint64(b, uint64(s.blocks.Len()))
+	b = binary.BigEndian.AppendUint64(b, s.space)
+	b = binary.BigEndian.AppendUint64(b, s.policy.Space)
+	var last uint64
+	if s.blocks.Len() > 0 {
+		last = s.blocks.Back().Value.(*Block).Header.Time
+	}
+	b = binary.BigEndian.AppendUint64(b, last)
+	b = binary.BigEndian.AppendUint64(b, s.nextIndex)
+	if s.tombstone != nil {
+		return append(b, steady.WireTrue)
+	}
+	return append(b, steady.WireFalse)
+}
@@ -1,28 +1,116 @@
 package main
 
 import (
+	"bytes"
 	"encoding/hex"
 	"fmt"
+	"io"
 	"net"
 
 	"github.com/pylls/steady"
 )
 
-func getID(conn net.Conn) (string, []byte, error) {
-	buf := make([]byte, steady.WireIdentifierSize)
-	if err := readn(buf, steady.WireIdentifierSize, conn); err != nil {
-		return "", nil, err
+// request is a command from a client: for clients from
+// steady.WireVersionFramed the arguments are read from the request frame,
+// for older clients directly from the connection
+type request struct {
+	conn    net.Conn
+	version byte
+	args    io.Reader
+}
+
+// readRequest reads the version and command of the next request, and the
+// rest of the request frame for framed clients
+func readRequest(conn net.Conn) (*request, byte, error) {
+	buf := make([]byte, 2+4)
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return nil, 0, fmt.Errorf("failed to read command: %v", err)
 	}
-	return hex.EncodeToString(buf), buf, nil
+	req := &request{
+		conn:    conn,
+		version: buf[0],
+		args:    conn,
+	}
+	if req.version > steady.WireVersion || !req.framed() {
+		return req, buf[1], nil
+	}
+	if _, err := io.ReadFull(conn, buf[2:]); err != nil {
+		return nil, 0, fmt.Errorf("failed to read frame length: %v", err)
+	}
+	f, err := steady.ReadFramePayload(conn, buf[0], buf[1], buf[2:], maxRequestSize(buf[1]))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.args = bytes.NewReader(f.Payload)
+	return req, f.Type, nil
+}
+
+// maxRequestSize is the largest request frame of a command, read before any
+// auth: blocks that follow a write are sent in frames of their own (see next)
+func maxRequestSize(cmd byte) int {
+	switch cmd {
+	case steady.WireCmdSetup:
+		return 2 + steady.WireMaxPolicySize + steady.WireAuthSize
+	case steady.WireCmdAdmin:
+		return 1 + steady.WireTombstoneSize + steady.WireAuthSize
+	default: // status, read, write, and unknown commands
+		return steady.WireIdentifierSize + steady.WireAuthSize
+	}
+}
+
+func (r *request) framed() bool {
+	return r.version >= steady.WireVersionFramed
 }
 
-func readn(dst []byte, n int, conn net.Conn) error {
-	l, err := conn.Read(dst)
+// next returns a reader for the next block of a request: the payload of the
+// next frame for framed clients, otherwise the connection
+func (r *request) next() (io.Reader, error) {
+	if !r.framed() {
+		return r.conn, nil
+	}
+	f, err := steady.ReadFrame(r.conn, steady.WireMaxFrameSize)
 	if err != nil {
-		return fmt.Errorf("failed to read from conn: %v", err)
+		return nil, err
+	}
+	if f.Type != steady.WireMore {
+		return nil, fmt.Errorf("unexpected frame type %d", f.Type)
+	}
+	return bytes.NewReader(f.Payload), nil
+}
+
+// reply replies with a status and payload: a frame for framed clients,
+// otherwise the payload, preceded by the status if status is set
+func (r *request) reply(t byte, status bool, payload ...[]byte) {
+	if r.framed() {
+		steady.WriteFrame(r.conn, t, payload...)
+		return
+	}
+	if status {
+		r.conn.Write([]byte{t})
+	}
+	for _, b := range payload {
+		r.conn.Write(b)
 	}
-	if l < n {
-		return fmt.Errorf("read %d bytes from conn, expected %d", l, n)
+}
+
+// fail replies to a failed command and returns the error: an error frame for
+// clients that support it, otherwise the legacy reply (if any)
+func (r *request) fail(legacy []byte, code byte, format string, args ...interface{}) error {
+	err := steady.NewWireError(code, format, args...)
+	if r.framed() {
+		r.conn.Write(steady.ErrorFrame(err))
+	} else if r.version >= steady.WireVersionErrors {
+		r.conn.Write(steady.EncodeWireError(err))
+	} else if legacy != nil {
+		r.conn.Write(legacy)
 	}
-	return nil
+	return err
+}
+
+func getID(r io.Reader) (string, []byte, error) {
+	buf := make([]byte, steady.WireIdentifierSize)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", nil, fmt.Errorf("failed to read id: %v", err)
+	}
+	return hex.EncodeToString(buf), buf, nil
 }
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pylls/steady"
+	"github.com/pylls/steady/lc"
+)
+
+var httpAddr = flag.String("http", "", "the address to serve the HTTP API on, disabled if empty")
+
+/*
+ * the HTTP API mirrors the TCP protocol: auth tags are the same as on TCP,
+ * hex-encoded in the X-Steady-Auth header, policies and blocks are sent as
+ * binary bodies (application/octet-stream), everything else as JSON:
+ * - POST /v1/policies: setup, the encoded policy as body
+ * - GET /v1/policies/ID: the stored blocks and any tombstone (public)
+ * - GET /v1/policies/ID/status: the latest block header (auth)
+ * - POST /v1/policies/ID/blocks: write, encoded blocks as body (auth on ACK),
+ *   replied to with the ACK and a receipt per block (see steady.Receipt)
+ * - GET /v1/policies/ID/blocks?from=N: read, the encoded blocks with an index
+ *   of at least N as body in order of index (public)
+ * - GET /v1/key: the verification key of the relay for receipts (public)
+ * - GET /v1/policies/ID/equivocations: blocks refused as equivocations of
+ *   the device, see steady.Equivocation (public)
+ * - GET /v1/log: a signed tree head of the transparency log of the relay,
+ *   see steady.TreeHead (public)
+ * - GET /v1/log/consistency?first=M&second=N: a consistency proof between the
+ *   log of size M and of size N (public)
+ * - GET /v1/log/inclusion?index=I&size=N: entry I and its audit path in the
+ *   log of size N (public)
+ * failures are replied to with the error code and message (see
+ * steady.WireError) and a matching HTTP status
+ */
+
+const httpAuthHeader = "X-Steady-Auth"
+
+// timeouts of the HTTP API server, generous enough to write and read blocks
+// of the largest size on slow links
+const (
+	httpReadHeaderTimeout = 10 * time.Second
+	httpReadTimeout       = 5 * time.Minute
+	httpWriteTimeout      = 5 * time.Minute
+	httpIdleTimeout       = 2 * time.Minute
+)
+
+// httpPolicy is the reply to GET /v1/policies/ID
+type httpPolicy struct {
+	ID                            string
+	Blocks, FirstIndex, NextIndex uint64
+	Tombstone                     []byte `json:",omitempty"`
+}
+
+// httpStatus is the reply to GET /v1/policies/ID/status
+type httpStatus struct {
+	ID     string
+	Header []byte `json:",omitempty"` // the latest block header, if any
+}
+
+// httpACK is the reply to POST /v1/policies/ID/blocks
+type httpACK struct {
+	Index    uint64
+	Auth     []byte
+	Receipts [][]byte // encoded, one per block
+}
+
+// httpKey is the reply to GET /v1/key
+type httpKey struct {
+	Key []byte
+}
+
+// httpTreeHead is the reply to GET /v1/log
+type httpTreeHead struct {
+	TreeHead []byte // encoded
+}
+
+// httpProof is the reply to GET /v1/log/consistency and /v1/log/inclusion
+type httpProof struct {
+	Entry []byte `json:",omitempty"` // for inclusion
+	Proof [][]byte
+}
+
+type httpError struct {
+	Code  byte
+	Error string
+}
+
+// serveHTTP serves the HTTP API on addr in the background
+func serveHTTP(addr string) {
+	go func() {
+		log.Printf("serving HTTP API at http://%s/v1/policies", addr)
+		server := &http.Server{
+			Addr:              addr,
+			Handler:           httpHandler(),
+			ReadHeaderTimeout: httpReadHeaderTimeout,
+			ReadTimeout:       httpReadTimeout,
+			WriteTimeout:      httpWriteTimeout,
+			IdleTimeout:       httpIdleTimeout,
+		}
+		for {
+			err := server.ListenAndServe()
+			log.Printf("HTTP API server failed: %v", err)
+			time.Sleep(time.Second)
+		}
+	}()
+}
+
+func httpHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/policies", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			httpFail(w, steady.NewWireError(steady.WireErrCommand, "%s %s", r.Method, r.URL.Path))
+			return
+		}
+		httpSetup(w, r)
+	})
+	mux.HandleFunc("/v1/key", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			httpFail(w, steady.NewWireError(steady.WireErrCommand, "%s %s", r.Method, r.URL.Path))
+			return
+		}
+		httpReply(w, http.StatusOK, httpKey{Key: relayVk})
+	})
+	mux.HandleFunc("/v1/log", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			httpFail(w, steady.NewWireError(steady.WireErrCommand, "%s %s", r.Method, r.URL.Path))
+			return
+		}
+		httpReply(w, http.StatusOK, httpTreeHead{TreeHead: steady.EncodeTreeHead(treeHead())})
+	})
+	mux.HandleFunc("/v1/log/", func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v1/log/consistency" && r.Method == http.MethodGet:
+			httpConsistency(w, r)
+		case r.URL.Path == "/v1/log/inclusion" && r.Method == http.MethodGet:
+			httpInclusion(w, r)
+		default:
+			httpFail(w, steady.NewWireError(steady.WireErrCommand, "%s %s", r.Method, r.URL.Path))
+		}
+	})
+	mux.HandleFunc("/v1/policies/", func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/policies/"), "/")
+		raw, err := hex.DecodeString(parts[0])
+		if err != nil || len(raw) != steady.WireIdentifierSize {
+			httpFail(w, steady.NewWireError(steady.WireErrRequest, "invalid id %q", parts[0]))
+			return
+		}
+		id := hex.EncodeToString(raw)
+
+		switch {
+		case len(parts) == 1 && r.Method == http.MethodGet:
+			httpPolicyInfo(w, id)
+		case len(parts) == 2 && parts[1] == "status" && r.Method == http.MethodGet:
+			httpStatusCheck(w, r, id, raw)
+		case len(parts) == 2 && parts[1] == "blocks" && r.Method == http.MethodPost:
+			httpWrite(w, r, id)
+		case len(parts) == 2 && parts[1] == "blocks" && r.Method == http.MethodGet:
+			httpRead(w, r, id)
+		case len(parts) == 2 && parts[1] == "equivocations" && r.Method == http.MethodGet:
+			httpEquivocations(w, id)
+		default:
+			httpFail(w, steady.NewWireError(steady.WireErrCommand, "%s %s", r.Method, r.URL.Path))
+		}
+	})
+	return mux
+}
+
+func httpSetup(w http.ResponseWriter, r *http.Request) {
+	log.Println("http setup")
+	metricCommands.Inc("command", "setup")
+	tag, e := httpAuth(r)
+	if e != nil {
+		httpFail(w, e)
+		return
+	}
+	encoded, e := httpBody(w, r, steady.WireMaxPolicySize)
+	if e != nil {
+		httpFail(w, e)
+		return
+	}
+	p, e := addPolicy(encoded, tag)
+	if e != nil {
+		httpFail(w, e)
+		return
+	}
+	log.Printf("\tcompleted, id: %s", hex.EncodeToString(p.ID))
+	httpReply(w, http.StatusCreated, httpStatus{ID: hex.EncodeToString(p.ID)})
+}
+
+func httpPolicyInfo(w http.ResponseWriter, id string) {
+	lock.Lock()
+	defer lock.Unlock()
+	s, exists := state[id]
+	if !exists {
+		httpFail(w, steady.NewWireError(steady.WireErrNoPolicy, "%s", id))
+		return
+	}
+	reply := httpPolicy{
+		ID:        id,
+		Blocks:    uint64(s.blocks.Len()),
+		NextIndex: s.nextIndex,
+		Tombstone: s.tombstone,
+	}
+	if s.blocks.Len() > 0 {
+		reply.FirstIndex = s.blocks.Front().Value.(*Block).Header.Index
+	}
+	httpReply(w, http.StatusOK, reply)
+}
+
+func httpStatusCheck(w http.ResponseWriter, r *http.Request, id string, raw []byte) {
+	log.Println("http status")
+	metricCommands.Inc("command", "status")
+	tag, e := httpAuth(r)
+	if e != nil {
+		httpFail(w, e)
+		return
+	}
+	if subtle.ConstantTimeCompare(tag, lc.Khash([]byte(*token), []byte("status"), raw)) != 1 {
+		httpFail(w, steady.NewWireError(steady.WireErrAuth, "invalid auth token"))
+		return
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	s, exists := state[id]
+	if !exists {
+		httpFail(w, steady.NewWireError(steady.WireErrNoPolicy, "%s", id))
+		return
+	}
+	reply := httpStatus{ID: id}
+	if s.blocks.Len() > 0 {
+		reply.Header = s.blocks.Back().Value.(*Block).HeaderEncoded
+	}
+	httpReply(w, http.StatusOK, reply)
+}
+
+func httpWrite(w http.ResponseWriter, r *http.Request, id string) {
+	log.Println("http write")
+	metricCommands.Inc("command", "write")
+	// read the body before taking the lock
+	body, e := httpBody(w, r, steady.MaxBlockSize)
+	if e != nil {
+		httpFail(w, e)
+		return
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	s, e := writable(id)
+	if e != nil {
+		httpFail(w, e)
+		return
+	}
+	var blocks []*Block
+	for br := bytes.NewReader(body); br.Len() > 0; {
+		b, err := readBlock(br, s.policy, s.nextIndex+uint64(len(blocks)))
+		if err != nil {
+			retainEquivocation(id, err)
+			httpFail(w, steady.NewWireError(steady.WireErrInvalidBlock, "failed to read block: %v", err))
+			return
+		}
+		blocks = append(blocks, b)
+	}
+	if len(blocks) == 0 {
+		httpFail(w, steady.NewWireError(steady.WireErrRequest, "got zero blocks"))
+		return
+	}
+
+	ack, e := commit(id, s, blocks)
+	if e != nil {
+		httpFail(w, e)
+		return
+	}
+	log.Printf("\twrote %d block(s)", len(blocks))
+	reply := httpACK{
+		Index: blocks[len(blocks)-1].Header.Index,
+		Auth:  ack[8:],
+	}
+	signed := receipts(s.policy.ID, blocks)
+	for i := 0; i < len(signed); i += steady.WireReceiptSize {
+		reply.Receipts = append(reply.Receipts, signed[i:i+steady.WireReceiptSize])
+	}
+	httpReply(w, http.StatusOK, reply)
+}
+
+func httpRead(w http.ResponseWriter, r *http.Request, id string) {
+	log.Println("http read")
+	metricCommands.Inc("command", "read")
+	var from uint64
+	if f := r.URL.Query().Get("from"); f != "" {
+		var err error
+		if from, err = strconv.ParseUint(f, 10, 64); err != nil {
+			httpFail(w, steady.NewWireError(steady.WireErrRequest, "invalid from %q", f))
+			return
+		}
+	}
+
+	// collect the blocks under lock, stored blocks are never modified
+	lock.Lock()
+	s, exists := state[id]
+	if !exists {
+		lock.Unlock()
+		httpFail(w, steady.NewWireError(steady.WireErrNoPolicy, "%s", id))
+		return
+	}
+	var blocks []*Block
+	for e := s.blocks.Front(); e != nil; e = e.Next() {
+		if block := e.Value.(*Block); block.Header.Index >= from {
+			blocks = append(blocks, block)
+		}
+	}
+	lock.Unlock()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("X-Steady-Blocks", strconv.Itoa(len(blocks)))
+	for _, block := range blocks {
+		w.Write(block.HeaderEncoded)
+		w.Write(block.Payload)
+	}
+}
+
+func httpEquivocations(w http.ResponseWriter, id string) {
+	lock.Lock()
+	defer lock.Unlock()
+	s, exists := state[id]
+	if !exists {
+		httpFail(w, steady.NewWireError(steady.WireErrNoPolicy, "%s", id))
+		return
+	}
+	equivocations := s.equivocations
+	if equivocations == nil {
+		equivocations = []steady.Equivocation{}
+	}
+	httpReply(w, http.StatusOK, equivocations)
+}
+
+func httpConsistency(w http.ResponseWriter, r *http.Request) {
+	first, e := httpUint(r, "first")
+	if e != nil {
+		httpFail(w, e)
+		return
+	}
+	second, e := httpUint(r, "second")
+	if e != nil {
+		httpFail(w, e)
+		return
+	}
+	proof, e := consistencyProof(first, second)
+	if e != nil {
+		httpFail(w, e)
+		return
+	}
+	httpReply(w, http.StatusOK, httpProof{Proof: proof})
+}
+
+func httpInclusion(w http.ResponseWriter, r *http.Request) {
+	index, e := httpUint(r, "index")
+	if e != nil {
+		httpFail(w, e)
+		return
+	}
+	size, e := httpUint(r, "size")
+	if e != nil {
+		httpFail(w, e)
+		return
+	}
+	entry, proof, e := inclusionProof(index, size)
+	if e != nil {
+		httpFail(w, e)
+		return
+	}
+	httpReply(w, http.StatusOK, httpProof{Entry: entry, Proof: proof})
+}
+
+// httpUint returns the unsigned integer query parameter name of a request
+func httpUint(r *http.Request, name string) (uint64, *steady.WireError) {
+	v := r.URL.Query().Get(name)
+	n, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return 0, steady.NewWireError(steady.WireErrRequest, "invalid %s %q", name, v)
+	}
+	return n, nil
+}
+
+// httpAuth returns the auth tag of a request
+func httpAuth(r *http.Request) ([]byte, *steady.WireError) {
+	tag, err := hex.DecodeString(r.Header.Get(httpAuthHeader))
+	if err != nil || len(tag) != steady.WireAuthSize {
+		return nil, steady.NewWireError(steady.WireErrAuth, "missing or malformed %s header", httpAuthHeader)
+	}
+	return tag, nil
+}
+
+// httpBody reads the body of a request of at most max bytes
+func httpBody(w http.ResponseWriter, r *http.Request, max int64) ([]byte, *steady.WireError) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, max))
+	if err != nil {
+		return nil, steady.NewWireError(steady.WireErrRequest, "failed to read body: %v", err)
+	}
+	return body, nil
+}
+
+func httpReply(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("\tfailed to reply: %v", err)
+	}
+}
+
+func httpFail(w http.ResponseWriter, e *steady.WireError) {
+	log.Printf("\t%v", e)
+	httpReply(w, httpStatusCode(e.Code), httpError{Code: e.Code, Error: e.Error()})
+}
+
+// httpStatusCode maps error codes to HTTP status codes
+func httpStatusCode(code byte) int {
+	switch code {
+	case steady.WireErrCommand:
+		return http.StatusNotFound
+	case steady.WireErrAuth:
+		return http.StatusUnauthorized
+	case steady.WireErrNoPolicy:
+		return http.StatusNotFound
+	case steady.WireErrPolicyExists:
+		return http.StatusConflict
+	case steady.WireErrLimit:
+		return http.StatusForbidden
+	case steady.WireErrRetired:
+		return http.StatusGone
+	case steady.WireErrVersion, steady.WireErrRequest,
+		steady.WireErrInvalidPolicy, steady.WireErrInvalidBlock:
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
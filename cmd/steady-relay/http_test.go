@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pylls/steady"
+	"github.com/pylls/steady/lc"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTP(t *testing.T) {
+	state = make(map[string]State)
+	vk, sk, _ := lc.SigningKeyGen()
+	pub, _, _ := lc.EncryptKeyGen()
+	now := uint64(time.Now().Unix())
+	p := steady.MakePolicy(sk, vk, pub, 10, 1024*1024, now)
+	server := httptest.NewServer(httpHandler())
+	defer server.Close()
+	url := server.URL + "/v1/policies/" + hex.EncodeToString(p.ID)
+
+	do := func(method, url string, auth, body []byte, code int, v interface{}) []byte {
+		req, err := http.NewRequest(method, url, bytes.NewReader(body))
+		assert.Nil(t, err, "failed to make request: %v", err)
+		if auth != nil {
+			req.Header.Set(httpAuthHeader, hex.EncodeToString(auth))
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err, "failed to %s %s: %v", method, url, err)
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		assert.Nil(t, err, "failed to read body: %v", err)
+		assert.Equal(t, code, resp.StatusCode, "wrong status for %s %s: %s", method, url, b)
+		if v != nil {
+			assert.Nil(t, json.Unmarshal(b, v), "failed to decode reply")
+		}
+		return b
+	}
+
+	// setup, once
+	policy := steady.EncodePolicy(p)
+	setupAuth := lc.Khash([]byte(*token), []byte("setup"), policy)
+	do("POST", server.URL+"/v1/policies", nil, policy, http.StatusUnauthorized, nil)
+	do("POST", server.URL+"/v1/policies", setupAuth, policy, http.StatusCreated, nil)
+	var e httpError
+	do("POST", server.URL+"/v1/policies", setupAuth, policy, http.StatusConflict, &e)
+	assert.Equal(t, byte(steady.WireErrPolicyExists), e.Code, "wrong error code")
+
+	// status without blocks
+	statusAuth := lc.Khash([]byte(*token), []byte("status"), p.ID)
+	var status httpStatus
+	do("GET", url+"/status", statusAuth, nil, http.StatusOK, &status)
+	assert.Empty(t, status.Header, "expected no blocks")
+
+	// the transparency log before writing
+	var th httpTreeHead
+	do("GET", server.URL+"/v1/log", nil, nil, http.StatusOK, &th)
+	older, err := steady.DecodeTreeHead(th.TreeHead)
+	assert.Nil(t, err, "failed to decode tree head: %v", err)
+
+	// write two blocks, then the same blocks again with the wrong indices
+	var body, last []byte
+	for i := uint64(0); i < 2; i++ {
+		block, err := steady.MakeEncodedBlock(i, 0, now, true, true, p,
+			[]steady.Event{{Time: now, Seq: i, Data: []byte("foo")}}, sk)
+		assert.Nil(t, err, "failed to make block: %v", err)
+		body, last = append(body, block...), block
+	}
+	var ack httpACK
+	do("POST", url+"/blocks", nil, body, http.StatusOK, &ack)
+	assert.Equal(t, uint64(1), ack.Index, "wrong index")
+	assert.Equal(t, lc.Khash([]byte(*token), []byte("write"), p.ID,
+		[]byte{0, 0, 0, 0, 0, 0, 0, 1}), ack.Auth, "wrong ACK")
+	assert.Len(t, ack.Receipts, 2, "expected a receipt per block")
+	receipt, err := steady.DecodeReceipt(ack.Receipts[1])
+	assert.Nil(t, err, "failed to decode receipt: %v", err)
+	var key httpKey
+	do("GET", server.URL+"/v1/key", nil, nil, http.StatusOK, &key)
+	assert.Nil(t, steady.VerifyReceipt(receipt, key.Key, p.ID, last), "failed to verify receipt")
+	do("POST", url+"/blocks", nil, body, http.StatusBadRequest, nil)
+
+	// the written blocks are in the log, consistent with the log before
+	do("GET", server.URL+"/v1/log", nil, nil, http.StatusOK, &th)
+	newer, err := steady.DecodeTreeHead(th.TreeHead)
+	assert.Nil(t, err, "failed to decode tree head: %v", err)
+	assert.Equal(t, older.Size+2, newer.Size, "wrong log size")
+	var proof httpProof
+	do("GET", fmt.Sprintf("%s/v1/log/consistency?first=%d&second=%d", server.URL, older.Size, newer.Size),
+		nil, nil, http.StatusOK, &proof)
+	assert.Nil(t, steady.VerifyTreeHeads(older, newer, proof.Proof), "inconsistent tree heads")
+	do("GET", fmt.Sprintf("%s/v1/log/inclusion?index=%d&size=%d", server.URL, newer.Size-1, newer.Size),
+		nil, nil, http.StatusOK, &proof)
+	assert.Nil(t, steady.VerifyLogEntry(newer, newer.Size-1, p.ID, last[:steady.WireBlockHeaderSize],
+		proof.Proof), "last block not in log")
+	do("GET", fmt.Sprintf("%s/v1/log/consistency?first=%d&second=%d", server.URL, newer.Size, newer.Size+1),
+		nil, nil, http.StatusBadRequest, nil)
+
+	// status and read
+	do("GET", url+"/status", statusAuth, nil, http.StatusOK, &status)
+	assert.Equal(t, last[:steady.WireBlockHeaderSize], status.Header, "wrong header")
+	var info httpPolicy
+	do("GET", url, nil, nil, http.StatusOK, &info)
+	assert.Equal(t, uint64(2), info.Blocks, "wrong number of blocks")
+	assert.Equal(t, uint64(2), info.NextIndex, "wrong next index")
+	assert.Equal(t, body, do("GET", url+"/blocks", nil, nil, http.StatusOK, nil), "wrong blocks")
+	assert.Equal(t, last, do("GET", url+"/blocks?from=1", nil, nil, http.StatusOK, nil), "wrong blocks")
+
+	// unknown policy
+	do("GET", server.URL+"/v1/policies/"+hex.EncodeToString(make([]byte, 32))+"/blocks",
+		nil, nil, http.StatusNotFound, nil)
+}
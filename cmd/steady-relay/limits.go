@@ -0,0 +1,50 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/pylls/steady"
+)
+
+// limits on the policies that the relay accepts on setup
+var (
+	maxPolicies = flag.Int("maxpolicies", 1024, "the max number of policies, 0 for no limit")
+	maxSpace    = flag.Uint64("maxspace", 4*1024, "the max total space (MiB) of all policies, 0 for no limit")
+	minTimeout  = flag.Uint64("mintimeout", 1, "the min timeout (s) of a policy")
+	maxTimeout  = flag.Uint64("maxtimeout", 24*3600, "the max timeout (s) of a policy")
+	maxDrift    = flag.Uint64("maxdrift", 3600, "the max difference (s) between the creation time of a policy and the relay clock")
+)
+
+// checkLimits checks if a new policy is within the limits of the relay at
+// time now, must hold lock
+func checkLimits(p steady.Policy, now uint64) error {
+	if *maxPolicies > 0 && len(state) >= *maxPolicies {
+		return fmt.Errorf("relay has the max number of policies (%d)", *maxPolicies)
+	}
+	if p.Timeout < *minTimeout || p.Timeout > *maxTimeout {
+		return fmt.Errorf("timeout %d s outside of allowed range [%d, %d]",
+			p.Timeout, *minTimeout, *maxTimeout)
+	}
+	if p.Space <= steady.WireBlockHeaderSize {
+		return fmt.Errorf("space %d bytes too small for any block", p.Space)
+	}
+	if *maxSpace > 0 {
+		limit := *maxSpace * 1024 * 1024
+		total := p.Space
+		for _, s := range state {
+			total += s.policy.Space
+			if total > limit || total < s.policy.Space { // or overflow
+				return fmt.Errorf("space %d bytes exceeds the remaining space of the relay", p.Space)
+			}
+		}
+		if total > limit {
+			return fmt.Errorf("space %d bytes exceeds the remaining space of the relay", p.Space)
+		}
+	}
+	if p.Time+*maxDrift < now || p.Time > now+*maxDrift {
+		return fmt.Errorf("creation time %d differs more than %d s from relay time %d",
+			p.Time, *maxDrift, now)
+	}
+	return nil
+}
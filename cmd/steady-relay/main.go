@@ -19,6 +19,21 @@ var (
 func main() {
 	flag.Parse()
 	state = make(map[string]State)
+	if err := loadKey(*keyFile); err != nil {
+		log.Fatalf("failed to load relay key: %v", err)
+	}
+	if err := openLog(*logFile); err != nil {
+		log.Fatalf("failed to open transparency log: %v", err)
+	}
+	if *metricsAddr != "" {
+		serveMetrics(*metricsAddr)
+	}
+	if *httpAddr != "" {
+		serveHTTP(*httpAddr)
+	}
+	if *peers != "" {
+		startReplication(*peers)
+	}
 
 	l, err := net.Listen("tcp", *listen)
 	if err != nil {
@@ -40,36 +55,47 @@ func handler(conn net.Conn) {
 	defer conn.Close()
 
 	for {
-		buf := make([]byte, 2)
-		l, err := conn.Read(buf)
+		req, cmd, err := readRequest(conn)
 		if err != nil {
 			log.Printf("failed to read: %v", err)
 			return
 		}
-		if l < 2 {
-			log.Println("failed to read command bytes")
-			return
-		}
-		if buf[0] > steady.WireVersion {
+		if req.version > steady.WireVersion {
+			// newer clients understand framed error replies
+			version := req.version
+			req.version = steady.WireVersion
+			req.fail(nil, steady.WireErrVersion,
+				"got version %d, relay supports up to %d", version, steady.WireVersion)
 			log.Println("got newer version of Steady")
 			return
 		}
 
-		switch buf[1] {
+		switch cmd {
 		case steady.WireCmdWrite: // auth on ACK
 			log.Println("write cmd")
-			write(conn)
+			metricCommands.Inc("command", "write")
+			err = write(req)
 		case steady.WireCmdSetup: // auth on setup parameters
 			log.Println("setup cmd")
-			setup(conn)
+			metricCommands.Inc("command", "setup")
+			err = setup(req)
 		case steady.WireCmdRead: // public
 			log.Println("read cmd")
-			read(conn)
+			metricCommands.Inc("command", "read")
+			err = read(req)
 		case steady.WireCmdStatus: // public
 			log.Println("status cmd")
-			status(conn)
+			metricCommands.Inc("command", "status")
+			err = status(req)
+		case steady.WireCmdAdmin: // auth on admin token
+			log.Println("admin cmd")
+			metricCommands.Inc("command", "admin")
+			err = admin(req)
 		default:
-			log.Println("unknown command")
+			err = req.fail(nil, steady.WireErrCommand, "unknown command %d", cmd)
+		}
+		if err != nil { // the rest of the request is unknown, so give up on conn
+			log.Printf("	%v", err)
 			return
 		}
 	}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"time"
+
+	"github.com/pylls/steady/metrics"
+)
+
+var (
+	metricsAddr = flag.String("metrics", "", "the address to serve Prometheus metrics on, disabled if empty")
+	registry    = metrics.NewRegistry()
+
+	metricCommands = registry.Counter("steady_relay_commands_total",
+		"Number of commands by command.")
+	metricWritten = registry.Counter("steady_relay_written_blocks_total",
+		"Number of blocks written by policy.")
+	metricWrittenBytes = registry.Counter("steady_relay_written_bytes_total",
+		"Number of bytes of blocks written by policy.")
+	metricEquivocations = registry.Counter("steady_relay_equivocations_total",
+		"Number of blocks refused as equivocations of the device by policy.")
+	metricEvictions = registry.Counter("steady_relay_evicted_blocks_total",
+		"Number of old blocks removed to make room for new blocks by policy.")
+	metricPolicies = registry.Gauge("steady_relay_policies",
+		"Number of policies.")
+	metricBlocks = registry.Gauge("steady_relay_blocks",
+		"Number of stored blocks by policy.")
+	metricBytes = registry.Gauge("steady_relay_bytes",
+		"Number of bytes of stored blocks by policy.")
+	metricSpace = registry.Gauge("steady_relay_space_bytes",
+		"Space of the policy (max bytes of stored blocks) by policy.")
+	metricLastBlock = registry.Gauge("steady_relay_last_block_timestamp_seconds",
+		"Time of the latest stored block by policy.")
+	metricLogEntries = registry.Gauge("steady_relay_log_entries",
+		"Number of entries in the transparency log.")
+)
+
+// serveMetrics serves metrics of the relay on addr in the background
+func serveMetrics(addr string) {
+	registry.OnCollect(func() {
+		lock.Lock()
+		defer lock.Unlock()
+		metricPolicies.Set(float64(len(state)))
+		metricLogEntries.Set(float64(logSize()))
+		for _, m := range []*metrics.Metric{metricBlocks, metricBytes, metricSpace, metricLastBlock} {
+			m.Reset() // policies may have been deleted
+		}
+		for id, s := range state {
+			metricBlocks.Set(float64(s.blocks.Len()), "policy", id)
+			metricBytes.Set(float64(s.space), "policy", id)
+			metricSpace.Set(float64(s.policy.Space), "policy", id)
+			if s.blocks.Len() > 0 {
+				metricLastBlock.Set(float64(s.blocks.Back().Value.(*Block).Header.Time), "policy", id)
+			}
+		}
+	})
+
+	go func() {
+		log.Printf("serving metrics at http://%s/metrics", addr)
+		for {
+			err := metrics.ListenAndServe(addr, registry)
+			log.Printf("metrics server failed: %v", err)
+			time.Sleep(time.Second)
+		}
+	}()
+}
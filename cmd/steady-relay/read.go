@@ -2,19 +2,16 @@ package main
 
 import (
 	"encoding/binary"
-	"log"
-	"net"
+	"io"
 
 	"github.com/pylls/steady"
-	"github.com/pylls/steady/lc"
 )
 
-func read(conn net.Conn) {
+func read(req *request) error {
 	// read setup id
-	id, _, err := getID(conn)
+	id, _, err := getID(req.args)
 	if err != nil {
-		log.Printf("\tfailed to get id: %v", err)
-		return
+		return req.fail(nil, steady.WireErrRequest, "failed to get id: %v", err)
 	}
 
 	// see if in state, reject if not
@@ -22,20 +19,13 @@ func read(conn net.Conn) {
 	defer lock.Unlock()
 	s, exists := state[id]
 	if !exists {
-		log.Printf("\tno such state")
-		return
+		return req.fail(nil, steady.WireErrNoPolicy, "%s", id)
 	}
 
 	// read last read block index
 	buf := make([]byte, 8)
-	l, err := conn.Read(buf)
-	if err != nil {
-		log.Printf("failed to read block index: %v", err)
-		return
-	}
-	if l != 8 {
-		log.Printf("unexpected reply, expected %d, got %d", 8, l)
-		return
+	if _, err := io.ReadFull(req.args, buf); err != nil {
+		return req.fail(nil, steady.WireErrRequest, "failed to read block index: %v", err)
 	}
 	index := binary.BigEndian.Uint64(buf)
 
@@ -49,25 +39,50 @@ func read(conn net.Conn) {
 		}
 	}
 	binary.BigEndian.PutUint64(buf, count)
-	conn.Write(buf)
+	if req.framed() {
+		// the count, the number of equivocations for newer clients, and any
+		// tombstone, followed by a frame per block and equivocation
+		var equivocations []steady.Equivocation
+		var num []byte
+		if req.version >= steady.WireVersionEquivocations {
+			equivocations = s.equivocations
+			num = binary.BigEndian.AppendUint16(nil, uint16(len(equivocations)))
+		}
+		req.reply(steady.WireTrue, true, buf, num, s.tombstone)
+		for e := s.blocks.Back(); e != nil; e = e.Prev() {
+			block := e.Value.(*Block)
+			if block.Header.Index < index {
+				break
+			}
+			req.reply(steady.WireMore, true, block.HeaderEncoded, block.Payload)
+		}
+		for i := range equivocations {
+			req.reply(steady.WireMore, true, steady.EncodeEquivocation(&equivocations[i]))
+		}
+		return nil
+	}
+	req.reply(steady.WireTrue, req.version >= steady.WireVersionErrors, buf)
 
 	// send each block
+	conn := req.conn
 	for e := s.blocks.Back(); e != nil; e = e.Prev() { // traverse in reverse order
 		block := e.Value.(*Block) // only cast once
 		if block.Header.Index >= index {
-			tmp := make([]byte, steady.WireBlockHeaderSize)
-			binary.BigEndian.PutUint64(tmp, block.Header.Index)
-			binary.BigEndian.PutUint64(tmp[8:], block.Header.LenCur)
-			binary.BigEndian.PutUint64(tmp[16:], block.Header.LenPrev)
-			copy(tmp[24:], block.Header.PayloadHash)
-			copy(tmp[24+lc.HashOutputLen:], block.Header.HeaderHash)
-			copy(tmp[24+2*lc.HashOutputLen:], block.Header.RootHash)
-			binary.BigEndian.PutUint64(tmp[24+3*lc.HashOutputLen:], block.Header.Time)
-			copy(tmp[32+3*lc.HashOutputLen:], block.Header.Signature)
-			conn.Write(tmp)
+			conn.Write(steady.EncodeBlockHeader(block.Header))
 			conn.Write(block.Payload)
 		} else {
 			break // we know all blocks before also have a smaller index
 		}
 	}
+
+	// newer clients get the tombstone of a retired policy
+	if req.version >= steady.WireVersionTombstone {
+		if s.tombstone == nil {
+			conn.Write([]byte{steady.WireFalse})
+		} else {
+			conn.Write([]byte{steady.WireTrue})
+			conn.Write(s.tombstone)
+		}
+	}
+	return nil
 }
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/pylls/steady"
+	"github.com/pylls/steady/lc"
+)
+
+var (
+	keyFile = flag.String("key", "steady-relay.key",
+		"the file with the signing key of the relay for receipts, created if missing")
+
+	// the identity of the relay, signing receipts for stored blocks
+	relayVk, relaySk []byte
+)
+
+// loadKey loads the signing key of the relay, creating it if missing
+func loadKey(filename string) error {
+	sk, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		var vk []byte
+		if vk, sk, err = lc.SigningKeyGen(); err != nil {
+			return err
+		}
+		if err = os.WriteFile(filename, sk, 0400); err != nil {
+			return err
+		}
+		log.Printf("created new relay key at %s", filename)
+		relayVk, relaySk = vk, sk
+	} else if err != nil {
+		return err
+	} else if len(sk) != lc.SigningKeySize {
+		return fmt.Errorf("invalid relay key, expected %d bytes, got %d", lc.SigningKeySize, len(sk))
+	} else {
+		relayVk, relaySk = sk[lc.SigningKeySize-lc.VericationKeySize:], sk
+	}
+	log.Printf("relay key %s", hex.EncodeToString(relayVk))
+	return nil
+}
+
+// receipts returns the encoded receipts for stored blocks
+func receipts(id []byte, blocks []*Block) []byte {
+	now := uint64(time.Now().Unix())
+	b := make([]byte, 0, len(blocks)*steady.WireReceiptSize)
+	for _, block := range blocks {
+		b = append(b, steady.EncodeReceipt(steady.MakeReceipt(relaySk, relayVk,
+			block.Header, id, now))...)
+	}
+	return b
+}
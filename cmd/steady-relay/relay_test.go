@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pylls/steady"
+	"github.com/pylls/steady/lc"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMain(m *testing.M) {
+	relayVk, relaySk, _ = lc.SigningKeyGen()
+	dir, err := os.MkdirTemp("", "steady-relay")
+	if err != nil {
+		panic(err)
+	}
+	if err = openLog(filepath.Join(dir, "log")); err != nil {
+		panic(err)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// send writes b to conn one byte at a time in the background, such that the
+// relay gets a short read for every byte
+func send(conn net.Conn, b ...[]byte) {
+	msg := bytes.Join(b, nil)
+	go func() {
+		for i := range msg {
+			if _, err := conn.Write(msg[i : i+1]); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+func frame(t byte, payload ...[]byte) []byte {
+	var p []byte
+	for _, b := range payload {
+		p = append(p, b...)
+	}
+	return steady.EncodeFrame(steady.Frame{
+		Version: steady.WireVersion,
+		Type:    t,
+		Payload: p,
+	})
+}
+
+func connect() net.Conn {
+	client, relay := net.Pipe()
+	go handler(relay)
+	return client
+}
+
+func TestFramed(t *testing.T) {
+	state = make(map[string]State)
+	vk, sk, _ := lc.SigningKeyGen()
+	pub, _, _ := lc.EncryptKeyGen()
+	now := uint64(time.Now().Unix())
+	p := steady.MakePolicy(sk, vk, pub, 10, 1024*1024, now)
+	conn := connect()
+	defer conn.Close()
+
+	// setup
+	policy := steady.EncodePolicy(p)
+	size := binary.BigEndian.AppendUint16(nil, uint16(len(policy)))
+	send(conn, frame(steady.WireCmdSetup, size, policy,
+		lc.Khash([]byte(*token), []byte("setup"), policy)))
+	reply, err := steady.ReadReply(conn)
+	assert.Nil(t, err, "failed to setup: %v", err)
+	assert.Equal(t, byte(steady.WireTrue), reply.Type, "wrong reply to setup")
+
+	// status without blocks
+	auth := lc.Khash([]byte(*token), []byte("status"), p.ID)
+	send(conn, frame(steady.WireCmdStatus, p.ID, auth))
+	reply, err = steady.ReadReply(conn)
+	assert.Nil(t, err, "failed to get status: %v", err)
+	assert.Equal(t, byte(steady.WireTrue), reply.Type, "expected no blocks")
+
+	// write a block
+	block, err := steady.MakeEncodedBlock(0, 0, now, true, true, p,
+		[]steady.Event{{Time: now, Data: []byte("foo")}}, sk)
+	assert.Nil(t, err, "failed to make block: %v", err)
+	send(conn, frame(steady.WireCmdWrite, p.ID, []byte{0, 1}), frame(steady.WireMore, block))
+	reply, err = steady.ReadReply(conn)
+	assert.Nil(t, err, "failed to write: %v", err)
+	assert.Equal(t, byte(steady.WireTrue), reply.Type, "wrong reply to write")
+	assert.Equal(t, append(make([]byte, 8),
+		lc.Khash([]byte(*token), []byte("write"), p.ID, make([]byte, 8))...),
+		reply.Payload[:8+steady.WireAuthSize], "wrong ACK")
+	r, err := steady.DecodeReceipt(reply.Payload[8+steady.WireAuthSize:])
+	assert.Nil(t, err, "failed to decode receipt: %v", err)
+	assert.Nil(t, steady.VerifyReceipt(r, relayVk, p.ID, block), "failed to verify receipt")
+
+	// status with the header of the block
+	send(conn, frame(steady.WireCmdStatus, p.ID, auth))
+	reply, err = steady.ReadReply(conn)
+	assert.Nil(t, err, "failed to get status: %v", err)
+	assert.Equal(t, byte(steady.WireMore), reply.Type, "expected a block")
+	assert.Equal(t, block[:steady.WireBlockHeaderSize], reply.Payload, "wrong header")
+
+	// read the block
+	send(conn, frame(steady.WireCmdRead, p.ID, make([]byte, 8)))
+	reply, err = steady.ReadReply(conn)
+	assert.Nil(t, err, "failed to read: %v", err)
+	assert.Equal(t, []byte{0, 0, 0, 0, 0, 0, 0, 1, 0, 0}, reply.Payload,
+		"expected one block and no equivocations")
+	reply, err = steady.ReadReply(conn)
+	assert.Nil(t, err, "failed to read block: %v", err)
+	assert.Equal(t, byte(steady.WireMore), reply.Type, "expected a block")
+	assert.Equal(t, block, reply.Payload, "wrong block")
+
+	// the block again, now with the wrong index
+	send(conn, frame(steady.WireCmdWrite, p.ID, []byte{0, 1}), frame(steady.WireMore, block))
+	_, err = steady.ReadReply(conn)
+	assert.True(t, errors.Is(err, steady.ErrInvalidBlock), "expected invalid block, got %v", err)
+
+	// another block with the same index, an equivocation of the device
+	conn = connect()
+	defer conn.Close()
+	other, err := steady.MakeEncodedBlock(0, 0, now, true, true, p,
+		[]steady.Event{{Time: now, Data: []byte("bar")}}, sk)
+	assert.Nil(t, err, "failed to make block: %v", err)
+	send(conn, frame(steady.WireCmdWrite, p.ID, []byte{0, 1}), frame(steady.WireMore, other))
+	_, err = steady.ReadReply(conn)
+	assert.True(t, errors.Is(err, steady.ErrInvalidBlock), "expected invalid block, got %v", err)
+
+	conn = connect()
+	defer conn.Close()
+	send(conn, frame(steady.WireCmdRead, p.ID, make([]byte, 8)))
+	reply, err = steady.ReadReply(conn)
+	assert.Nil(t, err, "failed to read: %v", err)
+	assert.Equal(t, []byte{0, 0, 0, 0, 0, 0, 0, 1, 0, 1}, reply.Payload,
+		"expected one block and one equivocation")
+	_, err = steady.ReadReply(conn)
+	assert.Nil(t, err, "failed to read block: %v", err)
+	reply, err = steady.ReadReply(conn)
+	assert.Nil(t, err, "failed to read equivocation: %v", err)
+	e, err := steady.DecodeEquivocation(reply.Payload, p)
+	assert.Nil(t, err, "invalid equivocation: %v", err)
+	assert.Equal(t, block[:steady.WireBlockHeaderSize], e.A, "expected the stored block first")
+	assert.Equal(t, other[:steady.WireBlockHeaderSize], e.B, "expected the refused block second")
+}
+
+func TestLegacy(t *testing.T) {
+	state = make(map[string]State)
+	vk, sk, _ := lc.SigningKeyGen()
+	pub, _, _ := lc.EncryptKeyGen()
+	now := uint64(time.Now().Unix())
+	p := steady.MakePolicy(sk, vk, pub, 10, 1024*1024, now)
+	conn := connect()
+	defer conn.Close()
+	version := byte(steady.WireVersionErrors)
+
+	// setup
+	policy := steady.EncodePolicy(p)
+	size := binary.BigEndian.AppendUint16(nil, uint16(len(policy)))
+	send(conn, []byte{version, steady.WireCmdSetup}, size, policy,
+		lc.Khash([]byte(*token), []byte("setup"), policy))
+	status, err := steady.ReadStatus(conn)
+	assert.Nil(t, err, "failed to setup: %v", err)
+	assert.Equal(t, byte(steady.WireTrue), status, "wrong reply to setup")
+
+	// write a block
+	block, err := steady.MakeEncodedBlock(0, 0, now, true, true, p,
+		[]steady.Event{{Time: now, Data: []byte("foo")}}, sk)
+	assert.Nil(t, err, "failed to make block: %v", err)
+	send(conn, []byte{version, steady.WireCmdWrite}, p.ID, []byte{0, 1}, block)
+	status, err = steady.ReadStatus(conn)
+	assert.Nil(t, err, "failed to write: %v", err)
+	assert.Equal(t, byte(steady.WireTrue), status, "wrong reply to write")
+	ack := make([]byte, 8+steady.WireAuthSize)
+	_, err = io.ReadFull(conn, ack)
+	assert.Nil(t, err, "failed to read ACK: %v", err)
+
+	// status with the header of the block
+	send(conn, []byte{version, steady.WireCmdStatus}, p.ID,
+		lc.Khash([]byte(*token), []byte("status"), p.ID))
+	status, err = steady.ReadStatus(conn)
+	assert.Nil(t, err, "failed to get status: %v", err)
+	assert.Equal(t, byte(steady.WireMore), status, "expected a block")
+	header := make([]byte, steady.WireBlockHeaderSize)
+	_, err = io.ReadFull(conn, header)
+	assert.Nil(t, err, "failed to read header: %v", err)
+
+	// read the block and no tombstone
+	send(conn, []byte{version, steady.WireCmdRead}, p.ID, make([]byte, 8))
+	status, err = steady.ReadStatus(conn)
+	assert.Nil(t, err, "failed to read: %v", err)
+	assert.Equal(t, byte(steady.WireTrue), status, "wrong reply to read")
+	reply := make([]byte, 8+len(block)+1)
+	_, err = io.ReadFull(conn, reply)
+	assert.Nil(t, err, "failed to read block: %v", err)
+	assert.Equal(t, block, reply[8:8+len(block)], "wrong block")
+	assert.Equal(t, byte(steady.WireFalse), reply[len(reply)-1], "unexpected tombstone")
+
+	// unknown policy
+	send(conn, []byte{version, steady.WireCmdRead}, make([]byte, steady.WireIdentifierSize))
+	_, err = steady.ReadStatus(conn)
+	assert.True(t, errors.Is(err, steady.ErrNoPolicy), "expected no policy, got %v", err)
+}
+
+func TestAdminDelete(t *testing.T) {
+	state = make(map[string]State)
+	*adminToken = "admin"
+	defer func() { *adminToken = "" }()
+	vk, sk, _ := lc.SigningKeyGen()
+	pub, _, _ := lc.EncryptKeyGen()
+	now := uint64(time.Now().Unix())
+	p := steady.MakePolicy(sk, vk, pub, 10, 1024*1024, now)
+	conn := connect()
+	defer conn.Close()
+	// the relay closes the connection on errors, so one per command
+	key := *adminToken
+	admin := func(cmd byte, body []byte) error {
+		conn := connect()
+		defer conn.Close()
+		send(conn, frame(steady.WireCmdAdmin, []byte{cmd}, body,
+			lc.Khash([]byte(key), []byte("admin"), []byte{cmd}, body)))
+		_, err := steady.ReadReply(conn)
+		return err
+	}
+
+	policy := steady.EncodePolicy(p)
+	send(conn, frame(steady.WireCmdSetup, binary.BigEndian.AppendUint16(nil, uint16(len(policy))),
+		policy, lc.Khash([]byte(*token), []byte("setup"), policy)))
+	_, err := steady.ReadReply(conn)
+	assert.Nil(t, err, "failed to setup: %v", err)
+
+	// only retired policies are deleted, after the grace period
+	err = admin(steady.WireAdminDelete, p.ID)
+	assert.True(t, errors.Is(err, steady.ErrRequest), "deleted active policy, got %v", err)
+	tombstone := steady.EncodeTombstone(steady.MakeTombstone(sk, p, 0, now))
+	assert.Nil(t, admin(steady.WireAdminRetire, tombstone), "failed to retire")
+	err = admin(steady.WireAdminDelete, p.ID)
+	assert.True(t, errors.Is(err, steady.ErrRequest), "deleted within grace period, got %v", err)
+
+	grace := *retireGrace
+	*retireGrace = 0
+	defer func() { *retireGrace = grace }()
+	key = "wrong"
+	err = admin(steady.WireAdminDelete, p.ID)
+	key = *adminToken
+	assert.True(t, errors.Is(err, steady.ErrAuth), "deleted without admin token, got %v", err)
+	assert.Nil(t, admin(steady.WireAdminDelete, p.ID), "failed to delete")
+	assert.Empty(t, state, "policy not deleted")
+	err = admin(steady.WireAdminShow, p.ID)
+	assert.True(t, errors.Is(err, steady.ErrNoPolicy), "expected no policy, got %v", err)
+	err = admin(steady.WireAdminDelete, p.ID)
+	assert.True(t, errors.Is(err, steady.ErrNoPolicy), "expected no policy, got %v", err)
+}
+
+func TestRequestSize(t *testing.T) {
+	// a request frame larger than any request of the command is refused
+	// before reading its payload
+	for _, cmd := range []byte{steady.WireCmdStatus, steady.WireCmdSetup,
+		steady.WireCmdRead, steady.WireCmdWrite, steady.WireCmdAdmin} {
+		conn := connect()
+		length := binary.BigEndian.AppendUint32(nil, uint32(maxRequestSize(cmd)+1))
+		send(conn, []byte{steady.WireVersion, cmd}, length)
+		_, err := steady.ReadReply(conn)
+		assert.NotNil(t, err, "expected closed connection for command %d", cmd)
+		conn.Close()
+	}
+}
+
+func TestReplication(t *testing.T) {
+	state = make(map[string]State)
+	*adminToken = "admin"
+	defer func() { *adminToken = "" }()
+	vk, sk, _ := lc.SigningKeyGen()
+	pub, _, _ := lc.EncryptKeyGen()
+	now := uint64(time.Now().Unix())
+	// created long ago, the peer trusts the relay that it was checked at setup
+	p := steady.MakePolicy(sk, vk, pub, 10, 1024*1024, now-2**maxDrift)
+	id := hex.EncodeToString(p.ID)
+	var blocks []*Block
+	for i := uint64(0); i < 8; i++ {
+		block, err := steady.MakeEncodedBlock(i, 0, now, true, true, p,
+			[]steady.Event{{Time: now, Seq: i, Data: []byte("foo")}}, sk)
+		assert.Nil(t, err, "failed to make block: %v", err)
+		bh, err := steady.DecodeBlockHeader(block[:steady.WireBlockHeaderSize], p)
+		assert.Nil(t, err, "failed to decode header: %v", err)
+		blocks = append(blocks, &Block{Header: bh, HeaderEncoded: block[:steady.WireBlockHeaderSize],
+			Payload: block[steady.WireBlockHeaderSize:]})
+	}
+
+	// the peer, served over TCP like any relay
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "failed to listen: %v", err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go handler(conn)
+		}
+	}()
+	r := &replica{addr: l.Addr().String(), dirty: make(map[string]bool)}
+	defer func() {
+		if r.conn != nil {
+			r.conn.Close()
+		}
+	}()
+	next := func() uint64 {
+		lock.Lock()
+		defer lock.Unlock()
+		return state[id].nextIndex
+	}
+
+	// a new policy and its blocks, then again with nothing to send
+	assert.Nil(t, r.sync(&replicated{policy: p, blocks: blocks[:3]}), "failed to sync")
+	assert.Equal(t, uint64(3), next(), "peer lacks blocks")
+	assert.Nil(t, r.sync(&replicated{policy: p, blocks: blocks[:3]}), "failed to sync again")
+
+	// a peer that fell behind catches up from its next index
+	assert.Nil(t, r.sync(&replicated{policy: p, blocks: blocks[1:5]}), "failed to catch up")
+	assert.Equal(t, uint64(5), next(), "peer did not catch up")
+
+	// the peer re-verifies blocks
+	tampered := *blocks[5]
+	tampered.Payload = append([]byte{}, tampered.Payload...)
+	tampered.Payload[0] ^= 1
+	err = r.sync(&replicated{policy: p, blocks: []*Block{&tampered}})
+	assert.True(t, errors.Is(err, steady.ErrInvalidBlock), "expected invalid block, got %v", err)
+	assert.Equal(t, uint64(5), next(), "peer accepted tampered block")
+
+	// blocks no longer stored cannot be sent
+	err = r.sync(&replicated{policy: p, blocks: blocks[6:]})
+	assert.True(t, errors.Is(err, errNotStored), "expected blocks not stored, got %v", err)
+
+	// retirement
+	tombstone := steady.EncodeTombstone(steady.MakeTombstone(sk, p, 5, now))
+	assert.Nil(t, r.sync(&replicated{policy: p, blocks: blocks[:5], tombstone: tombstone}),
+		"failed to replicate retirement")
+	lock.Lock()
+	assert.Equal(t, tombstone, state[id].tombstone, "peer not retired")
+	lock.Unlock()
+
+	// setup, writes, and retirements mark policies for sync
+	replicas = []*replica{r}
+	defer func() { replicas = nil }()
+	conn := connect()
+	defer conn.Close()
+	q := steady.MakePolicy(sk, vk, pub, 10, 1024*1024, now)
+	policy := steady.EncodePolicy(q)
+	send(conn, frame(steady.WireCmdSetup, binary.BigEndian.AppendUint16(nil, uint16(len(policy))),
+		policy, lc.Khash([]byte(*token), []byte("setup"), policy)))
+	_, err = steady.ReadReply(conn)
+	assert.Nil(t, err, "failed to setup: %v", err)
+	marked, ok := r.next()
+	assert.True(t, ok && marked == hex.EncodeToString(q.ID), "policy not marked for sync")
+}
+
+func TestTransparencyLog(t *testing.T) {
+	saved := tlog.entries
+	savedTree := tlog.tree
+	defer func() { tlog.entries, tlog.tree = saved, savedTree }()
+	filename := filepath.Join(t.TempDir(), "log")
+	assert.Nil(t, openLog(filename), "failed to open log")
+
+	id := make([]byte, steady.WireIdentifierSize)
+	var blocks []*Block
+	for i := 0; i < 5; i++ {
+		header := make([]byte, steady.WireBlockHeaderSize)
+		header[0] = byte(i)
+		blocks = append(blocks, &Block{HeaderEncoded: header})
+	}
+	assert.Nil(t, appendLog(id, blocks[:3]), "failed to append")
+	older := treeHead()
+
+	// restarted, the log is kept
+	tlog.entries.Close()
+	tlog.tree.Close()
+	assert.Nil(t, openLog(filename), "failed to reopen log")
+	reopened := treeHead()
+	assert.Equal(t, older.Size, reopened.Size, "wrong size of reopened log")
+	assert.Equal(t, older.Root, reopened.Root, "wrong root of reopened log")
+
+	// crashed after appending entries but not the tree
+	assert.Nil(t, appendLog(id, blocks[3:]), "failed to append")
+	newer := treeHead()
+	tlog.entries.Close()
+	tlog.tree.Close()
+	assert.Nil(t, os.Truncate(filename+".tree", 0), "failed to truncate tree")
+	assert.Nil(t, openLog(filename), "failed to reopen log")
+	assert.Equal(t, newer.Root, treeHead().Root, "tree not caught up with entries")
+
+	proof, e := consistencyProof(older.Size, newer.Size)
+	assert.Nil(t, e, "failed to prove consistency")
+	assert.Nil(t, steady.VerifyTreeHeads(older, newer, proof), "inconsistent tree heads")
+	entry, path, e := inclusionProof(3, newer.Size)
+	assert.Nil(t, e, "failed to prove inclusion")
+	assert.Equal(t, steady.LogEntry(id, blocks[3].HeaderEncoded), entry, "wrong entry")
+	assert.Nil(t, steady.VerifyLogEntry(newer, 3, id, blocks[3].HeaderEncoded, path),
+		"failed to verify inclusion")
+	tlog.entries.Close()
+	tlog.tree.Close()
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pylls/steady"
+	"github.com/pylls/steady/lc"
+)
+
+var (
+	peers = flag.String("peers", "",
+		"comma-separated addresses of relays to replicate policies, blocks, and retirements to, sharing the token (and admin token to replicate retirements)")
+	resync = flag.Duration("resync", time.Minute,
+		"how often to check that peers have all policies and stored blocks")
+
+	replicas []*replica
+
+	metricReplicated = registry.Counter("steady_relay_replicated_total",
+		"Number of requests replicated by peer.")
+	metricReplicationFailed = registry.Counter("steady_relay_replication_failures_total",
+		"Number of policies that failed to replicate (refused or unreachable) by peer.")
+)
+
+/*
+ * replication keeps peer relays in sync with the policies of this relay. A
+ * new policy (setup), verified blocks (write), or a retirement marks the
+ * policy for sync with each peer, and all policies are marked every resync
+ * interval, such that peers that missed requests or restarted catch up. To
+ * sync a policy, the replica asks the peer for its status and sends what it
+ * lacks from the stored blocks of the relay:
+ * - no policy: setup, authenticated for replication (see addPolicy)
+ * - blocks after the latest block at the peer: write, re-verified by the
+ *   peer against the replicated policy as for any device
+ * - a tombstone: retire, with the admin token (if any)
+ * A peer that lacks blocks no longer stored at the relay cannot catch up.
+ */
+type replica struct {
+	addr string
+	conn net.Conn
+
+	lock  sync.Mutex
+	dirty map[string]bool // IDs of policies to sync
+	wake  chan struct{}
+}
+
+// replicated is what a relay has of a policy, to sync with a peer
+type replicated struct {
+	policy    steady.Policy
+	blocks    []*Block
+	tombstone []byte
+}
+
+// replicationTimeout bounds each frame sent to and reply read from a peer
+const replicationTimeout = time.Minute
+
+// errNotStored is the error for a peer lacking blocks no longer stored
+var errNotStored = errors.New("peer lacks blocks no longer stored at the relay")
+
+// startReplication starts replicating to a comma-separated list of peers
+func startReplication(addrs string) {
+	for _, addr := range strings.Split(addrs, ",") {
+		r := &replica{
+			addr:  strings.TrimSpace(addr),
+			dirty: make(map[string]bool),
+			wake:  make(chan struct{}, 1),
+		}
+		replicas = append(replicas, r)
+		go r.run()
+		log.Printf("replicating to %s", r.addr)
+	}
+	go func() {
+		for {
+			lock.Lock()
+			for id := range state {
+				replicate(id)
+			}
+			lock.Unlock()
+			time.Sleep(*resync)
+		}
+	}()
+}
+
+// replicate marks a policy for sync with all peers
+func replicate(id string) {
+	for _, r := range replicas {
+		r.mark(id)
+	}
+}
+
+func (r *replica) mark(id string) {
+	r.lock.Lock()
+	r.dirty[id] = true
+	r.lock.Unlock()
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next returns the next policy to sync, if any
+func (r *replica) next() (string, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for id := range r.dirty {
+		delete(r.dirty, id)
+		return id, true
+	}
+	return "", false
+}
+
+func (r *replica) run() {
+	for range r.wake {
+		for id, ok := r.next(); ok; id, ok = r.next() {
+			lock.Lock()
+			p, exists := snapshot(id)
+			lock.Unlock()
+			if !exists { // deleted
+				continue
+			}
+			err := r.sync(p)
+			if err == nil {
+				continue
+			}
+			log.Printf("failed to replicate %s to %s: %v", id, r.addr, err)
+			metricReplicationFailed.Inc("peer", r.addr)
+			var werr *steady.WireError
+			if !errors.As(err, &werr) && !errors.Is(err, errNotStored) {
+				// unreachable, retry later
+				r.mark(id)
+				time.Sleep(time.Second)
+			} // otherwise refused, retrying will not help until resync
+		}
+	}
+}
+
+// snapshot returns what the relay has of a policy, must hold lock
+func snapshot(id string) (*replicated, bool) {
+	s, exists := state[id]
+	if !exists {
+		return nil, false
+	}
+	p := &replicated{
+		policy:    s.policy,
+		blocks:    make([]*Block, 0, s.blocks.Len()),
+		tombstone: s.tombstone,
+	}
+	for e := s.blocks.Front(); e != nil; e = e.Next() {
+		p.blocks = append(p.blocks, e.Value.(*Block))
+	}
+	return p, true
+}
+
+// sync sends the peer what it lacks of a policy, see replication above
+func (r *replica) sync(p *replicated) (err error) {
+	defer func() {
+		if err != nil && r.conn != nil {
+			r.conn.Close() // the peer closes the connection on errors
+			r.conn = nil
+		}
+	}()
+	next, exists, err := r.status(p.policy)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		encoded := steady.EncodePolicy(p.policy)
+		if err = r.request(steady.WireCmdSetup,
+			binary.BigEndian.AppendUint16(nil, uint16(len(encoded))), encoded,
+			lc.Khash([]byte(*token), []byte("replicate"), encoded)); err != nil {
+			return err
+		}
+		if _, err = r.reply(); err != nil {
+			return err
+		}
+	}
+
+	blocks := p.blocks
+	for len(blocks) > 0 && blocks[0].Header.Index < next {
+		blocks = blocks[1:]
+	}
+	if len(blocks) > 0 && blocks[0].Header.Index > next {
+		return fmt.Errorf("%w: %d to %d", errNotStored, next, blocks[0].Header.Index-1)
+	}
+	for len(blocks) > 0 {
+		n := len(blocks)
+		if n > 0xffff { // at most N blocks per write
+			n = 0xffff
+		}
+		if err = r.request(steady.WireCmdWrite, p.policy.ID,
+			binary.BigEndian.AppendUint16(nil, uint16(n))); err != nil {
+			return err
+		}
+		for _, b := range blocks[:n] {
+			if err = r.request(steady.WireMore, b.HeaderEncoded, b.Payload); err != nil {
+				return err
+			}
+		}
+		if _, err = r.reply(); err != nil {
+			return err
+		}
+		blocks = blocks[n:]
+	}
+
+	if p.tombstone != nil && *adminToken != "" {
+		cmd := []byte{steady.WireAdminRetire}
+		if err = r.request(steady.WireCmdAdmin, cmd, p.tombstone,
+			lc.Khash([]byte(*adminToken), []byte("admin"), cmd, p.tombstone)); err != nil {
+			return err
+		}
+		_, err = r.reply()
+	}
+	return err
+}
+
+// status returns the next index of a policy at the peer, and if the peer has
+// the policy
+func (r *replica) status(p steady.Policy) (uint64, bool, error) {
+	if err := r.request(steady.WireCmdStatus, p.ID,
+		lc.Khash([]byte(*token), []byte("status"), p.ID)); err != nil {
+		return 0, false, err
+	}
+	reply, err := steady.ReadReply(r.conn)
+	if err != nil {
+		return 0, false, err
+	}
+	switch reply.Type {
+	case steady.WireFalse:
+		return 0, false, nil
+	case steady.WireTrue:
+		return 0, true, nil
+	}
+	bh, err := steady.DecodeBlockHeader(reply.Payload, p)
+	if err != nil {
+		return 0, false, steady.NewWireError(steady.WireErrRequest,
+			"peer returned an invalid block header: %v", err)
+	}
+	return bh.Index + 1, true, nil
+}
+
+// request sends a frame of a request to the peer, connecting if needed
+func (r *replica) request(t byte, payload ...[]byte) error {
+	if r.conn == nil {
+		conn, err := net.DialTimeout("tcp", r.addr, 10*time.Second)
+		if err != nil {
+			return err
+		}
+		r.conn = conn
+	}
+	r.conn.SetDeadline(time.Now().Add(replicationTimeout))
+	return steady.WriteFrame(r.conn, t, payload...)
+}
+
+// reply reads the reply to a replicated request
+func (r *replica) reply() (steady.Frame, error) {
+	f, err := steady.ReadReply(r.conn)
+	if err == nil {
+		metricReplicated.Inc("peer", r.addr)
+	}
+	return f, err
+}
@@ -3,50 +3,99 @@ package main
 import (
 	"container/list"
 	"crypto/subtle"
+	"encoding/binary"
 	"encoding/hex"
+	"fmt"
+	"io"
 	"log"
-	"net"
+	"time"
 
 	"github.com/pylls/steady"
 	"github.com/pylls/steady/lc"
 )
 
-func setup(conn net.Conn) {
-	buf := make([]byte, steady.WirePolicySize+steady.WireAuthSize)
-	l, err := conn.Read(buf)
+func setup(req *request) error {
+	size := steady.WirePolicySize
+	if req.version >= steady.WireVersionPolicyLength {
+		// newer clients send the length of the policy, which depends on the
+		// number of recipients
+		buf := make([]byte, 2)
+		if _, err := io.ReadFull(req.args, buf); err != nil {
+			return setupFailed(req, steady.WireErrRequest,
+				"failed to read policy length: %v", err)
+		}
+		size = int(binary.BigEndian.Uint16(buf))
+		if size < steady.WirePolicySize || size > steady.WireMaxPolicySize {
+			return setupFailed(req, steady.WireErrRequest, "invalid policy length %d", size)
+		}
+	}
+
+	buf := make([]byte, size+steady.WireAuthSize)
+	l, err := io.ReadFull(req.args, buf)
 	if err != nil {
-		log.Printf("\tfailed to read policy: %v", err)
-		return
+		return setupFailed(req, steady.WireErrRequest, "failed to read policy: %v", err)
 	}
-	if l != steady.WirePolicySize+steady.WireAuthSize {
-		log.Printf("\tfailed to read policy, expected %d bytes, got %d",
-			steady.WirePolicySize+steady.WireAuthSize, l)
-		return
+	if l != size+steady.WireAuthSize {
+		return setupFailed(req, steady.WireErrRequest,
+			"failed to read policy, expected %d bytes, got %d", size+steady.WireAuthSize, l)
+	}
+
+	p, e := addPolicy(buf[:size], buf[size:])
+	if e != nil {
+		return setupFailed(req, e.Code, "%s", e.Message)
 	}
+	if req.framed() || req.version >= steady.WireVersionSetupReply {
+		req.reply(steady.WireTrue, true)
+	}
+	log.Printf("\tcompleted, id: %s", hex.EncodeToString(p.ID))
+	return nil
+}
 
-	if subtle.ConstantTimeCompare(buf[steady.WirePolicySize:], // sent tag
-		lc.Khash([]byte(*token), []byte("setup"), buf[:steady.WirePolicySize])) != 1 {
-		log.Printf("\tinvalid auth for setup")
-		return
+// addPolicy adds a policy given the encoded policy and the auth tag of setup,
+// or of replication by a peer relay (see replication) that already checked
+// the creation time of the policy
+func addPolicy(encoded, tag []byte) (steady.Policy, *steady.WireError) {
+	replicated := subtle.ConstantTimeCompare(tag,
+		lc.Khash([]byte(*token), []byte("replicate"), encoded)) == 1
+	if !replicated && subtle.ConstantTimeCompare(tag,
+		lc.Khash([]byte(*token), []byte("setup"), encoded)) != 1 {
+		return steady.Policy{}, steady.NewWireError(steady.WireErrAuth, "invalid auth for setup")
 	}
 
-	p, err := steady.DecodePolicy(buf[:steady.WirePolicySize])
+	p, err := steady.DecodePolicy(encoded)
 	if err != nil {
-		log.Printf("\tfailed to decode policy: %v", err)
-		return
+		return p, steady.NewWireError(steady.WireErrInvalidPolicy, "failed to decode policy: %v", err)
 	}
 	lock.Lock()
 	defer lock.Unlock()
 	_, exists := state[hex.EncodeToString(p.ID)]
 	if exists {
-		log.Println("\tpolicy already exists")
-		return
+		return p, steady.NewWireError(steady.WireErrPolicyExists, "%s", hex.EncodeToString(p.ID))
+	}
+	now := uint64(time.Now().Unix())
+	if replicated {
+		now = p.Time
+	}
+	if err = checkLimits(p, now); err != nil {
+		return p, steady.NewWireError(steady.WireErrLimit, "%v", err)
 	}
 
-	// TODO: add detailed setup checks
 	state[hex.EncodeToString(p.ID)] = State{
 		policy: p,
 		blocks: list.New(),
 	}
-	log.Printf("\tcompleted, id: %s", hex.EncodeToString(p.ID))
+	replicate(hex.EncodeToString(p.ID))
+	return p, nil
+}
+
+// setupFailed replies to a failed setup (see fail), where clients from
+// WireVersionSetupReply without error frames get WireFalse and the reason
+func setupFailed(req *request, code byte, format string, args ...interface{}) error {
+	var legacy []byte
+	if req.version >= steady.WireVersionSetupReply {
+		reason := fmt.Sprintf(format, args...)
+		legacy = binary.BigEndian.AppendUint16([]byte{steady.WireFalse}, uint16(len(reason)))
+		legacy = append(legacy, reason...)
+	}
+	return req.fail(legacy, code, format, args...)
 }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"container/list"
+	"time"
 
 	"github.com/pylls/steady"
 )
@@ -10,6 +11,13 @@ type State struct {
 	policy           steady.Policy
 	blocks           *list.List
 	space, nextIndex uint64
+	// tombstone is the encoded tombstone of a retired policy, nil if active
+	tombstone []byte
+	// retired is when the policy was retired at the relay
+	retired time.Time
+	// equivocations are proofs of the device signing different blocks with
+	// the same index, see retainEquivocation
+	equivocations []steady.Equivocation
 }
 
 type Block struct {
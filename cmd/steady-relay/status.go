@@ -2,30 +2,26 @@ package main
 
 import (
 	"crypto/subtle"
+	"io"
 	"log"
-	"net"
 
 	"github.com/pylls/steady"
 	"github.com/pylls/steady/lc"
 )
 
-func status(conn net.Conn) {
-	id, raw, err := getID(conn)
+func status(req *request) error {
+	id, raw, err := getID(req.args)
 	if err != nil {
-		log.Printf("\tfailed to get id: %v", err)
-		return
+		return req.fail(nil, steady.WireErrRequest, "failed to get id: %v", err)
 	}
 	log.Printf("\tid: %s", id)
 
 	buf := make([]byte, steady.WireAuthSize)
-	if err := readn(buf, steady.WireAuthSize, conn); err != nil {
-		log.Printf("\tfailed to read auth token: %v", err)
-		return
+	if _, err := io.ReadFull(req.args, buf); err != nil {
+		return req.fail(nil, steady.WireErrRequest, "failed to read auth token: %v", err)
 	}
 	if subtle.ConstantTimeCompare(buf, lc.Khash([]byte(*token), []byte("status"), raw)) != 1 {
-		log.Println("\tinvalid auth token")
-		conn.Write([]byte{steady.WireAuthErr})
-		return
+		return req.fail([]byte{steady.WireAuthErr}, steady.WireErrAuth, "invalid auth token")
 	}
 
 	lock.Lock()
@@ -33,14 +29,14 @@ func status(conn net.Conn) {
 	s, exists := state[id]
 	if exists {
 		if s.blocks.Len() == 0 {
-			conn.Write([]byte{steady.WireTrue})
+			req.reply(steady.WireTrue, true)
 		} else {
 			// reply with the latest block header
-			conn.Write([]byte{steady.WireMore})
-			conn.Write(s.blocks.Back().Value.(*Block).HeaderEncoded)
+			req.reply(steady.WireMore, true, s.blocks.Back().Value.(*Block).HeaderEncoded)
 		}
 
 	} else {
-		conn.Write([]byte{steady.WireFalse})
+		req.reply(steady.WireFalse, true)
 	}
+	return nil
 }
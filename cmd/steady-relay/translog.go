@@ -0,0 +1,165 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pylls/steady"
+)
+
+var logFile = flag.String("log", "steady-relay.log",
+	"the file of the transparency log of the relay, with its Merkle tree in FILE.tree, created if missing")
+
+/*
+ * the transparency log of the relay: an append-only Merkle tree over the
+ * headers of all blocks stored by the relay, across policies and including
+ * blocks since removed, committed to by signed tree heads (see
+ * steady.TreeHead). The log outlives restarts of the relay, as does its key:
+ * - the entries are appended to a file, synced before blocks are ACKed
+ * - the tree is kept in a file (see steady.HistoryTree) and caught up from
+ *   the entries on start, such that tree heads and proofs read O(log n)
+ *   hashes
+ */
+var tlog struct {
+	lock    sync.Mutex
+	entries *os.File
+	tree    *steady.HistoryTree
+}
+
+// logEntrySize is the size of an entry in the log, see steady.LogEntry
+const logEntrySize = steady.WireIdentifierSize + steady.WireBlockHeaderSize
+
+// openLog opens the transparency log kept in filename
+func openLog(filename string) error {
+	entries, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := entries.Stat()
+	if err != nil {
+		entries.Close()
+		return err
+	}
+	// drop an entry only partly written, e.g., on a crash
+	size := uint64(info.Size()) / logEntrySize
+	if err = entries.Truncate(int64(size * logEntrySize)); err != nil {
+		entries.Close()
+		return err
+	}
+
+	tree, err := steady.OpenHistoryTree(filename + ".tree")
+	if err == nil && tree.Size() > size { // not of these entries, make anew
+		tree.Close()
+		tree, err = steady.CreateHistoryTree(filename+".tree", steady.History{})
+	}
+	if err != nil {
+		entries.Close()
+		return err
+	}
+	// catch up with the entries appended before the tree on a crash
+	buf := make([]byte, 1024*logEntrySize)
+	for tree.Size() < size {
+		n := min(size-tree.Size(), 1024)
+		if _, err = entries.ReadAt(buf[:n*logEntrySize], int64(tree.Size()*logEntrySize)); err != nil {
+			break
+		}
+		leaves := make([][]byte, n)
+		for i := range leaves {
+			leaves[i] = buf[uint64(i)*logEntrySize : uint64(i+1)*logEntrySize]
+		}
+		if err = tree.Append(leaves); err != nil {
+			break
+		}
+	}
+	if err != nil {
+		tree.Close()
+		entries.Close()
+		return err
+	}
+	tlog.entries, tlog.tree = entries, tree
+	log.Printf("transparency log with %d entries at %s", size, filename)
+	return nil
+}
+
+// appendLog appends stored blocks of a policy to the transparency log
+func appendLog(id []byte, blocks []*Block) *steady.WireError {
+	tlog.lock.Lock()
+	defer tlog.lock.Unlock()
+	leaves := make([][]byte, 0, len(blocks))
+	b := make([]byte, 0, len(blocks)*logEntrySize)
+	for _, block := range blocks {
+		entry := steady.LogEntry(id, block.HeaderEncoded)
+		leaves = append(leaves, entry)
+		b = append(b, entry...)
+	}
+	offset := int64(tlog.tree.Size() * logEntrySize)
+	_, err := tlog.entries.WriteAt(b, offset)
+	if err == nil {
+		err = tlog.entries.Sync()
+	}
+	if err == nil {
+		err = tlog.tree.Append(leaves)
+	}
+	if err != nil {
+		// entries after the tree are not in the log, see openLog
+		tlog.entries.Truncate(offset)
+		return steady.NewWireError(steady.WireErrUnknown, "failed to append to the transparency log: %v", err)
+	}
+	return nil
+}
+
+// logSize returns the number of entries in the log
+func logSize() uint64 {
+	tlog.lock.Lock()
+	defer tlog.lock.Unlock()
+	return tlog.tree.Size()
+}
+
+// treeHead returns a signed tree head for the current log
+func treeHead() steady.TreeHead {
+	tlog.lock.Lock()
+	size := tlog.tree.Size()
+	root, _ := tlog.tree.Root(size) // the compact tree, no error
+	tlog.lock.Unlock()
+	return steady.MakeTreeHead(relaySk, relayVk, size, root, uint64(time.Now().Unix()))
+}
+
+// consistencyProof returns a proof that the log of size first is a prefix of
+// the log of size second
+func consistencyProof(first, second uint64) ([][]byte, *steady.WireError) {
+	tlog.lock.Lock()
+	defer tlog.lock.Unlock()
+	if first > second || second > tlog.tree.Size() {
+		return nil, steady.NewWireError(steady.WireErrRequest,
+			"invalid sizes %d and %d for log with %d entries", first, second, tlog.tree.Size())
+	}
+	proof, err := tlog.tree.ConsistencyProof(first, second)
+	if err != nil {
+		return nil, steady.NewWireError(steady.WireErrUnknown, "failed to read the transparency log: %v", err)
+	}
+	return proof, nil
+}
+
+// inclusionProof returns the entry with index and its audit path in the log
+// of size
+func inclusionProof(index, size uint64) ([]byte, [][]byte, *steady.WireError) {
+	tlog.lock.Lock()
+	defer tlog.lock.Unlock()
+	if index >= size || size > tlog.tree.Size() {
+		return nil, nil, steady.NewWireError(steady.WireErrRequest,
+			"invalid index %d and size %d for log with %d entries", index, size, tlog.tree.Size())
+	}
+	entry := make([]byte, logEntrySize)
+	_, err := tlog.entries.ReadAt(entry, int64(index*logEntrySize))
+	var path [][]byte
+	if err == nil {
+		path, err = tlog.tree.AuditPath(index, size)
+	}
+	if err != nil {
+		return nil, nil, steady.NewWireError(steady.WireErrUnknown, "failed to read the transparency log: %v", err)
+	}
+	return entry, path, nil
+}
@@ -1,12 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"container/list"
 	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log"
-	"net"
 
 	"github.com/pylls/steady"
 	"github.com/pylls/steady/lc"
@@ -16,73 +18,109 @@ import (
  * general idea of write:
  * - have device send n
  * - attempt to read n blocks, only store in the very end, error early
- * - fixed-size reply: error or auth the last block index
+ * - fixed-size reply: error or auth the last block index, newer clients get
+ *   WireTrue first or an error frame instead
+ * - framed clients send the ID and N in the request frame, followed by one
+ *   frame per block
+ * - newer clients get a receipt signed by the relay per block after the ACK
  */
-func write(conn net.Conn) {
+func write(req *request) error {
+	// legacy zero reply to indicate error
+	zero := make([]byte, 8+steady.WireAuthSize)
+
 	// read id
-	id, _, err := getID(conn)
+	id, _, err := getID(req.args)
 	if err != nil {
-		log.Printf("\tfailed to get id: %v", err)
-		return
+		return req.fail(zero, steady.WireErrRequest, "failed to get id: %v", err)
 	}
 
 	lock.Lock()
 	defer lock.Unlock()
-	// see if in state, reject if not
-	s, exists := state[id]
-	if !exists {
-		log.Printf("\tno such state")
-		return
+	s, e := writable(id)
+	if e != nil {
+		return req.fail(zero, e.Code, "%s", e.Message)
 	}
 
 	// get N from client
 	buf := make([]byte, 2)
-	_, err = io.ReadFull(conn, buf)
+	_, err = io.ReadFull(req.args, buf)
 	if err != nil {
-		log.Printf("\tfailed to read N: %v", err)
-		return
+		return req.fail(zero, steady.WireErrRequest, "failed to read N: %v", err)
 	}
 	N := binary.BigEndian.Uint16(buf)
 
 	if N == 0 {
-		log.Printf("\tgot zero N")
-		return
+		return req.fail(zero, steady.WireErrRequest, "got zero N")
 	}
 
 	// attempt to buffer N blocks
-	reply := make([]byte, 8+steady.WireAuthSize)
-	for i := 0; i < len(reply); i++ {
-		reply[i] = 0
-	}
 	blocks := make([]*Block, 0, N)
 	for i := uint16(0); i < N; i++ {
-		b, err := readBlock(conn, s.policy, s.nextIndex+uint64(i))
+		r, err := req.next()
+		if err != nil {
+			return req.fail(zero, steady.WireErrRequest, "failed to read block frame: %v", err)
+		}
+		b, err := readBlock(r, s.policy, s.nextIndex+uint64(i))
 		if err != nil {
-			conn.Write(reply) // send zero reply to indicate error
-			log.Printf("\tfailed to read block (%v)", err)
-			return
+			retainEquivocation(id, err)
+			return req.fail(zero, steady.WireErrInvalidBlock,
+				"failed to read block: %v", err)
 		}
 		blocks = append(blocks, b)
 	}
 
-	// all OK, store blocks and update state
+	// all OK, store blocks and reply with the ACK, and receipts for newer clients
+	ack, e := commit(id, s, blocks)
+	if e != nil {
+		return req.fail(zero, e.Code, "%s", e.Message)
+	}
+	var signed []byte
+	if req.version >= steady.WireVersionReceipts {
+		signed = receipts(s.policy.ID, blocks)
+	}
+	req.reply(steady.WireTrue, req.version >= steady.WireVersionErrors, ack, signed)
+	log.Printf("\twrote %d block(s)", N)
+	return nil
+}
+
+// writable returns the state of a policy that blocks can be written to, must
+// hold lock
+func writable(id string) (State, *steady.WireError) {
+	s, exists := state[id]
+	if !exists {
+		return s, steady.NewWireError(steady.WireErrNoPolicy, "%s", id)
+	}
+	if s.tombstone != nil {
+		return s, steady.NewWireError(steady.WireErrRetired, "%s", id)
+	}
+	return s, nil
+}
+
+// commit logs and stores blocks and updates the state of a policy, returning
+// the ACK: the index of the last block, authenticated with the policy ID and
+// token, must hold lock
+func commit(id string, s State, blocks []*Block) ([]byte, *steady.WireError) {
+	if e := appendLog(s.policy.ID, blocks); e != nil {
+		return nil, e
+	}
 	for i := 0; i < len(blocks); i++ {
 		s.space, s.nextIndex = store(blocks[i], s.blocks, s.space, s.policy)
+		metricWritten.Inc("policy", id)
+		metricWrittenBytes.Add(float64(blocks[i].Header.LenCur), "policy", id)
 	}
 	state[id] = s
+	replicate(id)
 
-	// reply with index of successfully written block, authenticate with policy ID and token
-	buf = make([]byte, 8+steady.WireAuthSize)
-	binary.BigEndian.PutUint64(buf, blocks[len(blocks)-1].Header.Index)
-	copy(buf[8:], lc.Khash([]byte(*token), []byte("write"), s.policy.ID, buf[:8]))
-	conn.Write(buf)
-	log.Printf("\twrote %d block(s)", N)
+	ack := make([]byte, 8+steady.WireAuthSize)
+	binary.BigEndian.PutUint64(ack, blocks[len(blocks)-1].Header.Index)
+	copy(ack[8:], lc.Khash([]byte(*token), []byte("write"), s.policy.ID, ack[:8]))
+	return ack, nil
 }
 
-func readBlock(conn net.Conn, policy steady.Policy, expectedIndex uint64) (b *Block, err error) {
+func readBlock(r io.Reader, policy steady.Policy, expectedIndex uint64) (b *Block, err error) {
 	// read header length
 	encodedHeader := make([]byte, steady.WireBlockHeaderSize)
-	l, err := io.ReadFull(conn, encodedHeader)
+	l, err := io.ReadFull(r, encodedHeader)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read block header: %v", err)
 	}
@@ -96,7 +134,7 @@ func readBlock(conn net.Conn, policy steady.Policy, expectedIndex uint64) (b *Bl
 		return nil, fmt.Errorf("failed to decode block header: %v", err)
 	}
 	if bh.Index != expectedIndex {
-		return nil, fmt.Errorf("wrong block index, expected %d, got %d", expectedIndex, bh.Index)
+		return nil, &indexError{expected: expectedIndex, index: bh.Index, header: encodedHeader}
 	}
 	if bh.LenCur > steady.MaxBlockSize {
 		return nil, fmt.Errorf("too large block, max is %d, got %d", steady.MaxBlockSize, bh.LenCur)
@@ -107,7 +145,7 @@ func readBlock(conn net.Conn, policy steady.Policy, expectedIndex uint64) (b *Bl
 
 	// read payload
 	buf := make([]byte, bh.LenCur-steady.WireBlockHeaderSize)
-	l, err = io.ReadFull(conn, buf)
+	l, err = io.ReadFull(r, buf)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read block payload: %v", err)
 	}
@@ -127,6 +165,59 @@ func readBlock(conn net.Conn, policy steady.Policy, expectedIndex uint64) (b *Bl
 	}, nil
 }
 
+// indexError is the error for a block with an unexpected index, with the
+// validly signed header of the block
+type indexError struct {
+	expected, index uint64
+	header          []byte
+}
+
+func (e *indexError) Error() string {
+	return fmt.Sprintf("wrong block index, expected %d, got %d", e.expected, e.index)
+}
+
+// maxEquivocations is the max number of equivocations retained per policy,
+// one is enough to prove that the device signed conflicting blocks
+const maxEquivocations = 16
+
+// retainEquivocation retains a block refused for its old index that differs
+// from the stored block with the same index: the device signed both, which
+// proves that the device (key) is compromised or lost its state, see
+// steady.Equivocation. Must hold lock.
+func retainEquivocation(id string, err error) {
+	var ie *indexError
+	if !errors.As(err, &ie) || ie.index >= ie.expected {
+		return
+	}
+	s := state[id]
+	if len(s.equivocations) >= maxEquivocations {
+		return
+	}
+	for e := s.blocks.Back(); e != nil; e = e.Prev() {
+		b := e.Value.(*Block)
+		if b.Header.Index > ie.index {
+			continue
+		}
+		if b.Header.Index < ie.index {
+			return // removed to make room
+		}
+		eq, err := steady.MakeEquivocation(s.policy, b.HeaderEncoded, ie.header)
+		if err != nil {
+			return // the same block, e.g., written again
+		}
+		for _, known := range s.equivocations {
+			if bytes.Equal(known.B, eq.B) {
+				return
+			}
+		}
+		s.equivocations = append(s.equivocations, *eq)
+		state[id] = s
+		log.Printf("	device equivocated on block %d", ie.index)
+		metricEquivocations.Inc("policy", id)
+		return
+	}
+}
+
 func store(b *Block, blocks *list.List, space uint64, policy steady.Policy) (uint64, uint64) {
 	blocks.PushBack(b)
 	space += b.Header.LenCur
@@ -134,6 +225,7 @@ func store(b *Block, blocks *list.List, space uint64, policy steady.Policy) (uin
 	// remove the front of the list and reduce current size until below max
 	for space > policy.Space {
 		log.Printf("\tremoved old block to make room...")
+		metricEvictions.Inc("policy", hex.EncodeToString(policy.ID))
 		space -= blocks.Remove(blocks.Front()).(*Block).Header.LenCur
 	}
 
@@ -5,8 +5,10 @@ import (
 	"flag"
 	"log"
 	"os"
+	"strings"
 
 	"github.com/pylls/steady/device"
+	"github.com/pylls/steady/metrics"
 )
 
 var (
@@ -14,11 +16,14 @@ var (
 	space          = flag.Uint("space", 100*1024, "the space")
 	path           = flag.String("path", "test", "the path")
 	token          = flag.String("token", "secret", "the access token")
-	server         = flag.String("server", "localhost:22333", "the server")
+	server         = flag.String("server", "localhost:22333", "the server, or comma-separated servers to write each block to")
+	quorum         = flag.Int("quorum", 0, "the number of servers that must ACK a block, 0 for all")
 	encrypt        = flag.Bool("encrypt", true, "use encryption")
 	compress       = flag.Bool("compress", true, "use compression")
 	flushSize      = flag.Int("flush", 1024, "buffer size in KiB")
 	blockBufferNum = flag.Int("blocks", 5, "max number of blocks in buffer")
+	maxEventSize   = flag.Int("maxevent", 64, "max event (line) size in KiB")
+	metricsAddr    = flag.String("metrics", "", "the address to serve Prometheus metrics on, disabled if empty")
 )
 
 func main() {
@@ -30,14 +35,24 @@ func main() {
 	}
 
 	log.Printf("attempting to load device at %s...", *path)
-	device, err := device.LoadDevice(*path, *server, *token,
-		*encrypt, *compress, *flushSize*1024, *blockBufferNum)
+	device, err := loadDevice()
 	if err != nil {
 		log.Fatalf("failed to load device: %v", err)
 	}
+	if err = device.SetMaxEventSize(*maxEventSize * 1024); err != nil {
+		log.Fatalf("failed to set max event size: %v", err)
+	}
+	if *metricsAddr != "" {
+		r := metrics.NewRegistry()
+		device.RegisterMetrics(r)
+		go func() {
+			log.Printf("metrics server failed: %v", metrics.ListenAndServe(*metricsAddr, r))
+		}()
+	}
 
 	log.Println("ok, starting to read from stdin...")
 	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Buffer(nil, *maxEventSize*1024)
 	for scanner.Scan() {
 		if err = device.Log(scanner.Text()); err != nil {
 			log.Fatalf("failed to log: %v", err)
@@ -50,3 +65,14 @@ func main() {
 	log.Println("all done, closing")
 	device.Close()
 }
+
+// loadDevice loads the device, writing to several relays if more than one
+// server is given
+func loadDevice() (*device.Device, error) {
+	if servers := strings.Split(*server, ","); len(servers) > 1 {
+		return device.LoadMultiDevice(*path, servers, *quorum, *token,
+			*encrypt, *compress, *flushSize*1024, *blockBufferNum)
+	}
+	return device.LoadDevice(*path, *server, *token,
+		*encrypt, *compress, *flushSize*1024, *blockBufferNum)
+}
@@ -4,18 +4,64 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/pylls/steady"
+	"github.com/pylls/steady/device"
+	"github.com/pylls/steady/metrics"
 	syslog "gopkg.in/mcuadros/go-syslog.v2"
+	"gopkg.in/mcuadros/go-syslog.v2/format"
 )
 
 var (
-	mod  = flag.Int("mod", 1000*1000, "how often to print count to stdout")
-	port = flag.Int("p", 514, "port to listen on")
+	mod            = flag.Int("mod", 1000*1000, "how often to print count to stdout")
+	port           = flag.Int("p", 514, "port to listen on")
+	path           = flag.String("path", "test", "the path")
+	token          = flag.String("token", "secret", "the access token")
+	server         = flag.String("server", "localhost:22333", "the server, or comma-separated servers to write each block to")
+	quorum         = flag.Int("quorum", 0, "the number of servers that must ACK a block, 0 for all")
+	encrypt        = flag.Bool("encrypt", true, "use encryption")
+	compress       = flag.Bool("compress", true, "use compression")
+	flushSize      = flag.Int("flush", 1024, "buffer size in KiB")
+	blockBufferNum = flag.Int("blocks", 5, "max number of blocks in buffer")
+	metricsAddr    = flag.String("metrics", "", "the address to serve Prometheus metrics on, disabled if empty")
+	shutdown       = flag.Duration("shutdown", 5*time.Second, "how long to wait for connected clients on shutdown before closing the device")
 )
 
+// parts of a syslog message mapped to fields of the structured event, the
+// remaining parts (message, timestamp, priority) have their own fields
+var fieldParts = map[string]bool{
+	"hostname":        true,
+	"tag":             true,
+	"app_name":        true,
+	"proc_id":         true,
+	"msg_id":          true,
+	"structured_data": true,
+	"client":          true,
+	"tls_peer":        true,
+}
+
 func main() {
 	flag.Parse()
 
+	log.Printf("attempting to load device at %s...", *path)
+	dev, err := loadDevice()
+	if err != nil {
+		log.Fatalf("failed to load device: %v", err)
+	}
+	if *metricsAddr != "" {
+		r := metrics.NewRegistry()
+		dev.RegisterMetrics(r)
+		go func() {
+			log.Printf("metrics server failed: %v", metrics.ListenAndServe(*metricsAddr, r))
+		}()
+	}
+
 	server := syslog.NewServer()
 	channel := make(syslog.LogPartsChannel, 1024)
 	handler := syslog.NewChannelHandler(channel)
@@ -32,16 +78,124 @@ func main() {
 		log.Fatalf("syslog server failed to boot: %s", err)
 	}
 
-	go func(channel syslog.LogPartsChannel) {
+	// flush the device on shutdown
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	log.Printf("syslog gateway up and running on port %d", *port)
+	serve(server, channel, dev, sig, *shutdown)
+	log.Println("all done, closed")
+}
+
+// eventLogger is where the gateway logs events, a device
+type eventLogger interface {
+	LogEvent(e steady.StructuredEvent) error
+	Close() error
+}
+
+// serve logs the messages received by the server to the device until stop,
+// then stops the server and closes the device. Connected TCP clients keep the
+// server from stopping, so the gateway waits at most timeout for the server
+// before closing the device with the messages received so far.
+func serve(server *syslog.Server, channel syslog.LogPartsChannel, dev eventLogger,
+	stop <-chan os.Signal, timeout time.Duration) {
+	done, quit := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
 		n := 0
-		for range channel {
+		logParts := func(parts format.LogParts) {
+			if err := dev.LogEvent(toEvent(parts)); err != nil {
+				log.Printf("failed to log event: %v", err)
+				return
+			}
 			n++
 			if n%*mod == 0 {
 				log.Printf("received %d events", n)
 			}
 		}
-	}(channel)
+		for {
+			select {
+			case parts := <-channel:
+				logParts(parts)
+			case <-quit: // log the messages already received
+				for {
+					select {
+					case parts := <-channel:
+						logParts(parts)
+					default:
+						return
+					}
+				}
+			}
+		}
+	}()
+
+	<-stop
+	log.Println("shutting down, flushing device")
+	server.Kill()
+	stopped := make(chan struct{})
+	go func() {
+		server.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(timeout):
+		log.Printf("server did not stop within %s, closing the device anyway", timeout)
+	}
+	// the channel stays open, the server may still send to it
+	close(quit)
+	<-done
+	dev.Close()
+}
+
+// toEvent maps a received syslog message (RFC 3164 or RFC 5424) to a
+// structured event
+func toEvent(parts format.LogParts) steady.StructuredEvent {
+	e := steady.StructuredEvent{
+		Time:     uint64(time.Now().Unix()),
+		Severity: uint8(asInt(parts["severity"])),
+		Facility: uint8(asInt(parts["facility"])),
+	}
+	if t, ok := parts["timestamp"].(time.Time); ok && !t.IsZero() {
+		e.Time = uint64(t.Unix())
+	}
+	if m, ok := parts["content"].(string); ok { // RFC 3164
+		e.Message = m
+	}
+	if m, ok := parts["message"].(string); ok { // RFC 5424
+		e.Message = m
+	}
+
+	// sort keys for a deterministic order of fields
+	keys := make([]string, 0, len(parts))
+	for k := range parts {
+		if fieldParts[k] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if v, ok := parts[k].(string); ok && v != "" && v != "-" {
+			e.Fields = append(e.Fields, steady.Field{Key: k, Value: v})
+		}
+	}
+	return e
+}
 
-	log.Printf("syslog receive up and running on port %d", *port)
-	server.Wait()
+func asInt(v interface{}) int {
+	if i, ok := v.(int); ok {
+		return i
+	}
+	return 0
+}
+
+// loadDevice loads the device, writing to several relays if more than one
+// server is given
+func loadDevice() (*device.Device, error) {
+	if servers := strings.Split(*server, ","); len(servers) > 1 {
+		return device.LoadMultiDevice(*path, servers, *quorum, *token,
+			*encrypt, *compress, *flushSize*1024, *blockBufferNum)
+	}
+	return device.LoadDevice(*path, *server, *token,
+		*encrypt, *compress, *flushSize*1024, *blockBufferNum)
 }
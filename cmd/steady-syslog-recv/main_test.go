@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pylls/steady"
+	"github.com/stretchr/testify/assert"
+	syslog "gopkg.in/mcuadros/go-syslog.v2"
+)
+
+// testLogger is a device that keeps logged events
+type testLogger struct {
+	lock   sync.Mutex
+	events []steady.StructuredEvent
+	closed bool
+}
+
+func (l *testLogger) LogEvent(e steady.StructuredEvent) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.events = append(l.events, e)
+	return nil
+}
+
+func (l *testLogger) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.closed = true
+	return nil
+}
+
+func (l *testLogger) logged() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return len(l.events)
+}
+
+func TestServeConnectedClient(t *testing.T) {
+	// a free port for the server
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "failed to listen: %v", err)
+	addr := l.Addr().String()
+	l.Close()
+
+	server := syslog.NewServer()
+	channel := make(syslog.LogPartsChannel, 1024)
+	server.SetFormat(syslog.Automatic)
+	server.SetHandler(syslog.NewChannelHandler(channel))
+	assert.Nil(t, server.ListenTCP(addr), "failed to listen for TCP")
+	assert.Nil(t, server.Boot(), "failed to boot")
+
+	dev := &testLogger{}
+	stop := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	go func() {
+		serve(server, channel, dev, stop, 100*time.Millisecond)
+		close(done)
+	}()
+
+	// a client that stays connected after sending a message
+	conn, err := net.Dial("tcp", addr)
+	assert.Nil(t, err, "failed to connect: %v", err)
+	defer conn.Close()
+	_, err = fmt.Fprintf(conn, "<34>Oct 11 22:14:15 mymachine su: hello\n")
+	assert.Nil(t, err, "failed to send: %v", err)
+	for start := time.Now(); dev.logged() == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("message not logged")
+		}
+	}
+
+	stop <- os.Interrupt
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown blocked by connected client")
+	}
+	assert.True(t, dev.closed, "device not closed")
+	assert.Equal(t, "hello", dev.events[0].Message, "wrong message")
+}
@@ -0,0 +1,11 @@
+//go:build windows
+
+package main
+
+import "os"
+
+// fileID identifies a file across renames, without inodes we only detect
+// truncation
+func fileID(fi os.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pylls/steady/device"
+	"github.com/pylls/steady/metrics"
+)
+
+var (
+	path           = flag.String("path", "test", "the path")
+	token          = flag.String("token", "secret", "the access token")
+	server         = flag.String("server", "localhost:22333", "the server, or comma-separated servers to write each block to")
+	quorum         = flag.Int("quorum", 0, "the number of servers that must ACK a block, 0 for all")
+	encrypt        = flag.Bool("encrypt", true, "use encryption")
+	compress       = flag.Bool("compress", true, "use compression")
+	flushSize      = flag.Int("flush", 1024, "buffer size in KiB")
+	blockBufferNum = flag.Int("blocks", 5, "max number of blocks in buffer")
+	poll           = flag.Duration("poll", 250*time.Millisecond, "how often to poll files for changes")
+	metricsAddr    = flag.String("metrics", "", "the address to serve Prometheus metrics on, disabled if empty")
+	closeTimeout   = flag.Duration("closetimeout", 0, "how long to wait on stop for a quorum of servers to ACK all blocks, 0 for no limit")
+)
+
+// offsetsFilename is where the offsets of followed files are persisted,
+// alongside the device state.
+const offsetsFilename = "%s.offsets"
+
+func main() {
+	flag.Parse()
+	if flag.NArg() == 0 {
+		log.Fatalf("usage: %s [flags] file [file ...]", os.Args[0])
+	}
+
+	o, err := readOffsets(fmt.Sprintf(offsetsFilename, *path))
+	if err != nil {
+		log.Fatalf("failed to read offsets: %v", err)
+	}
+
+	log.Printf("attempting to load device at %s...", *path)
+	dev, err := loadDevice()
+	if err != nil {
+		log.Fatalf("failed to load device: %v", err)
+	}
+	dev.SetCloseTimeout(*closeTimeout)
+	// offsets are only committed once the events are in a block ACKed by the relay
+	dev.SetAckHandler(func(index, nextSeq uint64) {
+		if err := o.ack(nextSeq); err != nil {
+			log.Printf("failed to write offsets: %v", err)
+		}
+	})
+	if *metricsAddr != "" {
+		r := metrics.NewRegistry()
+		dev.RegisterMetrics(r)
+		go func() {
+			log.Printf("metrics server failed: %v", metrics.ListenAndServe(*metricsAddr, r))
+		}()
+	}
+
+	stop := make(chan struct{})
+	var wait sync.WaitGroup
+	var logLock sync.Mutex // serializes logging, such that pending offsets are in order
+	for _, f := range flag.Args() {
+		t, err := newTailer(f, o.committed(f))
+		if err != nil {
+			log.Fatalf("failed to follow %s: %v", f, err)
+		}
+		log.Printf("following %s from offset %d", f, t.offset)
+		wait.Add(1)
+		go func(t *tailer) {
+			defer wait.Done()
+			t.follow(*poll, stop, func(line string, pos position) {
+				logLock.Lock()
+				defer logLock.Unlock()
+				seq, err := dev.LogSeq(line)
+				if err != nil {
+					log.Printf("failed to log line from %s: %v", t.path, err)
+					return
+				}
+				o.add(seq, t.path, pos)
+			})
+		}(t)
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	<-sig
+	log.Println("stopping, flushing device")
+	close(stop)
+	wait.Wait()
+	dev.Close()
+	log.Println("all done, closed")
+}
+
+// loadDevice loads the device, writing to several relays if more than one
+// server is given
+func loadDevice() (*device.Device, error) {
+	if servers := strings.Split(*server, ","); len(servers) > 1 {
+		return device.LoadMultiDevice(*path, servers, *quorum, *token,
+			*encrypt, *compress, *flushSize*1024, *blockBufferNum)
+	}
+	return device.LoadDevice(*path, *server, *token,
+		*encrypt, *compress, *flushSize*1024, *blockBufferNum)
+}
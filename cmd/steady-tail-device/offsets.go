@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// position is a position in a file, the file identified by its ID
+type position struct {
+	Offset int64
+	ID     uint64
+}
+
+type pendingLine struct {
+	seq  uint64
+	path string
+	pos  position
+}
+
+// offsets keeps track of the positions in all followed files: committed
+// positions are after the last line in a block ACKed by the relay.
+type offsets struct {
+	lock     sync.Mutex
+	filename string
+	files    map[string]position
+	pending  []pendingLine
+}
+
+func readOffsets(filename string) (*offsets, error) {
+	o := &offsets{
+		filename: filename,
+		files:    make(map[string]position),
+	}
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return o, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return o, json.Unmarshal(data, &o.files)
+}
+
+func (o *offsets) committed(path string) *position {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	pos, exists := o.files[path]
+	if !exists {
+		return nil
+	}
+	return &pos
+}
+
+// add a logged line with the position after the line
+func (o *offsets) add(seq uint64, path string, pos position) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.pending = append(o.pending, pendingLine{
+		seq:  seq,
+		path: path,
+		pos:  pos,
+	})
+}
+
+// ack commits the positions of all lines with a sequence number below nextSeq
+func (o *offsets) ack(nextSeq uint64) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	i := 0
+	for ; i < len(o.pending) && o.pending[i].seq < nextSeq; i++ {
+		o.files[o.pending[i].path] = o.pending[i].pos
+	}
+	if i == 0 {
+		return nil
+	}
+	o.pending = o.pending[i:]
+
+	data, err := json.Marshal(o.files)
+	if err != nil {
+		return err
+	}
+	// write and rename, such that we never end up with partial offsets
+	if err := ioutil.WriteFile(o.filename+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(o.filename+".tmp", o.filename)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOffsetsAck(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "offsets")
+	o, err := readOffsets(filename)
+	assert.Nil(t, err, "failed to read offsets: %v", err)
+	assert.Nil(t, o.committed("a"), "expected no committed position")
+
+	o.add(10, "a", position{Offset: 5, ID: 1})
+	o.add(11, "b", position{Offset: 7, ID: 2})
+	o.add(12, "a", position{Offset: 9, ID: 1})
+
+	// partial, only lines in ACKed blocks are committed
+	assert.Nil(t, o.ack(12), "failed to ack")
+	assert.Equal(t, &position{Offset: 5, ID: 1}, o.committed("a"), "wrong position")
+	assert.Equal(t, &position{Offset: 7, ID: 2}, o.committed("b"), "wrong position")
+
+	// out of order, an older ACK commits nothing
+	assert.Nil(t, o.ack(11), "failed to ack")
+	assert.Equal(t, &position{Offset: 5, ID: 1}, o.committed("a"), "committed unACKed line")
+	assert.Nil(t, o.ack(13), "failed to ack")
+	assert.Equal(t, &position{Offset: 9, ID: 1}, o.committed("a"), "wrong position")
+	assert.Nil(t, o.ack(13), "failed to ack again")
+
+	// persisted
+	o, err = readOffsets(filename)
+	assert.Nil(t, err, "failed to read offsets: %v", err)
+	assert.Equal(t, &position{Offset: 9, ID: 1}, o.committed("a"), "wrong persisted position")
+	assert.Equal(t, &position{Offset: 7, ID: 2}, o.committed("b"), "wrong persisted position")
+}
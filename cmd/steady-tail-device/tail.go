@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// tailer follows a file by path across rename and truncate rotation
+type tailer struct {
+	path    string
+	file    *os.File
+	reader  *bufio.Reader
+	id      uint64
+	offset  int64 // after the last complete line
+	partial []byte
+}
+
+// newTailer opens a file, resuming at pos if it is still the same file and
+// it has not been truncated
+func newTailer(path string, pos *position) (*tailer, error) {
+	t := &tailer{path: path}
+	if err := t.open(); err != nil {
+		return nil, err
+	}
+	if pos != nil && pos.ID == t.id {
+		fi, err := t.file.Stat()
+		if err != nil {
+			return nil, err
+		}
+		if fi.Size() >= pos.Offset {
+			if _, err := t.file.Seek(pos.Offset, io.SeekStart); err != nil {
+				return nil, err
+			}
+			t.offset = pos.Offset
+		}
+	}
+	t.reader = bufio.NewReader(t.file)
+	return t, nil
+}
+
+func (t *tailer) open() error {
+	f, err := os.Open(t.path)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if t.file != nil {
+		t.file.Close()
+	}
+	t.file = f
+	t.id = fileID(fi)
+	t.offset = 0
+	t.partial = nil
+	t.reader = bufio.NewReader(f)
+	return nil
+}
+
+// follow reads lines until stop, calling out with each line and the position
+// after the line
+func (t *tailer) follow(poll time.Duration, stop chan struct{},
+	out func(line string, pos position)) {
+	defer t.file.Close()
+	for {
+		t.drain(out)
+
+		// at the end of the file, wait for more data or rotation
+		select {
+		case <-stop:
+			return
+		case <-time.After(poll):
+		}
+		fi, err := os.Stat(t.path)
+		if err != nil { // rotated but not yet recreated
+			continue
+		}
+		if fileID(fi) != t.id { // renamed, read the rest of the old file first
+			t.drain(out)
+			if len(t.partial) > 0 {
+				t.offset += int64(len(t.partial))
+				out(string(t.partial), position{Offset: t.offset, ID: t.id})
+			}
+			if err := t.open(); err != nil {
+				log.Printf("failed to open rotated %s: %v", t.path, err)
+				continue
+			}
+			log.Printf("%s rotated, following new file", t.path)
+		} else if fi.Size() < t.offset+int64(len(t.partial)) { // truncated
+			if _, err := t.file.Seek(0, io.SeekStart); err != nil {
+				log.Printf("failed to seek in truncated %s: %v", t.path, err)
+				continue
+			}
+			t.offset = 0
+			t.partial = nil
+			t.reader.Reset(t.file)
+			log.Printf("%s truncated, following from start", t.path)
+		}
+	}
+}
+
+// drain reads all complete lines until the end of the file
+func (t *tailer) drain(out func(line string, pos position)) {
+	for {
+		line, err := t.reader.ReadBytes('\n')
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("failed to read %s: %v", t.path, err)
+			}
+			t.partial = append(t.partial, line...)
+			return
+		}
+		line = append(t.partial, line...)
+		t.partial = nil
+		t.offset += int64(len(line))
+		out(string(bytes.TrimRight(line, "\r\n")), position{Offset: t.offset, ID: t.id})
+	}
+}
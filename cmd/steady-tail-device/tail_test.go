@@ -0,0 +1,110 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type tailedLine struct {
+	line string
+	pos  position
+}
+
+// follow follows the file at path from pos in the background, returning the
+// followed lines and a function that stops following
+func follow(t *testing.T, path string, pos *position) (chan tailedLine, func()) {
+	tail, err := newTailer(path, pos)
+	assert.Nil(t, err, "failed to follow: %v", err)
+	lines := make(chan tailedLine, 100)
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		tail.follow(5*time.Millisecond, stop, func(line string, pos position) {
+			lines <- tailedLine{line: line, pos: pos}
+		})
+	}()
+	return lines, func() {
+		close(stop)
+		<-done
+	}
+}
+
+func expectLines(t *testing.T, lines chan tailedLine, expected ...string) []tailedLine {
+	var got []tailedLine
+	for _, e := range expected {
+		select {
+		case l := <-lines:
+			assert.Equal(t, e, l.line, "wrong line")
+			got = append(got, l)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timeout waiting for line %q", e)
+		}
+	}
+	return got
+}
+
+func appendFile(t *testing.T, path, data string) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	assert.Nil(t, err, "failed to open: %v", err)
+	_, err = f.WriteString(data)
+	assert.Nil(t, err, "failed to write: %v", err)
+	assert.Nil(t, f.Close(), "failed to close")
+}
+
+func TestFollowRename(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log")
+	appendFile(t, path, "one\ntwo\r\nthr")
+	lines, stop := follow(t, path, nil)
+	defer stop()
+	got := expectLines(t, lines, "one", "two")
+	assert.Equal(t, int64(len("one\ntwo\r\n")), got[1].pos.Offset, "wrong offset")
+
+	// the rest of the renamed file, including a partial line, is read before
+	// following the new file
+	appendFile(t, path, "ee\nfour")
+	assert.Nil(t, os.Rename(path, path+".1"), "failed to rename")
+	appendFile(t, path, "five\n")
+	got = expectLines(t, lines, "three", "four", "five")
+	assert.Equal(t, got[0].pos.ID, got[1].pos.ID, "partial line from another file")
+	assert.NotEqual(t, got[1].pos.ID, got[2].pos.ID, "new file not followed")
+	assert.Equal(t, int64(len("five\n")), got[2].pos.Offset, "wrong offset in new file")
+}
+
+func TestFollowTruncate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log")
+	appendFile(t, path, "a long first line\n")
+	lines, stop := follow(t, path, nil)
+	defer stop()
+	expectLines(t, lines, "a long first line")
+
+	assert.Nil(t, os.Truncate(path, 0), "failed to truncate")
+	appendFile(t, path, "short\n")
+	got := expectLines(t, lines, "short")
+	assert.Equal(t, int64(len("short\n")), got[0].pos.Offset, "wrong offset after truncate")
+}
+
+func TestResume(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log")
+	appendFile(t, path, "one\ntwo\n")
+	lines, stop := follow(t, path, nil)
+	got := expectLines(t, lines, "one", "two")
+	stop()
+
+	// resumes after the committed line
+	appendFile(t, path, "three\n")
+	lines, stop = follow(t, path, &got[0].pos)
+	expectLines(t, lines, "two", "three")
+	stop()
+
+	// a committed position in another file, or past the end of a truncated
+	// file, is ignored
+	for _, pos := range []position{{Offset: 4, ID: got[0].pos.ID + 1}, {Offset: 1 << 20, ID: got[0].pos.ID}} {
+		lines, stop = follow(t, path, &pos)
+		expectLines(t, lines, "one", "two", "three")
+		stop()
+	}
+}
@@ -0,0 +1,571 @@
+package collector
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pylls/steady"
+)
+
+// files of the archive, per policy in a directory named by the hex-encoded
+// policy ID (see Archive)
+const (
+	archivePolicyFile  = "policy"
+	archiveEvents      = "events"
+	archiveBlocks      = "blocks"
+	archiveAssessments = "assessments"
+
+	// an index entry is time, block index, offset, and length
+	indexEntrySize = 32
+)
+
+// ArchivedEvent is a verified event stored in an archive.
+type ArchivedEvent struct {
+	// Policy is the hex-encoded ID of the policy.
+	Policy string
+	// Time is the device time of the event, or the time of the block for
+	// blocks without per-event time.
+	Time    uint64
+	Message string
+	// Data is the event as committed to by the proof.
+	Data  []byte
+	Proof Proof
+}
+
+// Query selects what to search for in an archive. Zero values match
+// everything, i.e., a zero To or ToIndex means no upper bound.
+type Query struct {
+	// Policy is the ID of the policy to search, nil for all policies.
+	Policy []byte
+	// From and To is the inclusive time range.
+	From, To uint64
+	// FromIndex and ToIndex is the inclusive range of block indices.
+	FromIndex, ToIndex uint64
+	// Contains is a substring of the message of an event.
+	Contains string
+}
+
+// span is the inclusive ranges of time and block index of the query
+func (q Query) span() indexSpan {
+	s := indexSpan{fromTime: q.From, toTime: q.To, fromIndex: q.FromIndex, toIndex: q.ToIndex}
+	if s.toTime == 0 {
+		s.toTime = math.MaxUint64
+	}
+	if s.toIndex == 0 {
+		s.toIndex = math.MaxUint64
+	}
+	return s
+}
+
+// Archive is a local store of verified events with their proofs, block heads,
+// and assessments, indexed by policy, time, and block index. Each policy has
+// a directory with its encoded policy and, for events, blocks, and
+// assessments, a file of JSON lines and an index file.
+type Archive struct {
+	dir    string
+	lock   sync.Mutex
+	stores map[string]*policyStore
+	err    error
+}
+
+type policyStore struct {
+	policy                      steady.Policy
+	events, blocks, assessments *indexedFile
+}
+
+// OpenArchive opens (or creates) an archive in a directory.
+func OpenArchive(dir string) (*Archive, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &Archive{
+		dir:    dir,
+		stores: make(map[string]*policyStore),
+	}, nil
+}
+
+// Output returns an output that archives verified events, block heads, and
+// assessments for a policy. Events are archived together with the assessment
+// that they link to, i.e., at the end of each run of the collect loop.
+func (a *Archive) Output(policy steady.Policy) (Output, error) {
+	id := hex.EncodeToString(policy.ID)
+	dir := filepath.Join(a.dir, id)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	filename := filepath.Join(dir, archivePolicyFile)
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		if err = os.WriteFile(filename, steady.EncodePolicy(policy), 0600); err != nil {
+			return nil, err
+		}
+	}
+
+	a.lock.Lock()
+	s, err := a.open(id)
+	a.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(steady.EncodePolicy(s.policy), steady.EncodePolicy(policy)) {
+		return nil, fmt.Errorf("archive has a different policy with ID %s", id)
+	}
+
+	var pending []ArchivedEvent
+	return func(label string, meta interface{}, format string, args ...interface{}) {
+		switch label {
+		case "verified":
+			if p, ok := meta.(Proof); ok {
+				pending = append(pending, ArchivedEvent{
+					Policy:  id,
+					Time:    p.Time,
+					Message: fmt.Sprintf(format, args...),
+					Data:    p.Data,
+					Proof:   p,
+				})
+			}
+		case "assessment":
+			if as, ok := meta.(*Assessment); ok {
+				a.store(s, as, pending)
+				pending = nil
+			}
+		}
+	}, nil
+}
+
+func (a *Archive) store(s *policyStore, as *Assessment, events []ArchivedEvent) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	var err error
+	fail := func(e error) {
+		if err == nil && e != nil {
+			err = e
+		}
+	}
+
+	indices := make([]uint64, 0, len(as.Blockheads))
+	for index := range as.Blockheads {
+		indices = append(indices, index)
+	}
+	sort.Slice(indices, func(i, j int) bool { return indices[i] < indices[j] })
+	for _, index := range indices {
+		bh := as.Blockheads[index]
+		fail(s.blocks.append(bh.Time, index, bh))
+	}
+
+	for _, e := range events {
+		if e.Time == 0 { // no per-event time
+			e.Time = as.Blockheads[e.Proof.BlockID].Time
+		}
+		fail(s.events.append(e.Time, e.Proof.BlockID, e))
+	}
+
+	// block heads are stored on their own above
+	stored := *as
+	stored.Blockheads = nil
+	fail(s.assessments.append(as.Time, as.RequestIndex, stored))
+
+	if err != nil && a.err == nil {
+		a.err = err
+	}
+}
+
+// Err returns the first error when archiving, if any.
+func (a *Archive) Err() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.err
+}
+
+// Policies returns the policies in the archive.
+func (a *Archive) Policies() ([]steady.Policy, error) {
+	entries, err := os.ReadDir(a.dir)
+	if err != nil {
+		return nil, err
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	var policies []steady.Policy
+	for _, entry := range entries {
+		if _, err := hex.DecodeString(entry.Name()); err != nil || !entry.IsDir() {
+			continue
+		}
+		s, err := a.open(entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, s.policy)
+	}
+	return policies, nil
+}
+
+// Events calls fn for each archived event matching the query, in the order
+// archived per policy, until fn returns an error.
+func (a *Archive) Events(q Query, fn func(ArchivedEvent) error) error {
+	return a.search(q, func(s *policyStore) *indexedFile { return s.events },
+		func(line []byte) error {
+			var e ArchivedEvent
+			if err := json.Unmarshal(line, &e); err != nil {
+				return err
+			}
+			if !strings.Contains(e.Message, q.Contains) {
+				return nil
+			}
+			return fn(e)
+		})
+}
+
+// Assessments calls fn for each archived assessment matching the query (by
+// time and requested index), until fn returns an error. The block heads of
+// an assessment are archived separately, see BlockHead.
+func (a *Archive) Assessments(q Query, fn func(*Assessment) error) error {
+	return a.search(q, func(s *policyStore) *indexedFile { return s.assessments },
+		func(line []byte) error {
+			as := new(Assessment)
+			if err := json.Unmarshal(line, as); err != nil {
+				return err
+			}
+			return fn(as)
+		})
+}
+
+// BlockHead returns the archived head of the block with an index.
+func (a *Archive) BlockHead(policy []byte, index uint64) (*BlockHead, error) {
+	var bh *BlockHead
+	err := a.searchSpan(policy, indexSpan{toTime: math.MaxUint64, fromIndex: index, toIndex: index},
+		func(s *policyStore) *indexedFile { return s.blocks },
+		func(line []byte) error {
+			bh = new(BlockHead)
+			return json.Unmarshal(line, bh)
+		})
+	if err != nil {
+		return nil, err
+	}
+	if bh == nil {
+		return nil, fmt.Errorf("no block with index %d in archive", index)
+	}
+	return bh, nil
+}
+
+// Disclose re-exports the proof of an archived event as a disclosure,
+// verifiable by a third party with only the policy (see
+// steady.VerifyDisclosure).
+func (a *Archive) Disclose(e ArchivedEvent) (*steady.Disclosure, error) {
+	id, err := hex.DecodeString(e.Policy)
+	if err != nil {
+		return nil, err
+	}
+	bh, err := a.BlockHead(id, e.Proof.BlockID)
+	if err != nil {
+		return nil, err
+	}
+	if len(bh.Header) == 0 {
+		return nil, fmt.Errorf("no encoded header archived for block %d", bh.BlockID)
+	}
+	d := &steady.Disclosure{
+		Header:   bh.Header,
+		IV:       bh.IV,
+		Root:     bh.Root,
+		History:  bh.History,
+		TreeSize: bh.TreeSize,
+		Events: []steady.DisclosedEvent{{
+			Index: e.Proof.EventIndex,
+			Event: steady.Event{
+				Time: e.Proof.Time,
+				Seq:  e.Proof.Seq,
+				Data: e.Data,
+			},
+			Path: e.Proof.Path,
+		}},
+	}
+
+	a.lock.Lock()
+	s, err := a.open(e.Policy)
+	a.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if _, err = steady.VerifyDisclosure(d, s.policy); err != nil {
+		return nil, fmt.Errorf("archived event fails to verify: %v", err)
+	}
+	return d, nil
+}
+
+// Close closes all files of the archive.
+func (a *Archive) Close() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	var err error
+	for id, s := range a.stores {
+		for _, f := range []*indexedFile{s.events, s.blocks, s.assessments} {
+			if e := f.close(); e != nil && err == nil {
+				err = e
+			}
+		}
+		delete(a.stores, id)
+	}
+	return err
+}
+
+// search calls fn with each line matching the query in the file selected by
+// file, for one policy or all policies
+func (a *Archive) search(q Query, file func(*policyStore) *indexedFile,
+	fn func(line []byte) error) error {
+	return a.searchSpan(q.Policy, q.span(), file, fn)
+}
+
+// searchSpan is search for lines within a span, for the policy with an ID or
+// all policies if nil
+func (a *Archive) searchSpan(policy []byte, span indexSpan, file func(*policyStore) *indexedFile,
+	fn func(line []byte) error) error {
+	var ids []string
+	if policy != nil {
+		ids = append(ids, hex.EncodeToString(policy))
+	} else {
+		policies, err := a.Policies()
+		if err != nil {
+			return err
+		}
+		for _, p := range policies {
+			ids = append(ids, hex.EncodeToString(p.ID))
+		}
+	}
+
+	for _, id := range ids {
+		a.lock.Lock()
+		s, err := a.open(id)
+		a.lock.Unlock()
+		if err != nil {
+			return err
+		}
+		if err = file(s).scan(span, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// open opens the store of a policy, must hold lock
+func (a *Archive) open(id string) (*policyStore, error) {
+	if s, exists := a.stores[id]; exists {
+		return s, nil
+	}
+	dir := filepath.Join(a.dir, id)
+	b, err := os.ReadFile(filepath.Join(dir, archivePolicyFile))
+	if err != nil {
+		return nil, fmt.Errorf("no policy with ID %s in archive: %v", id, err)
+	}
+	s := new(policyStore)
+	if s.policy, err = steady.DecodePolicy(b); err != nil {
+		return nil, err
+	}
+	if s.events, err = openIndexedFile(filepath.Join(dir, archiveEvents)); err != nil {
+		return nil, err
+	}
+	if s.blocks, err = openIndexedFile(filepath.Join(dir, archiveBlocks)); err != nil {
+		s.events.close()
+		return nil, err
+	}
+	if s.assessments, err = openIndexedFile(filepath.Join(dir, archiveAssessments)); err != nil {
+		s.events.close()
+		s.blocks.close()
+		return nil, err
+	}
+	a.stores[id] = s
+	return s, nil
+}
+
+// indexSpan is the inclusive ranges of time and block index of lines
+type indexSpan struct {
+	fromTime, toTime, fromIndex, toIndex uint64
+}
+
+func (s indexSpan) match(time, index uint64) bool {
+	return time >= s.fromTime && time <= s.toTime &&
+		index >= s.fromIndex && index <= s.toIndex
+}
+
+// indexedFile is a file of JSON lines with an index file with an entry of
+// time, block index, offset, and length for each line. Lines are typically
+// appended in order of time and block index: as long as they are, the index
+// is bisected to find the lines within a span.
+type indexedFile struct {
+	data, index *os.File
+	size        int64 // of data
+
+	lock sync.Mutex
+	// entries in the index, and if the entries are sorted by time and by
+	// block index
+	entries                 int64
+	sortedTime, sortedIndex bool
+	lastTime, lastIndex     uint64
+}
+
+func openIndexedFile(name string) (*indexedFile, error) {
+	data, err := os.OpenFile(name+".jsonl", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	index, err := os.OpenFile(name+".idx", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		data.Close()
+		return nil, err
+	}
+	f := &indexedFile{data: data, index: index, sortedTime: true, sortedIndex: true}
+	if f.size, err = data.Seek(0, io.SeekEnd); err != nil {
+		f.close()
+		return nil, err
+	}
+
+	// drop any partially written index entry, lines without entries are
+	// never read
+	n, err := index.Seek(0, io.SeekEnd)
+	if err == nil && n%indexEntrySize != 0 {
+		err = index.Truncate(n - n%indexEntrySize)
+		if err == nil {
+			_, err = index.Seek(0, io.SeekEnd)
+		}
+	}
+	if err == nil {
+		err = f.load(n / indexEntrySize)
+	}
+	if err != nil {
+		f.close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// load reads the entries of the index to tell if they are sorted
+func (f *indexedFile) load(entries int64) error {
+	buf := make([]byte, indexEntrySize*1024)
+	for i := int64(0); i < entries; {
+		n := entries - i
+		if n > 1024 {
+			n = 1024
+		}
+		if _, err := f.index.ReadAt(buf[:n*indexEntrySize], i*indexEntrySize); err != nil {
+			return err
+		}
+		for j := int64(0); j < n; j++ {
+			f.add(binary.BigEndian.Uint64(buf[j*indexEntrySize:]),
+				binary.BigEndian.Uint64(buf[j*indexEntrySize+8:]))
+		}
+		i += n
+	}
+	return nil
+}
+
+// add accounts for an entry in the index, must hold lock (or be opening)
+func (f *indexedFile) add(time, index uint64) {
+	if f.entries > 0 {
+		f.sortedTime = f.sortedTime && time >= f.lastTime
+		f.sortedIndex = f.sortedIndex && index >= f.lastIndex
+	}
+	f.entries++
+	f.lastTime, f.lastIndex = time, index
+}
+
+func (f *indexedFile) append(time, index uint64, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if _, err = f.data.WriteAt(append(b, '\n'), f.size); err != nil {
+		return err
+	}
+	entry := make([]byte, indexEntrySize)
+	binary.BigEndian.PutUint64(entry, time)
+	binary.BigEndian.PutUint64(entry[8:], index)
+	binary.BigEndian.PutUint64(entry[16:], uint64(f.size))
+	binary.BigEndian.PutUint64(entry[24:], uint64(len(b)))
+	f.size += int64(len(b)) + 1
+	if _, err = f.index.Write(entry); err != nil {
+		return err
+	}
+	f.lock.Lock()
+	f.add(time, index)
+	f.lock.Unlock()
+	return nil
+}
+
+// scan calls fn with each line within span, in the order appended
+func (f *indexedFile) scan(span indexSpan, fn func(line []byte) error) error {
+	f.lock.Lock()
+	start, end := int64(0), f.entries
+	sortedTime, sortedIndex := f.sortedTime, f.sortedIndex
+	f.lock.Unlock()
+
+	// narrow down to the entries within span by bisecting on sorted keys
+	var err error
+	bisect := func(offset int, key uint64, after bool) int64 {
+		return int64(sort.Search(int(end), func(i int) bool {
+			b := make([]byte, 8)
+			if _, e := f.index.ReadAt(b, int64(i)*indexEntrySize+int64(offset)); e != nil {
+				err = e
+				return true
+			}
+			if after {
+				return binary.BigEndian.Uint64(b) > key
+			}
+			return binary.BigEndian.Uint64(b) >= key
+		}))
+	}
+	if sortedTime {
+		start, end = bisect(0, span.fromTime, false), bisect(0, span.toTime, true)
+	}
+	if sortedIndex && start < end {
+		if i := bisect(8, span.fromIndex, false); i > start {
+			start = i
+		}
+		if i := bisect(8, span.toIndex, true); i < end {
+			end = i
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	entries := make([]byte, indexEntrySize*1024)
+	for start < end {
+		n := end - start
+		if n > 1024 {
+			n = 1024
+		}
+		if _, err := f.index.ReadAt(entries[:n*indexEntrySize], start*indexEntrySize); err != nil {
+			return err
+		}
+		for i := int64(0); i < n*indexEntrySize; i += indexEntrySize {
+			if !span.match(binary.BigEndian.Uint64(entries[i:]), binary.BigEndian.Uint64(entries[i+8:])) {
+				continue
+			}
+			line := make([]byte, binary.BigEndian.Uint64(entries[i+24:]))
+			if _, err := f.data.ReadAt(line, int64(binary.BigEndian.Uint64(entries[i+16:]))); err != nil {
+				return err
+			}
+			if err := fn(line); err != nil {
+				return err
+			}
+		}
+		start += n
+	}
+	return nil
+}
+
+func (f *indexedFile) close() error {
+	err := f.data.Close()
+	if e := f.index.Close(); err == nil {
+		err = e
+	}
+	return err
+}
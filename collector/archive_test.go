@@ -0,0 +1,133 @@
+package collector
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pylls/steady"
+	"github.com/pylls/steady/lc"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArchive(t *testing.T) {
+	vk, sk, _ := lc.SigningKeyGen()
+	pub, pk, _ := lc.EncryptKeyGen()
+	p := steady.MakePolicy(sk, vk, pub, 0, 1, 2)
+	c := &Collector{Config: Config{Pub: pub, Priv: pk, Vk: vk, Policy: p}}
+
+	dir, err := os.MkdirTemp("", "steady-archive")
+	assert.Nil(t, err, "failed to make temporary dir: %s", err)
+	defer os.RemoveAll(dir)
+	archive, err := OpenArchive(dir)
+	assert.Nil(t, err, "failed to open archive: %s", err)
+	out, err := archive.Output(p)
+	assert.Nil(t, err, "failed to get output: %s", err)
+
+	// two blocks with two events each, at times 100 + index
+	var blocks []Block
+	for i := uint64(0); i < 2; i++ {
+		events := []steady.Event{
+			{Time: 100 + i, Seq: 2 * i, Data: []byte("foo")},
+			{Time: 100 + i, Seq: 2*i + 1, Data: []byte("bar")},
+		}
+		block, err := steady.MakeEncodedBlock(i, 0, uint64(time.Now().Unix()),
+			true, true, p, events, sk)
+		assert.Nil(t, err, "failed to make block: %s", err)
+		bh, err := steady.DecodeBlockHeader(block[:steady.WireBlockHeaderSize], p)
+		assert.Nil(t, err, "failed to decode header: %s", err)
+		blocks = append(blocks, Block{BlockHeader: bh, Payload: block[steady.WireBlockHeaderSize:]})
+	}
+	a := &Assessment{ID: 1, Time: 200, Blockheads: make(map[uint64]BlockHead)}
+	assert.Empty(t, c.outputValid(blocks, out, a), "failed to output blocks")
+	out("assessment", a, assessmentFormat, a.Overall)
+	assert.Nil(t, archive.Err(), "failed to archive: %s", archive.Err())
+	assert.Nil(t, archive.Close(), "failed to close archive")
+
+	// search a reopened archive
+	archive, err = OpenArchive(dir)
+	assert.Nil(t, err, "failed to reopen archive: %s", err)
+	defer archive.Close()
+	policies, err := archive.Policies()
+	assert.Nil(t, err, "failed to list policies: %s", err)
+	assert.Len(t, policies, 1, "expected one policy")
+
+	var found []ArchivedEvent
+	search := func(q Query) {
+		found = nil
+		err := archive.Events(q, func(e ArchivedEvent) error {
+			found = append(found, e)
+			return nil
+		})
+		assert.Nil(t, err, "failed to search: %s", err)
+	}
+	search(Query{})
+	assert.Len(t, found, 4, "expected all events")
+	search(Query{Policy: p.ID, From: 101})
+	assert.Len(t, found, 2, "expected events of second block by time")
+	search(Query{FromIndex: 1, ToIndex: 1, Contains: "bar"})
+	assert.Len(t, found, 1, "expected one event by index and substring")
+	assert.Equal(t, uint64(3), found[0].Proof.Seq, "wrong event")
+
+	d, err := archive.Disclose(found[0])
+	assert.Nil(t, err, "failed to disclose archived event: %s", err)
+	_, err = steady.VerifyDisclosure(d, p)
+	assert.Nil(t, err, "failed to verify disclosure: %s", err)
+
+	found[0].Data = []byte("baz")
+	_, err = archive.Disclose(found[0])
+	assert.NotNil(t, err, "disclosed modified event")
+
+	bh, err := archive.BlockHead(p.ID, 0)
+	assert.Nil(t, err, "failed to get block head: %s", err)
+	assert.Equal(t, uint64(0), bh.BlockID, "wrong block head")
+	_, err = archive.BlockHead(p.ID, 2)
+	assert.NotNil(t, err, "got block head for missing block")
+
+	n := 0
+	err = archive.Assessments(Query{}, func(*Assessment) error {
+		n++
+		return nil
+	})
+	assert.Nil(t, err, "failed to search assessments: %s", err)
+	assert.Equal(t, 1, n, "expected one assessment")
+}
+
+func TestIndexedFile(t *testing.T) {
+	f, err := openIndexedFile(filepath.Join(t.TempDir(), "file"))
+	assert.Nil(t, err, "failed to open: %s", err)
+	defer f.close()
+
+	scan := func(span indexSpan) []int {
+		var lines []int
+		err := f.scan(span, func(line []byte) error {
+			var v int
+			lines = append(lines, v)
+			return json.Unmarshal(line, &lines[len(lines)-1])
+		})
+		assert.Nil(t, err, "failed to scan: %s", err)
+		return lines
+	}
+	all := indexSpan{toTime: math.MaxUint64, toIndex: math.MaxUint64}
+
+	// sorted, line i at time 10*i and index i/2
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, f.append(uint64(10*i), uint64(i/2), i), "failed to append")
+	}
+	assert.True(t, f.sortedTime && f.sortedIndex, "expected sorted index")
+	assert.Equal(t, []int{0, 1}, scan(indexSpan{toTime: math.MaxUint64}), "wrong lines at index 0")
+	assert.Equal(t, []int{1500, 1501}, scan(indexSpan{fromTime: 15000, toTime: 15010,
+		toIndex: math.MaxUint64}), "wrong lines by time")
+	assert.Equal(t, []int{1001}, scan(indexSpan{fromTime: 10005, toTime: math.MaxUint64,
+		fromIndex: 500, toIndex: 500}), "wrong lines by time and index")
+	assert.Len(t, scan(all), 2000, "expected all lines")
+
+	// out of order, scanned in full
+	assert.Nil(t, f.append(5, 0, 2000), "failed to append")
+	assert.False(t, f.sortedTime || f.sortedIndex, "expected unsorted index")
+	assert.Equal(t, []int{0, 1, 2000}, scan(indexSpan{toTime: math.MaxUint64}), "wrong lines at index 0")
+	assert.Equal(t, []int{0, 2000}, scan(indexSpan{toTime: 5, toIndex: math.MaxUint64}), "wrong lines by time")
+}
@@ -1,11 +1,14 @@
 package collector
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
-	"io"
+	"math"
 	"net"
 	"sort"
+	"strings"
 	"time"
 
 	"github.com/pylls/steady"
@@ -19,12 +22,19 @@ type Output func(label string, meta interface{}, format string, args ...interfac
 
 // Collector is a Steady collector.
 type Collector struct {
-	address   string
-	conn      net.Conn
+	relays    []*relay
 	frequency time.Duration
 	delta     uint64
 	Config    Config
 	State     State
+	gossip    gossip
+	history   history
+}
+
+// relay is a relay that the collector reads from.
+type relay struct {
+	address string
+	conn    net.Conn
 }
 
 // State is the state kept by the collector.
@@ -42,42 +52,99 @@ func NewCollector(address string,
 	config Config,
 	frequency time.Duration,
 	delta uint64) (*Collector, error) {
-	conn, err := net.Dial("tcp", address)
-	if err != nil {
-		return nil, err
-	}
-	return &Collector{
-		address:   address,
-		conn:      conn,
+	return NewMultiRelayCollector([]string{address}, config, frequency, delta)
+}
+
+// NewMultiRelayCollector attempts to create a new collector connected to
+// several relays with the same policy, e.g., a relay and its replicas. The
+// collector reads from all relays and merges the blocks, detecting relays that
+// withhold blocks that other relays have.
+func NewMultiRelayCollector(addresses []string,
+	config Config,
+	frequency time.Duration,
+	delta uint64) (*Collector, error) {
+	c := &Collector{
 		frequency: frequency,
 		delta:     delta,
 		Config:    config,
-	}, nil
+	}
+	for _, address := range addresses {
+		conn, err := net.Dial("tcp", address)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		c.relays = append(c.relays, &relay{
+			address: address,
+			conn:    conn,
+		})
+	}
+	return c, nil
+}
+
+// reconnect replaces the connection to the relay.
+func (r *relay) reconnect() error {
+	r.conn.Close()
+	conn, err := net.Dial("tcp", r.address)
+	if err != nil {
+		return err
+	}
+	r.conn = conn
+	return nil
 }
 
-// Close closes the underlying connection to the relay.
+// Close closes the underlying connections to the relays, and the history
+// file, if any.
 func (c *Collector) Close() {
-	c.conn.Close()
+	for _, r := range c.relays {
+		r.conn.Close()
+	}
+	c.history.lock.Lock()
+	c.history.closeTree(nil)
+	c.history.lock.Unlock()
 }
 
 // Proof is an audit path that proves membership to a root in a block, and
 // the head of the block is part of the assessment.
 type Proof struct {
 	AssessmentID uint64
-	EventIndex   int
-	Path         [][]byte
+	// BlockID is the index of the block, see Assessment.Blockheads.
+	BlockID    uint64
+	EventIndex int
+	Path       [][]byte
+	// Time and Seq are the device time and sequence number of the event,
+	// committed to by the root (zero for blocks of older versions).
+	Time, Seq uint64
+	// HistoryIndex is the index of the event in the history of the device,
+	// committed to by blocks of steady.BlockVersionHistory (zero for blocks
+	// of older versions), see Collector.HistoryInclusion.
+	HistoryIndex uint64
+	// Event is the decoded event if it is a structured event, otherwise nil.
+	Event *steady.StructuredEvent `json:",omitempty"`
+	// Data is the event as committed to by the path, output as text already.
+	Data []byte `json:"-"`
 }
 
 // BlockHead is the minimal representation of a block for use with proofs.
 type BlockHead struct {
 	PayloadHash, RootHash, Root, IV, Signature []byte
 	BlockID, Time, TreeSize                    uint64
+	// Version is the block version, determining how events are encoded as
+	// leaves (see steady.EventLeaf).
+	Version byte
+	// History is the history of the device committed to by the block, nil
+	// for block versions before steady.BlockVersionHistory.
+	History *steady.BlockHistory `json:",omitempty"`
+	// Header is the encoded block header, as signed by the device.
+	Header []byte
 }
 
 // Unverified is the meta output description for unverifiable blocks and events.
 type Unverified struct {
 	AssessmentID uint64
 	Description  string
+	// Event is the decoded event if it is a structured event, otherwise nil.
+	Event *steady.StructuredEvent `json:",omitempty"`
 }
 
 const (
@@ -89,14 +156,27 @@ const (
 	RedAssessment = "evil"
 
 	// formatstrings
-	assessmentFormat = "overall %s"
-	timelyFormat     = "Block(s) delayed by %d seconds (policy timeout %d, delta %d)."
-	sequenceFormat   = "Expected block with index %d."
-	sizeFormat       = "Relay only returned %d bytes of valid blocks (policy space %d)"
-	missedFormat     = "%d blocks overwritten since last read %d seconds ago. Reasonable? Relay space %d bytes."
-	duplicateFormat  = "Got %d duplicate blocks from relay."
-	invalidFormat    = "Got %d invalid (old index and/or invalid signature) blocks from relay."
-	remainingFormat  = "Got %d remaining valid blocks that failed to be output"
+	assessmentFormat     = "overall %s"
+	timelyFormat         = "Block(s) delayed by %d seconds (policy timeout %d, delta %d)."
+	sequenceFormat       = "Expected block with index %d."
+	sizeFormat           = "Relay only returned %d bytes of valid blocks (policy space %d)"
+	missedFormat         = "%d blocks overwritten since last read %d seconds ago. Reasonable? Relay space %d bytes."
+	duplicateFormat      = "Got %d duplicate blocks from relay."
+	invalidFormat        = "Got %d invalid (old index and/or invalid signature) blocks from relay."
+	remainingFormat      = "Got %d remaining valid blocks that failed to be output"
+	retiredFormat        = "Policy retired by device at index %d."
+	retiredMissing       = "Policy retired by device at index %d, but relay has no blocks from index %d."
+	tombstoneFormat      = "Relay returned an invalid tombstone: %s"
+	differFormat         = "Relay %s returned %d block(s) that differ from blocks of other relays, first index %d."
+	missingFormat        = "Relay %s lacks %d block(s) returned by other relays, first index %d."
+	laggingFormat        = "Relay %s lacks %d recent block(s) returned by other relays, first index %d. Not yet written?"
+	relayErrFormat       = "Failed to read from relay %s: %v"
+	forkFormat           = "Block %d has two validly signed headers, one from another collector. Forked device?"
+	equivocateFormat     = "Device signed %d different block(s) with the same index as another block, first index %d. Compromised device?"
+	unseenHeadFormat     = "Another collector saw block %d made %d seconds ago, not returned by relay(s)."
+	historyFormat        = "Block %d commits to a history of the device that does not match the events read. Rewritten history?"
+	historyRestartFormat = "Block %d restarts the history of the device, previously %d events. Device lost its state?"
+	historyChangedFormat = "Block %d commits to another history of the device than when read before. Rewritten history?"
 )
 
 // Finding describes a finding as part of an assessment. The description is a freetext description
@@ -114,8 +194,11 @@ type Assessment struct {
 	// Finding is one or more findings.
 	Finding []Finding
 
-	// Relay is the URL of the queried relay.
+	// Relay is the URL of the queried relay, or comma-separated URLs of
+	// several relays.
 	Relay string
+	// Relays is the result per relay when reading from several relays.
+	Relays []RelayResult `json:",omitempty"`
 	// Time is the local time when performing the query.
 	Time uint64
 	// RequestIndex is the requested starting index in the query.
@@ -134,6 +217,15 @@ type Assessment struct {
 	// MissedBlocks is the number of missed blocks (see Description for details).
 	MissedBlocks uint64
 
+	// Tombstone is the tombstone of a retired policy, nil if still active.
+	Tombstone *steady.Tombstone `json:",omitempty"`
+
+	// Equivocations are proofs of the device signing different blocks with
+	// the same index: retained by relays, found by comparing blocks between
+	// relays and reads, or with the heads of other collectors (see
+	// Collector.ImportHead).
+	Equivocations []steady.Equivocation `json:",omitempty"`
+
 	// Blockheads is a map index->blockhead with the signed root of each block and
 	// associated data needed to verify the signature on the root. Use together with
 	// the path of each event from a valid block as a publicly verifiable proof of
@@ -141,6 +233,31 @@ type Assessment struct {
 	Blockheads map[uint64]BlockHead
 }
 
+// RelayResult is the result of reading from one of several relays, compared
+// to the union of the blocks of all relays.
+type RelayResult struct {
+	Relay string
+	// Err is the error reading from the relay, if any.
+	Err string `json:",omitempty"`
+	// Blocks is the number of blocks returned by the relay.
+	Blocks uint64
+	// Retired is true if the relay returned a tombstone.
+	Retired bool
+	// Missing are the indices of valid blocks that other relays returned,
+	// but not the relay.
+	Missing []uint64 `json:",omitempty"`
+	// Differ are the indices of blocks that differ from the blocks with the
+	// same index in the union.
+	Differ []uint64 `json:",omitempty"`
+	// Evicted are the indices of valid blocks that other relays returned, but
+	// that the relay must have removed to store its newer blocks within the
+	// space of the policy.
+	Evicted []uint64 `json:",omitempty"`
+	// Duplicate are the indices of blocks that the relay returned more than
+	// once.
+	Duplicate []uint64 `json:",omitempty"`
+}
+
 // CollectLoop is the main collect loop of the collector
 func (c *Collector) CollectLoop(state State, close chan struct{}, out Output) {
 	c.State = state
@@ -153,10 +270,10 @@ func (c *Collector) CollectLoop(state State, close chan struct{}, out Output) {
 		case <-ticker.C:
 		}
 
-		blocks, err := c.readFromRelay()
-		if err != nil {
-			out("warning", "", err.Error())
-			continue
+		reads := c.readFromRelays(out)
+		blocks, tombstone, ok := c.merge(reads)
+		if !ok {
+			continue // no relay replied
 		}
 
 		// group blocks into sorted list of:
@@ -170,7 +287,7 @@ func (c *Collector) CollectLoop(state State, close chan struct{}, out Output) {
 		}
 		assessment := &Assessment{
 			ID:              uint64(time.Now().UnixNano()),
-			Relay:           c.address,
+			Relay:           c.addresses(),
 			Time:            uint64(time.Now().Unix()),
 			RequestIndex:    c.State.Index,
 			TotalBlocks:     uint64(len(blocks)),
@@ -180,8 +297,19 @@ func (c *Collector) CollectLoop(state State, close chan struct{}, out Output) {
 			Blockheads:      make(map[uint64]BlockHead),
 			MissedBlocks:    missed,
 		}
+		if tombstone != nil {
+			t, err := steady.DecodeTombstone(tombstone, c.Config.Policy)
+			if err != nil {
+				newFinding(RedAssessment, fmt.Sprintf(tombstoneFormat, err), assessment)
+			} else {
+				assessment.Tombstone = &t
+			}
+		}
 
 		// create assessment by looking for findings to base the overall assessment on
+		c.crossCheck(reads, valid, assessment)
+		c.checkEquivocations(reads, invalid, assessment)
+		c.checkHeads(valid, assessment)
 		c.assess(valid, assessment)
 
 		// output all valid, invalid, and duplicate blocks with flags and link to assessment
@@ -203,53 +331,153 @@ func (c *Collector) CollectLoop(state State, close chan struct{}, out Output) {
 	}
 }
 
-func (c *Collector) readFromRelay() (blocks []Block, err error) {
+// relayRead is the result of reading from a relay.
+type relayRead struct {
+	blocks        []Block
+	tombstone     []byte
+	equivocations []steady.Equivocation
+	err           error
+}
+
+// readFromRelays reads from all relays, in the order of c.relays.
+func (c *Collector) readFromRelays(out Output) []relayRead {
+	reads := make([]relayRead, len(c.relays))
+	for i, r := range c.relays {
+		reads[i].blocks, reads[i].tombstone, reads[i].equivocations, reads[i].err =
+			r.read(c.Config.Policy, c.State.Index)
+		if err := reads[i].err; err != nil {
+			// the relay closes the connection on errors
+			var werr *steady.WireError
+			if errors.As(err, &werr) {
+				out("warning", werr, "%s: %s", r.address, err.Error())
+			} else {
+				out("warning", "", "%s: %s", r.address, err.Error())
+			}
+			if err = r.reconnect(); err != nil {
+				out("warning", "", "%s", err.Error())
+			}
+		}
+	}
+	return reads
+}
+
+// merge returns the union by index of the blocks read from relays, any
+// tombstone, and false if no relay replied. The blocks of a single relay are
+// returned as is. For blocks with the same index from several relays, the
+// first block with a valid payload is part of the union (see crossCheck).
+// Blocks that a relay returned more than once are kept as duplicates, as for
+// a single relay (see group).
+func (c *Collector) merge(reads []relayRead) (blocks []Block, tombstone []byte, ok bool) {
+	if len(reads) == 1 {
+		return reads[0].blocks, reads[0].tombstone, reads[0].err == nil
+	}
+	union := make(map[uint64]int) // index -> position in blocks
+	for _, read := range reads {
+		if read.err != nil {
+			continue
+		}
+		ok = true
+		returned := make(map[uint64]bool)
+		for _, b := range read.blocks {
+			index := b.BlockHeader.Index
+			i, exists := union[index]
+			switch {
+			case returned[index]:
+				blocks = append(blocks, b)
+			case !exists:
+				union[index] = len(blocks)
+				blocks = append(blocks, b)
+			case !steady.CheckPayloadHash(blocks[i].Payload, c.Config.Policy, blocks[i].BlockHeader) &&
+				steady.CheckPayloadHash(b.Payload, c.Config.Policy, b.BlockHeader):
+				blocks[i] = b
+			}
+			returned[index] = true
+		}
+		if tombstone == nil {
+			tombstone = read.tombstone
+		}
+	}
+	return
+}
+
+func sameBlock(a, b Block) bool {
+	return bytes.Equal(steady.EncodeBlockHeader(a.BlockHeader), steady.EncodeBlockHeader(b.BlockHeader)) &&
+		bytes.Equal(a.Payload, b.Payload)
+}
+
+func (c *Collector) addresses() string {
+	addresses := make([]string, 0, len(c.relays))
+	for _, r := range c.relays {
+		addresses = append(addresses, r.address)
+	}
+	return strings.Join(addresses, ",")
+}
+
+// read reads all blocks from index, any tombstone, and the equivocations
+// retained by the relay of a policy from the relay.
+func (r *relay) read(policy steady.Policy, from uint64) (blocks []Block, tombstone []byte,
+	equivocations []steady.Equivocation, err error) {
 	// send request
-	c.conn.Write([]byte{steady.WireVersion, steady.WireCmdRead})
-	c.conn.Write(c.Config.Policy.ID)
-	tmp := make([]byte, 8)
-	binary.BigEndian.PutUint64(tmp, c.State.Index)
-	c.conn.Write(tmp)
+	index := make([]byte, 8)
+	binary.BigEndian.PutUint64(index, from)
+	if err = steady.WriteFrame(r.conn, steady.WireCmdRead, policy.ID, index); err != nil {
+		return nil, nil, nil, err
+	}
 
-	// read number of blocks
-	if err = readn(tmp, 8, c.conn); err != nil {
-		return nil, err
+	// read the number of blocks and any tombstone, a *steady.WireError on failure
+	reply, err := steady.ReadReply(r.conn)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if reply.Type != steady.WireTrue ||
+		(len(reply.Payload) != 8+2 && len(reply.Payload) != 8+2+steady.WireTombstoneSize) {
+		return nil, nil, nil, fmt.Errorf("unexpected reply to read")
+	}
+	count := binary.BigEndian.Uint64(reply.Payload)
+	num := binary.BigEndian.Uint16(reply.Payload[8:])
+	if len(reply.Payload) > 8+2 {
+		tombstone = reply.Payload[8+2:]
 	}
-	count := binary.BigEndian.Uint64(tmp)
 
-	// get all blocks, one-by-one
+	// get all blocks, one frame per block
 	for i := uint64(0); i < count; i++ {
-		// read block header
-		buffer := make([]byte, steady.WireBlockHeaderSize)
-		if err = readn(buffer, steady.WireBlockHeaderSize, c.conn); err != nil {
-			return nil, err
+		f, err := steady.ReadReply(r.conn)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if f.Type != steady.WireMore || len(f.Payload) < steady.WireBlockHeaderSize {
+			return nil, nil, nil, fmt.Errorf("unexpected block frame")
 		}
-		bh, err := steady.DecodeBlockHeader(buffer, c.Config.Policy)
+		bh, err := steady.DecodeBlockHeader(f.Payload[:steady.WireBlockHeaderSize], policy)
 		if err != nil {
-			return nil, err
+			return nil, nil, nil, err
 		}
-		// read payload
-		buffer = make([]byte, int(bh.LenCur-steady.WireBlockHeaderSize))
-		if err = readn(buffer, int(bh.LenCur-steady.WireBlockHeaderSize), c.conn); err != nil {
-			return nil, err
+		if bh.LenCur != uint64(len(f.Payload)) {
+			return nil, nil, nil, fmt.Errorf("wrong block size, expected %d, got %d",
+				bh.LenCur, len(f.Payload))
 		}
 		blocks = append(blocks, Block{
 			BlockHeader: bh,
-			Payload:     buffer,
+			Payload:     f.Payload[steady.WireBlockHeaderSize:],
 		})
 	}
-	return
-}
 
-func readn(dst []byte, n int, conn net.Conn) error {
-	l, err := io.ReadFull(conn, dst)
-	if err != nil {
-		return fmt.Errorf("failed to read from conn: %v", err)
-	}
-	if l < n {
-		return fmt.Errorf("read %d bytes from conn, expected %d", l, n)
+	// get all equivocations, one frame per equivocation
+	for i := uint16(0); i < num; i++ {
+		f, err := steady.ReadReply(r.conn)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if f.Type != steady.WireMore {
+			return nil, nil, nil, fmt.Errorf("unexpected equivocation frame")
+		}
+		e, err := steady.DecodeEquivocation(f.Payload, policy)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("invalid equivocation: %v", err)
+		}
+		equivocations = append(equivocations, *e)
 	}
-	return nil
+	return
 }
 
 func (c *Collector) group(blocks []Block) (valid, invalid, duplicate []Block) {
@@ -284,17 +512,25 @@ func (c *Collector) group(blocks []Block) (valid, invalid, duplicate []Block) {
 // - len(valid) > 0 && valid[0].Index != state.Index
 // for each case we have specific checks to detect deletion
 func (c *Collector) assess(valid []Block, a *Assessment) {
+	// no more blocks are expected for a retired policy, so no timely check
+	retired := a.Tombstone != nil
 	if len(valid) == 0 {
 		// timely check relative to time in state
-		c.checkTimely(c.State.Time, a)
+		if !retired {
+			c.checkTimely(c.State.Time, a)
+		}
 	} else if valid[0].BlockHeader.Index == c.State.Index {
 		// timely check relative to last valid block
-		c.checkTimely(valid[len(valid)-1].BlockHeader.Time, a)
+		if !retired {
+			c.checkTimely(valid[len(valid)-1].BlockHeader.Time, a)
+		}
 		// sequence check
 		c.checkSequence(valid, a)
 	} else {
 		// timely check relative to last valid block
-		c.checkTimely(valid[len(valid)-1].BlockHeader.Time, a)
+		if !retired {
+			c.checkTimely(valid[len(valid)-1].BlockHeader.Time, a)
+		}
 		// sequence check
 		c.checkSequence(valid, a)
 		// size check
@@ -304,6 +540,9 @@ func (c *Collector) assess(valid []Block, a *Assessment) {
 			fmt.Sprintf(missedFormat, a.MissedBlocks,
 				a.Time-c.State.Time, c.Config.Policy.Space), a)
 	}
+	if retired {
+		c.checkRetired(valid, a)
+	}
 
 	// duplicate blocks
 	if a.DuplicateBlocks > 0 {
@@ -317,17 +556,167 @@ func (c *Collector) assess(valid []Block, a *Assessment) {
 	}
 
 	// set overall assessment
-	if len(a.Finding) == 0 {
-		a.Overall = GreenAssessment
-	} else {
-		a.Overall = YellowAssessment // yellow if no red
-		for i := 0; i < len(a.Finding); i++ {
-			if a.Finding[i].Label == RedAssessment {
-				a.Overall = RedAssessment
-				break // one red is enough
+	a.Overall = GreenAssessment
+	for i := 0; i < len(a.Finding); i++ {
+		if a.Finding[i].Label == RedAssessment {
+			a.Overall = RedAssessment
+			break // one red is enough
+		}
+		if a.Finding[i].Label == YellowAssessment {
+			a.Overall = YellowAssessment // yellow if no red
+		}
+	}
+}
+
+// checkRetired checks that the relay has all blocks up to the tombstone of a
+// retired policy: the relay only accepts a tombstone after the last block of
+// the device, which is never removed from the relay
+func (c *Collector) checkRetired(valid []Block, a *Assessment) {
+	next := c.State.Index
+	if len(valid) > 0 {
+		next = valid[len(valid)-1].BlockHeader.Index + 1
+	}
+	if next != a.Tombstone.Index {
+		newFinding(RedAssessment, fmt.Sprintf(retiredMissing, a.Tombstone.Index, next), a)
+		return
+	}
+	newFinding(GreenAssessment, fmt.Sprintf(retiredFormat, a.Tombstone.Index), a)
+}
+
+// crossCheck records the result of each relay and checks that each relay
+// that replied returned the same blocks as the union of all relays: relays
+// that return different blocks for the same index, or lack blocks that other
+// relays returned, are evil. The exceptions are a relay that lacks only the
+// newest blocks made less than timeout+delta ago, which may still be on their
+// way to the relay, and a relay that lacks blocks older than its oldest block
+// that it must have evicted (see evicted).
+func (c *Collector) crossCheck(reads []relayRead, valid []Block, a *Assessment) {
+	if len(c.relays) < 2 {
+		return
+	}
+	// the union has at most one block per index
+	union := make(map[uint64]Block, len(valid))
+	for _, b := range valid {
+		union[b.BlockHeader.Index] = b
+	}
+	for i, r := range c.relays {
+		result := RelayResult{Relay: r.address}
+		if reads[i].err != nil {
+			result.Err = reads[i].err.Error()
+			a.Relays = append(a.Relays, result)
+			newFinding(YellowAssessment, fmt.Sprintf(relayErrFormat, r.address, reads[i].err), a)
+			continue
+		}
+		result.Blocks = uint64(len(reads[i].blocks))
+		result.Retired = reads[i].tombstone != nil
+
+		has := make(map[uint64]bool)
+		var newest, oldest uint64 = 0, math.MaxUint64
+		for _, b := range reads[i].blocks {
+			index := b.BlockHeader.Index
+			if has[index] {
+				result.Duplicate = append(result.Duplicate, index)
+			}
+			has[index] = true
+			newest, oldest = max(newest, index), min(oldest, index)
+			if u, exists := union[index]; exists && !sameBlock(u, b) {
+				result.Differ = append(result.Differ, index)
+				c.equivocation(a, steady.EncodeBlockHeader(u.BlockHeader),
+					steady.EncodeBlockHeader(b.BlockHeader))
 			}
 		}
+		var lagging []uint64
+		for _, b := range valid {
+			index := b.BlockHeader.Index
+			if has[index] {
+				continue
+			}
+			switch {
+			case (len(reads[i].blocks) == 0 || index > newest) &&
+				a.Time < b.BlockHeader.Time+c.Config.Policy.Timeout+c.delta:
+				lagging = append(lagging, index)
+			case len(reads[i].blocks) > 0 && index < oldest && c.evicted(index, newest, union):
+				result.Evicted = append(result.Evicted, index)
+			default:
+				result.Missing = append(result.Missing, index)
+			}
+		}
+
+		if len(result.Differ) > 0 {
+			newFinding(RedAssessment, fmt.Sprintf(differFormat,
+				r.address, len(result.Differ), result.Differ[0]), a)
+		}
+		if len(result.Missing) > 0 {
+			newFinding(RedAssessment, fmt.Sprintf(missingFormat,
+				r.address, len(result.Missing), result.Missing[0]), a)
+		}
+		if len(lagging) > 0 {
+			newFinding(YellowAssessment, fmt.Sprintf(laggingFormat,
+				r.address, len(lagging), lagging[0]), a)
+		}
+		a.Relays = append(a.Relays, result)
+	}
+}
+
+// evicted returns true if a relay storing the block with index newest must
+// have removed the block with index: the relay removes its oldest blocks
+// while its blocks take more than the space of the policy
+func (c *Collector) evicted(index, newest uint64, union map[uint64]Block) bool {
+	var space uint64
+	for i := index; i <= newest; i++ {
+		if b, exists := union[i]; exists {
+			space += b.BlockHeader.LenCur
+		}
+	}
+	return space > c.Config.Policy.Space
+}
+
+// checkEquivocations checks for blocks signed by the device with the same
+// index as another block: equivocations retained by relays, and blocks with
+// an old index that differ from the block read before. Blocks that differ
+// between relays are checked by crossCheck.
+func (c *Collector) checkEquivocations(reads []relayRead, invalid []Block, a *Assessment) {
+	for _, read := range reads {
+		for _, e := range read.equivocations {
+			c.equivocation(a, e.A, e.B)
+		}
+	}
+	c.gossip.lock.Lock()
+	for _, b := range invalid {
+		if seen, ok := c.gossip.seen[b.BlockHeader.Index]; ok {
+			c.equivocation(a, seen, steady.EncodeBlockHeader(b.BlockHeader))
+		}
+	}
+	c.gossip.lock.Unlock()
+
+	first := -1
+	for i, e := range a.Equivocations {
+		if first < 0 || e.Index < a.Equivocations[first].Index {
+			first = i
+		}
 	}
+	if first >= 0 {
+		newFinding(RedAssessment, fmt.Sprintf(equivocateFormat,
+			len(a.Equivocations), a.Equivocations[first].Index), a)
+	}
+}
+
+// equivocation adds the equivocation of two encoded headers to the
+// assessment, unless the headers sign the same block or it is already known,
+// and returns true if added
+func (c *Collector) equivocation(a *Assessment, x, y []byte) bool {
+	e, err := steady.MakeEquivocation(c.Config.Policy, x, y)
+	if err != nil {
+		return false
+	}
+	for _, known := range a.Equivocations {
+		if (bytes.Equal(known.A, e.A) && bytes.Equal(known.B, e.B)) ||
+			(bytes.Equal(known.A, e.B) && bytes.Equal(known.B, e.A)) {
+			return false
+		}
+	}
+	a.Equivocations = append(a.Equivocations, *e)
+	return true
 }
 
 func (c *Collector) checkTimely(then uint64, a *Assessment) {
@@ -370,31 +759,47 @@ func (c *Collector) outputValid(ok []Block, out Output, a *Assessment) []Block {
 	remaining := make([]Block, 0)
 
 	for i := 0; i < len(ok); i++ {
-		events, iv, err := steady.DecodeBlockPayload(ok[i].Payload,
+		events, iv, history, err := steady.DecodeBlockPayloadHistory(ok[i].Payload,
 			c.Config.Pub, c.Config.Priv, c.Config.Policy, ok[i].BlockHeader)
 		if err != nil {
 			remaining = append(remaining, ok[i])
 			a.MissedBlocks++
 			continue
 		}
+		c.checkHistory(ok[i].BlockHeader, events, iv, history, a)
+		var first uint64 // the index of the first event in the history
+		if history != nil && history.Size >= uint64(len(events)) {
+			first = history.Size - uint64(len(events))
+		}
+		leaves := steady.EventLeaves(ok[i].BlockHeader.Version, events)
 		a.Blockheads[ok[i].BlockHeader.Index] = BlockHead{
 			BlockID:     ok[i].BlockHeader.Index,
 			PayloadHash: ok[i].BlockHeader.PayloadHash,
 			RootHash:    ok[i].BlockHeader.RootHash,
-			Root:        steady.MerkleTreeHash(events),
+			Root:        steady.MerkleTreeHash(leaves),
 			IV:          iv,
 			Signature:   ok[i].BlockHeader.Signature,
 			Time:        ok[i].BlockHeader.Time,
 			TreeSize:    uint64(len(events)),
+			Version:     ok[i].BlockHeader.Version,
+			History:     history.BlockHistory(),
+			Header:      steady.EncodeBlockHeader(ok[i].BlockHeader),
 		}
 
 		if events != nil {
 			for j := 0; j < len(events); j++ { // FIXME: make this concurrent
+				text, event := decodeEvent(events[j].Data)
 				out("verified", Proof{
 					AssessmentID: a.ID,
+					BlockID:      ok[i].BlockHeader.Index,
 					EventIndex:   j,
-					Path:         steady.AuditPath(j, events), // FIXME: make non-recursive
-				}, string(events[j]))
+					Path:         steady.AuditPath(j, leaves), // FIXME: make non-recursive
+					Time:         events[j].Time,
+					Seq:          events[j].Seq,
+					HistoryIndex: first + uint64(j),
+					Event:        event,
+					Data:         events[j].Data,
+				}, "%s", text)
 			}
 		}
 	}
@@ -410,17 +815,44 @@ func (c *Collector) outputBestEffort(b []Block, label string, out Output, a *Ass
 			out(label, Unverified{
 				AssessmentID: a.ID,
 				Description:  fmt.Sprintf("failed to decode block: %s", err),
-			}, string(b[i].Payload))
+			}, "%s", string(b[i].Payload))
 			continue
 		}
 		if events != nil {
 			for j := 0; j < len(events); j++ {
+				text, event := decodeEvent(events[j].Data)
 				out(label,
 					Unverified{
 						AssessmentID: a.ID,
 						Description:  "",
-					}, string(events[j]))
+						Event:        event,
+					}, "%s", text)
 			}
 		}
 	}
 }
+
+// Disclose decrypts a block and makes a disclosure of the events with the
+// given indices, verifiable by a third party with only the policy (see
+// steady.VerifyDisclosure).
+func (c *Config) Disclose(b Block, indices ...int) (*steady.Disclosure, error) {
+	events, iv, history, err := steady.DecodeBlockPayloadHistory(b.Payload,
+		c.Pub, c.Priv, c.Policy, b.BlockHeader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode block: %s", err)
+	}
+	return steady.MakeDisclosure(b.BlockHeader, events, iv, history.BlockHistory(), indices)
+}
+
+// decodeEvent decodes structured events, returning the text to output and the
+// structured event (if any)
+func decodeEvent(event []byte) (string, *steady.StructuredEvent) {
+	if !steady.IsStructuredEvent(event) {
+		return string(event), nil
+	}
+	e, err := steady.DecodeStructuredEvent(event)
+	if err != nil { // output as-is, text is untouched by collector
+		return string(event), nil
+	}
+	return e.String(), &e
+}
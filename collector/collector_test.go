@@ -0,0 +1,339 @@
+package collector
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pylls/steady"
+	"github.com/pylls/steady/lc"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCrossCheck(t *testing.T) {
+	vk, sk, _ := lc.SigningKeyGen()
+	pub, pk, _ := lc.EncryptKeyGen()
+	p := steady.MakePolicy(sk, vk, pub, 10, 1024*1024, 0)
+	c := &Collector{
+		relays: []*relay{{address: "a"}, {address: "b"}, {address: "c"}, {address: "d"}, {address: "e"}},
+		delta:  30,
+		Config: Config{Pub: pub, Priv: pk, Vk: vk, Policy: p},
+	}
+
+	now := uint64(time.Now().Unix())
+	block := func(index uint64, data string) Block {
+		encoded, err := steady.MakeEncodedBlock(index, 0, now, true, true, p,
+			[]steady.Event{{Time: now, Seq: index, Data: []byte(data)}}, sk)
+		assert.Nil(t, err, "failed to make block: %s", err)
+		bh, err := steady.DecodeBlockHeader(encoded[:steady.WireBlockHeaderSize], p)
+		assert.Nil(t, err, "failed to decode header: %s", err)
+		return Block{BlockHeader: bh, Payload: encoded[steady.WireBlockHeaderSize:]}
+	}
+	var blocks []Block
+	for i := uint64(0); i < 4; i++ {
+		blocks = append(blocks, block(i, fmt.Sprintf("event %d", i)))
+	}
+
+	fork := []Block{blocks[0], block(1, "fork"), blocks[2], blocks[3]}
+	reads := []relayRead{
+		{blocks: blocks},                        // a: all blocks
+		{blocks: []Block{blocks[0], blocks[3]}}, // b: withholds 1 and 2
+		{blocks: blocks[:2]},                    // c: lacks the recent blocks 2 and 3
+		{blocks: fork},                          // d: differs on 1
+		{err: fmt.Errorf("connection refused")}, // e: down
+	}
+	merged, _, ok := c.merge(reads)
+	assert.True(t, ok, "expected relays to reply")
+	assert.Len(t, merged, 4, "expected one block per index")
+	valid, invalid, duplicate := c.group(merged)
+	assert.Len(t, valid, 4, "expected all blocks to be valid")
+	assert.Empty(t, invalid, "expected no invalid blocks")
+	assert.Empty(t, duplicate, "expected no duplicate blocks")
+
+	a := &Assessment{Time: now}
+	c.crossCheck(reads, valid, a)
+	assert.Len(t, a.Relays, 5, "expected a result per relay")
+	assert.Empty(t, a.Relays[0].Missing, "expected a to have all blocks")
+	assert.Equal(t, []uint64{1, 2}, a.Relays[1].Missing, "expected b to withhold blocks")
+	assert.Empty(t, a.Relays[2].Missing, "expected c to lag")
+	assert.Equal(t, []uint64{1}, a.Relays[3].Differ, "expected d to differ")
+	assert.Equal(t, "connection refused", a.Relays[4].Err, "expected e to fail")
+
+	labels := make(map[string]int)
+	for _, f := range a.Finding {
+		labels[f.Label]++
+	}
+	assert.Equal(t, 2, labels[RedAssessment], "expected b and d to be evil")
+	assert.Equal(t, 2, labels[YellowAssessment], "expected c to lag and e to fail")
+
+	// the same blocks, made long ago, are missing
+	a = &Assessment{Time: now + p.Timeout + c.delta}
+	c.crossCheck(reads, valid, a)
+	assert.Equal(t, []uint64{2, 3}, a.Relays[2].Missing, "expected c to lack blocks")
+
+	// b evicted block 0 to store blocks 1 to 3 within the space of the policy,
+	// and a returned block 2 twice
+	c.relays = c.relays[:2]
+	reads = []relayRead{
+		{blocks: append(append([]Block{}, blocks...), blocks[2])},
+		{blocks: blocks[1:]},
+	}
+	merged, _, _ = c.merge(reads)
+	valid, _, duplicate = c.group(merged)
+	assert.Len(t, duplicate, 1, "expected the duplicate of a")
+	var space uint64
+	for _, b := range blocks[1:] {
+		space += b.BlockHeader.LenCur
+	}
+	c.Config.Policy.Space = space + blocks[0].BlockHeader.LenCur - 1
+	a = &Assessment{Time: now}
+	c.crossCheck(reads, valid, a)
+	assert.Equal(t, []uint64{2}, a.Relays[0].Duplicate, "expected a to return a duplicate")
+	assert.Equal(t, []uint64{0}, a.Relays[1].Evicted, "expected b to evict block 0")
+	assert.Empty(t, a.Relays[1].Missing, "expected b to lack no blocks")
+	assert.Empty(t, a.Finding, "expected no findings")
+
+	// with space for block 0, b withholds it
+	c.Config.Policy.Space++
+	a = &Assessment{Time: now}
+	c.crossCheck(reads, valid, a)
+	assert.Equal(t, []uint64{0}, a.Relays[1].Missing, "expected b to lack block 0")
+}
+
+func TestGossip(t *testing.T) {
+	vk, sk, _ := lc.SigningKeyGen()
+	pub, pk, _ := lc.EncryptKeyGen()
+	p := steady.MakePolicy(sk, vk, pub, 10, 1024*1024, 0)
+	c := &Collector{
+		relays: []*relay{{address: "a"}},
+		delta:  30,
+		Config: Config{Pub: pub, Priv: pk, Vk: vk, Policy: p},
+	}
+
+	now := uint64(time.Now().Unix())
+	block := func(index, time uint64, data string) Block {
+		encoded, err := steady.MakeEncodedBlock(index, 0, time, true, true, p,
+			[]steady.Event{{Time: time, Seq: index, Data: []byte(data)}}, sk)
+		assert.Nil(t, err, "failed to make block: %s", err)
+		bh, err := steady.DecodeBlockHeader(encoded[:steady.WireBlockHeaderSize], p)
+		assert.Nil(t, err, "failed to decode header: %s", err)
+		return Block{BlockHeader: bh, Payload: encoded[steady.WireBlockHeaderSize:]}
+	}
+	valid := []Block{block(0, now, "a"), block(1, now, "b")}
+	_, ok := c.Head()
+	assert.False(t, ok, "expected no head before reading")
+
+	// another collector was shown a fork at index 1, and a block we lack
+	fork := makeHead(p, block(1, now, "fork").BlockHeader)
+	ahead := makeHead(p, block(5, now-60, "ahead").BlockHeader)
+	assert.Nil(t, c.ImportHead(fork), "failed to import head")
+	assert.Nil(t, c.ImportHead(ahead), "failed to import head")
+	modified := fork
+	modified.Index = 2
+	assert.NotNil(t, c.ImportHead(modified), "imported head not matching its header")
+
+	a := &Assessment{Time: now}
+	c.checkHeads(valid, a)
+	head, ok := c.Head()
+	assert.True(t, ok, "expected a head")
+	assert.Equal(t, uint64(1), head.Index, "wrong head")
+	_, err := VerifyHead(head, p)
+	assert.Nil(t, err, "failed to verify head: %s", err)
+
+	assert.Len(t, a.Equivocations, 1, "expected a fork")
+	assert.Nil(t, steady.VerifyEquivocation(&a.Equivocations[0], p), "failed to verify equivocation")
+	assert.Len(t, a.Finding, 2, "expected the fork and the unseen head")
+	assert.Equal(t, RedAssessment, a.Finding[0].Label, "expected the fork to be evil")
+	assert.Equal(t, YellowAssessment, a.Finding[1].Label, "expected a warning for the unseen head")
+	assert.Len(t, c.gossip.imported, 1, "expected the unseen head to be kept")
+}
+
+func TestEquivocations(t *testing.T) {
+	vk, sk, _ := lc.SigningKeyGen()
+	pub, pk, _ := lc.EncryptKeyGen()
+	p := steady.MakePolicy(sk, vk, pub, 10, 1024*1024, 0)
+	c := &Collector{
+		relays: []*relay{{address: "a"}},
+		delta:  30,
+		Config: Config{Pub: pub, Priv: pk, Vk: vk, Policy: p},
+	}
+
+	now := uint64(time.Now().Unix())
+	header := func(index uint64, data string) []byte {
+		encoded, err := steady.MakeEncodedBlock(index, 0, now, true, true, p,
+			[]steady.Event{{Time: now, Seq: index, Data: []byte(data)}}, sk)
+		assert.Nil(t, err, "failed to make block: %s", err)
+		return encoded[:steady.WireBlockHeaderSize]
+	}
+	block := func(header []byte) Block {
+		bh, err := steady.DecodeBlockHeader(header, p)
+		assert.Nil(t, err, "failed to decode header: %s", err)
+		return Block{BlockHeader: bh}
+	}
+
+	// a previous run read blocks 0 and 1
+	h1 := header(1, "b")
+	c.checkHeads([]Block{block(header(0, "a")), block(h1)}, &Assessment{Time: now})
+	c.State.Index = 2
+
+	// the relay retained an equivocation on 1 and returns another block 0
+	retained, err := steady.MakeEquivocation(p, h1, header(1, "c"))
+	assert.Nil(t, err, "failed to make equivocation: %s", err)
+	reads := []relayRead{{equivocations: []steady.Equivocation{*retained, *retained}}}
+	a := &Assessment{Time: now}
+	c.checkEquivocations(reads, []Block{block(header(0, "other")), block(h1)}, a)
+	assert.Len(t, a.Equivocations, 2, "expected the retained and the old block")
+	for i := range a.Equivocations {
+		assert.Nil(t, steady.VerifyEquivocation(&a.Equivocations[i], p), "failed to verify equivocation")
+	}
+	assert.Equal(t, uint64(0), a.Equivocations[1].Index, "wrong index of old block")
+	assert.Len(t, a.Finding, 1, "expected a finding")
+	assert.Equal(t, RedAssessment, a.Finding[0].Label, "expected equivocations to be evil")
+}
+
+func TestHistory(t *testing.T) {
+	vk, sk, _ := lc.SigningKeyGen()
+	pub, pk, _ := lc.EncryptKeyGen()
+	p := steady.MakePolicy(sk, vk, pub, 10, 1024*1024, 0)
+	c := &Collector{Config: Config{Pub: pub, Priv: pk, Vk: vk, Policy: p}}
+
+	now := uint64(time.Now().Unix())
+	var h steady.History
+	block := func(index uint64, h *steady.History, data ...string) Block {
+		var events []steady.Event
+		for i, d := range data {
+			events = append(events, steady.Event{Time: now, Seq: index*10 + uint64(i), Data: []byte(d)})
+		}
+		encoded, err := steady.MakeEncodedHistoryBlock(index, 0, now, true, true, p, events, h, sk)
+		assert.Nil(t, err, "failed to make block: %s", err)
+		bh, err := steady.DecodeBlockHeader(encoded[:steady.WireBlockHeaderSize], p)
+		assert.Nil(t, err, "failed to decode header: %s", err)
+		return Block{BlockHeader: bh, Payload: encoded[steady.WireBlockHeaderSize:]}
+	}
+	var proofs []Proof
+	out := func(label string, meta interface{}, format string, args ...interface{}) {
+		if p, ok := meta.(Proof); ok {
+			proofs = append(proofs, p)
+		}
+	}
+	run := func(blocks ...Block) *Assessment {
+		a := &Assessment{Overall: GreenAssessment, Blockheads: make(map[uint64]BlockHead)}
+		assert.Empty(t, c.outputValid(blocks, out, a), "expected all blocks to be output")
+		return a
+	}
+
+	a := run(block(0, &h, "a", "b"), block(1, &h), block(2, &h, "c", "d", "e"))
+	assert.Equal(t, GreenAssessment, a.Overall, "expected the history to match")
+	assert.Len(t, proofs, 5, "expected a proof per event")
+	assert.Equal(t, uint64(3), proofs[3].HistoryIndex, "wrong history index")
+
+	// the first event is in the latest history, which extends the first
+	e := steady.Event{Time: proofs[0].Time, Seq: proofs[0].Seq, Data: proofs[0].Data}
+	inclusion, err := c.HistoryInclusion(proofs[0].HistoryIndex, e)
+	assert.Nil(t, err, "failed to prove inclusion: %s", err)
+	_, err = steady.VerifyHistoryInclusion(inclusion, p)
+	assert.Nil(t, err, "failed to verify inclusion: %s", err)
+	e.Data = []byte("x")
+	_, err = c.HistoryInclusion(proofs[0].HistoryIndex, e)
+	assert.NotNil(t, err, "proved inclusion of event not in history")
+	consistency, err := c.HistoryConsistency(0, 2)
+	assert.Nil(t, err, "failed to prove consistency: %s", err)
+	assert.Nil(t, steady.VerifyHistoryConsistency(consistency, p), "failed to verify consistency")
+
+	// the device starts over, then signs a history without its earlier events
+	h = steady.History{}
+	a = run(block(3, &h, "f"))
+	assert.Equal(t, YellowAssessment, a.Overall, "expected a restarted history")
+	h = steady.History{}
+	h.Append([][]byte{[]byte("not f")})
+	a = run(block(4, &h, "g"))
+	assert.Equal(t, RedAssessment, a.Overall, "expected a rewritten history")
+	_, err = c.HistoryConsistency(0, 2)
+	assert.NotNil(t, err, "proved consistency of history no longer read")
+
+	// a history kept in a file
+	filename := filepath.Join(t.TempDir(), "history")
+	state, err := c.SetHistoryFile(filename)
+	assert.Nil(t, err, "failed to set history file: %s", err)
+	assert.Nil(t, state, "resumed an empty history")
+	h, proofs = steady.History{}, nil
+	b5 := block(5, &h, "h", "i")
+	b6 := block(6, &h, "j")
+	a = run(b5, b6)
+	assert.Equal(t, GreenAssessment, a.Overall, "expected the history to match")
+	e = steady.Event{Time: proofs[1].Time, Seq: proofs[1].Seq, Data: proofs[1].Data}
+	inclusion, err = c.HistoryInclusion(proofs[1].HistoryIndex, e)
+	assert.Nil(t, err, "failed to prove inclusion: %s", err)
+	_, err = steady.VerifyHistoryInclusion(inclusion, p)
+	assert.Nil(t, err, "failed to verify inclusion: %s", err)
+	consistency, err = c.HistoryConsistency(5, 6)
+	assert.Nil(t, err, "failed to prove consistency: %s", err)
+	assert.Nil(t, steady.VerifyHistoryConsistency(consistency, p), "failed to verify consistency")
+	c.Close()
+
+	// resumed by another collector, which checks blocks read again
+	c = &Collector{Config: c.Config}
+	defer c.Close()
+	state, err = c.SetHistoryFile(filename)
+	assert.Nil(t, err, "failed to resume history: %s", err)
+	assert.Equal(t, &State{Index: 7, Time: now}, state, "wrong state to resume from")
+	a = run(b6, block(7, &h, "k"))
+	assert.Equal(t, GreenAssessment, a.Overall, "expected the history to match")
+	inclusion, err = c.HistoryInclusion(proofs[1].HistoryIndex, e)
+	assert.Nil(t, err, "failed to prove inclusion: %s", err)
+	_, err = steady.VerifyHistoryInclusion(inclusion, p)
+	assert.Nil(t, err, "failed to verify inclusion after resuming: %s", err)
+	consistency, err = c.HistoryConsistency(5, 7)
+	assert.Nil(t, err, "failed to prove consistency: %s", err)
+	assert.Nil(t, steady.VerifyHistoryConsistency(consistency, p), "failed to verify consistency")
+	other := steady.History{}
+	a = run(block(6, &other, "not j"))
+	assert.Equal(t, RedAssessment, a.Overall, "expected another history of a block read before")
+
+	// a collector starting from a later block trusts its history
+	c = &Collector{Config: c.Config}
+	proofs = nil
+	a = run(block(8, &h, "l", "m"), block(9, &h, "n"))
+	assert.Equal(t, GreenAssessment, a.Overall, "expected the history to match")
+	consistency, err = c.HistoryConsistency(8, 9)
+	assert.Nil(t, err, "failed to prove consistency: %s", err)
+	assert.Nil(t, steady.VerifyHistoryConsistency(consistency, p), "failed to verify consistency")
+	e = steady.Event{Time: proofs[2].Time, Seq: proofs[2].Seq, Data: proofs[2].Data}
+	inclusion, err = c.HistoryInclusion(proofs[2].HistoryIndex, e)
+	assert.Nil(t, err, "failed to prove inclusion: %s", err)
+	_, err = steady.VerifyHistoryInclusion(inclusion, p)
+	assert.Nil(t, err, "failed to verify inclusion: %s", err)
+	e = steady.Event{Time: proofs[0].Time, Seq: proofs[0].Seq, Data: proofs[0].Data}
+	_, err = c.HistoryInclusion(proofs[0].HistoryIndex, e)
+	assert.NotNil(t, err, "proved inclusion of event before the history read")
+	block(10, &h, "o") // missed
+	a = run(block(11, &h, "p"))
+	assert.Equal(t, GreenAssessment, a.Overall, "expected missed blocks to start over")
+	a = run(block(12, &h, "q"))
+	assert.Equal(t, GreenAssessment, a.Overall, "expected the history to match")
+}
+
+func TestOutputPercent(t *testing.T) {
+	vk, sk, _ := lc.SigningKeyGen()
+	pub, pk, _ := lc.EncryptKeyGen()
+	p := steady.MakePolicy(sk, vk, pub, 10, 1024*1024, 0)
+	c := &Collector{Config: Config{Pub: pub, Priv: pk, Vk: vk, Policy: p}}
+
+	now := uint64(time.Now().Unix())
+	var h steady.History
+	encoded, err := steady.MakeEncodedHistoryBlock(0, 0, now, true, true, p,
+		[]steady.Event{{Time: now, Data: []byte("disk 95% full")}}, &h, sk)
+	assert.Nil(t, err, "failed to make block: %s", err)
+	bh, err := steady.DecodeBlockHeader(encoded[:steady.WireBlockHeaderSize], p)
+	assert.Nil(t, err, "failed to decode header: %s", err)
+
+	var lines []Line
+	out := func(label string, meta interface{}, format string, args ...interface{}) {
+		lines = append(lines, MakeLine(p, label, meta, format, args...))
+	}
+	a := &Assessment{Overall: GreenAssessment, Blockheads: make(map[uint64]BlockHead)}
+	c.outputValid([]Block{{BlockHeader: bh, Payload: encoded[steady.WireBlockHeaderSize:]}}, out, a)
+	assert.Len(t, lines, 1, "expected a line per event")
+	assert.Equal(t, "disk 95% full", lines[0].Message, "wrong message")
+}
@@ -0,0 +1,172 @@
+package collector
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/pylls/steady"
+)
+
+/*
+ * A relay can show different collectors different histories (a split view),
+ * and the knowledge of each collector is local. Collectors therefore
+ * exchange (gossip) the latest valid block head each has seen, see
+ * Collector.Head and Collector.ImportHead. A collector compares imported
+ * heads with the blocks it read: two validly signed headers for the same
+ * index with different content is a fork, evil with an equivocation as proof
+ * (see steady.VerifyEquivocation). A head that the relays do not return
+ * within timeout+delta after it was made is a warning.
+ */
+
+// headWindow is the number of recent block headers a collector keeps to
+// compare with imported heads, older imported heads are ignored
+const headWindow = 1024
+
+// Head is the latest valid block head of a policy seen by a collector.
+type Head struct {
+	// ID is the ID of the policy.
+	ID                    []byte
+	Index, Time           uint64
+	HeaderHash, Signature []byte
+	// Header is the encoded block header, signed by the device, that the
+	// fields above are from.
+	Header []byte
+}
+
+// gossip is the state of the collector for gossip, under lock since heads are
+// imported while collecting
+type gossip struct {
+	lock sync.Mutex
+	head *Head
+	// seen are the encoded headers of recent valid blocks, by index
+	seen map[uint64][]byte
+	// imported are heads from other collectors not yet compared
+	imported []Head
+}
+
+// makeHead makes the head of a block
+func makeHead(policy steady.Policy, bh steady.BlockHeader) Head {
+	return Head{
+		ID:         policy.ID,
+		Index:      bh.Index,
+		Time:       bh.Time,
+		HeaderHash: bh.HeaderHash,
+		Signature:  bh.Signature,
+		Header:     steady.EncodeBlockHeader(bh),
+	}
+}
+
+// VerifyHead verifies that the header of a head is signed by the device of
+// the policy and matches the other fields of the head.
+func VerifyHead(h Head, policy steady.Policy) (steady.BlockHeader, error) {
+	if !bytes.Equal(h.ID, policy.ID) {
+		return steady.BlockHeader{}, fmt.Errorf("head for another policy")
+	}
+	bh, err := steady.DecodeBlockHeader(h.Header, policy)
+	if err != nil {
+		return steady.BlockHeader{}, err
+	}
+	if len(h.Header) != steady.WireBlockHeaderSize || bh.Index != h.Index || bh.Time != h.Time ||
+		!bytes.Equal(bh.HeaderHash, h.HeaderHash) || !bytes.Equal(bh.Signature, h.Signature) {
+		return steady.BlockHeader{}, fmt.Errorf("head does not match its header")
+	}
+	return bh, nil
+}
+
+// Head returns the latest valid block head seen by the collector, false if
+// the collector has yet to see a valid block.
+func (c *Collector) Head() (Head, bool) {
+	c.gossip.lock.Lock()
+	defer c.gossip.lock.Unlock()
+	if c.gossip.head == nil {
+		return Head{}, false
+	}
+	return *c.gossip.head, true
+}
+
+// ImportHead imports the head of another collector, compared with the blocks
+// read by the collector at its next run.
+func (c *Collector) ImportHead(h Head) error {
+	if _, err := VerifyHead(h, c.Config.Policy); err != nil {
+		return err
+	}
+	c.gossip.lock.Lock()
+	defer c.gossip.lock.Unlock()
+	for _, i := range c.gossip.imported {
+		if bytes.Equal(i.Header, h.Header) {
+			return nil
+		}
+	}
+	c.gossip.imported = append(c.gossip.imported, h)
+	return nil
+}
+
+// checkHeads remembers the headers of valid blocks and compares them with
+// imported heads, see gossip above
+func (c *Collector) checkHeads(valid []Block, a *Assessment) {
+	g := &c.gossip
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.seen == nil {
+		g.seen = make(map[uint64][]byte)
+	}
+	next := c.State.Index // the state after this run
+	for _, b := range valid {
+		g.seen[b.BlockHeader.Index] = steady.EncodeBlockHeader(b.BlockHeader)
+		next = b.BlockHeader.Index + 1
+	}
+	if len(valid) > 0 {
+		h := makeHead(c.Config.Policy, valid[len(valid)-1].BlockHeader)
+		g.head = &h
+	}
+	for index := range g.seen {
+		if index+headWindow < next {
+			delete(g.seen, index)
+		}
+	}
+
+	var pending []Head
+	for _, h := range g.imported {
+		if seen, ok := g.seen[h.Index]; ok {
+			if c.equivocation(a, seen, h.Header) {
+				newFinding(RedAssessment, fmt.Sprintf(forkFormat, h.Index), a)
+			}
+			continue
+		}
+		if h.Index < next {
+			continue // never read or too old to compare
+		}
+		if a.Time > h.Time+c.Config.Policy.Timeout+c.delta {
+			newFinding(YellowAssessment, fmt.Sprintf(unseenHeadFormat, h.Index, a.Time-h.Time), a)
+		}
+		pending = append(pending, h)
+	}
+	g.imported = pending
+}
+
+// WriteHead writes a head as JSON to a file, e.g., for other collectors to
+// import with ReadHead.
+func WriteHead(h Head, filename string) error {
+	b, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	tmp := filename + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+// ReadHead reads a head written by WriteHead.
+func ReadHead(filename string) (Head, error) {
+	var h Head
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return h, err
+	}
+	return h, json.Unmarshal(b, &h)
+}
@@ -0,0 +1,500 @@
+package collector
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/pylls/steady"
+	"github.com/pylls/steady/lc"
+)
+
+/*
+ * Blocks of steady.BlockVersionHistory commit to the history of the device:
+ * a Merkle tree over all events ever logged by the device (see
+ * steady.BlockHistory), and carry the compact history (see steady.History).
+ * The collector starts from the history of the first block it reads, trusting
+ * it, appends the events of each following block, and checks that the block
+ * commits to the result. After missed blocks, it starts over from the history
+ * of the next block read. With the tree, the collector proves that an event
+ * read is in the history committed to by the latest block (HistoryInclusion),
+ * and that the history committed to by a block read is a prefix of the history
+ * committed to by a later block (HistoryConsistency). For proofs, the
+ * collector keeps the hashes of all events and openings of all blocks read
+ * since it started, in memory up to maxHistoryMemory of each or in files (see
+ * SetHistoryFile), where they are kept across restarts.
+ */
+
+// history is the state of the collector for the history of the device, under
+// lock since proofs are made while collecting
+type history struct {
+	lock sync.Mutex
+	// compact is the history read so far, to check blocks, nil if none read
+	compact *steady.History
+	// latest is the index of the latest block read, if compact
+	latest uint64
+	// tree is the history read so far with the hashes of all events, and
+	// openings of the history committed to by the blocks read, to make
+	// proofs, nil if not kept (see treeErr)
+	tree     *steady.HistoryTree
+	openings *openings
+	treeErr  error
+	// file is where to keep the tree, in memory if empty (see SetHistoryFile)
+	file string
+}
+
+// maxHistoryMemory is the number of events in a history, and blocks, kept in
+// memory (32 MiB of hashes), a larger history has to be kept in a file
+const maxHistoryMemory = 1 << 20
+
+// SetHistoryFile keeps the hashes of the events in the history of the device
+// in a file instead of in memory, as needed to make proofs for a history of
+// more than maxHistoryMemory events or blocks, with the openings of the blocks
+// in FILE.blocks. A history kept in the file by an earlier collector is
+// resumed, returning the state to continue collecting from after its latest
+// block, nil if none. Set before collecting.
+func (c *Collector) SetHistoryFile(filename string) (*State, error) {
+	h := &c.history
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.reset()
+	h.file = filename
+
+	tree, err := steady.OpenHistoryTree(filename)
+	if err != nil {
+		return nil, err
+	}
+	o, err := openOpenings(filename + ".blocks")
+	if err != nil {
+		tree.Close()
+		return nil, err
+	}
+	latest, err := resume(tree, o)
+	var bh steady.BlockHeader
+	if err == nil && latest != nil {
+		bh, err = steady.DecodeBlockHeader(latest.Header, c.Config.Policy)
+		if err != nil { // of another policy, start over
+			latest, err = nil, nil
+		}
+	}
+	if err != nil || latest == nil {
+		o.close()
+		tree.Close()
+		return nil, err
+	}
+	compact := tree.History()
+	h.compact, h.latest, h.tree, h.openings = &compact, bh.Index, tree, o
+	return &State{Index: bh.Index + 1, Time: bh.Time}, nil
+}
+
+// resume returns the opening of the latest block read in the history kept in
+// the tree and openings, nil if none or they do not match
+func resume(tree *steady.HistoryTree, o *openings) (*steady.Disclosure, error) {
+	// drop openings of blocks not (fully) in the tree, e.g., on a crash
+	n := o.n
+	for ; n > 0; n-- {
+		d, err := o.get(o.first + n - 1)
+		if err != nil {
+			return nil, err
+		}
+		if d.History.Size <= tree.Size() {
+			break
+		}
+	}
+	if err := o.truncate(n); err != nil || n == 0 {
+		return nil, err
+	}
+	latest, err := o.get(o.first + n - 1)
+	if err != nil {
+		return nil, err
+	}
+	// drop events after the latest block, appended to the tree first
+	if tree.Truncate(latest.History.Size) != nil {
+		return nil, nil
+	}
+	if root, err := tree.Root(latest.History.Size); err != nil || !bytes.Equal(root, latest.History.Root) {
+		return nil, err
+	}
+	return latest, nil
+}
+
+// checkHistory checks the history committed to by a valid block with the
+// decoded events of the block, see history above
+func (c *Collector) checkHistory(bh steady.BlockHeader, events []steady.Event, iv []byte,
+	bhist *steady.History, a *Assessment) {
+	h := &c.history
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if bh.Version < steady.BlockVersionHistory {
+		h.reset()
+		return
+	}
+	d, err := steady.MakeDisclosure(bh, events, iv, bhist.BlockHistory(), nil)
+	if err != nil {
+		lateFinding(RedAssessment, fmt.Sprintf(historyFormat, bh.Index), a)
+		h.reset()
+		return
+	}
+	if h.compact != nil && bh.Index <= h.latest { // read before, e.g., when resumed
+		h.recheck(d, bh.Index, a)
+		return
+	}
+
+	leaves := steady.EventLeaves(bh.Version, events)
+	switch {
+	case h.compact != nil && bh.Index == h.latest+1 && bhist.Size == h.compact.Size+uint64(len(leaves)):
+		// continues the history read so far
+	case bhist.Size == uint64(len(leaves)): // starts the history
+		if h.compact != nil && h.compact.Size > 0 {
+			lateFinding(YellowAssessment, fmt.Sprintf(historyRestartFormat, bh.Index, h.compact.Size), a)
+		}
+		h.restart(steady.History{})
+	case h.compact != nil && bh.Index == h.latest+1:
+		lateFinding(RedAssessment, fmt.Sprintf(historyFormat, bh.Index), a)
+		h.restart(*bhist)
+		leaves = nil
+	case h.compact != nil && bhist.Size < h.compact.Size: // restarted in missed blocks
+		lateFinding(YellowAssessment, fmt.Sprintf(historyRestartFormat, bh.Index, h.compact.Size), a)
+		h.restart(*bhist)
+		leaves = nil
+	default: // the first block read, or after missed blocks
+		h.restart(*bhist)
+		leaves = nil
+	}
+
+	h.compact.Append(leaves)
+	if !bytes.Equal(h.compact.Root(), d.History.Root) {
+		lateFinding(RedAssessment, fmt.Sprintf(historyFormat, bh.Index), a)
+		h.restart(*bhist)
+		leaves = nil
+	}
+	h.latest = bh.Index
+	h.appendTree(leaves, d)
+}
+
+// recheck checks the history committed to by a block read before against its
+// opening, if kept, must hold lock
+func (h *history) recheck(d *steady.Disclosure, index uint64, a *Assessment) {
+	if h.openings == nil {
+		return
+	}
+	o, err := h.openings.get(index)
+	if err != nil { // read before the history was kept
+		return
+	}
+	if o.History.Size != d.History.Size || !bytes.Equal(o.History.Root, d.History.Root) {
+		lateFinding(RedAssessment, fmt.Sprintf(historyChangedFormat, index), a)
+	}
+}
+
+// restart starts reading the history from a history, must hold lock
+func (h *history) restart(start steady.History) {
+	h.closeTree(nil)
+	compact := steady.History{Size: start.Size, Subtrees: append([][]byte{}, start.Subtrees...)}
+	h.compact = &compact
+	if h.file == "" {
+		h.tree, h.openings = steady.NewHistoryTree(start), &openings{}
+		return
+	}
+	// the openings first, such that no opening is of another tree, see resume
+	o, err := createOpenings(h.file + ".blocks")
+	if err != nil {
+		h.closeTree(fmt.Errorf("failed to keep history of the device: %v", err))
+		return
+	}
+	tree, err := steady.CreateHistoryTree(h.file, start)
+	if err != nil {
+		o.close()
+		h.closeTree(fmt.Errorf("failed to keep history of the device: %v", err))
+		return
+	}
+	h.tree, h.openings = tree, o
+}
+
+// reset stops reading the history, must hold lock
+func (h *history) reset() {
+	h.compact = nil
+	h.closeTree(nil)
+}
+
+// appendTree appends leaves to the tree and the opening of their block, if
+// kept, must hold lock
+func (h *history) appendTree(leaves [][]byte, d *steady.Disclosure) {
+	if h.tree == nil {
+		return
+	}
+	err := h.tree.Append(leaves)
+	if err == nil {
+		err = h.openings.append(d)
+	}
+	if err != nil {
+		h.closeTree(fmt.Errorf("failed to keep history of the device: %v", err))
+	} else if h.file == "" && (h.tree.Size() > maxHistoryMemory || h.openings.n > maxHistoryMemory) {
+		h.closeTree(fmt.Errorf("history of the device too large to keep in memory, see SetHistoryFile"))
+	}
+}
+
+// closeTree stops keeping the tree for err, must hold lock
+func (h *history) closeTree(err error) {
+	if h.tree != nil {
+		h.tree.Close()
+		h.openings.close()
+	}
+	h.tree, h.openings, h.treeErr = nil, nil, err
+}
+
+// proofs returns an error if the collector cannot make proofs, must hold lock
+func (h *history) proofs() error {
+	switch {
+	case h.compact == nil:
+		return fmt.Errorf("no history of the device read")
+	case h.tree == nil:
+		return h.treeErr
+	}
+	return nil
+}
+
+// eventBlock returns the opening of the block read with the event with index
+// in the history, must hold lock
+func (h *history) eventBlock(index uint64) (*steady.Disclosure, error) {
+	o := h.openings
+	var err error
+	i := sort.Search(int(o.n), func(i int) bool {
+		d, e := o.get(o.first + uint64(i))
+		if e != nil {
+			err = e
+			return true
+		}
+		return d.History.Size > index
+	})
+	if err != nil {
+		return nil, err
+	}
+	if i == int(o.n) {
+		return nil, fmt.Errorf("event with index %d not in the history", index)
+	}
+	d, err := o.get(o.first + uint64(i))
+	if err != nil {
+		return nil, err
+	}
+	if index < d.History.Size-d.TreeSize {
+		return nil, fmt.Errorf("event with index %d before the blocks read", index)
+	}
+	return d, nil
+}
+
+// lateFinding is newFinding for findings made after the overall assessment
+func lateFinding(label, desc string, a *Assessment) {
+	newFinding(label, desc, a)
+	if label == RedAssessment || a.Overall == GreenAssessment {
+		a.Overall = label
+	}
+}
+
+// HistoryInclusion proves that the event with index in the history of the
+// device is in the history committed to by the latest block read by the
+// collector. The collector only keeps the hashes of events, so the event is
+// given, e.g., from the output of the collector (see Proof.HistoryIndex).
+func (c *Collector) HistoryInclusion(index uint64, e steady.Event) (*steady.HistoryInclusion, error) {
+	h := &c.history
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if err := h.proofs(); err != nil {
+		return nil, err
+	}
+	latest, err := h.openings.get(h.latest)
+	if err != nil {
+		return nil, err
+	}
+	// the leaf of the event as committed to by its block
+	d, err := h.eventBlock(index)
+	if err != nil {
+		return nil, err
+	}
+	bh, err := steady.DecodeBlockHeader(d.Header, c.Config.Policy)
+	if err != nil {
+		return nil, err
+	}
+	ok, err := h.tree.Contains(index, steady.EventLeaf(bh.Version, e))
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("event with index %d not in the history", index)
+	}
+	path, err := h.tree.AuditPath(index, latest.History.Size)
+	if err != nil {
+		return nil, err
+	}
+	return &steady.HistoryInclusion{
+		Block: *latest,
+		Index: index,
+		Event: e,
+		Path:  path,
+	}, nil
+}
+
+// HistoryConsistency proves that the history committed to by the block with
+// index older is a prefix of the history committed to by the block with index
+// newer.
+func (c *Collector) HistoryConsistency(older, newer uint64) (*steady.HistoryConsistency, error) {
+	h := &c.history
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if err := h.proofs(); err != nil {
+		return nil, err
+	}
+	if older > newer {
+		return nil, fmt.Errorf("block %d is after block %d", older, newer)
+	}
+	o, err := h.openings.get(older)
+	if err != nil {
+		return nil, err
+	}
+	n, err := h.openings.get(newer)
+	if err != nil {
+		return nil, err
+	}
+	proof, err := h.tree.ConsistencyProof(o.History.Size, n.History.Size)
+	if err != nil {
+		return nil, err
+	}
+	return &steady.HistoryConsistency{
+		Older: *o,
+		Newer: *n,
+		Proof: proof,
+	}, nil
+}
+
+// openings open the history committed to by consecutive blocks, each encoded
+// in openingSize bytes (see encodeOpening), in memory or in a file
+type openings struct {
+	// first is the index of the first block, n the number of blocks
+	first, n uint64
+	memory   []byte
+	file     *os.File
+}
+
+// openingSize is the size of an encoded opening: the header, IV, root, number
+// of events, and history of a block
+const openingSize = steady.WireBlockHeaderSize + steady.IVsize + lc.HashOutputLen + 8 +
+	8 + lc.HashOutputLen
+
+// createOpenings makes no openings kept in a file, truncating the file if it
+// exists
+func createOpenings(filename string) (*openings, error) {
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &openings{file: f}, nil
+}
+
+// openOpenings opens the openings kept in a file, created if missing. An
+// opening only partly written, e.g., on a crash, is dropped.
+func openOpenings(filename string) (*openings, error) {
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	o := &openings{file: f, n: uint64(info.Size()) / openingSize}
+	err = o.truncate(o.n)
+	if err == nil && o.n > 0 {
+		b := make([]byte, 8) // the index in the header of the first block
+		if _, err = f.ReadAt(b, 0); err == nil {
+			o.first = binary.BigEndian.Uint64(b)
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return o, nil
+}
+
+// append appends the opening of the block after the latest, if any
+func (o *openings) append(d *steady.Disclosure) error {
+	b := encodeOpening(d)
+	if o.n == 0 {
+		o.first = binary.BigEndian.Uint64(d.Header)
+	}
+	if o.file != nil {
+		if _, err := o.file.WriteAt(b, int64(o.n*openingSize)); err != nil {
+			return err
+		}
+	} else {
+		o.memory = append(o.memory, b...)
+	}
+	o.n++
+	return nil
+}
+
+// get returns the opening of the block with index
+func (o *openings) get(index uint64) (*steady.Disclosure, error) {
+	if index < o.first || index >= o.first+o.n {
+		return nil, fmt.Errorf("no history read for block %d", index)
+	}
+	offset := (index - o.first) * openingSize
+	if o.file == nil {
+		return decodeOpening(o.memory[offset : offset+openingSize]), nil
+	}
+	b := make([]byte, openingSize)
+	if _, err := o.file.ReadAt(b, int64(offset)); err != nil {
+		return nil, err
+	}
+	return decodeOpening(b), nil
+}
+
+// truncate keeps the first n openings
+func (o *openings) truncate(n uint64) error {
+	if o.file != nil {
+		if err := o.file.Truncate(int64(n * openingSize)); err != nil {
+			return err
+		}
+	} else {
+		o.memory = o.memory[:n*openingSize]
+	}
+	o.n = n
+	return nil
+}
+
+// close closes the file of the openings, if any
+func (o *openings) close() {
+	if o.file != nil {
+		o.file.Close()
+	}
+}
+
+func encodeOpening(d *steady.Disclosure) []byte {
+	b := make([]byte, 0, openingSize)
+	b = append(b, d.Header...)
+	b = append(b, d.IV...)
+	b = append(b, d.Root...)
+	b = binary.BigEndian.AppendUint64(b, d.TreeSize)
+	b = binary.BigEndian.AppendUint64(b, d.History.Size)
+	return append(b, d.History.Root...)
+}
+
+func decodeOpening(b []byte) *steady.Disclosure {
+	iv := b[steady.WireBlockHeaderSize:]
+	root := iv[steady.IVsize:]
+	sizes := root[lc.HashOutputLen:]
+	return &steady.Disclosure{
+		Header:   append([]byte{}, b[:steady.WireBlockHeaderSize]...),
+		IV:       append([]byte{}, iv[:steady.IVsize]...),
+		Root:     append([]byte{}, root[:lc.HashOutputLen]...),
+		TreeSize: binary.BigEndian.Uint64(sizes),
+		History: &steady.BlockHistory{
+			Size: binary.BigEndian.Uint64(sizes[8:]),
+			Root: append([]byte{}, sizes[16:16+lc.HashOutputLen]...),
+		},
+	}
+}
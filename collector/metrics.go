@@ -0,0 +1,53 @@
+package collector
+
+import (
+	"encoding/hex"
+
+	"github.com/pylls/steady"
+	"github.com/pylls/steady/metrics"
+)
+
+// Metrics are the metrics of one or more collectors, see Output.
+type Metrics struct {
+	assessments, events, blocks, warnings, last *metrics.Metric
+}
+
+// NewMetrics adds collector metrics to a registry.
+func NewMetrics(r *metrics.Registry) *Metrics {
+	return &Metrics{
+		assessments: r.Counter("steady_collector_assessments_total",
+			"Number of assessments by overall assessment."),
+		events: r.Counter("steady_collector_events_total",
+			"Number of events by label (verified, unverified, invalid, or duplicate)."),
+		blocks: r.Counter("steady_collector_blocks_total",
+			"Number of blocks in assessments by kind (valid, invalid, duplicate, or missed)."),
+		warnings: r.Counter("steady_collector_warnings_total",
+			"Number of warnings, e.g., failures to read from the relay."),
+		last: r.Gauge("steady_collector_last_assessment_timestamp_seconds",
+			"Time of the latest assessment."),
+	}
+}
+
+// Output returns an output that updates the metrics for a policy.
+func (m *Metrics) Output(policy steady.Policy) Output {
+	id := hex.EncodeToString(policy.ID)
+	return func(label string, meta interface{}, format string, args ...interface{}) {
+		switch label {
+		case "verified", "unverified", "invalid", "duplicate":
+			m.events.Inc("policy", id, "label", label)
+		case "warning":
+			m.warnings.Inc("policy", id)
+		case "assessment":
+			a, ok := meta.(*Assessment)
+			if !ok {
+				return
+			}
+			m.assessments.Inc("policy", id, "overall", a.Overall)
+			m.blocks.Add(float64(a.ValidBlocks), "policy", id, "kind", "valid")
+			m.blocks.Add(float64(a.InvalidBlocks), "policy", id, "kind", "invalid")
+			m.blocks.Add(float64(a.DuplicateBlocks), "policy", id, "kind", "duplicate")
+			m.blocks.Add(float64(a.MissedBlocks), "policy", id, "kind", "missed")
+			m.last.Set(float64(a.Time), "policy", id)
+		}
+	}
+}
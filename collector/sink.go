@@ -0,0 +1,215 @@
+package collector
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pylls/steady"
+)
+
+// Line is the output of a collector as written by sinks, one per line.
+type Line struct {
+	// Time is the local time when the line was written.
+	Time uint64
+	// Label is the label of the output (see Output).
+	Label string
+	// AssessmentID links the line to an assessment, zero if none.
+	AssessmentID uint64
+	// Policy is the hex-encoded ID of the policy.
+	Policy string
+	// Message is the formatted output, e.g., the event.
+	Message string
+	// Meta is the meta output: a Proof, Unverified, or Assessment.
+	Meta interface{} `json:",omitempty"`
+}
+
+// Tee returns an output that outputs to all outs.
+func Tee(outs ...Output) Output {
+	return func(label string, meta interface{}, format string, args ...interface{}) {
+		for _, out := range outs {
+			out(label, meta, format, args...)
+		}
+	}
+}
+
+// MakeLine makes a line of output for a policy.
+func MakeLine(policy steady.Policy, label string, meta interface{},
+	format string, args ...interface{}) Line {
+	if s, ok := meta.(string); ok && s == "" { // no meta
+		meta = nil
+	}
+	return Line{
+		Time:         uint64(time.Now().Unix()),
+		Label:        label,
+		AssessmentID: assessmentID(meta),
+		Policy:       hex.EncodeToString(policy.ID),
+		Message:      fmt.Sprintf(format, args...),
+		Meta:         meta,
+	}
+}
+
+func assessmentID(meta interface{}) uint64 {
+	switch m := meta.(type) {
+	case Proof:
+		return m.AssessmentID
+	case Unverified:
+		return m.AssessmentID
+	case *Assessment:
+		return m.ID
+	default:
+		return 0
+	}
+}
+
+// JSONLinesSink writes all output as JSON lines (see Line) to a file that is
+// rotated when it grows too large.
+type JSONLinesSink struct {
+	policy steady.Policy
+	lock   sync.Mutex
+	file   *rotatingFile
+	err    error
+}
+
+// NewJSONLinesSink creates a sink writing to filename. Once the file is larger
+// than maxSize bytes, it is rotated to filename.1, filename.1 to filename.2,
+// and so on, keeping at most maxFiles rotated files. A zero maxSize never
+// rotates.
+func NewJSONLinesSink(filename string, policy steady.Policy,
+	maxSize int64, maxFiles int) (*JSONLinesSink, error) {
+	f, err := openRotatingFile(filename, maxSize, maxFiles)
+	if err != nil {
+		return nil, err
+	}
+	return &JSONLinesSink{
+		policy: policy,
+		file:   f,
+	}, nil
+}
+
+// NewDirSink creates a JSON lines sink writing to a directory per policy,
+// dir/<hex-encoded policy ID>/events.jsonl, see NewJSONLinesSink.
+func NewDirSink(dir string, policy steady.Policy,
+	maxSize int64, maxFiles int) (*JSONLinesSink, error) {
+	dir = filepath.Join(dir, hex.EncodeToString(policy.ID))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return NewJSONLinesSink(filepath.Join(dir, "events.jsonl"), policy, maxSize, maxFiles)
+}
+
+// Output writes the output as a line, see Output.
+func (s *JSONLinesSink) Output(label string, meta interface{}, format string, args ...interface{}) {
+	b, err := json.Marshal(MakeLine(s.policy, label, meta, format, args...))
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err == nil {
+		err = s.file.write(append(b, '\n'))
+	}
+	if err != nil && s.err == nil {
+		s.err = err
+	}
+}
+
+// Err returns the first error when writing, if any.
+func (s *JSONLinesSink) Err() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.err
+}
+
+// Close closes the underlying file.
+func (s *JSONLinesSink) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.file.close()
+}
+
+// rotatingFile is a file that is rotated when larger than maxSize
+type rotatingFile struct {
+	filename string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+func openRotatingFile(filename string, maxSize int64, maxFiles int) (*rotatingFile, error) {
+	r := &rotatingFile{
+		filename: filename,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+	return r, r.open()
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.file = f
+	r.size = fi.Size()
+	return nil
+}
+
+// write writes b, rotating the file first if it would grow too large. If
+// rotation fails, b is still written to the (reopened) file.
+func (r *rotatingFile) write(b []byte) error {
+	var rerr error
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(b)) > r.maxSize {
+		rerr = r.rotate()
+	}
+	if r.file == nil { // closed by a failed rotation
+		if err := r.open(); err != nil {
+			return err
+		}
+	}
+	n, err := r.file.Write(b)
+	r.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return rerr
+}
+
+// rotate rotates and reopens the file, on failure the file is reopened as-is
+// if possible, such that later writes do not fail
+func (r *rotatingFile) rotate() error {
+	err := r.file.Close()
+	r.file = nil
+	if err == nil {
+		err = r.shift()
+	}
+	if oerr := r.open(); err == nil {
+		err = oerr
+	}
+	return err
+}
+
+// shift shifts filename.i to filename.i+1, dropping the oldest
+func (r *rotatingFile) shift() error {
+	for i := r.maxFiles - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", r.filename, i), fmt.Sprintf("%s.%d", r.filename, i+1))
+	}
+	if r.maxFiles > 0 {
+		return os.Rename(r.filename, r.filename+".1")
+	}
+	return os.Remove(r.filename)
+}
+
+func (r *rotatingFile) close() error {
+	if r.file == nil {
+		return nil
+	}
+	return r.file.Close()
+}
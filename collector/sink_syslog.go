@@ -0,0 +1,71 @@
+//go:build !windows && !plan9
+
+package collector
+
+import (
+	"fmt"
+	"log/syslog"
+
+	"github.com/pylls/steady"
+)
+
+// SyslogSink forwards verified events to syslog, with the label, assessment
+// ID, and policy ID in front of each message.
+type SyslogSink struct {
+	policy steady.Policy
+	writer *syslog.Writer
+}
+
+// NewSyslogSink creates a sink forwarding to the local syslog daemon with the
+// given tag, see syslog.New.
+func NewSyslogSink(policy steady.Policy, tag string) (*SyslogSink, error) {
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_USER, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &SyslogSink{
+		policy: policy,
+		writer: w,
+	}, nil
+}
+
+// Output forwards verified events, see Output.
+func (s *SyslogSink) Output(label string, meta interface{}, format string, args ...interface{}) {
+	if label != "verified" {
+		return
+	}
+	msg, severity := syslogMessage(MakeLine(s.policy, label, meta, format, args...))
+	switch severity {
+	case 0:
+		s.writer.Emerg(msg)
+	case 1:
+		s.writer.Alert(msg)
+	case 2:
+		s.writer.Crit(msg)
+	case 3:
+		s.writer.Err(msg)
+	case 4:
+		s.writer.Warning(msg)
+	case 5:
+		s.writer.Notice(msg)
+	case 7:
+		s.writer.Debug(msg)
+	default:
+		s.writer.Info(msg)
+	}
+}
+
+// syslogMessage returns the message of a line and its severity, keeping the
+// severity of structured events
+func syslogMessage(l Line) (string, uint8) {
+	msg := fmt.Sprintf("[%s assessment=%d policy=%s] %s", l.Label, l.AssessmentID, l.Policy, l.Message)
+	if p, ok := l.Meta.(Proof); ok && p.Event != nil {
+		return msg, p.Event.Severity
+	}
+	return msg, 6
+}
+
+// Close closes the connection to syslog.
+func (s *SyslogSink) Close() error {
+	return s.writer.Close()
+}
@@ -0,0 +1,19 @@
+//go:build !windows && !plan9
+
+package collector
+
+import (
+	"testing"
+
+	"github.com/pylls/steady"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSyslogMessage(t *testing.T) {
+	msg, severity := syslogMessage(Line{Label: "verified", AssessmentID: 7, Policy: "ab", Message: "hello"})
+	assert.Equal(t, "[verified assessment=7 policy=ab] hello", msg, "wrong message")
+	assert.Equal(t, uint8(6), severity, "wrong default severity")
+
+	_, severity = syslogMessage(Line{Meta: Proof{Event: &steady.StructuredEvent{Severity: 3}}})
+	assert.Equal(t, uint8(3), severity, "severity of structured event not kept")
+}
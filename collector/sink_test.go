@@ -0,0 +1,101 @@
+package collector
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pylls/steady"
+	"github.com/pylls/steady/lc"
+	"github.com/stretchr/testify/assert"
+)
+
+func readLines(t *testing.T, filename string) []Line {
+	f, err := os.Open(filename)
+	assert.Nil(t, err, "failed to open %s: %v", filename, err)
+	defer f.Close()
+	var lines []Line
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var l Line
+		assert.Nil(t, json.Unmarshal(scanner.Bytes(), &l), "invalid line %s", scanner.Text())
+		lines = append(lines, l)
+	}
+	return lines
+}
+
+func TestDirSink(t *testing.T) {
+	vk, sk, _ := lc.SigningKeyGen()
+	pub, _, _ := lc.EncryptKeyGen()
+	p := steady.MakePolicy(sk, vk, pub, 10, 1024*1024, 0)
+	dir := t.TempDir()
+	s, err := NewDirSink(dir, p, 0, 0)
+	assert.Nil(t, err, "failed to create sink: %v", err)
+
+	s.Output("assessment", &Assessment{ID: 7, Overall: GreenAssessment}, "done")
+	s.Output("verified", Proof{AssessmentID: 7}, "event %d", 1)
+	s.Output("unverified", Unverified{AssessmentID: 8}, "event %d", 2)
+	s.Output("info", "", "no meta")
+	assert.Nil(t, s.Err(), "failed to write: %v", s.Err())
+	assert.Nil(t, s.Close(), "failed to close")
+
+	lines := readLines(t, filepath.Join(dir, hex.EncodeToString(p.ID), "events.jsonl"))
+	assert.True(t, len(lines) == 4, "wrong number of lines, got %d", len(lines))
+	if len(lines) != 4 {
+		return
+	}
+	for i, expected := range []struct {
+		label   string
+		id      uint64
+		message string
+	}{{"assessment", 7, "done"}, {"verified", 7, "event 1"}, {"unverified", 8, "event 2"}, {"info", 0, "no meta"}} {
+		assert.Equal(t, expected.label, lines[i].Label, "wrong label")
+		assert.Equal(t, expected.id, lines[i].AssessmentID, "wrong assessment ID")
+		assert.Equal(t, expected.message, lines[i].Message, "wrong message")
+		assert.Equal(t, hex.EncodeToString(p.ID), lines[i].Policy, "wrong policy")
+	}
+	assert.Nil(t, lines[3].Meta, "unexpected meta")
+}
+
+func TestRotatingFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "out")
+	r, err := openRotatingFile(filename, 4, 2)
+	assert.Nil(t, err, "failed to open: %v", err)
+	for i := 0; i < 4; i++ {
+		assert.Nil(t, r.write([]byte(fmt.Sprintf("%d\n", i))), "failed to write")
+		assert.Nil(t, r.write([]byte(fmt.Sprintf("%d\n", i))), "failed to write")
+	}
+	// rotated three times, keeping the two latest rotated files
+	for file, expected := range map[string]string{
+		filename: "3\n3\n", filename + ".1": "2\n2\n", filename + ".2": "1\n1\n"} {
+		b, err := ioutil.ReadFile(file)
+		assert.Nil(t, err, "failed to read %s: %v", file, err)
+		assert.Equal(t, expected, string(b), "wrong content in %s", file)
+	}
+	_, err = os.Stat(filename + ".3")
+	assert.True(t, os.IsNotExist(err), "kept too many files")
+
+	// a failed rotation still writes, and later rotations work again
+	assert.Nil(t, os.Remove(filename+".1"), "failed to remove")
+	assert.Nil(t, os.MkdirAll(filepath.Join(filename+".1", "blocker"), 0700), "failed to mkdir")
+	assert.NotNil(t, r.write([]byte("4\n")), "rotated onto a directory")
+	assert.Nil(t, os.RemoveAll(filename+".1"), "failed to remove")
+	assert.Nil(t, r.write([]byte("5\n")), "failed to write after failed rotation")
+	b, err := ioutil.ReadFile(filename + ".1")
+	assert.Nil(t, err, "failed to read: %v", err)
+	assert.Equal(t, "3\n3\n4\n", string(b), "lost line in failed rotation")
+	assert.Nil(t, r.close(), "failed to close")
+
+	// without rotated files, the file is truncated on rotation
+	r, err = openRotatingFile(filename, 4, 0)
+	assert.Nil(t, err, "failed to open: %v", err)
+	assert.Nil(t, r.write([]byte("66\n")), "failed to write")
+	assert.Nil(t, r.close(), "failed to close")
+	b, _ = ioutil.ReadFile(filename)
+	assert.Equal(t, "66\n", string(b), "not truncated")
+}
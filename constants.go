@@ -8,24 +8,111 @@ const (
 	SetupFilename       = "%s.device"
 	DeviceStateFilename = "%s.state"
 	CollectorFilename   = "%s.collector"
+	// SpoolDirname is where a device writing to several relays keeps blocks
+	// until all relays have ACKed them.
+	SpoolDirname = "%s.spool"
+	// ReceiptsFilename is where a device keeps the receipts of relays for
+	// written blocks.
+	ReceiptsFilename = "%s.receipts"
+	// HistoryFilename is where a device keeps its history, see History.
+	HistoryFilename = "%s.history"
 
-	WireVersion        = 0x42
+	WireVersion        = 0x49
 	WireIdentifierSize = 32
 
+	// WireVersionPolicyLength is the first version where setup sends the
+	// length of the (variable size) encoded policy.
+	WireVersionPolicyLength = 0x43
+	// WireVersionTombstone is the first version where the reply to read ends
+	// with the tombstone of a retired policy, if any.
+	WireVersionTombstone = 0x44
+	// WireVersionSetupReply is the first version where the relay replies to
+	// setup with WireTrue, or WireFalse followed by the length (uint16) and
+	// text of the reason.
+	WireVersionSetupReply = 0x45
+	// WireVersionErrors is the first version where every reply starts with a
+	// status byte, and failures are replied to with an error frame (see
+	// WireError) before the relay closes the connection.
+	WireVersionErrors = 0x46
+	// WireVersionFramed is the first version where requests and replies are
+	// sent as length-prefixed frames (see Frame).
+	WireVersionFramed = 0x47
+	// WireVersionEquivocations is the first version where the reply to read
+	// has the number (uint16) of equivocations retained by the relay after
+	// the number of blocks, with one frame per equivocation after the blocks.
+	WireVersionEquivocations = 0x48
+	// WireVersionReceipts is the first version where the reply to write ends
+	// with a receipt signed by the relay per written block (see Receipt).
+	WireVersionReceipts = 0x49
+
 	// commands
 	WireCmdStatus = 0x0
 	WireCmdSetup  = 0x1
 	WireCmdRead   = 0x2
 	WireCmdWrite  = 0x3
+	WireCmdAdmin  = 0x4
+
+	// admin commands, following WireCmdAdmin
+	WireAdminList   = 0x0
+	WireAdminShow   = 0x1
+	WireAdminRetire = 0x2
+	WireAdminDelete = 0x3
 
 	WireTrue    = 0x1
 	WireFalse   = 0x0
 	WireMore    = 0xA
 	WireAuthErr = 0xF
+	WireErr     = 0xE
+
+	// error codes in error frames
+	WireErrUnknown       = 0x0
+	WireErrVersion       = 0x1 // unsupported version
+	WireErrCommand       = 0x2 // unknown command
+	WireErrRequest       = 0x3 // malformed or truncated request
+	WireErrAuth          = 0x4 // invalid authentication
+	WireErrNoPolicy      = 0x5 // no such policy
+	WireErrPolicyExists  = 0x6 // policy already exists
+	WireErrInvalidPolicy = 0x7 // invalid policy
+	WireErrLimit         = 0x8 // policy outside of relay limits
+	WireErrInvalidBlock  = 0x9 // invalid block
+	WireErrRetired       = 0xA // policy is retired
 
 	WirePolicySize      = WireIdentifierSize + lc.VericationKeySize + lc.PublicKeySize + 3*8 + lc.SignatureSize
+	WireMaxRecipients   = 16
+	WireMaxPolicySize   = WirePolicySize + 1 + WireMaxRecipients*lc.PublicKeySize
 	WireBlockHeaderSize = 4*8 + 3*lc.HashOutputLen + lc.SignatureSize
 	WireAuthSize        = lc.HashOutputLen
+	WireFrameHeaderSize = 1 + 1 + 4
+	WireTombstoneSize   = WireIdentifierSize + 2*8 + lc.SignatureSize
+	// WireEquivocationSize is the size of an encoded equivocation: the policy
+	// ID and two block headers.
+	WireEquivocationSize = WireIdentifierSize + 2*WireBlockHeaderSize
+	// WireReceiptSize is the size of an encoded receipt: the verification key
+	// of the relay, policy ID, index, header hash, time, and signature.
+	WireReceiptSize = lc.VericationKeySize + WireIdentifierSize + 8 + lc.HashOutputLen + 8 +
+		lc.SignatureSize
+	// WireTreeHeadSize is the size of an encoded tree head: the verification
+	// key of the relay, size, root, time, and signature.
+	WireTreeHeadSize = lc.VericationKeySize + 8 + lc.HashOutputLen + 8 + lc.SignatureSize
+	// WireAdminPolicySize is the size of a policy summary in admin replies:
+	// ID, number of blocks, bytes used, space, time of last block, next
+	// index, and retired flag.
+	WireAdminPolicySize = WireIdentifierSize + 5*8 + 1
+	// WireMaxFrameSize is the largest payload of a frame, fitting a block.
+	WireMaxFrameSize = MaxBlockSize
 
 	MaxBlockSize = 104857600 // 100 MiB
+	// BlockOverhead is an upper bound on the bytes in a block that are not
+	// event data for a block with a single event: header, IV, length encoding,
+	// history of the device, and encryption and compression overhead.
+	BlockOverhead = 8192
+	// MaxEventSize is the largest event that fits in a block of MaxBlockSize.
+	MaxEventSize = MaxBlockSize - BlockOverhead
+
+	// block format versions, committed to by the header hash
+	BlockVersionLegacy  = 0x0 // uint16 event lengths, no version in header hash
+	BlockVersionVarint  = 0x1 // uvarint event lengths
+	BlockVersionEvents  = 0x2 // per-event time and sequence number
+	BlockVersionHistory = 0x3 // root hash commits to the history of the device
+	BlockVersion        = BlockVersionHistory
 )
@@ -7,11 +7,15 @@ package device
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"math/bits"
 	"net"
 	"os"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pylls/steady"
@@ -22,23 +26,82 @@ type Device struct {
 	Sk     []byte
 	Policy steady.Policy
 	// never written or read from disk below
-	server    string
-	conn      net.Conn
-	testing   bool
-	chanClose chan bool
-	chanLog   chan string
-	lock      sync.Mutex
-	open      bool
-	wait      sync.WaitGroup
+	server       string
+	conn         net.Conn
+	testing      bool
+	chanClose    chan bool
+	chanLog      chan steady.Event
+	lock         sync.Mutex
+	open         bool
+	wait         sync.WaitGroup
+	maxEventSize int
+	nextSeq      uint64
+	ackLock      sync.Mutex
+	onAck        AckHandler
+	queue        chan pendingBlock
+	stats        stats
+	errLock      sync.Mutex
+	err          error
+	multi        *multi // nil unless writing to several relays
+	receiptLock  sync.Mutex
+	receiptsFile string
+	historyFile  string
+	relayKeys    map[string][]byte
+}
+
+// stats are kept by the device for metrics, see RegisterMetrics
+type stats struct {
+	// blocks and events ACKed by the relay
+	blocks, events atomic.Uint64
+	// retries of writes to the relay
+	retries atomic.Uint64
+	// successful writes and their total latency (ns)
+	writes, latency atomic.Uint64
+}
+
+// AckHandler is called when the relay has ACKed all blocks up to and
+// including index. All events with a sequence number below nextSeq are in
+// ACKed blocks.
+type AckHandler func(index, nextSeq uint64)
+
+// pendingBlock is an encoded block waiting to be sent to the relay
+type pendingBlock struct {
+	encoded []byte
+	nextSeq uint64
+	events  int
+	// history is the history of the device committed to by the block
+	history steady.History
 }
 
 type DeviceState struct {
-	NextIndex, TimePrev, LenPrev uint64
+	NextIndex, TimePrev, LenPrev, NextSeq uint64
+	// Relays is the index of the next block to write to each relay, for
+	// devices writing to several relays (see LoadMultiDevice).
+	Relays map[string]uint64
+	// History is the history of the device committed to by its blocks,
+	// written as of the latest block ACKed and started over when lost (see
+	// steady.History).
+	History steady.History
 }
 
+// MakeDevice sets up a new policy at the relay and writes the device config to
+// path. Payloads are encrypted to pub and any additional recipients.
 func MakeDevice(sk, vk, pub []byte,
 	timeout, space, time uint64,
-	path, server, token string) (*steady.Policy, error) {
+	path, server, token string, recipients ...[]byte) (*steady.Policy, error) {
+	return MakeMultiDevice(sk, vk, pub, timeout, space, time, path, []string{server},
+		token, recipients...)
+}
+
+// MakeMultiDevice is like MakeDevice but sets up the policy at several relays,
+// see LoadMultiDevice.
+func MakeMultiDevice(sk, vk, pub []byte,
+	timeout, space, time uint64,
+	path string, servers []string, token string, recipients ...[]byte) (*steady.Policy, error) {
+	if len(recipients) > steady.WireMaxRecipients {
+		return nil, fmt.Errorf("too many recipients, max %d, got %d",
+			steady.WireMaxRecipients, len(recipients))
+	}
 	if _, err := os.Stat(fmt.Sprintf(steady.SetupFilename, path)); !os.IsNotExist(err) {
 		return nil, fmt.Errorf("config file already exists at path "+steady.SetupFilename, path)
 	}
@@ -46,53 +109,170 @@ func MakeDevice(sk, vk, pub []byte,
 		return nil, fmt.Errorf("state file already exists at path "+steady.DeviceStateFilename, path)
 	}
 
+	p := steady.MakePolicy(sk, vk, pub, timeout, space, time, recipients...)
+	for _, server := range servers {
+		if err := setupPolicy(server, p, token); err != nil {
+			if len(servers) > 1 {
+				return nil, fmt.Errorf("relay %s: %w", server, err)
+			}
+			return nil, err
+		}
+	}
+
+	return &p, writeDevice(&Device{
+		Sk:     sk,
+		Policy: p,
+	}, fmt.Sprintf(steady.SetupFilename, path))
+}
+
+// setupPolicy sets up a new policy at the relay
+func setupPolicy(server string, p steady.Policy, token string) error {
 	// attempt to connect to relay
 	conn, err := net.Dial("tcp", server)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer conn.Close()
 
 	// attempt to setup new policy and then check status
-	p := steady.MakePolicy(sk, vk, pub, timeout, space, time)
-	conn.Write([]byte{steady.WireVersion, steady.WireCmdSetup})
 	encodedPolicy := steady.EncodePolicy(p)
-	conn.Write(encodedPolicy)
-	conn.Write(lc.Khash([]byte(token), []byte("setup"), encodedPolicy))
+	size := make([]byte, 2)
+	binary.BigEndian.PutUint16(size, uint16(len(encodedPolicy)))
+	steady.WriteFrame(conn, steady.WireCmdSetup, size, encodedPolicy,
+		lc.Khash([]byte(token), []byte("setup"), encodedPolicy))
+	if err = readSetupReply(conn); err != nil {
+		return err
+	}
 	status, _, err := checkStatus(conn, p.ID, token)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get status: %v", err)
+		return fmt.Errorf("failed to get status: %w", err)
 	}
-	if status[0] != steady.WireTrue {
-		return nil, fmt.Errorf("failed to setup, wrong relay?")
+	if status != steady.WireTrue {
+		return fmt.Errorf("failed to setup, wrong relay?")
 	}
-
-	return &p, writeDevice(&Device{
-		Sk:     sk,
-		Policy: p,
-	}, fmt.Sprintf(steady.SetupFilename, path))
+	return nil
 }
 
 // Log (on device)
 func (d *Device) Log(msg string) error {
-	if len(msg) > 65535 {
-		return fmt.Errorf("max message length is %d, got %d", 65535, len(msg))
+	_, err := d.LogSeq(msg)
+	return err
+}
+
+// LogSeq logs like Log and returns the sequence number of the event. Text
+// starting with steady.StructuredEventPrefix is rejected, log such events with
+// LogEvent.
+func (d *Device) LogSeq(msg string) (uint64, error) {
+	if steady.IsStructuredEvent([]byte(msg)) {
+		return 0, fmt.Errorf("text starts with the structured event prefix")
 	}
+	return d.logSeq(msg)
+}
+
+func (d *Device) logSeq(msg string) (uint64, error) {
 	d.lock.Lock()
 	defer d.lock.Unlock()
+	if len(msg) > d.maxEventSize {
+		return 0, fmt.Errorf("max message length is %d, got %d", d.maxEventSize, len(msg))
+	}
 	if !d.open {
-		return fmt.Errorf("device is closed")
+		return 0, fmt.Errorf("device is closed")
+	}
+	// sequence numbers are assigned under lock, in the order events are sent
+	seq := d.nextSeq
+	d.chanLog <- steady.Event{
+		Time: uint64(time.Now().Unix()),
+		Seq:  seq,
+		Data: []byte(msg),
 	}
-	d.chanLog <- msg
+	d.nextSeq++
+	return seq, nil
+}
+
+// SetAckHandler sets a handler called each time the relay ACKs blocks.
+func (d *Device) SetAckHandler(fn AckHandler) {
+	d.ackLock.Lock()
+	defer d.ackLock.Unlock()
+	d.onAck = fn
+}
+
+// Err returns the error of the latest failed write to the relay, or nil if
+// the latest write succeeded. The device keeps retrying failed writes, so
+// errors like steady.ErrRetired tell that it is pointless to keep logging.
+func (d *Device) Err() error {
+	d.errLock.Lock()
+	defer d.errLock.Unlock()
+	return d.err
+}
+
+func (d *Device) setErr(err error) {
+	d.errLock.Lock()
+	defer d.errLock.Unlock()
+	d.err = err
+}
+
+// acked is called when all blocks up to and including last are ACKed. The
+// history is written as of the block, so that it continues after the latest
+// block at the relay if the device stops without writing its state.
+func (d *Device) acked(last pendingBlock) {
+	index := binary.BigEndian.Uint64(last.encoded[:8])
+	d.ackLock.Lock()
+	defer d.ackLock.Unlock()
+	if err := writeHistory(last.history, index+1, d.historyFile); err != nil {
+		d.setErr(fmt.Errorf("failed to write history: %v", err))
+	}
+	if d.onAck != nil {
+		d.onAck(index, last.nextSeq)
+	}
+}
+
+// LogEvent logs a structured event (on device). A zero Time is set to the
+// current time.
+func (d *Device) LogEvent(e steady.StructuredEvent) error {
+	if e.Time == 0 {
+		e.Time = uint64(time.Now().Unix())
+	}
+	b, err := steady.EncodeStructuredEvent(e)
+	if err != nil {
+		return err
+	}
+	_, err = d.logSeq(string(b))
+	return err
+}
+
+// SetMaxEventSize sets the maximum length of messages accepted by Log. The
+// size is bounded by steady.MaxEventSize and the space of the device's policy.
+func (d *Device) SetMaxEventSize(size int) error {
+	if size < 0 || size > maxEventSize(d.Policy) {
+		return fmt.Errorf("invalid max event size, max is %d, got %d",
+			maxEventSize(d.Policy), size)
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.maxEventSize = size
 	return nil
 }
 
+// maxEventSize is the largest event that fits in a block the relay accepts
+func maxEventSize(p steady.Policy) int {
+	if p.Space <= steady.BlockOverhead {
+		return 0
+	}
+	if p.Space-steady.BlockOverhead < steady.MaxEventSize {
+		return int(p.Space - steady.BlockOverhead)
+	}
+	return steady.MaxEventSize
+}
+
 // Close flushes the device, closes connection to the relay, and frees all
 // resources. Afterwards the device can no longer be used to log.
 func (d *Device) Close() error {
 	// get lock, prevent others from logging more
 	d.lock.Lock()
 	defer d.lock.Unlock()
+	if !d.open { // already closed
+		return nil
+	}
 	d.open = false
 	// close log chan, give close msg
 	close(d.chanLog)
@@ -104,6 +284,35 @@ func (d *Device) Close() error {
 	return nil
 }
 
+// SetCloseTimeout bounds how long Close of a device writing to several
+// relays (see LoadMultiDevice) waits for a quorum of relays to ACK all blocks.
+// Blocks not yet ACKed stay in the spool and are written once the device is
+// loaded again. A zero timeout, the default, waits until a quorum ACKs.
+func (d *Device) SetCloseTimeout(timeout time.Duration) {
+	if d.multi == nil {
+		return
+	}
+	d.multi.lock.Lock()
+	defer d.multi.lock.Unlock()
+	d.multi.closeTimeout = timeout
+}
+
+// MakeTombstone makes a tombstone retiring the closed device at path, i.e.,
+// no blocks will follow those written per the device state. The relay only
+// accepts the tombstone if it has all blocks of the device.
+func MakeTombstone(path string) (*steady.Tombstone, error) {
+	device, err := readDevice(fmt.Sprintf(steady.SetupFilename, path))
+	if err != nil {
+		return nil, err
+	}
+	state, err := readDeviceState(fmt.Sprintf(steady.DeviceStateFilename, path))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read device state: %v", err)
+	}
+	t := steady.MakeTombstone(device.Sk, device.Policy, state.NextIndex, uint64(time.Now().Unix()))
+	return &t, nil
+}
+
 // estimating memory usage: flushSize*(blockBufferNum+1)
 // LoadDevice loads a device from the given fs path
 func LoadDevice(path, server, token string, encrypt, compress bool,
@@ -113,30 +322,25 @@ func LoadDevice(path, server, token string, encrypt, compress bool,
 	if err != nil {
 		return nil, err
 	}
-	state, err := readDeviceState(fmt.Sprintf(steady.DeviceStateFilename, path))
-	if err != nil { // assume error means we don't have any state
-		state = new(DeviceState)
-		state.NextIndex = 0
-		state.LenPrev = 0
-		state.TimePrev = device.Policy.Time
-	}
+	state := loadDeviceState(path, device.Policy)
 
 	device.server = server
+	device.maxEventSize = maxEventSize(device.Policy)
 	// attempt to connect to relay and check status
 	if err := device.connect(); err != nil {
 		return nil, err
 	}
 	status, header, err := checkStatus(device.conn, device.Policy.ID, token)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get status: %v", err)
+		return nil, fmt.Errorf("failed to get status: %w", err)
 	}
-	if status[0] == steady.WireFalse {
+	if status == steady.WireFalse {
 		return nil, fmt.Errorf("device is not setup at relay")
 	}
-	if status[0] == steady.WireTrue && state.NextIndex != 0 {
+	if status == steady.WireTrue && state.NextIndex != 0 {
 		return nil, fmt.Errorf("relay returned inconsistent state on status check")
 	}
-	if status[0] == steady.WireMore {
+	if status == steady.WireMore {
 		bh, err := steady.DecodeBlockHeader(header, device.Policy)
 		if err != nil {
 			return nil, fmt.Errorf("relay returned an invalid block header on status check: %v", err)
@@ -144,20 +348,48 @@ func LoadDevice(path, server, token string, encrypt, compress bool,
 		if bh.Index+1 < state.NextIndex {
 			return nil, fmt.Errorf("relay returned old block header on status check, possible attack")
 		}
-		state.NextIndex = bh.Index + 1
-		state.LenPrev = bh.LenCur
-		state.TimePrev = bh.Time
+		if err := state.continueFrom(header, device.Policy); err != nil {
+			return nil, err
+		}
 	}
+	device.start(path, state, encrypt, compress, flushSize, blockBufferNum, token)
+	return device, nil
+}
 
-	// setup channels and spawn worker
-	device.chanClose = make(chan bool, 1)
-	device.chanLog = make(chan string, flushSize/512) // Note: assuming 512 bytes average messages
-	device.open = true
-	device.wait.Add(1)
-	go device.loggingThread(fmt.Sprintf(steady.DeviceStateFilename, path), state, encrypt, compress,
-		flushSize, blockBufferNum, token)
+// loadDeviceState loads the state of the device at path, or the initial state
+func loadDeviceState(path string, policy steady.Policy) *DeviceState {
+	state, err := readDeviceState(fmt.Sprintf(steady.DeviceStateFilename, path))
+	if err != nil { // assume error means we don't have any state
+		state = new(DeviceState)
+		state.NextIndex = 0
+		state.LenPrev = 0
+		state.TimePrev = policy.Time
+		state.NextSeq = 0
+	}
+	return state
+}
 
-	return device, nil
+// start starts logging to the relay(s) from state
+func (d *Device) start(path string, state *DeviceState, encrypt, compress bool,
+	flushSize, blockBufferNum int, token string) {
+	d.nextSeq = state.NextSeq
+	d.receiptsFile = fmt.Sprintf(steady.ReceiptsFilename, path)
+	d.historyFile = fmt.Sprintf(steady.HistoryFilename, path)
+	// the history as of the latest block, written on ACK or close
+	history, err := readHistory(d.historyFile, state.NextIndex)
+	if err != nil { // lost or stale, start over
+		history = steady.History{}
+	}
+	state.History = history
+
+	// setup channels and spawn worker
+	d.chanClose = make(chan bool, 1)
+	d.chanLog = make(chan steady.Event, flushSize/512) // Note: assuming 512 bytes average messages
+	d.queue = make(chan pendingBlock, blockBufferNum)
+	d.open = true
+	d.wait.Add(1)
+	go d.loggingThread(fmt.Sprintf(steady.DeviceStateFilename, path), state, encrypt, compress,
+		flushSize, token)
 }
 
 func (d *Device) connect() (err error) {
@@ -169,78 +401,110 @@ func (d *Device) connect() (err error) {
 }
 
 func (d *Device) loggingThread(stateFile string, state *DeviceState,
-	encrypt, compress bool, flushSize, blockBufferNum int, token string) {
+	encrypt, compress bool, flushSize int, token string) {
 	timer := time.After(time.Duration(int64(d.Policy.Timeout)-
 		(time.Now().Unix()-int64(state.TimePrev))) * time.Second)
-	var buffer [][]byte
+	var buffer []steady.Event
 	var bufferSize int
 
 	// async sender of blocks
-	blockChan := make(chan []byte, blockBufferNum)
+	blockChan := d.queue
 	var waitSender sync.WaitGroup
 	waitSender.Add(1)
-	go d.sender(blockChan, &waitSender, token)
+	if d.multi != nil {
+		go d.multi.run(blockChan, &waitSender, state)
+	} else {
+		go d.sender(blockChan, &waitSender, token)
+	}
 
+	logChan := d.chanLog
 	for {
 		select {
 		case <-timer: // timeout, send a block
 			d.makeBlock(buffer, state, encrypt, compress, blockChan)
-			buffer = make([][]byte, 0)
+			buffer = make([]steady.Event, 0)
 			bufferSize = 0
 			timer = time.After(time.Duration(d.Policy.Timeout) * time.Second)
-		case data := <-d.chanLog: // buffer log data
+		case data, ok := <-logChan: // buffer log data
+			if !ok { // closed, wait for the signal to close
+				logChan = nil
+				continue
+			}
 			// TODO: we should drop here if it makes sense to, such that we can keep statistics on drops
 			// if we need to drop or not is simple: check length of blockChan
-			buffer = append(buffer, []byte(data))
-			bufferSize += len(data) + 2 // for uint_16 length encoding
+			if bufferSize > 0 && bufferSize+eventSize(data) > maxEventSize(d.Policy) {
+				// a large event would make the block too large for the relay, flush first
+				d.makeBlock(buffer, state, encrypt, compress, blockChan)
+				buffer = make([]steady.Event, 0)
+				bufferSize = 0
+			}
+			buffer = append(buffer, data)
+			bufferSize += eventSize(data)
 			if bufferSize >= flushSize {
 				d.makeBlock(buffer, state, encrypt, compress, blockChan)
-				buffer = make([][]byte, 0)
+				buffer = make([]steady.Event, 0)
 				bufferSize = 0
 				timer = time.After(time.Duration(d.Policy.Timeout) * time.Second)
 			}
 		case <-d.chanClose: // signal to close
 			for data := range d.chanLog { // drain the log channel
-				buffer = append(buffer, []byte(data))
-				bufferSize += len(data) + 2 // for uint_16 length encoding
+				if bufferSize > 0 && bufferSize+eventSize(data) > maxEventSize(d.Policy) {
+					d.makeBlock(buffer, state, encrypt, compress, blockChan)
+					buffer = make([]steady.Event, 0)
+					bufferSize = 0
+				}
+				buffer = append(buffer, data)
+				bufferSize += eventSize(data)
 			}
 			if bufferSize > 0 { // send any data if we have any
 				d.makeBlock(buffer, state, encrypt, compress, blockChan)
-				buffer = make([][]byte, 0)
+				buffer = make([]steady.Event, 0)
 				bufferSize = 0
 				timer = time.After(time.Duration(d.Policy.Timeout) * time.Second)
 			}
-			close(blockChan)                   // this will make sender eventually wrap up
-			waitSender.Wait()                  // so we wait for sender to finish sending
-			writeDeviceState(state, stateFile) // attempt to save state, ignore any error
-			d.wait.Done()                      // all good, signal done
+			close(blockChan)               // this will make sender eventually wrap up
+			waitSender.Wait()              // so we wait for sender to finish sending
+			d.writeState(state, stateFile) // attempt to save state, ignore any error
+			d.wait.Done()                  // all good, signal done
 			return
 		}
 	}
 }
 
-func (d *Device) makeBlock(buffer [][]byte, s *DeviceState, encrypt, compress bool,
-	blockChan chan []byte) {
+// eventSize is the size of an encoded event in a block
+func eventSize(e steady.Event) int {
+	var buf [binary.MaxVarintLen64]byte
+	l := len(steady.EventLeaf(steady.BlockVersion, e))
+	return l + binary.PutUvarint(buf[:], uint64(l))
+}
+
+func (d *Device) makeBlock(buffer []steady.Event, s *DeviceState, encrypt, compress bool,
+	blockChan chan pendingBlock) {
 	t := uint64(time.Now().Unix())
-	block, err := steady.MakeEncodedBlock(s.NextIndex, s.LenPrev, t,
-		encrypt, compress, d.Policy, buffer, d.Sk)
+	block, err := steady.MakeEncodedHistoryBlock(s.NextIndex, s.LenPrev, t,
+		encrypt, compress, d.Policy, buffer, &s.History, d.Sk)
 	if err != nil {
 		panic(fmt.Sprintf("error on MakeEncodeBlock, should not happen: %v", err))
 	}
 	s.NextIndex++
+	if len(buffer) > 0 {
+		s.NextSeq = buffer[len(buffer)-1].Seq + 1
+	}
 	s.LenPrev = uint64(len(block))
 	s.TimePrev = t
 
-	blockChan <- block
+	blockChan <- pendingBlock{
+		encoded: block,
+		nextSeq: s.NextSeq,
+		events:  len(buffer),
+		history: s.History,
+	}
 }
 
-func (d *Device) sender(in chan []byte, wait *sync.WaitGroup, token string) {
+func (d *Device) sender(in chan pendingBlock, wait *sync.WaitGroup, token string) {
 	defer wait.Done()
-	buf := make([]byte, 8+steady.WireAuthSize)
-	numBlocks := make([]byte, 2)
-	binary.BigEndian.PutUint16(numBlocks, 1)
 	for {
-		blocks := make([][]byte, 0)
+		blocks := make([]pendingBlock, 0)
 
 		// get blocks
 		if len(in) > 1 { // we got a queue, get them all and write
@@ -254,40 +518,146 @@ func (d *Device) sender(in chan []byte, wait *sync.WaitGroup, token string) {
 			}
 			blocks = append(blocks, block)
 		}
-		binary.BigEndian.PutUint16(numBlocks, uint16(len(blocks)))
+
+		encoded := make([][]byte, len(blocks))
+		for i := 0; i < len(blocks); i++ {
+			encoded[i] = blocks[i].encoded
+		}
 
 		// loop until we've written all blocks
 		firstTry := true
+		start := time.Now()
 		for {
 			if !firstTry { // only reconnect if not the first try
+				d.stats.retries.Add(1)
 				if err := d.connect(); err != nil {
 					continue
 				}
 			}
 			firstTry = false
 
-			d.conn.Write([]byte{steady.WireVersion, steady.WireCmdWrite}) // we want to write blocks...
-			d.conn.Write(d.Policy.ID)                                     // ...to this policy...
-			d.conn.Write(numBlocks)                                       // ...and this many blocks
+			receipts, err := writeBlocks(d.conn, d.Policy.ID, encoded, token)
+			if err != nil {
+				d.setErr(err)
+				var werr *steady.WireError
+				if errors.As(err, &werr) {
+					time.Sleep(time.Second) // relay refused, no point to hurry
+				}
+				continue
+			}
+			d.setErr(d.storeReceipts(d.server, receipts))
 
-			// send all blocks
+			d.stats.writes.Add(1)
+			d.stats.latency.Add(uint64(time.Since(start)))
+			d.stats.blocks.Add(uint64(len(blocks)))
 			for i := 0; i < len(blocks); i++ {
-				d.conn.Write(blocks[i])
+				d.stats.events.Add(uint64(blocks[i].events))
 			}
+			d.acked(blocks[len(blocks)-1])
+			break
+		}
+	}
+}
 
-			// read authentication tag from relay
-			l, err := d.conn.Read(buf)
-			if err != nil || l != 8+steady.WireAuthSize {
-				continue
-			}
-			if !bytes.Equal(blocks[len(blocks)-1][:8], buf[:8]) ||
-				!bytes.Equal(buf[8:], lc.Khash([]byte(token), []byte("write"), d.Policy.ID, blocks[len(blocks)-1][:8])) {
-				continue
+// writeBlocks writes encoded blocks to the relay, one frame per block, and
+// checks the authenticated ACK of the last block and the receipt signed by
+// the relay for each block. A *steady.WireError is returned if the relay
+// refused the blocks.
+func writeBlocks(conn net.Conn, id []byte, blocks [][]byte, token string) ([]steady.Receipt, error) {
+	numBlocks := make([]byte, 2)
+	binary.BigEndian.PutUint16(numBlocks, uint16(len(blocks)))
+	// we want to write this many blocks to this policy
+	steady.WriteFrame(conn, steady.WireCmdWrite, id, numBlocks)
+	for i := 0; i < len(blocks); i++ {
+		steady.WriteFrame(conn, steady.WireMore, blocks[i])
+	}
+
+	// read authentication tag and receipts from relay
+	reply, err := steady.ReadReply(conn)
+	if err != nil {
+		return nil, err
+	}
+	if reply.Type != steady.WireTrue ||
+		len(reply.Payload) != 8+steady.WireAuthSize+len(blocks)*steady.WireReceiptSize {
+		return nil, fmt.Errorf("unexpected reply to write")
+	}
+	last := blocks[len(blocks)-1][:8]
+	if !bytes.Equal(last, reply.Payload[:8]) ||
+		!bytes.Equal(reply.Payload[8:8+steady.WireAuthSize],
+			lc.Khash([]byte(token), []byte("write"), id, last)) {
+		return nil, fmt.Errorf("invalid ACK from relay")
+	}
+	receipts := make([]steady.Receipt, len(blocks))
+	encoded := reply.Payload[8+steady.WireAuthSize:]
+	for i := range blocks {
+		receipts[i], err = steady.DecodeReceipt(encoded[i*steady.WireReceiptSize : (i+1)*steady.WireReceiptSize])
+		if err == nil {
+			err = steady.VerifyReceipt(receipts[i], receipts[i].Relay, id, blocks[i])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid receipt from relay: %v", err)
+		}
+	}
+	return receipts, nil
+}
+
+// SetRelayKey sets the verification key of the relay at server, such that
+// receipts signed by other keys are rejected. Without a key, receipts are
+// stored as is, to be verified when presented (see ReadReceipts).
+func (d *Device) SetRelayKey(server string, vk []byte) {
+	d.receiptLock.Lock()
+	defer d.receiptLock.Unlock()
+	if d.relayKeys == nil {
+		d.relayKeys = make(map[string][]byte)
+	}
+	d.relayKeys[server] = vk
+}
+
+// storeReceipts appends the receipts of the relay at server to the receipts
+// file of the device
+func (d *Device) storeReceipts(server string, receipts []steady.Receipt) error {
+	d.receiptLock.Lock()
+	defer d.receiptLock.Unlock()
+	if vk, ok := d.relayKeys[server]; ok {
+		for _, r := range receipts {
+			if !bytes.Equal(r.Relay, vk) {
+				return fmt.Errorf("receipt from relay %s signed by unexpected key", server)
 			}
+		}
+	}
+	f, err := os.OpenFile(d.receiptsFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to store receipts: %v", err)
+	}
+	for _, r := range receipts {
+		if _, err = f.Write(steady.EncodeReceipt(r)); err != nil {
+			f.Close()
+			return fmt.Errorf("failed to store receipts: %v", err)
+		}
+	}
+	return f.Close()
+}
 
-			break
+// ReadReceipts reads the receipts stored by the device at path, in the order
+// received. Verify that each receipt is from the expected relay with
+// steady.VerifyReceipt.
+func ReadReceipts(path string) ([]steady.Receipt, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf(steady.ReceiptsFilename, path))
+	if err != nil {
+		return nil, err
+	}
+	if len(data)%steady.WireReceiptSize != 0 {
+		return nil, fmt.Errorf("receipts file has a truncated receipt")
+	}
+	receipts := make([]steady.Receipt, 0, len(data)/steady.WireReceiptSize)
+	for ; len(data) > 0; data = data[steady.WireReceiptSize:] {
+		r, err := steady.DecodeReceipt(data[:steady.WireReceiptSize])
+		if err != nil {
+			return nil, err
 		}
+		receipts = append(receipts, r)
 	}
+	return receipts, nil
 }
 
 func writeDevice(device *Device, filename string) error {
@@ -311,29 +681,32 @@ func readDevice(filename string) (*Device, error) {
 	return &device, err
 }
 
-func checkStatus(conn net.Conn, id []byte, token string) (status, header []byte, err error) {
-	buf := make([]byte, 1)
-	conn.Write([]byte{steady.WireVersion, steady.WireCmdStatus})
-	conn.Write(id)
-	conn.Write(lc.Khash([]byte(token), []byte("status"), id))
-	l, err := conn.Read(buf)
+// readSetupReply reads the reply to setup, a *steady.WireError on failure
+func readSetupReply(conn net.Conn) error {
+	reply, err := steady.ReadReply(conn)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to read reply to status check: %v", err)
+		return fmt.Errorf("relay refused setup: %w", err)
 	}
-	if l < 1 {
-		return nil, nil, fmt.Errorf("failed to read reply to status check")
+	if reply.Type != steady.WireTrue {
+		return fmt.Errorf("unexpected reply to setup")
 	}
-	if buf[0] == steady.WireMore {
-		header = make([]byte, steady.WireBlockHeaderSize)
-		l, err = conn.Read(header)
-		if err != nil {
-			return nil, nil, fmt.Errorf("failed to read block header after status check: %v", err)
-		}
-		if l < steady.WireBlockHeaderSize {
-			return nil, nil, fmt.Errorf("too short reply to status check")
+	return nil
+}
+
+func checkStatus(conn net.Conn, id []byte, token string) (status byte, header []byte, err error) {
+	steady.WriteFrame(conn, steady.WireCmdStatus, id, lc.Khash([]byte(token), []byte("status"), id))
+	reply, err := steady.ReadReply(conn)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to read reply to status check: %w", err)
+	}
+	if reply.Type == steady.WireMore {
+		if len(reply.Payload) != steady.WireBlockHeaderSize {
+			return 0, nil, fmt.Errorf("wrong block header size after status check, got %d",
+				len(reply.Payload))
 		}
+		header = reply.Payload
 	}
-	return buf, header, nil
+	return reply.Type, header, nil
 }
 
 func readDeviceState(filename string) (*DeviceState, error) {
@@ -348,13 +721,81 @@ func readDeviceState(filename string) (*DeviceState, error) {
 	state.NextIndex = binary.BigEndian.Uint64(data[:8])
 	state.TimePrev = binary.BigEndian.Uint64(data[8:16])
 	state.LenPrev = binary.BigEndian.Uint64(data[16:24])
+	if len(data) >= 32 { // older states lack the sequence number
+		state.NextSeq = binary.BigEndian.Uint64(data[24:32])
+	}
+	// followed by the length (uint16), address and next index of each relay
+	for data = data[min(len(data), 32):]; len(data) > 0; {
+		if len(data) < 2 || len(data) < 2+int(binary.BigEndian.Uint16(data))+8 {
+			return nil, fmt.Errorf("state has a truncated relay")
+		}
+		l := int(binary.BigEndian.Uint16(data))
+		if state.Relays == nil {
+			state.Relays = make(map[string]uint64)
+		}
+		state.Relays[string(data[2:2+l])] = binary.BigEndian.Uint64(data[2+l:])
+		data = data[2+l+8:]
+	}
 	return &state, nil
 }
 
+// writeState writes the state of the device and its history
+func (d *Device) writeState(state *DeviceState, stateFile string) error {
+	if err := writeDeviceState(state, stateFile); err != nil {
+		return err
+	}
+	return writeHistory(state.History, state.NextIndex, d.historyFile)
+}
+
+// readHistory reads the history of a device, kept apart from the state: the
+// index of the next block, size, and subtrees (see steady.History). Fails if
+// the history is not for the block with nextIndex.
+func readHistory(filename string, nextIndex uint64) (h steady.History, err error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return h, err
+	}
+	if len(data) < 16 || (len(data)-16)%lc.HashOutputLen != 0 {
+		return h, fmt.Errorf("history has invalid length %d", len(data))
+	}
+	if index := binary.BigEndian.Uint64(data); index != nextIndex {
+		return h, fmt.Errorf("history for block %d, expected block %d", index, nextIndex)
+	}
+	h.Size = binary.BigEndian.Uint64(data[8:])
+	for data = data[16:]; len(data) > 0; data = data[lc.HashOutputLen:] {
+		h.Subtrees = append(h.Subtrees, data[:lc.HashOutputLen])
+	}
+	if len(h.Subtrees) != bits.OnesCount64(h.Size) {
+		return steady.History{}, fmt.Errorf("history has %d subtrees for size %d",
+			len(h.Subtrees), h.Size)
+	}
+	return h, nil
+}
+
+func writeHistory(h steady.History, nextIndex uint64, filename string) error {
+	buf := binary.BigEndian.AppendUint64(nil, nextIndex)
+	buf = binary.BigEndian.AppendUint64(buf, h.Size)
+	for _, subtree := range h.Subtrees {
+		buf = append(buf, subtree...)
+	}
+	return ioutil.WriteFile(filename, buf, 0600)
+}
+
 func writeDeviceState(state *DeviceState, filename string) error {
-	var buf [24]byte
+	buf := make([]byte, 32)
 	binary.BigEndian.PutUint64(buf[:], state.NextIndex)
 	binary.BigEndian.PutUint64(buf[8:], state.TimePrev)
 	binary.BigEndian.PutUint64(buf[16:], state.LenPrev)
-	return ioutil.WriteFile(filename, buf[:], 0600)
+	binary.BigEndian.PutUint64(buf[24:], state.NextSeq)
+	relays := make([]string, 0, len(state.Relays))
+	for relay := range state.Relays {
+		relays = append(relays, relay)
+	}
+	sort.Strings(relays)
+	for _, relay := range relays {
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(relay)))
+		buf = append(buf, relay...)
+		buf = binary.BigEndian.AppendUint64(buf, state.Relays[relay])
+	}
+	return ioutil.WriteFile(filename, buf, 0600)
 }
@@ -0,0 +1,35 @@
+package device
+
+import (
+	"encoding/hex"
+
+	"github.com/pylls/steady/metrics"
+)
+
+// RegisterMetrics adds metrics of the device to a registry: the depth of the
+// queues of events and blocks, the number of blocks and events written to the
+// relay, retries, and the latency of writes.
+func (d *Device) RegisterMetrics(r *metrics.Registry) {
+	id := hex.EncodeToString(d.Policy.ID)
+	queuedEvents := r.Gauge("steady_device_queued_events",
+		"Number of logged events waiting to be put in a block.")
+	queuedBlocks := r.Gauge("steady_device_queued_blocks",
+		"Number of blocks waiting to be sent to the relay.")
+	blocks := r.Counter("steady_device_written_blocks_total",
+		"Number of blocks written to (and ACKed by) the relay.")
+	events := r.Counter("steady_device_written_events_total",
+		"Number of events in blocks written to the relay.")
+	retries := r.Counter("steady_device_write_retries_total",
+		"Number of retried writes to the relay.")
+	latency := r.Summary("steady_device_write_latency_seconds",
+		"Time from first attempt to ACK of writes to the relay.")
+
+	r.OnCollect(func() {
+		queuedEvents.Set(float64(len(d.chanLog)), "policy", id)
+		queuedBlocks.Set(float64(len(d.queue)), "policy", id)
+		blocks.Set(float64(d.stats.blocks.Load()), "policy", id)
+		events.Set(float64(d.stats.events.Load()), "policy", id)
+		retries.Set(float64(d.stats.retries.Load()), "policy", id)
+		latency.SetSummary(float64(d.stats.latency.Load())/1e9, d.stats.writes.Load(), "policy", id)
+	})
+}
@@ -0,0 +1,29 @@
+package device
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/pylls/steady"
+	"github.com/pylls/steady/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegisterMetrics(t *testing.T) {
+	r := metrics.NewRegistry()
+	a, b := testDevice(10), testDevice(10)
+	a.Policy.ID, b.Policy.ID = []byte{0x0a}, []byte{0x0b}
+	a.RegisterMetrics(r)
+	b.RegisterMetrics(r)
+	a.chanLog <- steady.Event{}
+
+	var buf bytes.Buffer
+	_, err := r.WriteTo(&buf)
+	assert.Nil(t, err, "failed to write metrics: %v", err)
+	out := buf.String()
+	assert.Equal(t, 1, strings.Count(out, "# TYPE steady_device_queued_events gauge"),
+		"expected one family for both devices")
+	assert.Contains(t, out, `steady_device_queued_events{policy="0a"} 1`)
+	assert.Contains(t, out, `steady_device_queued_events{policy="0b"} 0`)
+}
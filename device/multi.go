@@ -0,0 +1,387 @@
+package device
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pylls/steady"
+)
+
+/*
+ * A device writing to several relays puts every block in a spool on disk
+ * and writes it to each relay in order, one writer per relay. A block is
+ * ACKed (see AckHandler) once a quorum of relays have ACKed it with the
+ * authenticated reply to write. Relays that are down or lagging catch up
+ * from the spool when they recover, also after the device is loaded again
+ * (progress per relay is kept in DeviceState.Relays). Blocks are removed
+ * from the spool once all relays have them. Close waits for a quorum of
+ * relays to ACK all blocks, forever unless bounded by SetCloseTimeout.
+ */
+type multi struct {
+	d      *Device
+	spool  *spool
+	relays []*relayWriter
+	quorum int
+	token  string
+	batch  int // max blocks per write
+
+	lock sync.Mutex
+	cond *sync.Cond // signalled on new blocks, ACKs, and stop
+	// pending are the blocks in the spool from this run not yet ACKed by
+	// a quorum of relays
+	pending map[uint64]pendingBlock
+	acked   uint64 // the index of the first block not ACKed by a quorum
+	// closeTimeout bounds waiting for a quorum on close, zero for no bound
+	closeTimeout time.Duration
+	stopped      bool
+	stop         chan struct{}
+	wait         sync.WaitGroup
+}
+
+// relayWriter writes blocks from the spool to one relay, fields under
+// multi.lock
+type relayWriter struct {
+	server string
+	conn   net.Conn
+	next   uint64 // the index of the next block to write to the relay
+	err    error  // the error of the latest write, if it failed
+}
+
+// relayTimeout bounds connecting to and checking the status at a relay
+const relayTimeout = 10 * time.Second
+
+// LoadMultiDevice loads a device from the given fs path that writes each
+// block to all servers. Blocks are ACKed once quorum relays have them, a
+// quorum of 0 means all relays. Loading fails unless a quorum of relays is
+// reachable and all relays can catch up from the spool of the device.
+func LoadMultiDevice(path string, servers []string, quorum int, token string,
+	encrypt, compress bool, flushSize, blockBufferNum int) (*Device, error) {
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no relays")
+	}
+	if quorum == 0 {
+		quorum = len(servers)
+	}
+	if quorum < 0 || quorum > len(servers) {
+		return nil, fmt.Errorf("invalid quorum %d for %d relays", quorum, len(servers))
+	}
+	device, err := readDevice(fmt.Sprintf(steady.SetupFilename, path))
+	if err != nil {
+		return nil, err
+	}
+	state := loadDeviceState(path, device.Policy)
+	device.maxEventSize = maxEventSize(device.Policy)
+
+	s, err := openSpool(fmt.Sprintf(steady.SpoolDirname, path))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open spool: %v", err)
+	}
+	if s.next > state.NextIndex {
+		// blocks were spooled after the state was saved, continue after them
+		block, err := s.get(s.next - 1)
+		if err != nil || len(block) < steady.WireBlockHeaderSize {
+			return nil, fmt.Errorf("failed to read last block in spool: %v", err)
+		}
+		if err := state.continueFrom(block[:steady.WireBlockHeaderSize], device.Policy); err != nil {
+			return nil, fmt.Errorf("invalid block in spool: %v", err)
+		}
+	}
+
+	m := &multi{
+		d:       device,
+		spool:   s,
+		quorum:  quorum,
+		token:   token,
+		batch:   blockBufferNum + 1,
+		pending: make(map[uint64]pendingBlock),
+		stop:    make(chan struct{}),
+	}
+	m.cond = sync.NewCond(&m.lock)
+	fail := func(err error) (*Device, error) {
+		for _, w := range m.relays {
+			if w.conn != nil {
+				w.conn.Close()
+			}
+		}
+		return nil, err
+	}
+
+	// check status at each relay, the latest block header at any relay
+	// tells where to continue if the state is stale
+	reachable := 0
+	var latest []byte
+	var latestNext uint64
+	for _, server := range servers {
+		w := &relayWriter{server: server, next: s.first}
+		next, known := state.Relays[server]
+		if known {
+			w.next = next
+		}
+		m.relays = append(m.relays, w)
+		conn, err := net.DialTimeout("tcp", server, relayTimeout)
+		if err != nil {
+			w.err = err
+			continue
+		}
+		conn.SetDeadline(time.Now().Add(relayTimeout)) // don't hang on a relay
+		status, header, err := checkStatus(conn, device.Policy.ID, token)
+		conn.SetDeadline(time.Time{})
+		if err != nil {
+			conn.Close()
+			w.err = fmt.Errorf("failed to get status: %w", err)
+			continue
+		}
+		w.conn = conn
+		reachable++
+		switch status {
+		case steady.WireFalse:
+			return fail(fmt.Errorf("device is not setup at relay %s", server))
+		case steady.WireTrue:
+			if known && next != 0 {
+				return fail(fmt.Errorf("relay %s returned inconsistent state on status check", server))
+			}
+			w.next = 0
+		case steady.WireMore:
+			bh, err := steady.DecodeBlockHeader(header, device.Policy)
+			if err != nil {
+				return fail(fmt.Errorf("relay %s returned an invalid block header on status check: %v",
+					server, err))
+			}
+			if bh.Index+1 < w.next {
+				return fail(fmt.Errorf("relay %s returned old block header on status check, possible attack",
+					server))
+			}
+			w.next = bh.Index + 1
+			if w.next >= state.NextIndex && (latest == nil || w.next > latestNext) {
+				latest, latestNext = header, w.next
+			}
+		}
+	}
+	if reachable < quorum {
+		return fail(fmt.Errorf("only %d of %d relays reachable, quorum is %d",
+			reachable, len(servers), quorum))
+	}
+	if latest != nil {
+		if err := state.continueFrom(latest, device.Policy); err != nil {
+			return fail(err)
+		}
+	}
+	if s.next < state.NextIndex {
+		// nothing to catch up on from the spool (e.g., it is new)
+		if err := s.remove(s.next); err != nil {
+			return fail(fmt.Errorf("failed to clear spool: %v", err))
+		}
+		s.first, s.next = state.NextIndex, state.NextIndex
+	}
+	for _, w := range m.relays {
+		if w.next < s.first {
+			return fail(fmt.Errorf("relay %s lacks blocks %d to %d that are not in the spool",
+				w.server, w.next, s.first-1))
+		}
+	}
+	m.progress()
+
+	device.multi = m
+	device.start(path, state, encrypt, compress, flushSize, blockBufferNum, token)
+	return device, nil
+}
+
+// continueFrom makes the state continue after the block with the encoded
+// header, e.g., from the latest block at a relay
+func (s *DeviceState) continueFrom(header []byte, p steady.Policy) error {
+	bh, err := steady.DecodeBlockHeader(header, p)
+	if err != nil {
+		return err
+	}
+	if s.NextIndex == 0 || bh.Index+1 > s.NextIndex {
+		// state lost or stale, continue sequence numbers from the clock so
+		// they keep increasing
+		s.NextSeq = uint64(time.Now().UnixNano())
+	}
+	s.NextIndex = bh.Index + 1
+	s.LenPrev = bh.LenCur
+	s.TimePrev = bh.Time
+	return nil
+}
+
+// run spools blocks and starts the writers, on close it waits for a quorum
+// of relays to ACK all blocks before stopping the writers
+func (m *multi) run(in chan pendingBlock, wait *sync.WaitGroup, state *DeviceState) {
+	defer wait.Done()
+	for _, w := range m.relays {
+		m.wait.Add(1)
+		go m.write(w)
+	}
+
+	for b := range in {
+		index := binary.BigEndian.Uint64(b.encoded[:8])
+		m.lock.Lock()
+		for {
+			err := m.spool.put(index, b.encoded)
+			if err == nil {
+				break
+			}
+			m.d.setErr(fmt.Errorf("failed to spool block: %v", err))
+			m.lock.Unlock()
+			time.Sleep(time.Second)
+			m.lock.Lock()
+		}
+		m.pending[index] = b
+		m.cond.Broadcast()
+		// keep at most as many blocks waiting for a quorum as fit in the queue
+		for m.spool.next-m.acked > uint64(cap(in)) {
+			m.cond.Wait()
+		}
+		m.lock.Unlock()
+	}
+
+	m.lock.Lock()
+	expired := false
+	if m.closeTimeout > 0 {
+		timer := time.AfterFunc(m.closeTimeout, func() {
+			m.lock.Lock()
+			expired = true
+			m.cond.Broadcast()
+			m.lock.Unlock()
+		})
+		defer timer.Stop()
+	}
+	for m.acked < m.spool.next && !expired {
+		m.cond.Wait()
+	}
+	if m.acked < m.spool.next {
+		m.d.setErr(fmt.Errorf("closed before a quorum of relays ACKed blocks %d to %d, kept in the spool",
+			m.acked, m.spool.next-1))
+	}
+	m.stopped = true
+	close(m.stop)
+	m.cond.Broadcast()
+	for _, w := range m.relays {
+		if w.conn != nil {
+			w.conn.Close() // abort writes in progress to lagging relays
+		}
+	}
+	m.lock.Unlock()
+	m.wait.Wait()
+
+	state.Relays = make(map[string]uint64)
+	for _, w := range m.relays {
+		state.Relays[w.server] = w.next
+	}
+}
+
+// write writes blocks from the spool to a relay until stopped
+func (m *multi) write(w *relayWriter) {
+	defer m.wait.Done()
+	for {
+		m.lock.Lock()
+		for w.next >= m.spool.next && !m.stopped {
+			m.cond.Wait()
+		}
+		if m.stopped {
+			m.lock.Unlock()
+			return
+		}
+		var blocks [][]byte
+		var err error
+		for i := w.next; i < m.spool.next && len(blocks) < m.batch; i++ {
+			var block []byte
+			if block, err = m.spool.get(i); err != nil {
+				break
+			}
+			blocks = append(blocks, block)
+		}
+		conn := w.conn
+		m.lock.Unlock()
+
+		if err == nil && conn == nil {
+			if conn, err = net.DialTimeout("tcp", w.server, relayTimeout); err == nil {
+				m.lock.Lock()
+				if m.stopped {
+					m.lock.Unlock()
+					conn.Close()
+					return
+				}
+				w.conn = conn
+				m.lock.Unlock()
+			}
+		}
+		start := time.Now()
+		var receipts []steady.Receipt
+		if err == nil {
+			receipts, err = writeBlocks(conn, m.d.Policy.ID, blocks, m.token)
+		}
+		if err == nil {
+			if rerr := m.d.storeReceipts(w.server, receipts); rerr != nil {
+				m.d.setErr(rerr)
+			}
+		}
+
+		m.lock.Lock()
+		if err == nil {
+			w.next += uint64(len(blocks))
+			w.err = nil
+			m.d.stats.writes.Add(1)
+			m.d.stats.latency.Add(uint64(time.Since(start)))
+		} else {
+			w.err = fmt.Errorf("relay %s: %w", w.server, err)
+			if w.conn != nil {
+				w.conn.Close() // the relay closes the connection on errors
+				w.conn = nil
+			}
+		}
+		m.progress()
+		stopped := m.stopped
+		m.lock.Unlock()
+
+		if err != nil {
+			if stopped {
+				return
+			}
+			m.d.stats.retries.Add(1)
+			select { // retry after a while, the relay is down or refused
+			case <-m.stop:
+				return
+			case <-time.After(time.Second):
+			}
+		}
+	}
+}
+
+// progress ACKs blocks written to a quorum of relays and removes blocks
+// written to all relays from the spool, must hold lock
+func (m *multi) progress() {
+	nexts := make([]uint64, 0, len(m.relays))
+	var err error
+	for _, w := range m.relays {
+		nexts = append(nexts, w.next)
+		if err == nil {
+			err = w.err
+		}
+	}
+	sort.Slice(nexts, func(i, j int) bool { return nexts[i] > nexts[j] })
+	m.d.setErr(err)
+
+	if acked := nexts[m.quorum-1]; acked > m.acked {
+		last, ok := m.pending[acked-1]
+		for i := m.acked; i < acked; i++ {
+			if b, ok := m.pending[i]; ok {
+				m.d.stats.blocks.Add(1)
+				m.d.stats.events.Add(uint64(b.events))
+				delete(m.pending, i)
+			}
+		}
+		m.acked = acked
+		if ok { // not ACKed before the device was loaded
+			m.d.acked(last)
+		}
+	}
+	if err := m.spool.remove(nexts[len(nexts)-1]); err != nil {
+		m.d.setErr(fmt.Errorf("failed to remove blocks from spool: %v", err))
+	}
+	m.cond.Broadcast()
+}
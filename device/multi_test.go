@@ -0,0 +1,366 @@
+package device
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pylls/steady"
+	"github.com/pylls/steady/lc"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpool(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "spool")
+	s, err := openSpool(dir)
+	assert.Nil(t, err, "failed to open spool: %v", err)
+	assert.Equal(t, s.first, s.next, "expected an empty spool")
+
+	for i := uint64(5); i < 8; i++ {
+		assert.Nil(t, s.put(i, []byte{byte(i)}), "failed to put block %d", i)
+	}
+	assert.NotNil(t, s.put(9, []byte{9}), "expected blocks in order")
+	assert.Nil(t, s.remove(6), "failed to remove blocks")
+	_, err = s.get(5)
+	assert.NotNil(t, err, "expected a removed block")
+
+	// reopened from disk
+	s, err = openSpool(dir)
+	assert.Nil(t, err, "failed to reopen spool: %v", err)
+	assert.Equal(t, uint64(6), s.first, "wrong first block")
+	assert.Equal(t, uint64(8), s.next, "wrong next block")
+	block, err := s.get(7)
+	assert.Nil(t, err, "failed to get block: %v", err)
+	assert.Equal(t, []byte{7}, block, "wrong block")
+}
+
+func TestDeviceStateRelays(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "state")
+	state := &DeviceState{NextIndex: 8, TimePrev: 2, LenPrev: 3, NextSeq: 4,
+		Relays: map[string]uint64{"a:22333": 8, "b:22333": 6}}
+	assert.Nil(t, writeDeviceState(state, filename), "failed to write state")
+	read, err := readDeviceState(filename)
+	assert.Nil(t, err, "failed to read state: %v", err)
+	assert.Equal(t, state, read, "wrong state")
+}
+
+func TestContinueFrom(t *testing.T) {
+	vk, sk, _ := lc.SigningKeyGen()
+	pub, _, _ := lc.EncryptKeyGen()
+	p := steady.MakePolicy(sk, vk, pub, 0, 1, 2)
+	block, err := steady.MakeEncodedBlock(4, 0, 10, true, true, p,
+		[]steady.Event{{Time: 10, Seq: 1, Data: []byte{0x10}}}, sk)
+	assert.Nil(t, err, "failed to make encoded block: %v", err)
+	header := block[:steady.WireBlockHeaderSize]
+
+	// up to date, sequence numbers continue
+	state := &DeviceState{NextIndex: 5, NextSeq: 7}
+	assert.Nil(t, state.continueFrom(header, p), "failed to continue")
+	assert.Equal(t, uint64(7), state.NextSeq, "reseeded sequence numbers")
+
+	// stale, the relay has blocks logged after the state was written
+	state = &DeviceState{NextIndex: 2, NextSeq: 7}
+	assert.Nil(t, state.continueFrom(header, p), "failed to continue")
+	assert.Equal(t, uint64(5), state.NextIndex, "wrong next index")
+	assert.True(t, state.NextSeq > 7, "sequence numbers not reseeded")
+}
+
+func TestHistoryFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "history")
+	var h steady.History
+	h.Append([][]byte{{0x01}, {0x02}, {0x03}})
+	assert.Nil(t, writeHistory(h, 8, filename), "failed to write history")
+	read, err := readHistory(filename, 8)
+	assert.Nil(t, err, "failed to read history: %v", err)
+	assert.Equal(t, h.BlockHistory(), read.BlockHistory(), "wrong history")
+	_, err = readHistory(filename, 9)
+	assert.NotNil(t, err, "read stale history")
+}
+
+func TestReceipts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "d")
+	vk, sk, _ := lc.SigningKeyGen()
+	relayVk, relaySk, _ := lc.SigningKeyGen()
+	pub, _, _ := lc.EncryptKeyGen()
+	p := steady.MakePolicy(sk, vk, pub, 0, 1, 2)
+	block, err := steady.MakeEncodedBlock(0, 0, 10, true, true, p,
+		[]steady.Event{{Time: 10, Seq: 1, Data: []byte{0x10}}}, sk)
+	assert.Nil(t, err, "failed to make encoded block: %v", err)
+	bh, err := steady.DecodeBlockHeader(block[:steady.WireBlockHeaderSize], p)
+	assert.Nil(t, err, "failed to decode header: %v", err)
+	r := steady.MakeReceipt(relaySk, relayVk, bh, p.ID, 42)
+
+	d := &Device{receiptsFile: fmt.Sprintf(steady.ReceiptsFilename, path)}
+	assert.Nil(t, d.storeReceipts("a:22333", []steady.Receipt{r, r}), "failed to store receipts")
+	d.SetRelayKey("b:22333", vk)
+	assert.NotNil(t, d.storeReceipts("b:22333", []steady.Receipt{r}),
+		"stored receipt signed by unexpected key")
+
+	receipts, err := ReadReceipts(path)
+	assert.Nil(t, err, "failed to read receipts: %v", err)
+	assert.Equal(t, []steady.Receipt{r, r}, receipts, "wrong receipts")
+	assert.Nil(t, steady.VerifyReceipt(receipts[0], relayVk, p.ID, block), "failed to verify receipt")
+}
+
+// testRelay is a relay in the test process that stores the blocks of one
+// policy, enough for devices to write to it
+type testRelay struct {
+	addr     string
+	policy   steady.Policy
+	vk, sk   []byte
+	lock     sync.Mutex
+	listener net.Listener
+	conns    []net.Conn
+	blocks   [][]byte
+}
+
+func newTestRelay(t *testing.T, p steady.Policy) *testRelay {
+	r := &testRelay{addr: "127.0.0.1:0", policy: p}
+	r.vk, r.sk, _ = lc.SigningKeyGen()
+	r.start(t)
+	return r
+}
+
+// start listens on the address of the relay, the same after a stop
+func (r *testRelay) start(t *testing.T) {
+	l, err := net.Listen("tcp", r.addr)
+	assert.Nil(t, err, "failed to listen: %v", err)
+	r.lock.Lock()
+	r.listener, r.addr = l, l.Addr().String()
+	r.lock.Unlock()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			r.lock.Lock()
+			r.conns = append(r.conns, conn)
+			r.lock.Unlock()
+			go r.serve(conn)
+		}
+	}()
+}
+
+// stop stops listening and closes all connections, keeping the blocks
+func (r *testRelay) stop() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.listener.Close()
+	for _, conn := range r.conns {
+		conn.Close()
+	}
+	r.conns = nil
+}
+
+func (r *testRelay) next() uint64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return uint64(len(r.blocks))
+}
+
+func (r *testRelay) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		f, err := steady.ReadFrame(conn, steady.WireMaxFrameSize)
+		if err != nil {
+			return
+		}
+		switch f.Type {
+		case steady.WireCmdStatus:
+			r.lock.Lock()
+			if len(r.blocks) == 0 {
+				steady.WriteFrame(conn, steady.WireTrue)
+			} else {
+				steady.WriteFrame(conn, steady.WireMore, r.blocks[len(r.blocks)-1][:steady.WireBlockHeaderSize])
+			}
+			r.lock.Unlock()
+		case steady.WireCmdWrite:
+			n := int(binary.BigEndian.Uint16(f.Payload[steady.WireIdentifierSize:]))
+			var blocks [][]byte
+			for i := 0; i < n; i++ {
+				b, err := steady.ReadFrame(conn, steady.WireMaxFrameSize)
+				if err != nil {
+					return
+				}
+				blocks = append(blocks, b.Payload)
+			}
+			reply, ok := r.write(blocks)
+			if !ok {
+				conn.Write(steady.ErrorFrame(steady.NewWireError(steady.WireErrInvalidBlock, "wrong index")))
+				return
+			}
+			steady.WriteFrame(conn, steady.WireTrue, reply)
+		default:
+			return
+		}
+	}
+}
+
+// write stores blocks in order, returning the reply with the ACK and receipts
+func (r *testRelay) write(blocks [][]byte) ([]byte, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var receipts []byte
+	for _, b := range blocks {
+		bh, err := steady.DecodeBlockHeader(b[:steady.WireBlockHeaderSize], r.policy)
+		if err != nil || bh.Index != uint64(len(r.blocks)) {
+			return nil, false
+		}
+		r.blocks = append(r.blocks, b)
+		receipts = append(receipts, steady.EncodeReceipt(
+			steady.MakeReceipt(r.sk, r.vk, bh, r.policy.ID, bh.Index))...)
+	}
+	last := blocks[len(blocks)-1][:8]
+	reply := append(append([]byte{}, last...), lc.Khash([]byte("secret"), []byte("write"), r.policy.ID, last)...)
+	return append(reply, receipts...), true
+}
+
+func TestMultiDevice(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "d")
+	vk, sk, _ := lc.SigningKeyGen()
+	pub, _, _ := lc.EncryptKeyGen()
+	p := steady.MakePolicy(sk, vk, pub, 3600, 1024*1024, uint64(time.Now().Unix()))
+	assert.Nil(t, writeDevice(&Device{Sk: sk, Policy: p}, fmt.Sprintf(steady.SetupFilename, path)),
+		"failed to write device")
+	relays := []*testRelay{newTestRelay(t, p), newTestRelay(t, p), newTestRelay(t, p)}
+	defer func() {
+		for _, r := range relays {
+			r.stop()
+		}
+	}()
+	servers := []string{relays[0].addr, relays[1].addr, relays[2].addr}
+	eventually := func(cond func() bool, msg string) {
+		for start := time.Now(); !cond(); time.Sleep(10 * time.Millisecond) {
+			if time.Since(start) > 5*time.Second {
+				t.Fatal(msg)
+			}
+		}
+	}
+	// each event is a block of its own
+	load := func() (*Device, chan uint64) {
+		d, err := LoadMultiDevice(path, servers, 2, "secret", true, true, 1, 5)
+		assert.Nil(t, err, "failed to load device: %v", err)
+		acks := make(chan uint64, 100)
+		d.SetAckHandler(func(index, nextSeq uint64) { acks <- index })
+		return d, acks
+	}
+
+	// one relay down, a quorum of the others ACKs
+	relays[2].stop()
+	d, acks := load()
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, d.Log(fmt.Sprintf("event %d", i)), "failed to log")
+	}
+	eventually(func() bool { return len(acks) > 0 && relays[0].next() == 3 && relays[1].next() == 3 },
+		"blocks not written to a quorum")
+	for index := range acks {
+		if index == 2 {
+			break
+		}
+	}
+	assert.Equal(t, uint64(0), relays[2].next(), "wrote to a relay that is down")
+	assert.Nil(t, d.Close(), "failed to close")
+
+	// resumed from the state, the relay that was down catches up from the
+	// spool once it recovers
+	state, err := readDeviceState(fmt.Sprintf(steady.DeviceStateFilename, path))
+	assert.Nil(t, err, "failed to read state: %v", err)
+	assert.Equal(t, map[string]uint64{servers[0]: 3, servers[1]: 3, servers[2]: 0}, state.Relays,
+		"wrong progress per relay")
+	relays[2].start(t)
+	d, _ = load()
+	eventually(func() bool { return relays[2].next() == 3 }, "relay did not catch up")
+	assert.Nil(t, d.Log("event 3"), "failed to log")
+	eventually(func() bool {
+		d.multi.lock.Lock()
+		defer d.multi.lock.Unlock()
+		return d.multi.spool.first == 4
+	}, "blocks written to all relays left in the spool")
+	assert.Equal(t, uint64(4), relays[2].next(), "relay did not catch up")
+	assert.Nil(t, d.Close(), "failed to close")
+
+	// without a quorum, close gives up after the timeout and keeps the
+	// block in the spool
+	d, _ = load()
+	relays[0].stop()
+	relays[1].stop()
+	d.SetCloseTimeout(100 * time.Millisecond)
+	assert.Nil(t, d.Log("event 4"), "failed to log")
+	assert.Nil(t, d.Close(), "failed to close")
+	assert.NotNil(t, d.Err(), "expected an error on close without a quorum")
+	s, err := openSpool(fmt.Sprintf(steady.SpoolDirname, path))
+	assert.Nil(t, err, "failed to open spool: %v", err)
+	assert.Equal(t, uint64(5), s.next, "block not kept in the spool")
+	relays[0].start(t)
+	d, _ = load()
+	eventually(func() bool { return relays[0].next() == 5 }, "relay did not catch up")
+	assert.Nil(t, d.Close(), "failed to close")
+}
+
+func TestCloseLargeEvents(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "d")
+	vk, sk, _ := lc.SigningKeyGen()
+	pub, _, _ := lc.EncryptKeyGen()
+	p := steady.MakePolicy(sk, vk, pub, 3600, steady.BlockOverhead+10000, uint64(time.Now().Unix()))
+	assert.Nil(t, writeDevice(&Device{Sk: sk, Policy: p}, fmt.Sprintf(steady.SetupFilename, path)),
+		"failed to write device")
+	relay := newTestRelay(t, p)
+	defer relay.stop()
+
+	// two events that only fit in a block each, queued when closing
+	for i := 0; i < 10; i++ {
+		d, err := LoadMultiDevice(path, []string{relay.addr}, 1, "secret", true, false, 1024*1024, 5)
+		assert.Nil(t, err, "failed to load device: %v", err)
+		assert.Nil(t, d.Log(strings.Repeat("a", 6000)), "failed to log")
+		assert.Nil(t, d.Log(strings.Repeat("b", 6000)), "failed to log")
+		assert.Nil(t, d.Close(), "failed to close")
+	}
+	assert.Equal(t, uint64(20), relay.next(), "expected a block per event")
+	for _, b := range relay.blocks {
+		assert.True(t, uint64(len(b)) <= p.Space, "block of %d bytes larger than the policy", len(b))
+	}
+}
+
+func TestHistoryAcked(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "d")
+	vk, sk, _ := lc.SigningKeyGen()
+	pub, pk, _ := lc.EncryptKeyGen()
+	p := steady.MakePolicy(sk, vk, pub, 3600, 1024*1024, uint64(time.Now().Unix()))
+	assert.Nil(t, writeDevice(&Device{Sk: sk, Policy: p}, fmt.Sprintf(steady.SetupFilename, path)),
+		"failed to write device")
+	relay := newTestRelay(t, p)
+	defer relay.stop()
+
+	// each event is a block of its own, the device stops without closing
+	d, err := LoadMultiDevice(path, []string{relay.addr}, 1, "secret", true, true, 1, 5)
+	assert.Nil(t, err, "failed to load device: %v", err)
+	acks := make(chan uint64, 100)
+	d.SetAckHandler(func(index, nextSeq uint64) { acks <- index })
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, d.Log(fmt.Sprintf("event %d", i)), "failed to log")
+	}
+	for index := range acks {
+		if index == 2 {
+			break
+		}
+	}
+
+	// loaded again, the history continues after the latest block
+	d, err = LoadMultiDevice(path, []string{relay.addr}, 1, "secret", true, true, 1, 5)
+	assert.Nil(t, err, "failed to load device: %v", err)
+	assert.Nil(t, d.Log("event 3"), "failed to log")
+	assert.Nil(t, d.Close(), "failed to close")
+	assert.Equal(t, uint64(4), relay.next(), "expected a block per event")
+	block := relay.blocks[3]
+	bh, err := steady.DecodeBlockHeader(block[:steady.WireBlockHeaderSize], p)
+	assert.Nil(t, err, "failed to decode header: %v", err)
+	_, _, history, err := steady.DecodeBlockPayloadHistory(block[steady.WireBlockHeaderSize:], pub, pk, p, bh)
+	assert.Nil(t, err, "failed to decode payload: %v", err)
+	assert.Equal(t, uint64(4), history.Size, "history started over")
+}
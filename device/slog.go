@@ -0,0 +1,191 @@
+package device
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"runtime"
+	"time"
+
+	"github.com/pylls/steady"
+)
+
+// SlogFacility is the syslog facility (user-level) of events logged by Handler.
+const SlogFacility = 1
+
+// Handler is a slog.Handler that logs records as structured events to a
+// device, e.g., slog.SetDefault(slog.New(device.NewHandler(d, nil))). Close the
+// device on shutdown to flush any buffered events.
+type Handler struct {
+	device *Device
+	opts   slog.HandlerOptions
+	fields []steady.Field // from WithAttrs
+	groups []string       // from WithGroup
+}
+
+// NewHandler creates a handler logging to the device. If opts is nil, the
+// default options are used.
+func NewHandler(d *Device, opts *slog.HandlerOptions) *Handler {
+	h := &Handler{device: d}
+	if opts != nil {
+		h.opts = *opts
+	}
+	return h
+}
+
+// Enabled reports whether the handler handles records at the given level.
+func (h *Handler) Enabled(_ context.Context, level slog.Level) bool {
+	min := slog.LevelInfo
+	if h.opts.Level != nil {
+		min = h.opts.Level.Level()
+	}
+	return level >= min
+}
+
+// Handle logs the record to the device.
+func (h *Handler) Handle(_ context.Context, r slog.Record) error {
+	return h.device.LogEvent(h.event(r))
+}
+
+// WithAttrs returns a handler that adds attrs to every record.
+func (h *Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := h.clone()
+	for _, a := range attrs {
+		h2.fields = h2.appendAttr(h2.fields, h2.groups, a)
+	}
+	return h2
+}
+
+// WithGroup returns a handler that puts all following attributes in a group.
+func (h *Handler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := h.clone()
+	h2.groups = append(h2.groups, name)
+	return h2
+}
+
+func (h *Handler) clone() *Handler {
+	return &Handler{
+		device: h.device,
+		opts:   h.opts,
+		fields: append([]steady.Field{}, h.fields...),
+		groups: append([]string{}, h.groups...),
+	}
+}
+
+// event maps a record to a structured event
+func (h *Handler) event(r slog.Record) steady.StructuredEvent {
+	e := steady.StructuredEvent{
+		Severity: severity(r.Level),
+		Facility: SlogFacility,
+		Message:  r.Message,
+		Fields:   append([]steady.Field{}, h.fields...),
+	}
+	if !r.Time.IsZero() {
+		e.Time = uint64(r.Time.Unix())
+	}
+	if h.opts.AddSource && r.PC != 0 {
+		f, _ := runtime.CallersFrames([]uintptr{r.PC}).Next()
+		e.Fields = h.appendAttr(e.Fields, nil,
+			slog.String(slog.SourceKey, fmt.Sprintf("%s:%d", f.File, f.Line)))
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		e.Fields = h.appendAttr(e.Fields, h.groups, a)
+		return true
+	})
+	return e
+}
+
+// appendAttr appends an attribute as fields, with keys prefixed by groups
+func (h *Handler) appendAttr(fields []steady.Field, groups []string, a slog.Attr) []steady.Field {
+	a.Value = a.Value.Resolve()
+	if a.Value.Kind() != slog.KindGroup && h.opts.ReplaceAttr != nil {
+		a = h.opts.ReplaceAttr(groups, a)
+		a.Value = a.Value.Resolve()
+	}
+	if a.Equal(slog.Attr{}) { // ignore empty attributes
+		return fields
+	}
+
+	if a.Value.Kind() == slog.KindGroup {
+		if a.Key != "" { // inline groups without a key
+			groups = append(groups[:len(groups):len(groups)], a.Key)
+		}
+		for _, ga := range a.Value.Group() {
+			fields = h.appendAttr(fields, groups, ga)
+		}
+		return fields
+	}
+
+	key := a.Key
+	for i := len(groups) - 1; i >= 0; i-- {
+		key = groups[i] + "." + key
+	}
+	return append(fields, steady.Field{Key: key, Value: value(a.Value)})
+}
+
+// value maps a slog value to a value of a field in a structured event
+func value(v slog.Value) interface{} {
+	switch v.Kind() {
+	case slog.KindString:
+		return v.String()
+	case slog.KindInt64:
+		return v.Int64()
+	case slog.KindUint64:
+		return v.Uint64()
+	case slog.KindFloat64:
+		return v.Float64()
+	case slog.KindBool:
+		return v.Bool()
+	case slog.KindDuration:
+		return v.Duration().String()
+	case slog.KindTime:
+		return v.Time().Format(time.RFC3339Nano)
+	}
+	if b, ok := v.Any().([]byte); ok {
+		return b
+	}
+	return fmt.Sprint(v.Any())
+}
+
+// severity maps a slog level to a syslog severity
+func severity(l slog.Level) uint8 {
+	switch {
+	case l >= slog.LevelError:
+		return 3 // error
+	case l >= slog.LevelWarn:
+		return 4 // warning
+	case l >= slog.LevelInfo:
+		return 6 // informational
+	default:
+		return 7 // debug
+	}
+}
+
+// Writer is an io.Writer that logs each written line as an event to a device,
+// e.g., log.SetOutput(device.NewWriter(d)).
+type Writer struct {
+	device *Device
+}
+
+// NewWriter creates a writer logging to the device.
+func NewWriter(d *Device) *Writer {
+	return &Writer{device: d}
+}
+
+// Write logs each non-empty line in p as an event.
+func (w *Writer) Write(p []byte) (int, error) {
+	for _, line := range bytes.Split(p, []byte("\n")) {
+		line = bytes.TrimRight(line, "\r")
+		if len(line) == 0 {
+			continue
+		}
+		if err := w.device.Log(string(line)); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
@@ -0,0 +1,110 @@
+package device
+
+import (
+	"context"
+	"log/slog"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pylls/steady"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandlerEvent(t *testing.T) {
+	var h slog.Handler = NewHandler(nil, &slog.HandlerOptions{Level: slog.LevelWarn})
+	assert.False(t, h.Enabled(context.Background(), slog.LevelInfo), "handler enabled below level")
+	assert.True(t, h.Enabled(context.Background(), slog.LevelError), "handler disabled above level")
+
+	h = h.WithAttrs([]slog.Attr{slog.String("service", "api")}).WithGroup("req")
+	r := slog.NewRecord(time.Unix(1234567890, 0), slog.LevelError, "request failed", 0)
+	r.AddAttrs(slog.Int("status", 500), slog.Bool("retry", false),
+		slog.Group("user", slog.String("id", "42")), slog.Attr{})
+
+	e := h.(*Handler).event(r)
+	assert.True(t, e.Time == 1234567890, "wrong time")
+	assert.True(t, e.Severity == 3, "wrong severity")
+	assert.True(t, e.Message == "request failed", "wrong message")
+	expected := []steady.Field{
+		{Key: "service", Value: "api"},
+		{Key: "req.status", Value: int64(500)},
+		{Key: "req.retry", Value: false},
+		{Key: "req.user.id", Value: "42"},
+	}
+	assert.True(t, len(e.Fields) == len(expected), "wrong number of fields, got %v", e.Fields)
+	for i := 0; i < len(expected) && i < len(e.Fields); i++ {
+		assert.True(t, e.Fields[i] == expected[i], "wrong field, expected %v, got %v",
+			expected[i], e.Fields[i])
+	}
+	_, err := steady.EncodeStructuredEvent(e)
+	assert.Nil(t, err, "failed to encode event: %v", err)
+}
+
+// testDevice is an open device buffering up to 10 logged events in chanLog
+func testDevice(maxSize int) *Device {
+	return &Device{open: true, maxEventSize: maxSize, chanLog: make(chan steady.Event, 10)}
+}
+
+func TestHandlerOptions(t *testing.T) {
+	h := NewHandler(nil, &slog.HandlerOptions{
+		AddSource: true,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			switch {
+			case a.Key == "password":
+				return slog.String(a.Key, "redacted")
+			case a.Key == "drop":
+				return slog.Attr{}
+			case len(groups) > 0 && groups[0] == "req":
+				a.Key = "r" + a.Key
+			}
+			return a
+		},
+	}).WithGroup("req")
+
+	var pcs [1]uintptr
+	runtime.Callers(1, pcs[:])
+	r := slog.NewRecord(time.Time{}, slog.LevelDebug, "msg", pcs[0])
+	r.AddAttrs(slog.String("password", "hunter2"), slog.Int("drop", 1), slog.Int("id", 7))
+
+	e := h.(*Handler).event(r)
+	assert.True(t, e.Time == 0, "zero time not kept")
+	assert.True(t, e.Severity == 7, "wrong severity")
+	assert.True(t, len(e.Fields) == 3, "wrong number of fields, got %v", e.Fields)
+	if len(e.Fields) == 3 {
+		assert.Equal(t, slog.SourceKey, e.Fields[0].Key, "source not first")
+		assert.True(t, strings.Contains(e.Fields[0].Value.(string), "slog_test.go:"),
+			"wrong source %v", e.Fields[0].Value)
+		assert.Equal(t, steady.Field{Key: "req.password", Value: "redacted"}, e.Fields[1], "not replaced")
+		assert.Equal(t, steady.Field{Key: "req.rid", Value: int64(7)}, e.Fields[2], "not replaced")
+	}
+}
+
+func TestWriter(t *testing.T) {
+	d := testDevice(5)
+	w := NewWriter(d)
+	p := []byte("one\r\n\ntwo\n\nthree")
+	n, err := w.Write(p)
+	assert.Nil(t, err, "failed to write: %v", err)
+	assert.Equal(t, len(p), n, "wrong length written")
+	for _, line := range []string{"one", "two", "three"} {
+		assert.Equal(t, line, string((<-d.chanLog).Data), "wrong line")
+	}
+	assert.True(t, len(d.chanLog) == 0, "logged empty line")
+
+	// a line that fails to log fails the write, lines before it are logged
+	n, err = w.Write([]byte("four\ntoo long\nfive\n"))
+	assert.NotNil(t, err, "logged too long line")
+	assert.Equal(t, 0, n, "partial write not 0")
+	assert.Equal(t, "four", string((<-d.chanLog).Data), "wrong line")
+	assert.True(t, len(d.chanLog) == 0, "logged lines after the failed line")
+}
+
+func TestLogStructuredPrefix(t *testing.T) {
+	d := testDevice(steady.MaxEventSize)
+	assert.NotNil(t, d.Log(steady.StructuredEventPrefix+"spoofed"), "logged text with prefix")
+	assert.Nil(t, d.LogEvent(steady.StructuredEvent{Message: "hello"}), "failed to log event")
+	e := <-d.chanLog
+	assert.True(t, steady.IsStructuredEvent(e.Data), "structured event not encoded")
+	assert.True(t, len(d.chanLog) == 0, "logged rejected text")
+}
@@ -0,0 +1,88 @@
+package device
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// spool keeps encoded blocks on disk, one file per block named by index,
+// until all relays have ACKed them. Lagging relays catch up from the spool.
+type spool struct {
+	dir string
+	// first is the lowest index in the spool, next the index after the
+	// highest, first == next if empty
+	first, next uint64
+}
+
+const spoolSuffix = ".block"
+
+// openSpool opens the spool in dir, creating it if needed.
+func openSpool(dir string) (*spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	s := &spool{dir: dir}
+	empty := true
+	for _, e := range entries {
+		index, err := strconv.ParseUint(strings.TrimSuffix(e.Name(), spoolSuffix), 10, 64)
+		if err != nil || !strings.HasSuffix(e.Name(), spoolSuffix) {
+			continue // e.g., a partially written block
+		}
+		if empty || index < s.first {
+			s.first = index
+		}
+		if empty || index >= s.next {
+			s.next = index + 1
+		}
+		empty = false
+	}
+	return s, nil
+}
+
+func (s *spool) filename(index uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", index, spoolSuffix))
+}
+
+// put adds the block with the next index to the spool.
+func (s *spool) put(index uint64, block []byte) error {
+	if s.first != s.next && index != s.next {
+		return fmt.Errorf("expected block %d in spool, got %d", s.next, index)
+	}
+	tmp := s.filename(index) + ".tmp"
+	if err := os.WriteFile(tmp, block, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.filename(index)); err != nil {
+		return err
+	}
+	if s.first == s.next {
+		s.first = index
+	}
+	s.next = index + 1
+	return nil
+}
+
+// get returns the block with the given index from the spool.
+func (s *spool) get(index uint64) ([]byte, error) {
+	if index < s.first || index >= s.next {
+		return nil, fmt.Errorf("block %d not in spool [%d, %d)", index, s.first, s.next)
+	}
+	return os.ReadFile(s.filename(index))
+}
+
+// remove removes all blocks with an index below the given index.
+func (s *spool) remove(below uint64) error {
+	for ; s.first < below && s.first < s.next; s.first++ {
+		if err := os.Remove(s.filename(s.first)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package steady
+
+import (
+	"crypto/subtle"
+	"fmt"
+
+	"github.com/pylls/steady/lc"
+)
+
+// Disclosure reveals a subset of the events of a block to a third party. The
+// signed header binds the root (through the IV) and each disclosed event has
+// an audit path to the root.
+type Disclosure struct {
+	// Header is the encoded block header, signed by the device.
+	Header []byte
+	// IV, Root, and History are such that BlockRootHash(version, IV, Root,
+	// History) is the signed RootHash.
+	IV, Root []byte
+	// History is the history of the device committed to by blocks of
+	// BlockVersionHistory, nil for older versions.
+	History *BlockHistory `json:",omitempty"`
+	// TreeSize is the number of events in the block.
+	TreeSize uint64
+	Events   []DisclosedEvent
+}
+
+// DisclosedEvent is an event in a Disclosure.
+type DisclosedEvent struct {
+	Index int
+	Event Event
+	Path  [][]byte
+}
+
+// MakeDisclosure makes a disclosure of the events with the given indices out
+// of the (decoded) events and history of a block, see
+// DecodeBlockPayloadHistory.
+func MakeDisclosure(bh BlockHeader, events []Event, IV []byte, history *BlockHistory,
+	indices []int) (*Disclosure, error) {
+	leaves := EventLeaves(bh.Version, events)
+	d := &Disclosure{
+		Header:   EncodeBlockHeader(bh),
+		IV:       IV,
+		Root:     MerkleTreeHash(leaves),
+		History:  history,
+		TreeSize: uint64(len(events)),
+	}
+	if subtle.ConstantTimeCompare(BlockRootHash(bh.Version, IV, d.Root, history), bh.RootHash) != 1 {
+		return nil, fmt.Errorf("events, IV, and history do not match the root hash of the block")
+	}
+
+	for _, i := range indices {
+		if i < 0 || i >= len(events) {
+			return nil, fmt.Errorf("no event with index %d in block", i)
+		}
+		d.Events = append(d.Events, DisclosedEvent{
+			Index: i,
+			Event: events[i],
+			Path:  AuditPath(i, leaves),
+		})
+	}
+	return d, nil
+}
+
+// VerifyDisclosure verifies a disclosure for a policy, returning the header of
+// the block with the disclosed events.
+func VerifyDisclosure(d *Disclosure, policy Policy) (BlockHeader, error) {
+	bh, err := DecodeBlockHeader(d.Header, policy)
+	if err != nil {
+		return BlockHeader{}, err
+	}
+	if bh.Version >= BlockVersionHistory && (d.History == nil ||
+		len(d.History.Root) != lc.HashOutputLen) {
+		return BlockHeader{}, fmt.Errorf("missing history of block with version %d", bh.Version)
+	}
+	if subtle.ConstantTimeCompare(BlockRootHash(bh.Version, d.IV, d.Root, d.History),
+		bh.RootHash) != 1 {
+		return BlockHeader{}, fmt.Errorf("IV, root, and history do not match the signed root hash")
+	}
+
+	disclosed := make(map[int]bool)
+	for _, e := range d.Events {
+		if e.Index < 0 || uint64(e.Index) >= d.TreeSize {
+			return BlockHeader{}, fmt.Errorf("event index %d outside of block with %d events",
+				e.Index, d.TreeSize)
+		}
+		if disclosed[e.Index] {
+			return BlockHeader{}, fmt.Errorf("event index %d disclosed more than once", e.Index)
+		}
+		disclosed[e.Index] = true
+		if subtle.ConstantTimeCompare(RootFromAuditPath(EventLeaf(bh.Version, e.Event),
+			e.Index, int(d.TreeSize), e.Path), d.Root) != 1 {
+			return BlockHeader{}, fmt.Errorf("event with index %d is not in the block", e.Index)
+		}
+	}
+	return bh, nil
+}
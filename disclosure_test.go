@@ -0,0 +1,62 @@
+package steady
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pylls/steady/lc"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDisclosure(t *testing.T) {
+	vk, sk, _ := lc.SigningKeyGen()
+	pub, pk, _ := lc.EncryptKeyGen()
+	p := MakePolicy(sk, vk, pub, 0, 1, 2)
+
+	events := makeEvents([][]byte{{0x10}, {0x20, 0x21}, {0x30, 0x31}, {0x40}, {0x50}})
+	block, err := MakeEncodedBlock(3, 0, uint64(time.Now().Unix()), true, true, p, events, sk)
+	assert.Nil(t, err, "failed to make encoded block: %s", err)
+	bh, err := DecodeBlockHeader(block[:WireBlockHeaderSize], p)
+	assert.Nil(t, err, "failed to decode valid header: %s", err)
+	recEvents, iv, err := DecodeBlockPayload(block[WireBlockHeaderSize:], pub, pk, p, bh)
+	assert.Nil(t, err, "failed to decode valid payload: %s", err)
+
+	d, err := MakeDisclosure(bh, recEvents, iv, nil, []int{1, 4})
+	assert.Nil(t, err, "failed to make disclosure: %s", err)
+	assert.True(t, len(d.Events) == 2, "unexpected number of disclosed events")
+	dbh, err := VerifyDisclosure(d, p)
+	assert.Nil(t, err, "failed to verify valid disclosure: %s", err)
+	assert.True(t, dbh.Index == 3, "wrong block index in disclosure")
+
+	_, err = MakeDisclosure(bh, recEvents, iv, nil, []int{5})
+	assert.NotNil(t, err, "made disclosure for event not in block")
+
+	// an event not in the block
+	d.Events[0].Event.Data = []byte{0x66}
+	_, err = VerifyDisclosure(d, p)
+	assert.NotNil(t, err, "verified disclosure of modified event")
+	d.Events[0].Event = recEvents[1]
+
+	// a valid event with the wrong time or sequence number
+	d.Events[1].Event.Seq++
+	_, err = VerifyDisclosure(d, p)
+	assert.NotNil(t, err, "verified disclosure of event with modified seq")
+	d.Events[1].Event = recEvents[4]
+
+	// a valid event at the wrong index
+	d.Events[1].Index = 3
+	_, err = VerifyDisclosure(d, p)
+	assert.NotNil(t, err, "verified disclosure with wrong index")
+	d.Events[1].Index = 4
+
+	// an index outside of the block
+	d.Events[1].Index = 5
+	_, err = VerifyDisclosure(d, p)
+	assert.NotNil(t, err, "verified disclosure with index outside of block")
+	d.Events[1].Index = 4
+
+	// wrong IV
+	d.IV = make([]byte, IVsize)
+	_, err = VerifyDisclosure(d, p)
+	assert.NotNil(t, err, "verified disclosure with wrong IV")
+}
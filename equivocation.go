@@ -0,0 +1,87 @@
+package steady
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Equivocation is proof that the device of a policy signed two different
+// block headers with the same index, verifiable with only the policy. An
+// honest device never does, but a device that lost its state can be rolled
+// back by a relay, and a relay can show different collectors different
+// forks of such a device.
+type Equivocation struct {
+	// ID is the ID of the policy.
+	ID    []byte
+	Index uint64
+	// A and B are the encoded block headers, both signed by the device.
+	A, B []byte
+}
+
+// MakeEquivocation makes an equivocation out of two encoded block headers,
+// failing unless the headers prove an equivocation (see VerifyEquivocation).
+func MakeEquivocation(policy Policy, a, b []byte) (*Equivocation, error) {
+	if len(a) < WireBlockHeaderSize || len(b) < WireBlockHeaderSize {
+		return nil, fmt.Errorf("too short block header")
+	}
+	e := &Equivocation{
+		ID: policy.ID,
+		A:  a[:WireBlockHeaderSize],
+		B:  b[:WireBlockHeaderSize],
+	}
+	bh, err := DecodeBlockHeader(e.A, policy)
+	if err != nil {
+		return nil, err
+	}
+	e.Index = bh.Index
+	if err = VerifyEquivocation(e, policy); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// VerifyEquivocation verifies that both headers of an equivocation are
+// signed by the device of the policy, have the index of the equivocation,
+// and differ in what is signed (the header hash, root hash, or time).
+func VerifyEquivocation(e *Equivocation, policy Policy) error {
+	if !bytes.Equal(e.ID, policy.ID) {
+		return fmt.Errorf("equivocation for another policy")
+	}
+	a, err := DecodeBlockHeader(e.A, policy)
+	if err != nil {
+		return fmt.Errorf("first header: %v", err)
+	}
+	b, err := DecodeBlockHeader(e.B, policy)
+	if err != nil {
+		return fmt.Errorf("second header: %v", err)
+	}
+	if a.Index != e.Index || b.Index != e.Index {
+		return fmt.Errorf("headers with index %d and %d, expected %d", a.Index, b.Index, e.Index)
+	}
+	if bytes.Equal(a.HeaderHash, b.HeaderHash) && bytes.Equal(a.RootHash, b.RootHash) &&
+		a.Time == b.Time {
+		return fmt.Errorf("headers sign the same block")
+	}
+	return nil
+}
+
+// EncodeEquivocation encodes an equivocation as sent on the wire.
+func EncodeEquivocation(e *Equivocation) []byte {
+	b := make([]byte, 0, WireEquivocationSize)
+	b = append(b, e.ID...)
+	b = append(b, e.A...)
+	return append(b, e.B...)
+}
+
+// DecodeEquivocation decodes and verifies an equivocation for a policy.
+func DecodeEquivocation(b []byte, policy Policy) (*Equivocation, error) {
+	if len(b) != WireEquivocationSize {
+		return nil, fmt.Errorf("invalid encoded equivocation length, expected %d, got %d",
+			WireEquivocationSize, len(b))
+	}
+	if !bytes.Equal(b[:WireIdentifierSize], policy.ID) {
+		return nil, fmt.Errorf("equivocation for another policy")
+	}
+	return MakeEquivocation(policy, b[WireIdentifierSize:WireIdentifierSize+WireBlockHeaderSize],
+		b[WireIdentifierSize+WireBlockHeaderSize:])
+}
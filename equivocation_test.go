@@ -0,0 +1,55 @@
+package steady
+
+import (
+	"testing"
+
+	"github.com/pylls/steady/lc"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEquivocation(t *testing.T) {
+	vk, sk, _ := lc.SigningKeyGen()
+	pub, _, _ := lc.EncryptKeyGen()
+	p := MakePolicy(sk, vk, pub, 0, 1, 2)
+
+	block := func(index, time uint64, data byte) []byte {
+		b, err := MakeEncodedBlock(index, 0, time, true, true, p,
+			makeEvents([][]byte{{data}}), sk)
+		assert.Nil(t, err, "failed to make encoded block: %s", err)
+		return b
+	}
+	a, b := block(3, 10, 0x10), block(3, 10, 0x20)
+
+	e, err := MakeEquivocation(p, a, b)
+	assert.Nil(t, err, "failed to make equivocation: %s", err)
+	assert.True(t, e.Index == 3, "wrong index")
+	assert.Nil(t, VerifyEquivocation(e, p), "failed to verify equivocation")
+
+	d, err := DecodeEquivocation(EncodeEquivocation(e), p)
+	assert.Nil(t, err, "failed to decode equivocation: %s", err)
+	assert.Equal(t, e, d, "wrong decoded equivocation")
+
+	// the same block twice
+	_, err = MakeEquivocation(p, a, a)
+	assert.NotNil(t, err, "made equivocation of the same block")
+
+	// different indices
+	_, err = MakeEquivocation(p, a, block(4, 10, 0x20))
+	assert.NotNil(t, err, "made equivocation of blocks with different indices")
+
+	// another device
+	vk2, sk2, _ := lc.SigningKeyGen()
+	other, err := MakeEncodedBlock(3, 0, 10, true, true, p, makeEvents([][]byte{{0x30}}), sk2)
+	assert.Nil(t, err, "failed to make encoded block: %s", err)
+	_, err = MakeEquivocation(p, a, other)
+	assert.NotNil(t, err, "made equivocation with a header not signed by the device")
+
+	// another policy
+	p2 := MakePolicy(sk2, vk2, pub, 0, 1, 2)
+	assert.NotNil(t, VerifyEquivocation(e, p2), "verified equivocation for another policy")
+
+	// a modified header
+	e.B = append([]byte{}, e.B...)
+	e.B[WireBlockHeaderSize-1] ^= 0x01
+	assert.NotNil(t, VerifyEquivocation(e, p), "verified equivocation with a modified signature")
+}
@@ -0,0 +1,112 @@
+package steady
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// WireError is an error reply from the relay, sent as an error frame:
+// WireErr, the code, and the length (uint16) and text of the message.
+type WireError struct {
+	Code    byte
+	Message string
+}
+
+// errors by code, for use with errors.Is
+var (
+	ErrVersion       = &WireError{Code: WireErrVersion}
+	ErrCommand       = &WireError{Code: WireErrCommand}
+	ErrRequest       = &WireError{Code: WireErrRequest}
+	ErrAuth          = &WireError{Code: WireErrAuth}
+	ErrNoPolicy      = &WireError{Code: WireErrNoPolicy}
+	ErrPolicyExists  = &WireError{Code: WireErrPolicyExists}
+	ErrInvalidPolicy = &WireError{Code: WireErrInvalidPolicy}
+	ErrLimit         = &WireError{Code: WireErrLimit}
+	ErrInvalidBlock  = &WireError{Code: WireErrInvalidBlock}
+	ErrRetired       = &WireError{Code: WireErrRetired}
+)
+
+var wireErrorNames = map[byte]string{
+	WireErrUnknown:       "unknown error",
+	WireErrVersion:       "unsupported version",
+	WireErrCommand:       "unknown command",
+	WireErrRequest:       "malformed request",
+	WireErrAuth:          "invalid auth",
+	WireErrNoPolicy:      "no such policy",
+	WireErrPolicyExists:  "policy already exists",
+	WireErrInvalidPolicy: "invalid policy",
+	WireErrLimit:         "outside of relay limits",
+	WireErrInvalidBlock:  "invalid block",
+	WireErrRetired:       "policy is retired",
+}
+
+// NewWireError makes a wire error with a formatted message.
+func NewWireError(code byte, format string, args ...interface{}) *WireError {
+	return &WireError{
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+func (e *WireError) Error() string {
+	name, exists := wireErrorNames[e.Code]
+	if !exists {
+		name = wireErrorNames[WireErrUnknown]
+	}
+	if e.Message == "" {
+		return "relay: " + name
+	}
+	return fmt.Sprintf("relay: %s: %s", name, e.Message)
+}
+
+// Is reports if target is a wire error with the same code.
+func (e *WireError) Is(target error) bool {
+	t, ok := target.(*WireError)
+	return ok && t.Code == e.Code
+}
+
+// EncodeWireError encodes an error frame, truncating long messages.
+func EncodeWireError(e *WireError) []byte {
+	msg := e.Message
+	if len(msg) > 0xffff {
+		msg = msg[:0xffff]
+	}
+	b := []byte{WireErr, e.Code}
+	b = binary.BigEndian.AppendUint16(b, uint16(len(msg)))
+	return append(b, msg...)
+}
+
+// ReadWireError reads the rest of an error frame, after the leading WireErr
+// byte, returning the read wire error.
+func ReadWireError(r io.Reader) (*WireError, error) {
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, fmt.Errorf("failed to read error frame: %v", err)
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(buf[1:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, fmt.Errorf("failed to read error frame: %v", err)
+	}
+	return &WireError{
+		Code:    buf[0],
+		Message: string(msg),
+	}, nil
+}
+
+// ReadStatus reads the status byte that starts a reply, returning the status
+// or the wire error of an error frame.
+func ReadStatus(r io.Reader) (byte, error) {
+	buf := make([]byte, 1)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return 0, fmt.Errorf("failed to read reply: %v", err)
+	}
+	if buf[0] != WireErr {
+		return buf[0], nil
+	}
+	e, err := ReadWireError(r)
+	if err != nil {
+		return 0, err
+	}
+	return WireErr, e
+}
@@ -0,0 +1,30 @@
+package steady
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWireError(t *testing.T) {
+	r := bytes.NewReader(append(EncodeWireError(NewWireError(WireErrRetired, "at index %d", 42)),
+		WireTrue))
+
+	status, err := ReadStatus(r)
+	assert.Equal(t, byte(WireErr), status, "expected error frame")
+	var e *WireError
+	assert.True(t, errors.As(err, &e), "expected a wire error, got %v", err)
+	assert.Equal(t, "at index 42", e.Message, "wrong message")
+	assert.True(t, errors.Is(fmt.Errorf("wrapped: %w", err), ErrRetired), "not retired")
+	assert.False(t, errors.Is(err, ErrAuth), "wrong code")
+
+	status, err = ReadStatus(r)
+	assert.Nil(t, err, "failed to read status: %v", err)
+	assert.Equal(t, byte(WireTrue), status, "wrong status")
+
+	_, err = ReadStatus(bytes.NewReader([]byte{WireErr, WireErrAuth, 0, 5, 'a'}))
+	assert.NotNil(t, err, "read truncated error frame")
+}
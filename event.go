@@ -0,0 +1,202 @@
+package steady
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// StructuredEventPrefix marks an event as a structured event (see
+// EncodeStructuredEvent). Device.Log rejects text events with the prefix.
+const StructuredEventPrefix = "\x00se\x01"
+
+// field value types in the structured event encoding
+const (
+	fieldString = iota
+	fieldInt
+	fieldUint
+	fieldFloat
+	fieldBool
+	fieldBytes
+)
+
+// StructuredEvent is an event with typed fields, encoded on top of the opaque
+// events of a block. Severity and Facility are as in syslog (RFC 5424).
+type StructuredEvent struct {
+	Time               uint64
+	Severity, Facility uint8
+	Message            string
+	Fields             []Field
+}
+
+// Field is a key/value pair of a structured event. The value is one of
+// string, int64, uint64, float64, bool, or []byte. An int is encoded as int64.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// IsStructuredEvent returns true if the event is an encoded structured event.
+func IsStructuredEvent(event []byte) bool {
+	return bytes.HasPrefix(event, []byte(StructuredEventPrefix))
+}
+
+// EncodeStructuredEvent encodes a structured event as an event.
+func EncodeStructuredEvent(e StructuredEvent) ([]byte, error) {
+	b := []byte(StructuredEventPrefix)
+	b = binary.AppendUvarint(b, e.Time)
+	b = append(b, e.Severity, e.Facility)
+	b = appendString(b, e.Message)
+	b = binary.AppendUvarint(b, uint64(len(e.Fields)))
+	for i := 0; i < len(e.Fields); i++ {
+		b = appendString(b, e.Fields[i].Key)
+		switch v := e.Fields[i].Value.(type) {
+		case string:
+			b = appendString(append(b, fieldString), v)
+		case int64:
+			b = binary.AppendVarint(append(b, fieldInt), v)
+		case int:
+			b = binary.AppendVarint(append(b, fieldInt), int64(v))
+		case uint64:
+			b = binary.AppendUvarint(append(b, fieldUint), v)
+		case float64:
+			b = binary.BigEndian.AppendUint64(append(b, fieldFloat), math.Float64bits(v))
+		case bool:
+			if v {
+				b = append(b, fieldBool, WireTrue)
+			} else {
+				b = append(b, fieldBool, WireFalse)
+			}
+		case []byte:
+			b = appendString(append(b, fieldBytes), string(v))
+		default:
+			return nil, fmt.Errorf("unsupported type %T of field %s", v, e.Fields[i].Key)
+		}
+	}
+	return b, nil
+}
+
+// DecodeStructuredEvent decodes an encoded structured event.
+func DecodeStructuredEvent(event []byte) (e StructuredEvent, err error) {
+	if !IsStructuredEvent(event) {
+		return e, fmt.Errorf("not a structured event")
+	}
+	d := &decoder{buf: event[len(StructuredEventPrefix):]}
+	e.Time = d.uvarint()
+	e.Severity = d.byte()
+	e.Facility = d.byte()
+	e.Message = d.string()
+	n := d.uvarint()
+	if n > uint64(len(d.buf)) { // each field is at least one byte
+		return StructuredEvent{}, fmt.Errorf("invalid number of fields")
+	}
+	for i := uint64(0); i < n && d.err == nil; i++ {
+		f := Field{Key: d.string()}
+		switch d.byte() {
+		case fieldString:
+			f.Value = d.string()
+		case fieldInt:
+			f.Value = d.varint()
+		case fieldUint:
+			f.Value = d.uvarint()
+		case fieldFloat:
+			f.Value = math.Float64frombits(d.uint64())
+		case fieldBool:
+			f.Value = d.byte() == WireTrue
+		case fieldBytes:
+			f.Value = []byte(d.string())
+		default:
+			d.fail()
+		}
+		e.Fields = append(e.Fields, f)
+	}
+	if d.err == nil && len(d.buf) > 0 {
+		d.fail()
+	}
+	if d.err != nil {
+		return StructuredEvent{}, d.err
+	}
+	return e, nil
+}
+
+// String returns a single line text representation of the event.
+func (e StructuredEvent) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s <%d.%d> %s", time.Unix(int64(e.Time), 0).UTC().Format(time.RFC3339),
+		e.Facility, e.Severity, e.Message)
+	for i := 0; i < len(e.Fields); i++ {
+		fmt.Fprintf(&b, " %s=%v", e.Fields[i].Key, e.Fields[i].Value)
+	}
+	return b.String()
+}
+
+func appendString(b []byte, s string) []byte {
+	return append(binary.AppendUvarint(b, uint64(len(s))), s...)
+}
+
+// decoder reads from buf until the first error
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) fail() {
+	if d.err == nil {
+		d.err = fmt.Errorf("invalid encoded structured event")
+	}
+	d.buf = nil
+}
+
+func (d *decoder) uvarint() uint64 {
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.fail()
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *decoder) varint() int64 {
+	v, n := binary.Varint(d.buf)
+	if n <= 0 {
+		d.fail()
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *decoder) byte() byte {
+	if len(d.buf) < 1 {
+		d.fail()
+		return 0
+	}
+	v := d.buf[0]
+	d.buf = d.buf[1:]
+	return v
+}
+
+func (d *decoder) uint64() uint64 {
+	if len(d.buf) < 8 {
+		d.fail()
+		return 0
+	}
+	v := binary.BigEndian.Uint64(d.buf)
+	d.buf = d.buf[8:]
+	return v
+}
+
+func (d *decoder) string() string {
+	l := d.uvarint()
+	if l > uint64(len(d.buf)) {
+		d.fail()
+		return ""
+	}
+	s := string(d.buf[:l])
+	d.buf = d.buf[l:]
+	return s
+}
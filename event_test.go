@@ -0,0 +1,50 @@
+package steady
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStructuredEvent(t *testing.T) {
+	e := StructuredEvent{
+		Time:     1234567890,
+		Severity: 3,
+		Facility: 4,
+		Message:  "login failed",
+		Fields: []Field{
+			{Key: "user", Value: "root"},
+			{Key: "attempt", Value: int64(-3)},
+			{Key: "port", Value: uint64(22)},
+			{Key: "score", Value: 0.75},
+			{Key: "blocked", Value: true},
+			{Key: "raw", Value: []byte{0x00, 0x01}},
+		},
+	}
+	b, err := EncodeStructuredEvent(e)
+	assert.Nil(t, err, "failed to encode structured event: %v", err)
+	assert.True(t, IsStructuredEvent(b), "encoded event not structured")
+	assert.False(t, IsStructuredEvent([]byte("login failed")), "text event is structured")
+
+	e2, err := DecodeStructuredEvent(b)
+	assert.Nil(t, err, "failed to decode structured event: %v", err)
+	assert.True(t, e.Time == e2.Time, "Time mismatch after encode and decode")
+	assert.True(t, e.Severity == e2.Severity, "Severity mismatch after encode and decode")
+	assert.True(t, e.Facility == e2.Facility, "Facility mismatch after encode and decode")
+	assert.True(t, e.Message == e2.Message, "Message mismatch after encode and decode")
+	assert.True(t, len(e.Fields) == len(e2.Fields), "Fields mismatch after encode and decode")
+	for i := 0; i < len(e.Fields)-1; i++ {
+		assert.True(t, e.Fields[i] == e2.Fields[i], "Field %s mismatch after encode and decode",
+			e.Fields[i].Key)
+	}
+	assert.True(t, bytes.Equal(e2.Fields[5].Value.([]byte), []byte{0x00, 0x01}),
+		"Field raw mismatch after encode and decode")
+
+	for i := len(StructuredEventPrefix); i < len(b); i++ {
+		_, err = DecodeStructuredEvent(b[:i])
+		assert.NotNil(t, err, "decoded truncated structured event of length %d", i)
+	}
+	_, err = EncodeStructuredEvent(StructuredEvent{Fields: []Field{{Key: "bad", Value: struct{}{}}}})
+	assert.NotNil(t, err, "encoded field with unsupported type")
+}
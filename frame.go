@@ -0,0 +1,104 @@
+package steady
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Frame is a length-prefixed message on the wire: the version, the type, the
+// length (uint32) of the payload, and the payload. Requests are typed by
+// command and replies by status. Blocks that follow a write request, or a
+// reply to read, are sent in frames of type WireMore, one block per frame.
+// Failures are replied to with a frame of type WireErr, with the error code
+// and message as payload.
+type Frame struct {
+	Version, Type byte
+	Payload       []byte
+}
+
+// EncodeFrame encodes a frame as sent on the wire.
+func EncodeFrame(f Frame) []byte {
+	b := make([]byte, 0, WireFrameHeaderSize+len(f.Payload))
+	b = append(b, f.Version, f.Type)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(f.Payload)))
+	return append(b, f.Payload...)
+}
+
+// WriteFrame writes an encoded frame of the current version.
+func WriteFrame(w io.Writer, t byte, payload ...[]byte) error {
+	var p []byte
+	for _, b := range payload {
+		p = append(p, b...)
+	}
+	_, err := w.Write(EncodeFrame(Frame{Version: WireVersion, Type: t, Payload: p}))
+	return err
+}
+
+// ReadFrame reads a frame with a payload of at most max bytes.
+func ReadFrame(r io.Reader, max int) (Frame, error) {
+	header := make([]byte, WireFrameHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return Frame{}, fmt.Errorf("failed to read frame header: %v", err)
+	}
+	return ReadFramePayload(r, header[0], header[1], header[2:], max)
+}
+
+// ReadFramePayload reads the payload of a frame, given the version, type and
+// encoded length already read from r. The payload grows as it is read, such
+// that a large length alone does not allocate up to max bytes.
+func ReadFramePayload(r io.Reader, version, t byte, length []byte, max int) (Frame, error) {
+	size := binary.BigEndian.Uint32(length)
+	if uint64(size) > uint64(max) {
+		return Frame{}, fmt.Errorf("too large frame, max is %d, got %d", max, size)
+	}
+	payload := bytes.NewBuffer(make([]byte, 0, min(int(size), frameReadChunk)))
+	if _, err := io.CopyN(payload, r, int64(size)); err != nil {
+		return Frame{}, fmt.Errorf("failed to read frame payload: %v", err)
+	}
+	return Frame{
+		Version: version,
+		Type:    t,
+		Payload: payload.Bytes(),
+	}, nil
+}
+
+// frameReadChunk is the initial capacity of a payload being read
+const frameReadChunk = 64 * 1024
+
+// ReadReply reads a reply frame, returning the wire error of an error frame.
+func ReadReply(r io.Reader) (Frame, error) {
+	f, err := ReadFrame(r, WireMaxFrameSize)
+	if err != nil {
+		return f, err
+	}
+	if f.Type == WireErr {
+		e, err := DecodeWireError(f.Payload)
+		if err != nil {
+			return f, err
+		}
+		return f, e
+	}
+	return f, nil
+}
+
+// ErrorFrame encodes a wire error as a frame.
+func ErrorFrame(e *WireError) []byte {
+	return EncodeFrame(Frame{
+		Version: WireVersion,
+		Type:    WireErr,
+		Payload: append([]byte{e.Code}, e.Message...),
+	})
+}
+
+// DecodeWireError decodes the payload of an error frame.
+func DecodeWireError(payload []byte) (*WireError, error) {
+	if len(payload) == 0 {
+		return nil, fmt.Errorf("empty error frame")
+	}
+	return &WireError{
+		Code:    payload[0],
+		Message: string(payload[1:]),
+	}, nil
+}
@@ -0,0 +1,55 @@
+package steady
+
+import (
+	"bytes"
+	"errors"
+	"runtime"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFrame(t *testing.T) {
+	var b bytes.Buffer
+	assert.Nil(t, WriteFrame(&b, WireCmdRead, []byte("foo"), []byte("bar")), "failed to write frame")
+	b.Write(ErrorFrame(NewWireError(WireErrNoPolicy, "foobar")))
+	b.Write(EncodeFrame(Frame{Version: WireVersion, Type: WireTrue}))
+
+	// deliver the frames byte by byte
+	r := iotest.OneByteReader(&b)
+	f, err := ReadFrame(r, WireMaxFrameSize)
+	assert.Nil(t, err, "failed to read frame: %v", err)
+	assert.Equal(t, byte(WireVersion), f.Version, "wrong version")
+	assert.Equal(t, byte(WireCmdRead), f.Type, "wrong type")
+	assert.Equal(t, []byte("foobar"), f.Payload, "wrong payload")
+
+	f, err = ReadReply(r)
+	assert.Equal(t, byte(WireErr), f.Type, "expected error frame")
+	assert.True(t, errors.Is(err, ErrNoPolicy), "expected no policy, got %v", err)
+	assert.Equal(t, "relay: no such policy: foobar", err.Error(), "wrong error")
+
+	f, err = ReadReply(r)
+	assert.Nil(t, err, "failed to read reply: %v", err)
+	assert.Equal(t, byte(WireTrue), f.Type, "wrong status")
+	assert.Empty(t, f.Payload, "expected empty payload")
+
+	// too large and truncated frames
+	large := EncodeFrame(Frame{Version: WireVersion, Type: WireMore, Payload: make([]byte, 10)})
+	_, err = ReadFrame(bytes.NewReader(large), 9)
+	assert.NotNil(t, err, "read too large frame")
+	_, err = ReadFrame(bytes.NewReader(large[:len(large)-1]), 10)
+	assert.NotNil(t, err, "read truncated frame")
+	_, err = ReadFrame(bytes.NewReader(large[:WireFrameHeaderSize-1]), 10)
+	assert.NotNil(t, err, "read truncated frame header")
+
+	// the payload grows as it is read, a large length alone allocates little
+	huge := []byte{WireVersion, WireMore, 0x06, 0x40, 0x00, 0x00, 0x01}
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err = ReadFrame(bytes.NewReader(huge), WireMaxFrameSize)
+	runtime.ReadMemStats(&after)
+	assert.NotNil(t, err, "read truncated frame")
+	assert.True(t, after.TotalAlloc-before.TotalAlloc < 1024*1024,
+		"allocated %d bytes", after.TotalAlloc-before.TotalAlloc)
+}
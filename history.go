@@ -0,0 +1,521 @@
+package steady
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"os"
+
+	"github.com/pylls/steady/lc"
+)
+
+// BlockHistory is the history of a device committed to by a block of
+// BlockVersionHistory: the size and root of the Merkle tree over the leaves
+// (see EventLeaf) of all events logged by the device, up to and including the
+// events of the block, in order.
+type BlockHistory struct {
+	Size uint64
+	Root []byte
+}
+
+func encodeBlockHistory(h *BlockHistory) []byte {
+	if h == nil {
+		return nil
+	}
+	return append(binary.BigEndian.AppendUint64(nil, h.Size), h.Root...)
+}
+
+// encodeHistory encodes a history in the payload of a block: the subtrees
+// followed by the size, as read from the end by decodeHistory
+func encodeHistory(h *History) []byte {
+	var b []byte
+	for _, subtree := range h.Subtrees {
+		b = append(b, subtree...)
+	}
+	return binary.BigEndian.AppendUint64(b, h.Size)
+}
+
+// decodeHistory decodes the history at the end of b, returning the rest
+func decodeHistory(b []byte) (*History, []byte, error) {
+	if len(b) < 8 {
+		return nil, nil, fmt.Errorf("too short payload, missing history")
+	}
+	h := &History{Size: binary.BigEndian.Uint64(b[len(b)-8:])}
+	b = b[:len(b)-8]
+	n := bits.OnesCount64(h.Size) * lc.HashOutputLen
+	if len(b) < n {
+		return nil, nil, fmt.Errorf("too short payload, missing history subtrees")
+	}
+	for subtrees := b[len(b)-n:]; len(subtrees) > 0; subtrees = subtrees[lc.HashOutputLen:] {
+		h.Subtrees = append(h.Subtrees, append([]byte{}, subtrees[:lc.HashOutputLen]...))
+	}
+	return h, b[:len(b)-n], nil
+}
+
+// BlockRootHash is the root hash signed in the header of a block: the root of
+// the events of the block keyed with the IV, for BlockVersionHistory together
+// with the history of the device.
+func BlockRootHash(version byte, iv, root []byte, history *BlockHistory) []byte {
+	if version < BlockVersionHistory {
+		return lc.Khash(iv, root)
+	}
+	return lc.Khash(iv, root, encodeBlockHistory(history))
+}
+
+// History is the Merkle tree over the history of a device as kept by the
+// device and carried by its blocks: only the roots of the perfect subtrees,
+// largest first, enough to append events and compute the root (see
+// MakeEncodedHistoryBlock).
+type History struct {
+	Size     uint64
+	Subtrees [][]byte
+}
+
+// Append appends leaves to the history.
+func (h *History) Append(leaves [][]byte) {
+	for _, leaf := range leaves {
+		h.appendHash(leafHash(leaf))
+	}
+}
+
+// appendHash appends the hash of a leaf to the history, returning the hash
+// followed by the roots of the subtrees made by merging it, smallest first
+func (h *History) appendHash(hash []byte) [][]byte {
+	nodes := [][]byte{hash}
+	h.Subtrees = append(h.Subtrees, hash)
+	// merge the subtrees of equal size, one per trailing one bit of size
+	for size := h.Size; size&1 == 1; size >>= 1 {
+		n := len(h.Subtrees)
+		h.Subtrees = append(h.Subtrees[:n-2],
+			lc.Hash([]byte{NodePrefix}, h.Subtrees[n-2], h.Subtrees[n-1]))
+		nodes = append(nodes, h.Subtrees[n-2])
+	}
+	h.Size++
+	return nodes
+}
+
+// Root returns the root of the history, as MerkleTreeHash over all leaves.
+func (h *History) Root() []byte {
+	if len(h.Subtrees) == 0 {
+		return lc.Hash([]byte{})
+	}
+	root := h.Subtrees[len(h.Subtrees)-1]
+	for i := len(h.Subtrees) - 2; i >= 0; i-- {
+		root = lc.Hash([]byte{NodePrefix}, h.Subtrees[i], root)
+	}
+	return root
+}
+
+// BlockHistory returns the history as committed to by a block, nil for no
+// history.
+func (h *History) BlockHistory() *BlockHistory {
+	if h == nil {
+		return nil
+	}
+	return &BlockHistory{Size: h.Size, Root: h.Root()}
+}
+
+func (h *History) clone() History {
+	return History{Size: h.Size, Subtrees: append([][]byte{}, h.Subtrees...)}
+}
+
+// HistoryTree is the Merkle tree over the history of a device with the hashes
+// of all leaves and perfect subtrees, as kept by a collector to make proofs
+// reading O(log n) hashes. A tree may start from a history carried by a block
+// (see NewHistoryTree), with only the roots of the perfect subtrees of the
+// leaves before: enough for proofs of the leaves after. The hashes are kept in
+// memory, or in a file for a tree made with CreateHistoryTree or
+// OpenHistoryTree.
+type HistoryTree struct {
+	// start is the number of leaves the tree started from, with the roots of
+	// their perfect subtrees by position in post-order (see nodePosition)
+	start    uint64
+	subtrees map[uint64][]byte
+	// nodes are the concatenated hashes of all leaves and perfect subtrees
+	// after start in post-order, unless in file after the header
+	nodes  []byte
+	file   *os.File
+	header int64
+	// history is the compact tree of all leaves, for the latest root
+	history History
+}
+
+// NewHistoryTree makes a tree in memory starting from a history, e.g., the
+// empty history as the zero value.
+func NewHistoryTree(start History) *HistoryTree {
+	t := new(HistoryTree)
+	t.setStart(start)
+	return t
+}
+
+// CreateHistoryTree makes a tree starting from a history keeping its hashes in
+// a file, truncating the file if it exists.
+func CreateHistoryTree(filename string, start History) (*HistoryTree, error) {
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	t := &HistoryTree{file: f}
+	if err = t.writeHeader(start); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// OpenHistoryTree opens the tree kept in a file, created empty if missing.
+// Hashes of a leaf only partly written, e.g., on a crash, are dropped.
+func OpenHistoryTree(filename string) (*HistoryTree, error) {
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	t := &HistoryTree{file: f}
+	if err = t.open(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// open reads the header and the largest size with all hashes in the file
+func (t *HistoryTree) open() error {
+	info, err := t.file.Stat()
+	if err != nil {
+		return err
+	}
+	start, err := t.readHeader(info.Size())
+	if err != nil {
+		return err
+	}
+	if start == nil { // new, or the header only partly written
+		if err = t.file.Truncate(0); err != nil {
+			return err
+		}
+		return t.writeHeader(History{})
+	}
+	t.header = 8 + int64(len(start.Subtrees))*lc.HashOutputLen
+	t.setStart(*start)
+
+	nodes := uint64(info.Size()-t.header) / lc.HashOutputLen
+	base := nodePosition(t.start, 0)
+	size := t.start + nodes/2 + 64
+	for size > t.start && nodePosition(size, 0)-base > nodes {
+		size--
+	}
+	return t.truncate(size)
+}
+
+// readHeader reads the history the tree in a file of size bytes started from,
+// nil if not (fully) written: the size followed by the subtrees
+func (t *HistoryTree) readHeader(size int64) (*History, error) {
+	if size < 8 {
+		return nil, nil
+	}
+	b := make([]byte, 8)
+	if _, err := t.file.ReadAt(b, 0); err != nil {
+		return nil, err
+	}
+	h := &History{Size: binary.BigEndian.Uint64(b)}
+	b = make([]byte, bits.OnesCount64(h.Size)*lc.HashOutputLen)
+	if size < 8+int64(len(b)) {
+		return nil, nil
+	}
+	if _, err := t.file.ReadAt(b, 8); err != nil {
+		return nil, err
+	}
+	for ; len(b) > 0; b = b[lc.HashOutputLen:] {
+		h.Subtrees = append(h.Subtrees, b[:lc.HashOutputLen])
+	}
+	return h, nil
+}
+
+// writeHeader makes the empty tree in a file start from a history
+func (t *HistoryTree) writeHeader(start History) error {
+	b := binary.BigEndian.AppendUint64(nil, start.Size)
+	for _, subtree := range start.Subtrees {
+		b = append(b, subtree...)
+	}
+	if _, err := t.file.WriteAt(b, 0); err != nil {
+		return err
+	}
+	t.header = int64(len(b))
+	t.setStart(start)
+	return nil
+}
+
+// setStart makes the empty tree start from a history
+func (t *HistoryTree) setStart(start History) {
+	t.start, t.history = start.Size, start.clone()
+	t.subtrees = make(map[uint64][]byte)
+	i := 0
+	perfectSubtrees(start.Size, func(lo, n uint64) {
+		t.subtrees[nodePosition(lo+n-1, bits.TrailingZeros64(n))] = start.Subtrees[i]
+		i++
+	})
+}
+
+// perfectSubtrees calls fn with the first leaf and number of leaves of each
+// perfect subtree of a tree with size leaves, largest first
+func perfectSubtrees(size uint64, fn func(lo, n uint64)) {
+	for lo, level := uint64(0), 63; level >= 0; level-- {
+		if n := uint64(1) << level; size&n != 0 {
+			fn(lo, n)
+			lo += n
+		}
+	}
+}
+
+// nodePosition returns the position in post-order of the root of the perfect
+// subtree with 2^level leaves ending with the leaf with index last, e.g., the
+// number of hashes before the leaf with index last for level 0
+func nodePosition(last uint64, level int) uint64 {
+	return 2*last - uint64(bits.OnesCount64(last)) + uint64(level)
+}
+
+// Append appends leaves to the tree.
+func (t *HistoryTree) Append(leaves [][]byte) error {
+	var b []byte
+	history := t.history.clone()
+	for _, leaf := range leaves {
+		for _, node := range history.appendHash(leafHash(leaf)) {
+			b = append(b, node...)
+		}
+	}
+	if t.file != nil {
+		offset := (nodePosition(t.Size(), 0) - nodePosition(t.start, 0)) * lc.HashOutputLen
+		if _, err := t.file.WriteAt(b, t.header+int64(offset)); err != nil {
+			return err
+		}
+	} else {
+		t.nodes = append(t.nodes, b...)
+	}
+	t.history = history
+	return nil
+}
+
+// Truncate drops the leaves after the first size, e.g., appended before a
+// crash, keeping at least the leaves the tree started from.
+func (t *HistoryTree) Truncate(size uint64) error {
+	if size < t.start || size > t.Size() {
+		return fmt.Errorf("size %d outside of tree with leaves %d to %d", size, t.start, t.Size())
+	}
+	return t.truncate(size)
+}
+
+// truncate drops the hashes after the first size leaves and rebuilds the
+// compact tree from the roots of the perfect subtrees
+func (t *HistoryTree) truncate(size uint64) error {
+	end := (nodePosition(size, 0) - nodePosition(t.start, 0)) * lc.HashOutputLen
+	if t.file != nil {
+		if err := t.file.Truncate(t.header + int64(end)); err != nil {
+			return err
+		}
+	} else {
+		t.nodes = t.nodes[:end]
+	}
+	r := &nodeReader{t: t}
+	history := History{Size: size}
+	perfectSubtrees(size, func(lo, n uint64) {
+		history.Subtrees = append(history.Subtrees, r.node(lo, n))
+	})
+	if r.err != nil {
+		return r.err
+	}
+	t.history = history
+	return nil
+}
+
+// Size returns the number of leaves in the tree.
+func (t *HistoryTree) Size() uint64 {
+	return t.history.Size
+}
+
+// Start returns the number of leaves the tree started from, see
+// NewHistoryTree. Proofs of these leaves fail.
+func (t *HistoryTree) Start() uint64 {
+	return t.start
+}
+
+// History returns the compact tree of all leaves.
+func (t *HistoryTree) History() History {
+	return t.history.clone()
+}
+
+// Root returns the root of the tree with the first size leaves.
+func (t *HistoryTree) Root(size uint64) ([]byte, error) {
+	if size == t.Size() {
+		return t.history.Root(), nil
+	}
+	if size > t.Size() {
+		return nil, fmt.Errorf("size %d larger than tree with %d leaves", size, t.Size())
+	}
+	r := &nodeReader{t: t}
+	root := r.treeHash(0, int(size))
+	return root, r.err
+}
+
+// Contains returns true if the leaf with index in the tree is leaf.
+func (t *HistoryTree) Contains(index uint64, leaf []byte) (bool, error) {
+	if index >= t.Size() {
+		return false, nil
+	}
+	r := &nodeReader{t: t}
+	hash := r.node(index, 1)
+	return r.err == nil && subtle.ConstantTimeCompare(hash, leafHash(leaf)) == 1, r.err
+}
+
+// AuditPath returns the audit path of the leaf with index in the tree with
+// the first size leaves.
+func (t *HistoryTree) AuditPath(index, size uint64) ([][]byte, error) {
+	if index >= size || size > t.Size() {
+		return nil, fmt.Errorf("leaf index %d and size %d outside of tree with %d leaves",
+			index, size, t.Size())
+	}
+	r := &nodeReader{t: t}
+	path := auditPath(int(index), 0, int(size), r.treeHash)
+	return path, r.err
+}
+
+// ConsistencyProof returns a consistency proof between the tree with the first
+// m leaves and the tree with the first n leaves.
+func (t *HistoryTree) ConsistencyProof(m, n uint64) ([][]byte, error) {
+	if m > n || n > t.Size() {
+		return nil, fmt.Errorf("sizes %d and %d outside of tree with %d leaves", m, n, t.Size())
+	}
+	r := &nodeReader{t: t}
+	proof := consistencyProof(int(m), int(n), r.treeHash)
+	return proof, r.err
+}
+
+// Close closes the file of the tree, if any.
+func (t *HistoryTree) Close() error {
+	if t.file == nil {
+		return nil
+	}
+	return t.file.Close()
+}
+
+// nodeReader reads the hashes of a tree to make proofs, keeping the first
+// error
+type nodeReader struct {
+	t   *HistoryTree
+	err error
+}
+
+// treeHash is a rangeHash reading the roots of perfect subtrees: as split by
+// MTH, the leaves lo to hi are a perfect subtree followed by the rest
+func (r *nodeReader) treeHash(lo, hi int) []byte {
+	n := hi - lo
+	switch {
+	case n == 0:
+		return lc.Hash([]byte{})
+	case n&(n-1) == 0:
+		return r.node(uint64(lo), uint64(n))
+	}
+	k := split(n)
+	return lc.Hash([]byte{NodePrefix}, r.node(uint64(lo), uint64(k)), r.treeHash(lo+k, hi))
+}
+
+// node reads the root of the perfect subtree of n leaves from the leaf with
+// index lo, before the start of the tree only if one of its subtrees
+func (r *nodeReader) node(lo, n uint64) []byte {
+	if r.err != nil {
+		return nil
+	}
+	pos, base := nodePosition(lo+n-1, bits.TrailingZeros64(n)), nodePosition(r.t.start, 0)
+	if pos < base {
+		hash, ok := r.t.subtrees[pos]
+		if !ok {
+			r.err = fmt.Errorf("no hash of leaves %d to %d, before leaf %d that the tree started from",
+				lo, lo+n-1, r.t.start)
+		}
+		return hash
+	}
+	offset := (pos - base) * lc.HashOutputLen
+	if r.t.file == nil {
+		return r.t.nodes[offset : offset+lc.HashOutputLen : offset+lc.HashOutputLen]
+	}
+	b := make([]byte, lc.HashOutputLen)
+	if _, err := r.t.file.ReadAt(b, r.t.header+int64(offset)); err != nil {
+		r.err = err
+		return nil
+	}
+	return b
+}
+
+// HistoryInclusion proves that an event is in the history of a device as
+// committed to by a block, e.g., the latest block read by a collector.
+type HistoryInclusion struct {
+	// Block opens the signed root hash of the block, disclosing no events.
+	Block Disclosure
+	// Index is the index of the event in the history.
+	Index uint64
+	Event Event
+	Path  [][]byte
+}
+
+// HistoryConsistency proves that the history of a device committed to by an
+// older block is a prefix of the history committed to by a newer block.
+type HistoryConsistency struct {
+	// Older and Newer open the signed root hashes of the blocks, disclosing
+	// no events.
+	Older, Newer Disclosure
+	Proof        [][]byte
+}
+
+// VerifyHistoryInclusion verifies a proof of an event in the history of the
+// device of a policy, returning the header of the block committing to the
+// history.
+func VerifyHistoryInclusion(p *HistoryInclusion, policy Policy) (BlockHeader, error) {
+	bh, err := verifyHistoryBlock(&p.Block, policy)
+	if err != nil {
+		return BlockHeader{}, err
+	}
+	h := p.Block.History
+	if p.Index >= h.Size {
+		return BlockHeader{}, fmt.Errorf("event index %d outside of history with %d events",
+			p.Index, h.Size)
+	}
+	if subtle.ConstantTimeCompare(RootFromAuditPath(EventLeaf(bh.Version, p.Event),
+		int(p.Index), int(h.Size), p.Path), h.Root) != 1 {
+		return BlockHeader{}, fmt.Errorf("event with index %d is not in the history", p.Index)
+	}
+	return bh, nil
+}
+
+// VerifyHistoryConsistency verifies a proof that the history of the device of
+// a policy committed to by an older block is a prefix of the history committed
+// to by a newer block.
+func VerifyHistoryConsistency(p *HistoryConsistency, policy Policy) error {
+	older, err := verifyHistoryBlock(&p.Older, policy)
+	if err != nil {
+		return err
+	}
+	newer, err := verifyHistoryBlock(&p.Newer, policy)
+	if err != nil {
+		return err
+	}
+	if older.Index > newer.Index {
+		return fmt.Errorf("older block %d is after newer block %d", older.Index, newer.Index)
+	}
+	if !VerifyConsistency(int(p.Older.History.Size), int(p.Newer.History.Size),
+		p.Older.History.Root, p.Newer.History.Root, p.Proof) {
+		return fmt.Errorf("history of block %d is not a prefix of the history of block %d",
+			older.Index, newer.Index)
+	}
+	return nil
+}
+
+// verifyHistoryBlock verifies that a disclosure opens the history of a block
+func verifyHistoryBlock(d *Disclosure, policy Policy) (BlockHeader, error) {
+	bh, err := VerifyDisclosure(d, policy)
+	if err != nil {
+		return BlockHeader{}, err
+	}
+	if bh.Version < BlockVersionHistory {
+		return BlockHeader{}, fmt.Errorf("block %d does not commit to a history", bh.Index)
+	}
+	return bh, nil
+}
@@ -0,0 +1,183 @@
+package steady
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pylls/steady/lc"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistory(t *testing.T) {
+	var h History
+	var leaves [][]byte
+	for i := 0; i < 20; i++ {
+		assert.Equal(t, MerkleTreeHash(leaves), h.Root(), "wrong root for size %d", i)
+		leaves = append(leaves, []byte{byte(i)})
+		h.Append(leaves[i:])
+	}
+}
+
+func TestHistoryBlocks(t *testing.T) {
+	vk, sk, _ := lc.SigningKeyGen()
+	pub, pk, _ := lc.EncryptKeyGen()
+	p := MakePolicy(sk, vk, pub, 0, 1, 2)
+
+	// three blocks, the tree and an opening of the history of each
+	var h History
+	var tree HistoryTree
+	var blocks []*Disclosure
+	var all []Event
+	for i, data := range [][][]byte{{{0x10}, {0x11}}, {}, {{0x30}, {0x31}, {0x32}}} {
+		events := makeEvents(data)
+		block, err := MakeEncodedHistoryBlock(uint64(i), 0, uint64(time.Now().Unix()), true, true, p,
+			events, &h, sk)
+		assert.Nil(t, err, "failed to make block: %s", err)
+		bh, err := DecodeBlockHeader(block[:WireBlockHeaderSize], p)
+		assert.Nil(t, err, "failed to decode valid header: %s", err)
+		assert.True(t, bh.Version == BlockVersionHistory, "wrong version, got %d", bh.Version)
+		recEvents, iv, history, err := DecodeBlockPayloadHistory(block[WireBlockHeaderSize:],
+			pub, pk, p, bh)
+		assert.Nil(t, err, "failed to decode valid payload: %s", err)
+		assert.Equal(t, &h, history, "wrong history in block")
+
+		assert.Nil(t, tree.Append(EventLeaves(bh.Version, recEvents)), "failed to append")
+		all = append(all, recEvents...)
+		root, err := tree.Root(tree.Size())
+		assert.Nil(t, err, "failed to compute root: %s", err)
+		assert.Equal(t, history.Root(), root, "wrong root of tree")
+		d, err := MakeDisclosure(bh, recEvents, iv, history.BlockHistory(), nil)
+		assert.Nil(t, err, "failed to open history: %s", err)
+		blocks = append(blocks, d)
+	}
+	assert.Equal(t, uint64(5), h.Size, "wrong history size")
+
+	// an event of the first block in the history of the last block
+	path, err := tree.AuditPath(1, 5)
+	assert.Nil(t, err, "failed to make audit path: %s", err)
+	p1 := &HistoryInclusion{Block: *blocks[2], Index: 1, Event: all[1], Path: path}
+	bh, err := VerifyHistoryInclusion(p1, p)
+	assert.Nil(t, err, "failed to verify inclusion: %s", err)
+	assert.True(t, bh.Index == 2, "wrong block index")
+	p1.Event.Seq++
+	_, err = VerifyHistoryInclusion(p1, p)
+	assert.NotNil(t, err, "verified inclusion of modified event")
+
+	// the history of the first block is a prefix of the history of the last
+	proof, err := tree.ConsistencyProof(2, 5)
+	assert.Nil(t, err, "failed to make consistency proof: %s", err)
+	p2 := &HistoryConsistency{Older: *blocks[0], Newer: *blocks[2], Proof: proof}
+	assert.Nil(t, VerifyHistoryConsistency(p2, p), "failed to verify consistency")
+	p2.Older, p2.Newer = p2.Newer, p2.Older
+	assert.NotNil(t, VerifyHistoryConsistency(p2, p), "verified consistency in wrong order")
+
+	// a history that does not match the signed root hash
+	p2.Older, p2.Newer = *blocks[0], *blocks[2]
+	root, _ := tree.Root(1)
+	p2.Older.History = &BlockHistory{Size: 1, Root: root}
+	assert.NotNil(t, VerifyHistoryConsistency(p2, p), "verified history not signed by the device")
+}
+
+func TestHistoryTreeFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "history")
+	file, err := CreateHistoryTree(filename, History{})
+	assert.Nil(t, err, "failed to open tree: %s", err)
+	defer file.Close()
+	var memory HistoryTree
+	var leaves [][]byte
+	for i := 0; i < 20; i++ {
+		leaves = append(leaves, []byte{byte(i)})
+		assert.Nil(t, file.Append(leaves[i:]), "failed to append")
+		assert.Nil(t, memory.Append(leaves[i:]), "failed to append")
+	}
+	for size := uint64(0); size <= 20; size++ {
+		root, err := file.Root(size)
+		assert.Nil(t, err, "failed to compute root: %s", err)
+		assert.Equal(t, MerkleTreeHash(leaves[:size]), root, "wrong root for size %d", size)
+		for i := uint64(0); i < size; i++ {
+			path, err := file.AuditPath(i, size)
+			assert.Nil(t, err, "failed to make audit path: %s", err)
+			expected, _ := memory.AuditPath(i, size)
+			assert.Equal(t, expected, path, "wrong audit path for %d in size %d", i, size)
+		}
+		proof, err := file.ConsistencyProof(size/2, size)
+		assert.Nil(t, err, "failed to make consistency proof: %s", err)
+		assert.Equal(t, ConsistencyProof(int(size/2), leaves[:size]), proof, "wrong proof for size %d", size)
+	}
+	ok, err := file.Contains(3, leaves[3])
+	assert.True(t, ok && err == nil, "leaf not in tree")
+	ok, _ = file.Contains(3, leaves[4])
+	assert.False(t, ok, "wrong leaf in tree")
+	_, err = file.AuditPath(20, 21)
+	assert.NotNil(t, err, "made audit path outside of tree")
+
+	// reopened, without the hashes of a leaf only partly written
+	root, _ := file.Root(20)
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0600)
+	assert.Nil(t, err, "failed to open file: %s", err)
+	f.Write([]byte{1, 2, 3})
+	f.Close()
+	file.Close()
+	file, err = OpenHistoryTree(filename)
+	assert.Nil(t, err, "failed to reopen tree: %s", err)
+	assert.Equal(t, uint64(20), file.Size(), "wrong size of reopened tree")
+	reopened, _ := file.Root(20)
+	assert.Equal(t, root, reopened, "wrong root of reopened tree")
+	assert.Nil(t, file.Append([][]byte{{20}}), "failed to append")
+	root, _ = file.Root(21)
+	assert.Equal(t, MerkleTreeHash(append(leaves, []byte{20})), root, "wrong root after reopening")
+	path, err := file.AuditPath(20, 21)
+	assert.Nil(t, err, "failed to make audit path: %s", err)
+	assert.Equal(t, AuditPath(20, append(leaves, []byte{20})), path, "wrong audit path after reopening")
+}
+
+func TestHistoryTreeStart(t *testing.T) {
+	var leaves [][]byte
+	for i := 0; i < 20; i++ {
+		leaves = append(leaves, []byte{byte(i)})
+	}
+	for start := 0; start < 20; start++ {
+		var h History
+		h.Append(leaves[:start])
+		filename := filepath.Join(t.TempDir(), "history")
+		file, err := CreateHistoryTree(filename, h)
+		assert.Nil(t, err, "failed to create tree: %s", err)
+		for _, tree := range []*HistoryTree{NewHistoryTree(h), file} {
+			assert.Nil(t, tree.Append(leaves[start:]), "failed to append")
+			for size := start; size <= 20; size++ {
+				root, err := tree.Root(uint64(size))
+				assert.Nil(t, err, "failed to compute root: %s", err)
+				assert.Equal(t, MerkleTreeHash(leaves[:size]), root, "wrong root for size %d", size)
+				for i := start; i < size; i++ {
+					path, err := tree.AuditPath(uint64(i), uint64(size))
+					assert.Nil(t, err, "failed to make audit path: %s", err)
+					assert.Equal(t, AuditPath(i, leaves[:size]), path, "wrong audit path for %d in size %d", i, size)
+				}
+				for m := start; m <= size; m++ {
+					proof, err := tree.ConsistencyProof(uint64(m), uint64(size))
+					assert.Nil(t, err, "failed to make consistency proof: %s", err)
+					assert.Equal(t, ConsistencyProof(m, leaves[:size]), proof, "wrong proof for %d and %d", m, size)
+				}
+			}
+			if start > 1 && start&1 == 0 {
+				_, err := tree.AuditPath(uint64(start-1), 20)
+				assert.NotNil(t, err, "made audit path before the start of the tree")
+			}
+		}
+
+		// reopened and truncated, the hashes before the start are kept
+		file.Close()
+		file, err = OpenHistoryTree(filename)
+		assert.Nil(t, err, "failed to reopen tree: %s", err)
+		assert.Equal(t, uint64(start), file.Start(), "wrong start of reopened tree")
+		assert.Equal(t, uint64(20), file.Size(), "wrong size of reopened tree")
+		assert.NotNil(t, file.Truncate(uint64(start)-1), "truncated before the start of the tree")
+		assert.Nil(t, file.Truncate(uint64(start)), "failed to truncate")
+		assert.Nil(t, file.Append(leaves[start:]), "failed to append")
+		h = file.History()
+		assert.Equal(t, MerkleTreeHash(leaves), h.Root(), "wrong root after truncating")
+		file.Close()
+	}
+}
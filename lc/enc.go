@@ -13,6 +13,13 @@ import (
 const (
 	PublicKeySize   = 32
 	PrivategKeySize = 32
+
+	// WrappedKeySize is the size of a data key encrypted to one recipient.
+	WrappedKeySize = dataKeySize + 16 + PublicKeySize
+	// MaxRecipients is the maximum number of recipients for EncryptMulti.
+	MaxRecipients = 255
+
+	dataKeySize = 32
 )
 
 func EncryptKeyGen() (pub, pk []byte, err error) {
@@ -46,13 +53,9 @@ func Encrypt(pub, data []byte) (ct []byte, err error) {
 	nonce := kdf(secret[:], pub, ephmPub[:], []byte("nonce"))[:12]
 
 	// AES-GCM with nonce from keyMaterial
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create block cipher: %s", err)
-	}
-	aesgcm, err := cipher.NewGCM(block)
+	aesgcm, err := newGCM(key)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create GCM AEAD: %s", err)
+		return nil, err
 	}
 
 	return append(aesgcm.Seal(data[:0], nonce, data, ephmPub[:]),
@@ -81,6 +84,77 @@ func Decrypt(ct, pub, pk []byte) (data []byte, err error) {
 	nonce := kdf(secret[:], pub, public[:], []byte("nonce"))[:12]
 
 	// AES-GCM with nonce from keyMaterial
+	aesgcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return aesgcm.Open(nil, nonce, ct[:len(ct)-32], public[:])
+}
+
+// EncryptMulti encrypts data to several recipients: a random data key encrypts
+// the data and the data key is encrypted to each recipient's public key.
+// Potentially overwrites the underlying data in the process!
+func EncryptMulti(pubs [][]byte, data []byte) (ct []byte, err error) {
+	if len(pubs) == 0 || len(pubs) > MaxRecipients {
+		return nil, fmt.Errorf("invalid number of recipients, expected 1-%d, got %d",
+			MaxRecipients, len(pubs))
+	}
+	key := make([]byte, dataKeySize)
+	if _, err = io.ReadFull(rand.Reader, key); err != nil {
+		return nil, fmt.Errorf("failed to generate data key: %s", err)
+	}
+
+	// wrap the data key for each recipient
+	wrapped := make([]byte, 0, len(pubs)*WrappedKeySize+1)
+	for i := 0; i < len(pubs); i++ {
+		w, err := Encrypt(pubs[i], append([]byte{}, key...))
+		if err != nil {
+			return nil, fmt.Errorf("failed to wrap key for recipient %d: %s", i, err)
+		}
+		wrapped = append(wrapped, w...)
+	}
+	wrapped = append(wrapped, byte(len(pubs)))
+
+	aesgcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	// the key is fresh for each message, so a fixed nonce is fine
+	return append(aesgcm.Seal(data[:0], kdf(key, nil, nil, []byte("nonce"))[:12], data, wrapped),
+		wrapped...), nil
+}
+
+// DecryptMulti decrypts data encrypted with EncryptMulti by one of the
+// recipients.
+func DecryptMulti(ct, pub, pk []byte) (data []byte, err error) {
+	if len(ct) < 1 {
+		return nil, fmt.Errorf("too short ciphertext")
+	}
+	n := int(ct[len(ct)-1])
+	if n == 0 || len(ct) < n*WrappedKeySize+1 {
+		return nil, fmt.Errorf("too short ciphertext")
+	}
+	wrapped := ct[len(ct)-n*WrappedKeySize-1:]
+	ct = ct[:len(ct)-len(wrapped)]
+
+	// attempt to unwrap each key, only ours will authenticate
+	var key []byte
+	for i := 0; i < n && key == nil; i++ {
+		key, _ = Decrypt(wrapped[i*WrappedKeySize:(i+1)*WrappedKeySize], pub, pk)
+	}
+	if key == nil {
+		return nil, fmt.Errorf("not a recipient")
+	}
+
+	aesgcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return aesgcm.Open(nil, kdf(key, nil, nil, []byte("nonce"))[:12], ct, wrapped)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create block cipher: %s", err)
@@ -89,6 +163,5 @@ func Decrypt(ct, pub, pk []byte) (data []byte, err error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to create GCM AEAD: %s", err)
 	}
-
-	return aesgcm.Open(nil, nonce, ct[:len(ct)-32], public[:])
+	return aesgcm, nil
 }
@@ -17,3 +17,25 @@ func TestEncryptDecrypt(t *testing.T) {
 	assert.Nil(t, err, "failed to decrypt")
 	assert.True(t, bytes.Equal(data, pt), "decrypt gave different plaintext")
 }
+
+func TestEncryptDecryptMulti(t *testing.T) {
+	pubs := make([][]byte, 3)
+	pks := make([][]byte, 3)
+	for i := 0; i < len(pubs); i++ {
+		var err error
+		pubs[i], pks[i], err = EncryptKeyGen()
+		assert.Nil(t, err, "got error when generation encryption key-pair")
+	}
+	data := []byte("secret message")
+	ct, err := EncryptMulti(pubs, append([]byte{}, data...))
+	assert.Nil(t, err, "failed to encrypt")
+	for i := 0; i < len(pubs); i++ {
+		pt, err := DecryptMulti(ct, pubs[i], pks[i])
+		assert.Nil(t, err, "failed to decrypt for recipient %d", i)
+		assert.True(t, bytes.Equal(data, pt), "decrypt gave different plaintext")
+	}
+
+	pub, pk, _ := EncryptKeyGen()
+	_, err = DecryptMulti(ct, pub, pk)
+	assert.NotNil(t, err, "decrypted as non-recipient")
+}
@@ -1,6 +1,7 @@
 package steady
 
 import (
+	"bytes"
 	"math"
 	"math/big"
 
@@ -17,22 +18,36 @@ const (
 
 // AuditPath as in RFC6962
 func AuditPath(m int, data [][]byte) [][]byte {
-	if len(data) <= 1 {
+	return auditPath(m, 0, len(data), hashesRange(leafHashes(data)))
+}
+
+// rangeHash returns MTH over the leaves lo to hi of a tree
+type rangeHash func(lo, hi int) []byte
+
+// hashesRange is rangeHash over leaf hashes
+func hashesRange(hashes [][]byte) rangeHash {
+	return func(lo, hi int) []byte {
+		return treeHash(hashes[lo:hi])
+	}
+}
+
+// auditPath is AuditPath over the leaves lo to hi of a tree, m relative to lo
+func auditPath(m, lo, hi int, mth rangeHash) [][]byte {
+	if hi-lo <= 1 {
 		return nil
 	}
-	// k is the largest power of two smaller than n (i.e., k < n <= 2k)
-	k := int(math.Pow(2, float64(big.NewInt(int64(len(data)-1)).BitLen()-1)))
+	k := split(hi - lo)
 	if m < k {
 		// PATH(m, D[n]) = PATH(m, D[0:k]) : MTH(D[k:n])
-		return append(AuditPath(m, data[:k]), MerkleTreeHash(data[k:]))
+		return append(auditPath(m, lo, lo+k, mth), mth(lo+k, hi))
 	} // index >= k
 	// PATH(m, D[n]) = PATH(m - k, D[k:n]) : MTH(D[0:k])
-	return append(AuditPath(m-k, data[k:]), MerkleTreeHash(data[:k]))
+	return append(auditPath(m-k, lo+k, hi, mth), mth(lo, lo+k))
 }
 
 // RootFromAuditPath computes the expected root from an audit path
 func RootFromAuditPath(l []byte, index, size int, path [][]byte) (r []byte) {
-	r = lc.Hash([]byte{LeafPrefix}, l)
+	r = leafHash(l)
 	lastIndex := size - 1
 	for lastIndex > 0 {
 		if index%2 == 1 {
@@ -60,15 +75,107 @@ func head(data [][]byte) (h []byte, tail [][]byte) {
 
 // MerkleTreeHash as in RFC6962
 func MerkleTreeHash(data [][]byte) (root []byte) {
-	switch len(data) {
+	return treeHash(leafHashes(data))
+}
+
+// treeHash is MerkleTreeHash over leaf hashes
+func treeHash(hashes [][]byte) []byte {
+	switch len(hashes) {
 	case 0: // MTH({}) = HASH()
 		return lc.Hash([]byte{})
 	case 1: // MTH({d(0)}) = HASH(0x00 || d(0))
-		return lc.Hash([]byte{LeafPrefix}, data[0])
+		return hashes[0]
+	}
+	// MTH(D[n]) = HASH(0x01 || MTH(D[0:k]) || MTH(D[k:n]))
+	k := split(len(hashes))
+	return lc.Hash([]byte{NodePrefix}, treeHash(hashes[:k]), treeHash(hashes[k:]))
+}
+
+func leafHash(data []byte) []byte {
+	return lc.Hash([]byte{LeafPrefix}, data)
+}
+
+func leafHashes(data [][]byte) [][]byte {
+	hashes := make([][]byte, len(data))
+	for i := range data {
+		hashes[i] = leafHash(data[i])
+	}
+	return hashes
+}
+
+// split returns k, the largest power of two smaller than n (i.e., k < n <= 2k)
+func split(n int) int {
+	return int(math.Pow(2, float64(big.NewInt(int64(n-1)).BitLen()-1)))
+}
+
+// ConsistencyProof as in RFC6962, proving that the tree of the first m
+// entries of data is a prefix of the tree of all data
+func ConsistencyProof(m int, data [][]byte) [][]byte {
+	return consistencyProof(m, len(data), hashesRange(leafHashes(data)))
+}
+
+// consistencyProof is ConsistencyProof over the first n leaves of a tree
+func consistencyProof(m, n int, mth rangeHash) [][]byte {
+	if m <= 0 || m >= n {
+		return nil
+	}
+	return subProof(m, 0, n, true, mth)
+}
+
+// subProof is SUBPROOF(m, D[n], b) in RFC6962 over the leaves lo to hi of a
+// tree, m relative to lo
+func subProof(m, lo, hi int, b bool, mth rangeHash) [][]byte {
+	if m == hi-lo {
+		if b { // SUBPROOF(m, D[m], true) = {}
+			return nil
+		} // SUBPROOF(m, D[m], false) = {MTH(D[m])}
+		return [][]byte{mth(lo, hi)}
+	}
+	k := split(hi - lo)
+	if m <= k {
+		// SUBPROOF(m, D[n], b) = SUBPROOF(m, D[0:k], b) : MTH(D[k:n])
+		return append(subProof(m, lo, lo+k, b, mth), mth(lo+k, hi))
+	} // m > k
+	// SUBPROOF(m, D[n], b) = SUBPROOF(m - k, D[k:n], false) : MTH(D[0:k])
+	return append(subProof(m-k, lo+k, hi, false, mth), mth(lo, lo+k))
+}
+
+// VerifyConsistency verifies a consistency proof between the root of a tree
+// of size m and the root of a tree of size n, as in RFC9162 (section 2.1.4.2)
+func VerifyConsistency(m, n int, oldRoot, newRoot []byte, proof [][]byte) bool {
+	switch {
+	case m < 0 || m > n:
+		return false
+	case m == n:
+		return len(proof) == 0 && bytes.Equal(oldRoot, newRoot)
+	case m == 0: // the empty tree is a prefix of every tree
+		return len(proof) == 0
+	}
+	if m&(m-1) == 0 { // m is a power of two, the old root is a node in the proof
+		proof = append([][]byte{oldRoot}, proof...)
+	}
+	if len(proof) == 0 {
+		return false
+	}
+	fn, sn := m-1, n-1
+	for fn&1 == 1 {
+		fn, sn = fn>>1, sn>>1
+	}
+	fr, sr := proof[0], proof[0]
+	for _, c := range proof[1:] {
+		if sn == 0 {
+			return false
+		}
+		if fn&1 == 1 || fn == sn {
+			fr = lc.Hash([]byte{NodePrefix}, c, fr)
+			sr = lc.Hash([]byte{NodePrefix}, c, sr)
+			for fn&1 == 0 && fn != 0 {
+				fn, sn = fn>>1, sn>>1
+			}
+		} else {
+			sr = lc.Hash([]byte{NodePrefix}, sr, c)
+		}
+		fn, sn = fn>>1, sn>>1
 	}
-	// MTH(D[n]) = HASH(0x01 || MTH(D[0:k]) || MTH(D[k:n])), where
-	// k is the largest power of two smaller than n (i.e., k < n <= 2k)
-	k := int(math.Pow(2, float64(big.NewInt(int64(len(data)-1)).BitLen()-1)))
-	return lc.Hash([]byte{NodePrefix}, MerkleTreeHash(data[:k]),
-		MerkleTreeHash(data[k:]))
+	return sn == 0 && bytes.Equal(fr, oldRoot) && bytes.Equal(sr, newRoot)
 }
@@ -81,6 +81,77 @@ func TestAuditPath(t *testing.T) {
 		"verified audit path with wrong index")
 }
 
+func TestConsistencyProof(t *testing.T) {
+	data := googleTestLeaves()
+	for n := 1; n <= len(data); n++ {
+		for m := 1; m <= n; m++ {
+			proof := ConsistencyProof(m, data[:n])
+			assert.True(t, VerifyConsistency(m, n, MerkleTreeHash(data[:m]),
+				MerkleTreeHash(data[:n]), proof), "fail for sizes %d and %d", m, n)
+			if m == n || m == 1 {
+				continue
+			}
+			assert.False(t, VerifyConsistency(m, n, MerkleTreeHash(data[1:m]),
+				MerkleTreeHash(data[:n]), proof), "verified another old tree")
+			assert.False(t, VerifyConsistency(m-1, n, MerkleTreeHash(data[:m]),
+				MerkleTreeHash(data[:n]), proof), "verified with the wrong size")
+		}
+	}
+}
+
+func TestConsistencyProofVectors(t *testing.T) {
+	data := googleTestLeaves()
+	for _, v := range googleConsistencyProofs() {
+		proof := ConsistencyProof(v.m, data[:v.n])
+		assert.Equal(t, len(v.proof), len(proof), "wrong proof length for sizes %d and %d", v.m, v.n)
+		for i := range v.proof {
+			assert.Equal(t, mustDecode(v.proof[i]), proof[i],
+				"wrong node %d in proof for sizes %d and %d", i, v.m, v.n)
+		}
+		oldRoot, newRoot := googleRootForTestLeaves(v.m-1), googleRootForTestLeaves(v.n-1)
+		assert.True(t, VerifyConsistency(v.m, v.n, oldRoot, newRoot, proof),
+			"fail for sizes %d and %d", v.m, v.n)
+		if v.m == v.n {
+			continue
+		}
+		assert.False(t, VerifyConsistency(v.m, v.n, newRoot, newRoot, proof),
+			"verified with the wrong old root")
+		assert.False(t, VerifyConsistency(v.m, v.n, oldRoot, oldRoot, proof),
+			"verified with the wrong new root")
+		assert.False(t, VerifyConsistency(v.m, v.n, oldRoot, newRoot, proof[1:]),
+			"verified truncated proof")
+		assert.False(t, VerifyConsistency(v.m, v.n, oldRoot, newRoot, append(proof, proof[0])),
+			"verified extended proof")
+		assert.False(t, VerifyConsistency(v.n, v.m, newRoot, oldRoot, proof),
+			"verified with swapped sizes")
+	}
+}
+
+// consistency proofs from Google's CT implementation (see googleTestLeaves),
+// recalculated for Blake2b256
+func googleConsistencyProofs() []struct {
+	m, n  int
+	proof []string
+} {
+	return []struct {
+		m, n  int
+		proof []string
+	}{
+		{1, 1, nil},
+		{1, 8, []string{
+			"9ee6dfb61a2fb903df487c401663825643bb825d41695e63df8af6162ab145a6",
+			"4410d256c615d5be5efd88bfe791098db5ef8adc6e4b6d5950ce34f9fbbfc83d",
+			"b0932ab3e3f71f186a2a2b9247eff0a6e3d8693b2836284645743bcb34c823aa"}},
+		{6, 8, []string{
+			"858268af4f1eb286011123329b72d29d9fecd88a2ec4b919a555a36deef1cd65",
+			"f4b02aedb9eca168d47f50db39a464a01d57961153f2708878e45cf3d3d17ae4",
+			"dad1013557a71536d36ab10db2ea4847bed7ded78aa9d2682ffc0e221e758444"}},
+		{2, 5, []string{
+			"4410d256c615d5be5efd88bfe791098db5ef8adc6e4b6d5950ce34f9fbbfc83d",
+			"3234371fe31af918988719ccf80cc04c639e69fee40c584ca7d63b5bdb352197"}},
+	}
+}
+
 func BenchmarkMerkleTreeHash(b *testing.B) {
 	data := make([][]byte, 0)
 	for _, a := range googleTestLeaves() {
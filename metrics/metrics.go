@@ -0,0 +1,270 @@
+// Package metrics is a minimal registry of counters, gauges, and summaries,
+// exposed over HTTP in the Prometheus text format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metric types in the text format
+const (
+	typeCounter = "counter"
+	typeGauge   = "gauge"
+	typeSummary = "summary"
+)
+
+// Registry is a set of metrics.
+type Registry struct {
+	lock       sync.Mutex
+	families   []*family
+	collectors []func()
+}
+
+// family is a metric with all its series, one per set of labels
+type family struct {
+	name, help, typ string
+	series          map[string]*series
+}
+
+type series struct {
+	value float64 // or sum for summaries
+	count uint64
+}
+
+// Metric is a counter, gauge, or summary in a registry. Labels are given as
+// key/value pairs to each method, e.g., m.Inc("policy", id).
+type Metric struct {
+	r *Registry
+	f *family
+}
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return new(Registry)
+}
+
+// Counter adds a counter to the registry. By convention, the name of a
+// counter ends with _total.
+func (r *Registry) Counter(name, help string) *Metric {
+	return r.add(name, help, typeCounter)
+}
+
+// Gauge adds a gauge to the registry.
+func (r *Registry) Gauge(name, help string) *Metric {
+	return r.add(name, help, typeGauge)
+}
+
+// Summary adds a summary (sum and count of observations, no quantiles) to the
+// registry.
+func (r *Registry) Summary(name, help string) *Metric {
+	return r.add(name, help, typeSummary)
+}
+
+// add adds a metric to the registry, or returns the metric already added with
+// the name, e.g., by another device logging to the same registry. Adding a
+// metric with the name of another type or help panics, as the registry would
+// write metrics that Prometheus rejects.
+func (r *Registry) add(name, help, typ string) *Metric {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, f := range r.families {
+		if f.name != name {
+			continue
+		}
+		if f.typ != typ || f.help != help {
+			panic(fmt.Sprintf("metric %s already added as %s %q, got %s %q",
+				name, f.typ, f.help, typ, help))
+		}
+		return &Metric{r: r, f: f}
+	}
+	f := &family{
+		name:   name,
+		help:   help,
+		typ:    typ,
+		series: make(map[string]*series),
+	}
+	r.families = append(r.families, f)
+	return &Metric{r: r, f: f}
+}
+
+// OnCollect registers fn to be called before the metrics are written, e.g.,
+// to set gauges from some state.
+func (r *Registry) OnCollect(fn func()) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.collectors = append(r.collectors, fn)
+}
+
+// Inc increases a counter or gauge by one.
+func (m *Metric) Inc(labels ...string) {
+	m.Add(1, labels...)
+}
+
+// Add adds v to a counter or gauge.
+func (m *Metric) Add(v float64, labels ...string) {
+	m.r.lock.Lock()
+	defer m.r.lock.Unlock()
+	m.get(labels).value += v
+}
+
+// Set sets a gauge to v, or a counter kept elsewhere (see OnCollect).
+func (m *Metric) Set(v float64, labels ...string) {
+	m.r.lock.Lock()
+	defer m.r.lock.Unlock()
+	m.get(labels).value = v
+}
+
+// SetSummary sets the sum and count of a summary kept elsewhere.
+func (m *Metric) SetSummary(sum float64, count uint64, labels ...string) {
+	m.r.lock.Lock()
+	defer m.r.lock.Unlock()
+	s := m.get(labels)
+	s.value = sum
+	s.count = count
+}
+
+// Observe adds an observation to a summary.
+func (m *Metric) Observe(v float64, labels ...string) {
+	m.r.lock.Lock()
+	defer m.r.lock.Unlock()
+	s := m.get(labels)
+	s.value += v
+	s.count++
+}
+
+// Reset removes all series of the metric, e.g., to drop gauges for labels
+// that no longer exist before setting them again.
+func (m *Metric) Reset() {
+	m.r.lock.Lock()
+	defer m.r.lock.Unlock()
+	m.f.series = make(map[string]*series)
+}
+
+// get returns the series for labels, must hold lock
+func (m *Metric) get(labels []string) *series {
+	key := formatLabels(labels)
+	s, exists := m.f.series[key]
+	if !exists {
+		s = new(series)
+		m.f.series[key] = s
+	}
+	return s
+}
+
+// formatLabels formats key/value pairs as {k="v",...}, an odd last key is
+// ignored
+func formatLabels(labels []string) string {
+	if len(labels) < 2 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(labels[i])
+		b.WriteString(`="`)
+		b.WriteString(escape(labels[i+1]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func escape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// WriteTo writes all metrics in the Prometheus text format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.lock.Lock()
+	collectors := r.collectors
+	r.lock.Unlock()
+	for _, fn := range collectors {
+		fn()
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	cw := &countWriter{w: bufio.NewWriter(w)}
+	for _, f := range r.families {
+		fmt.Fprintf(cw, "# HELP %s %s\n# TYPE %s %s\n",
+			f.name, strings.ReplaceAll(f.help, "\n", `\n`), f.name, f.typ)
+		keys := make([]string, 0, len(f.series))
+		for key := range f.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			s := f.series[key]
+			if f.typ == typeSummary {
+				fmt.Fprintf(cw, "%s_sum%s %s\n", f.name, key, formatValue(s.value))
+				fmt.Fprintf(cw, "%s_count%s %d\n", f.name, key, s.count)
+			} else {
+				fmt.Fprintf(cw, "%s%s %s\n", f.name, key, formatValue(s.value))
+			}
+		}
+	}
+	if cw.err == nil {
+		cw.err = cw.w.Flush()
+	}
+	return cw.n, cw.err
+}
+
+type countWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	c.err = err
+	return n, err
+}
+
+// ServeHTTP serves the metrics.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+// timeouts of the metrics server, scrapes are small
+const (
+	httpReadHeaderTimeout = 10 * time.Second
+	httpReadTimeout       = 30 * time.Second
+	httpWriteTimeout      = 30 * time.Second
+	httpIdleTimeout       = 2 * time.Minute
+)
+
+// ListenAndServe serves the metrics at /metrics on addr.
+func ListenAndServe(addr string, r *Registry) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", r)
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: httpReadHeaderTimeout,
+		ReadTimeout:       httpReadTimeout,
+		WriteTimeout:      httpWriteTimeout,
+		IdleTimeout:       httpIdleTimeout,
+	}
+	return server.ListenAndServe()
+}
@@ -0,0 +1,65 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteTo(t *testing.T) {
+	r := NewRegistry()
+	c := r.Counter("test_events_total", "Number of events.")
+	g := r.Gauge("test_queue", "Queue depth.")
+	s := r.Summary("test_latency_seconds", "Latency.")
+
+	c.Inc("label", "b")
+	c.Add(2, "label", "a\"\n")
+	c.Inc("label", "b")
+	r.OnCollect(func() { g.Set(7) })
+	s.Observe(0.5)
+	s.Observe(1.5)
+
+	var b bytes.Buffer
+	n, err := r.WriteTo(&b)
+	assert.Nil(t, err, "failed to write metrics: %s", err)
+	assert.Equal(t, int64(b.Len()), n, "wrong number of bytes written")
+	assert.Equal(t, `# HELP test_events_total Number of events.
+# TYPE test_events_total counter
+test_events_total{label="a\"\n"} 2
+test_events_total{label="b"} 2
+# HELP test_queue Queue depth.
+# TYPE test_queue gauge
+test_queue 7
+# HELP test_latency_seconds Latency.
+# TYPE test_latency_seconds summary
+test_latency_seconds_sum 2
+test_latency_seconds_count 2
+`, b.String())
+
+	g.Reset()
+	b.Reset()
+	r.OnCollect(func() { g.Reset() })
+	r.WriteTo(&b)
+	assert.NotContains(t, b.String(), "test_queue 7", "gauge not reset")
+}
+
+func TestAddExisting(t *testing.T) {
+	r := NewRegistry()
+	a := r.Counter("test_events_total", "Number of events.")
+	b := r.Counter("test_events_total", "Number of events.")
+	a.Inc("label", "a")
+	b.Inc("label", "b")
+
+	var buf bytes.Buffer
+	r.WriteTo(&buf)
+	assert.Equal(t, `# HELP test_events_total Number of events.
+# TYPE test_events_total counter
+test_events_total{label="a"} 1
+test_events_total{label="b"} 1
+`, buf.String())
+	assert.Panics(t, func() { r.Gauge("test_events_total", "Number of events.") },
+		"added metric with another type")
+	assert.Panics(t, func() { r.Counter("test_events_total", "Other.") },
+		"added metric with another help")
+}
@@ -12,10 +12,15 @@ import (
 type Policy struct {
 	ID, Signature, Vk, Pub []byte
 	Timeout, Space, Time   uint64
+	// Recipients are optional public keys, in addition to Pub, that payloads
+	// are encrypted to.
+	Recipients [][]byte
 }
 
+// MakePolicy makes a new signed policy. Payloads are encrypted to pub and any
+// additional recipients.
 func MakePolicy(sk, vk, pub []byte,
-	timeout, space, time uint64) Policy {
+	timeout, space, time uint64, recipients ...[]byte) Policy {
 	id := make([]byte, WireIdentifierSize)
 	if _, err := io.ReadFull(rand.Reader, id); err != nil {
 		panic(err)
@@ -29,7 +34,10 @@ func MakePolicy(sk, vk, pub []byte,
 		Space:   space,
 		Time:    time,
 	}
-	buf := make([]byte, 0, WirePolicySize-lc.SignatureSize)
+	if len(recipients) > 0 {
+		p.Recipients = recipients
+	}
+	buf := make([]byte, 0, EncodedPolicySize(p)-lc.SignatureSize)
 	buf = encodePolicy(p, buf)
 	p.Signature = lc.Sign(sk, buf)
 	return p
@@ -44,11 +52,28 @@ func encodePolicy(p Policy, b []byte) []byte {
 	binary.BigEndian.PutUint64(tmp, p.Timeout)
 	binary.BigEndian.PutUint64(tmp[8:], p.Space)
 	binary.BigEndian.PutUint64(tmp[16:], p.Time)
-	return append(b, tmp...)
+	b = append(b, tmp...)
+
+	// policies without additional recipients keep the original encoding
+	if len(p.Recipients) > 0 {
+		b = append(b, byte(len(p.Recipients)))
+		for i := 0; i < len(p.Recipients); i++ {
+			b = append(b, p.Recipients[i]...)
+		}
+	}
+	return b
+}
+
+// EncodedPolicySize returns the size of the encoded policy.
+func EncodedPolicySize(p Policy) int {
+	if len(p.Recipients) == 0 {
+		return WirePolicySize
+	}
+	return WirePolicySize + 1 + len(p.Recipients)*lc.PublicKeySize
 }
 
 func EncodePolicy(p Policy) []byte {
-	b := make([]byte, 0, WirePolicySize)
+	b := make([]byte, 0, EncodedPolicySize(p))
 	b = encodePolicy(p, b)
 
 	return append(b, p.Signature...)
@@ -56,12 +81,23 @@ func EncodePolicy(p Policy) []byte {
 
 func DecodePolicy(b []byte) (Policy, error) {
 	var p Policy
-	if len(b) != WirePolicySize {
+	recipients := 0
+	if len(b) > WirePolicySize {
+		recipients = int(b[WirePolicySize-lc.SignatureSize])
+		if recipients == 0 || recipients > WireMaxRecipients {
+			return p, fmt.Errorf("invalid number of recipients in policy, got %d", recipients)
+		}
+	}
+	size := WirePolicySize
+	if recipients > 0 {
+		size += 1 + recipients*lc.PublicKeySize
+	}
+	if len(b) != size {
 		return p, fmt.Errorf("invalid encoded policy length, expected %d, got %d",
-			WirePolicySize, len(b))
+			size, len(b))
 	}
 	if !lc.Verify(b[WireIdentifierSize:WireIdentifierSize+lc.VericationKeySize],
-		b[:WirePolicySize-lc.SignatureSize], b[WirePolicySize-lc.SignatureSize:]) {
+		b[:size-lc.SignatureSize], b[size-lc.SignatureSize:]) {
 		return p, fmt.Errorf("invalid signature in Policy")
 	}
 
@@ -78,8 +114,21 @@ func DecodePolicy(b []byte) (Policy, error) {
 	copied += 8
 	p.Time = binary.BigEndian.Uint64(b[copied:])
 	copied += 8
+	if recipients > 0 {
+		copied++ // number of recipients
+		p.Recipients = make([][]byte, recipients)
+		for i := 0; i < recipients; i++ {
+			p.Recipients[i] = make([]byte, lc.PublicKeySize)
+			copied += copy(p.Recipients[i], b[copied:])
+		}
+	}
 	p.Signature = make([]byte, lc.SignatureSize)
 	copied += copy(p.Signature, b[copied:])
 
 	return p, nil
 }
+
+// RecipientKeys returns all public keys that payloads are encrypted to.
+func (p Policy) RecipientKeys() [][]byte {
+	return append([][]byte{p.Pub}, p.Recipients...)
+}
@@ -26,3 +26,25 @@ func TestEncodePolicy(t *testing.T) {
 	assert.True(t, p.Time == p2.Time, "Time mismatch after encode and decode")
 	assert.True(t, p.Timeout == p2.Timeout, "Timeout mismatch after encode and decode")
 }
+
+func TestEncodePolicyRecipients(t *testing.T) {
+	vk, sk, _ := lc.SigningKeyGen()
+	pub, _, _ := lc.EncryptKeyGen()
+	r1, _, _ := lc.EncryptKeyGen()
+	r2, _, _ := lc.EncryptKeyGen()
+	p := MakePolicy(sk, vk, pub, 0, 1, 2, r1, r2)
+	b := EncodePolicy(p)
+	assert.True(t, len(b) == EncodedPolicySize(p),
+		"encoded policy not expected size, got %d, expected %d", len(b), EncodedPolicySize(p))
+
+	p2, err := DecodePolicy(b)
+	assert.Nil(t, err, "failed to decode policy: %v", err)
+	assert.True(t, len(p2.Recipients) == 2, "Recipients mismatch after encode and decode")
+	assert.True(t, bytes.Equal(p2.Recipients[0], r1), "Recipients mismatch after encode and decode")
+	assert.True(t, bytes.Equal(p2.Recipients[1], r2), "Recipients mismatch after encode and decode")
+	assert.True(t, len(p2.RecipientKeys()) == 3, "unexpected number of recipient keys")
+
+	b[len(b)-lc.SignatureSize-1] ^= 0x01 // flip a bit in the last recipient
+	_, err = DecodePolicy(b)
+	assert.NotNil(t, err, "decoded policy with modified recipient")
+}
@@ -0,0 +1,100 @@
+package steady
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/pylls/steady/lc"
+)
+
+// Receipt is signed by a relay when it stores a block. Unlike the ACK to
+// write, authenticated with the token shared with the device, anyone with
+// the verification key of the relay can verify a receipt, e.g., as evidence
+// that the relay accepted a block it later deleted.
+type Receipt struct {
+	// Relay is the verification key of the relay.
+	Relay []byte
+	// ID is the ID of the policy.
+	ID    []byte
+	Index uint64
+	// HeaderHash is the header hash of the block, see BlockHeader.
+	HeaderHash []byte
+	// Time is the time of the relay when storing the block.
+	Time      uint64
+	Signature []byte
+}
+
+// receiptDomain separates signatures on receipts from other signatures by
+// the relay.
+const receiptDomain = "steady receipt"
+
+// MakeReceipt makes a receipt for a stored block with the signing key sk and
+// verification key vk of the relay.
+func MakeReceipt(sk, vk []byte, bh BlockHeader, id []byte, time uint64) Receipt {
+	r := Receipt{
+		Relay:      vk,
+		ID:         id,
+		Index:      bh.Index,
+		HeaderHash: bh.HeaderHash,
+		Time:       time,
+	}
+	r.Signature = lc.Sign(sk, receiptSigned(r))
+	return r
+}
+
+func receiptSigned(r Receipt) []byte {
+	b := make([]byte, 0, len(receiptDomain)+WireReceiptSize-lc.SignatureSize)
+	b = append(b, receiptDomain...)
+	b = append(b, r.Relay...)
+	b = append(b, r.ID...)
+	b = binary.BigEndian.AppendUint64(b, r.Index)
+	b = append(b, r.HeaderHash...)
+	return binary.BigEndian.AppendUint64(b, r.Time)
+}
+
+// EncodeReceipt encodes a receipt as sent on the wire.
+func EncodeReceipt(r Receipt) []byte {
+	return append(receiptSigned(r)[len(receiptDomain):], r.Signature...)
+}
+
+// DecodeReceipt decodes a receipt and verifies that it is signed by the relay
+// with the verification key in the receipt. Check that the key is the key
+// of the relay with VerifyReceipt.
+func DecodeReceipt(b []byte) (r Receipt, err error) {
+	if len(b) != WireReceiptSize {
+		return r, fmt.Errorf("invalid encoded receipt length, expected %d, got %d",
+			WireReceiptSize, len(b))
+	}
+	r.Relay = append([]byte{}, b[:lc.VericationKeySize]...)
+	b = b[lc.VericationKeySize:]
+	r.ID = append([]byte{}, b[:WireIdentifierSize]...)
+	b = b[WireIdentifierSize:]
+	r.Index = binary.BigEndian.Uint64(b)
+	r.HeaderHash = append([]byte{}, b[8:8+lc.HashOutputLen]...)
+	r.Time = binary.BigEndian.Uint64(b[8+lc.HashOutputLen:])
+	r.Signature = append([]byte{}, b[16+lc.HashOutputLen:]...)
+	if !lc.Verify(r.Relay, receiptSigned(r), r.Signature) {
+		return Receipt{}, fmt.Errorf("invalid signature in receipt")
+	}
+	return r, nil
+}
+
+// VerifyReceipt verifies that a receipt is signed by the relay with the
+// verification key vk for the block with the encoded header.
+func VerifyReceipt(r Receipt, vk []byte, id, header []byte) error {
+	if !bytes.Equal(r.Relay, vk) {
+		return fmt.Errorf("receipt from another relay")
+	}
+	if !lc.Verify(vk, receiptSigned(r), r.Signature) {
+		return fmt.Errorf("invalid signature in receipt")
+	}
+	if len(header) < WireBlockHeaderSize {
+		return fmt.Errorf("too short block header")
+	}
+	if !bytes.Equal(r.ID, id) || r.Index != binary.BigEndian.Uint64(header) ||
+		!bytes.Equal(r.HeaderHash, header[24+lc.HashOutputLen:24+2*lc.HashOutputLen]) {
+		return fmt.Errorf("receipt for another block")
+	}
+	return nil
+}
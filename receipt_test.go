@@ -0,0 +1,44 @@
+package steady
+
+import (
+	"testing"
+
+	"github.com/pylls/steady/lc"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReceipt(t *testing.T) {
+	vk, sk, _ := lc.SigningKeyGen()
+	pub, _, _ := lc.EncryptKeyGen()
+	p := MakePolicy(sk, vk, pub, 0, 1, 2)
+	relayVk, relaySk, _ := lc.SigningKeyGen()
+
+	block, err := MakeEncodedBlock(3, 0, 10, true, true, p, makeEvents([][]byte{{0x10}}), sk)
+	assert.Nil(t, err, "failed to make encoded block: %s", err)
+	header := block[:WireBlockHeaderSize]
+	bh, err := DecodeBlockHeader(header, p)
+	assert.Nil(t, err, "failed to decode valid header: %s", err)
+
+	r := MakeReceipt(relaySk, relayVk, bh, p.ID, 42)
+	encoded := EncodeReceipt(r)
+	assert.Len(t, encoded, WireReceiptSize, "wrong encoded receipt size")
+	d, err := DecodeReceipt(encoded)
+	assert.Nil(t, err, "failed to decode receipt: %s", err)
+	assert.Equal(t, r, d, "wrong decoded receipt")
+	assert.Nil(t, VerifyReceipt(d, relayVk, p.ID, header), "failed to verify receipt")
+
+	// another relay
+	otherVk, _, _ := lc.SigningKeyGen()
+	assert.NotNil(t, VerifyReceipt(d, otherVk, p.ID, header), "verified receipt of another relay")
+
+	// another block
+	other, err := MakeEncodedBlock(3, 0, 10, true, true, p, makeEvents([][]byte{{0x20}}), sk)
+	assert.Nil(t, err, "failed to make encoded block: %s", err)
+	assert.NotNil(t, VerifyReceipt(d, relayVk, p.ID, other[:WireBlockHeaderSize]),
+		"verified receipt for another block")
+
+	// a modified receipt
+	encoded[len(encoded)-lc.SignatureSize-1] ^= 0x01
+	_, err = DecodeReceipt(encoded)
+	assert.NotNil(t, err, "decoded modified receipt")
+}
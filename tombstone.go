@@ -0,0 +1,71 @@
+package steady
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/pylls/steady/lc"
+)
+
+// Tombstone marks the end of a policy: signed by the device, it states that
+// the device will never make a block with an index of Index or larger. A
+// relay cannot make a tombstone, so collectors can tell a retired device
+// from a relay that deletes blocks.
+type Tombstone struct {
+	ID          []byte
+	Index, Time uint64
+	Signature   []byte
+}
+
+// tombstoneDomain separates signatures on tombstones from other signatures
+// by the device.
+const tombstoneDomain = "steady tombstone"
+
+// MakeTombstone makes a tombstone for a policy, where index is the index of
+// the next block the device would have made.
+func MakeTombstone(sk []byte, policy Policy, index, time uint64) Tombstone {
+	t := Tombstone{
+		ID:    policy.ID,
+		Index: index,
+		Time:  time,
+	}
+	t.Signature = lc.Sign(sk, tombstoneSigned(t))
+	return t
+}
+
+func tombstoneSigned(t Tombstone) []byte {
+	b := make([]byte, 0, len(tombstoneDomain)+WireTombstoneSize-lc.SignatureSize)
+	b = append(b, tombstoneDomain...)
+	b = append(b, t.ID...)
+	b = binary.BigEndian.AppendUint64(b, t.Index)
+	return binary.BigEndian.AppendUint64(b, t.Time)
+}
+
+// EncodeTombstone encodes a tombstone as sent on the wire.
+func EncodeTombstone(t Tombstone) []byte {
+	return append(tombstoneSigned(t)[len(tombstoneDomain):], t.Signature...)
+}
+
+// DecodeTombstone decodes a tombstone and verifies that it is signed by the
+// device of the policy.
+func DecodeTombstone(b []byte, policy Policy) (t Tombstone, err error) {
+	if len(b) != WireTombstoneSize {
+		return t, fmt.Errorf("invalid encoded tombstone length, expected %d, got %d",
+			WireTombstoneSize, len(b))
+	}
+	t.ID = make([]byte, WireIdentifierSize)
+	copy(t.ID, b)
+	t.Index = binary.BigEndian.Uint64(b[WireIdentifierSize:])
+	t.Time = binary.BigEndian.Uint64(b[WireIdentifierSize+8:])
+	t.Signature = make([]byte, lc.SignatureSize)
+	copy(t.Signature, b[WireIdentifierSize+16:])
+
+	if !bytes.Equal(t.ID, policy.ID) {
+		return Tombstone{}, fmt.Errorf("tombstone for another policy")
+	}
+	if !lc.Verify(policy.Vk, tombstoneSigned(t), t.Signature) {
+		return Tombstone{}, fmt.Errorf("invalid signature in tombstone")
+	}
+	return t, nil
+}
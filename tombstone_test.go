@@ -0,0 +1,33 @@
+package steady
+
+import (
+	"testing"
+
+	"github.com/pylls/steady/lc"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTombstone(t *testing.T) {
+	vk, sk, _ := lc.SigningKeyGen()
+	pub, _, _ := lc.EncryptKeyGen()
+	p := MakePolicy(sk, vk, pub, 0, 1, 2)
+
+	b := EncodeTombstone(MakeTombstone(sk, p, 42, 1337))
+	assert.Len(t, b, WireTombstoneSize, "wrong encoded tombstone size")
+	ts, err := DecodeTombstone(b, p)
+	assert.Nil(t, err, "failed to decode tombstone: %v", err)
+	assert.Equal(t, uint64(42), ts.Index, "wrong index")
+	assert.Equal(t, uint64(1337), ts.Time, "wrong time")
+
+	b[WireIdentifierSize+7]++ // change the index
+	_, err = DecodeTombstone(b, p)
+	assert.NotNil(t, err, "decoded modified tombstone")
+
+	// signed by another device
+	vk2, sk2, _ := lc.SigningKeyGen()
+	_, err = DecodeTombstone(EncodeTombstone(MakeTombstone(sk2, p, 42, 1337)), p)
+	assert.NotNil(t, err, "decoded tombstone signed by other key")
+	_, err = DecodeTombstone(EncodeTombstone(MakeTombstone(sk, p, 42, 1337)),
+		MakePolicy(sk2, vk2, pub, 0, 1, 2))
+	assert.NotNil(t, err, "decoded tombstone for other policy")
+}
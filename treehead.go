@@ -0,0 +1,121 @@
+package steady
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/pylls/steady/lc"
+)
+
+// TreeHead is signed by a relay to commit to its transparency log: a Merkle
+// tree (see MerkleTreeHash) over the headers of all blocks stored by the
+// relay, across policies, in the order stored (see LogEntry). A relay cannot
+// rewrite its log without signing two inconsistent tree heads, so auditors
+// keep the tree heads they see and check that each is consistent with the
+// next with VerifyTreeHeads, and that blocks are in the log with
+// VerifyLogEntry.
+type TreeHead struct {
+	// Relay is the verification key of the relay, as for receipts.
+	Relay []byte
+	// Size is the number of entries in the log.
+	Size      uint64
+	Root      []byte
+	Time      uint64
+	Signature []byte
+}
+
+// treeHeadDomain separates signatures on tree heads from other signatures by
+// the relay.
+const treeHeadDomain = "steady tree head"
+
+// LogEntry is the entry in the transparency log of a relay for a stored
+// block with the encoded header.
+func LogEntry(id, header []byte) []byte {
+	return append(append(make([]byte, 0, len(id)+len(header)), id...), header...)
+}
+
+// MakeTreeHead makes a tree head for a log of size entries with root with the
+// signing key sk and verification key vk of the relay.
+func MakeTreeHead(sk, vk []byte, size uint64, root []byte, time uint64) TreeHead {
+	th := TreeHead{
+		Relay: vk,
+		Size:  size,
+		Root:  root,
+		Time:  time,
+	}
+	th.Signature = lc.Sign(sk, treeHeadSigned(th))
+	return th
+}
+
+func treeHeadSigned(th TreeHead) []byte {
+	b := make([]byte, 0, len(treeHeadDomain)+WireTreeHeadSize-lc.SignatureSize)
+	b = append(b, treeHeadDomain...)
+	b = append(b, th.Relay...)
+	b = binary.BigEndian.AppendUint64(b, th.Size)
+	b = append(b, th.Root...)
+	return binary.BigEndian.AppendUint64(b, th.Time)
+}
+
+// EncodeTreeHead encodes a tree head as sent on the wire.
+func EncodeTreeHead(th TreeHead) []byte {
+	return append(treeHeadSigned(th)[len(treeHeadDomain):], th.Signature...)
+}
+
+// DecodeTreeHead decodes a tree head and verifies that it is signed by the
+// relay with the verification key in the tree head. Check that the key is
+// the key of the relay.
+func DecodeTreeHead(b []byte) (th TreeHead, err error) {
+	if len(b) != WireTreeHeadSize {
+		return th, fmt.Errorf("invalid encoded tree head length, expected %d, got %d",
+			WireTreeHeadSize, len(b))
+	}
+	th.Relay = append([]byte{}, b[:lc.VericationKeySize]...)
+	b = b[lc.VericationKeySize:]
+	th.Size = binary.BigEndian.Uint64(b)
+	th.Root = append([]byte{}, b[8:8+lc.HashOutputLen]...)
+	th.Time = binary.BigEndian.Uint64(b[8+lc.HashOutputLen:])
+	th.Signature = append([]byte{}, b[16+lc.HashOutputLen:]...)
+	if !lc.Verify(th.Relay, treeHeadSigned(th), th.Signature) {
+		return TreeHead{}, fmt.Errorf("invalid signature in tree head")
+	}
+	return th, nil
+}
+
+// VerifyTreeHeads verifies that the log of the older tree head is a prefix
+// of the log of the newer tree head of the same relay, with the consistency
+// proof from the relay (see ConsistencyProof).
+func VerifyTreeHeads(older, newer TreeHead, proof [][]byte) error {
+	if !bytes.Equal(older.Relay, newer.Relay) {
+		return fmt.Errorf("tree heads from different relays")
+	}
+	for _, th := range []TreeHead{older, newer} {
+		if !lc.Verify(th.Relay, treeHeadSigned(th), th.Signature) {
+			return fmt.Errorf("invalid signature in tree head")
+		}
+	}
+	if older.Size > newer.Size {
+		return fmt.Errorf("older tree head has %d entries, newer has %d",
+			older.Size, newer.Size)
+	}
+	if !VerifyConsistency(int(older.Size), int(newer.Size), older.Root, newer.Root, proof) {
+		return fmt.Errorf("inconsistent tree heads of size %d and %d", older.Size, newer.Size)
+	}
+	return nil
+}
+
+// VerifyLogEntry verifies that the entry with index in the log is for the
+// block with the encoded header, with the audit path from the relay (see
+// AuditPath).
+func VerifyLogEntry(th TreeHead, index uint64, id, header []byte, path [][]byte) error {
+	if !lc.Verify(th.Relay, treeHeadSigned(th), th.Signature) {
+		return fmt.Errorf("invalid signature in tree head")
+	}
+	if index >= th.Size {
+		return fmt.Errorf("entry %d not in log of size %d", index, th.Size)
+	}
+	if !bytes.Equal(RootFromAuditPath(LogEntry(id, header), int(index), int(th.Size), path), th.Root) {
+		return fmt.Errorf("entry %d of log is for another block", index)
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package steady
+
+import (
+	"testing"
+
+	"github.com/pylls/steady/lc"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTreeHead(t *testing.T) {
+	relayVk, relaySk, _ := lc.SigningKeyGen()
+	id := lc.Hash([]byte("policy"))
+	var entries [][]byte
+	for i := byte(0); i < 5; i++ {
+		entries = append(entries, LogEntry(id, []byte{i}))
+	}
+	older := MakeTreeHead(relaySk, relayVk, 3, MerkleTreeHash(entries[:3]), 10)
+	newer := MakeTreeHead(relaySk, relayVk, 5, MerkleTreeHash(entries), 20)
+
+	encoded := EncodeTreeHead(newer)
+	assert.Len(t, encoded, WireTreeHeadSize, "wrong encoded tree head size")
+	d, err := DecodeTreeHead(encoded)
+	assert.Nil(t, err, "failed to decode tree head: %s", err)
+	assert.Equal(t, newer, d, "wrong decoded tree head")
+
+	proof := ConsistencyProof(3, entries)
+	assert.Nil(t, VerifyTreeHeads(older, newer, proof), "failed to verify tree heads")
+	assert.NotNil(t, VerifyTreeHeads(newer, older, proof), "verified tree heads in wrong order")
+	assert.Nil(t, VerifyLogEntry(newer, 1, id, []byte{1}, AuditPath(1, entries)),
+		"failed to verify log entry")
+	assert.NotNil(t, VerifyLogEntry(newer, 1, id, []byte{2}, AuditPath(1, entries)),
+		"verified log entry for another block")
+
+	// a rewritten log
+	rewritten := append([][]byte{LogEntry(id, []byte{9})}, entries[1:]...)
+	forged := MakeTreeHead(relaySk, relayVk, 5, MerkleTreeHash(rewritten), 20)
+	assert.NotNil(t, VerifyTreeHeads(older, forged, ConsistencyProof(3, rewritten)),
+		"verified rewritten log")
+
+	// another relay
+	otherVk, otherSk, _ := lc.SigningKeyGen()
+	other := MakeTreeHead(otherSk, otherVk, 5, MerkleTreeHash(entries), 20)
+	assert.NotNil(t, VerifyTreeHeads(older, other, proof), "verified tree heads of different relays")
+
+	// a modified tree head
+	encoded[lc.VericationKeySize] ^= 0x01
+	_, err = DecodeTreeHead(encoded)
+	assert.NotNil(t, err, "decoded modified tree head")
+}